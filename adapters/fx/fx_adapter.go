@@ -2,73 +2,184 @@ package fx
 
 import (
 	"context"
+	"errors"
 	"github.com/KasperskyLab/klogga"
 	"github.com/KasperskyLab/klogga/exporters/golog"
 	"go.uber.org/fx"
 	"go.uber.org/fx/fxevent"
+	"log"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
 const Component klogga.ComponentName = "fx"
 
+const (
+	appStartSpanName = "app start"
+	appStopSpanName  = "app stop"
+)
+
+// fxTracer writes fx startup and shutdown as two traces:
+// the root span covers the whole phase, constructors, invokes and hooks are its children
+// with their real durations, so it is easy to see what made the startup slow
 type fxTracer struct {
 	trs klogga.Tracer
+
+	mu sync.Mutex
+	// root span of the current startup or shutdown phase
+	root    *klogga.Span
+	rootCtx context.Context
+	// hooks are stopped during a failed start, they are nested in the rollback span
+	rollback    *klogga.Span
+	rollbackCtx context.Context
+	// spans of invokes and hooks that are executing right now,
+	// hooks of the same caller and function are queued in the order of execution
+	running map[string][]*klogga.Span
+	// shutdown of the factory, it is called after the app stop span is written
+	shutdown func(ctx context.Context) error
 }
 
-func (t fxTracer) LogEvent(event fxevent.Event) {
-	span := klogga.StartLeaf(context.Background())
-	defer span.FlushTo(t.trs)
-	span.Tag("event", reflect.TypeOf(event).String())
+func newFxTracer(trs klogga.Tracer) *fxTracer {
+	return &fxTracer{trs: trs, running: map[string][]*klogga.Span{}}
+}
+
+func (t *fxTracer) LogEvent(event fxevent.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	eventType := reflect.TypeOf(event).String()
 	switch e := event.(type) {
 	case *fxevent.OnStartExecuting:
-		span.OverrideName("OnStartExecuting").Tag("caller", e.CallerName).Tag("callee", e.FunctionName)
+		t.startChild(appStartSpanName, "OnStartExecuting", e.CallerName+e.FunctionName).
+			Tag("event", eventType).Tag("caller", e.CallerName).Tag("callee", e.FunctionName)
 	case *fxevent.OnStartExecuted:
-		span.OverrideName("OnStartExecuted").Tag("caller", e.CallerName).Tag("callee", e.FunctionName)
-		if e.Err != nil {
-			span.ErrVoid(e.Err)
-		} else {
-			span.Message("runtime:" + e.Runtime.String())
-		}
+		t.finishChild(appStartSpanName, "OnStartExecuting", e.CallerName+e.FunctionName, e.Runtime).
+			Tag("caller", e.CallerName).Tag("callee", e.FunctionName).
+			ErrSpan(e.Err).FlushTo(t.trs)
 	case *fxevent.OnStopExecuting:
-		span.OverrideName("OnStopExecuting").Tag("caller", e.CallerName).Tag("callee", e.FunctionName)
+		t.startChild(appStopSpanName, "OnStopExecuting", e.CallerName+e.FunctionName).
+			Tag("event", eventType).Tag("caller", e.CallerName).Tag("callee", e.FunctionName)
 	case *fxevent.OnStopExecuted:
-		span.OverrideName("OnStopExecuted").Tag("caller", e.CallerName).Tag("callee", e.FunctionName)
-		if e.Err != nil {
-			span.ErrVoid(e.Err)
-		} else {
-			span.Message("runtime:" + e.Runtime.String())
-		}
+		t.finishChild(appStopSpanName, "OnStopExecuting", e.CallerName+e.FunctionName, e.Runtime).
+			Tag("caller", e.CallerName).Tag("callee", e.FunctionName).
+			ErrSpan(e.Err).FlushTo(t.trs)
 	case *fxevent.Supplied:
-		span.OverrideName("Supplied").Message("supplied type:" + e.TypeName).ErrVoid(e.Err)
+		t.leaf("Supplied", eventType).Message("supplied type:" + e.TypeName).ErrSpan(e.Err).FlushTo(t.trs)
 	case *fxevent.Provided:
-		span.OverrideName("Provided").
-			Message("output types:" + strings.Join(e.OutputTypeNames, ",")).ErrVoid(e.Err)
+		t.leaf("Provided", eventType).
+			Message("output types:" + strings.Join(e.OutputTypeNames, ",")).ErrSpan(e.Err).FlushTo(t.trs)
+	case *fxevent.Decorated:
+		t.leaf("Decorated", eventType).
+			Message("output types:" + strings.Join(e.OutputTypeNames, ",")).ErrSpan(e.Err).FlushTo(t.trs)
+	case *fxevent.LoggerInitialized:
+		t.leaf("LoggerInitialized", eventType).Tag("caller", e.ConstructorName).ErrSpan(e.Err).FlushTo(t.trs)
 	case *fxevent.Invoking:
-		span.OverrideName("Invoking").Tag("func", e.FunctionName)
+		t.startChild(appStartSpanName, "Invoking", e.FunctionName).Tag("event", eventType).Tag("func", e.FunctionName)
 	case *fxevent.Invoked:
-		span.OverrideName("Invoked").Tag("func", e.FunctionName)
+		span := t.finishChild(appStartSpanName, "Invoking", e.FunctionName, 0).Tag("func", e.FunctionName)
 		if e.Err != nil {
 			span.ErrSpan(e.Err).Message("stack:" + e.Trace)
 		}
-	case *fxevent.Stopping:
-		span.OverrideName("Stopping").Message("signal " + strings.ToUpper(e.Signal.String()))
-	case *fxevent.Stopped:
-		span.OverrideName("Stopped").ErrVoid(e.Err)
+		t.trs.Finish(span)
 	case *fxevent.RollingBack:
-		span.OverrideName("RollingBack").ErrVoid(e.StartErr)
+		t.rollback, t.rollbackCtx = klogga.Start(t.phase(appStartSpanName), klogga.WithName("RollingBack"))
+		t.rollback.Tag("event", eventType).ErrVoid(e.StartErr)
 	case *fxevent.RolledBack:
-		span.OverrideName("RolledBack").ErrVoid(e.Err)
+		if t.rollback != nil {
+			t.rollback.DeferErr(e.Err).FlushTo(t.trs)
+			t.rollback, t.rollbackCtx = nil, nil
+		}
 	case *fxevent.Started:
-		span.OverrideName("Started").ErrVoid(e.Err)
-	case *fxevent.LoggerInitialized:
-		span.OverrideName("LoggerInitialized").Tag("caller", e.ConstructorName).ErrVoid(e.Err)
+		t.phase(appStartSpanName)
+		t.finishPhase(e.Err)
+		if e.Err != nil {
+			// the hooks are rolled back, the app is not stopped after a failed start
+			t.shutdownFactory()
+		}
+	case *fxevent.Stopping:
+		t.phase(appStopSpanName)
+		t.root.Tag("signal", strings.ToUpper(e.Signal.String()))
+	case *fxevent.Stopped:
+		t.phase(appStopSpanName)
+		t.finishPhase(e.Err)
+		t.shutdownFactory()
+	}
+}
+
+// shutdownFactory shuts down the factory after the last span of the app is written,
+// in the OnStop hook the app stop span would be dropped
+func (t *fxTracer) shutdownFactory() {
+	if t.shutdown == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fx.DefaultTimeout)
+	defer cancel()
+	if err := t.shutdown(ctx); err != nil {
+		log.Printf("klogga fx: factory shutdown failed: %v", err)
+	}
+	t.shutdown = nil
+}
+
+// phase returns the context for spans of the current phase,
+// a new root span is started if there is no current phase
+func (t *fxTracer) phase(name string) context.Context {
+	if t.rollback != nil {
+		return t.rollbackCtx
+	}
+	if t.root == nil {
+		t.root, t.rootCtx = klogga.Start(context.Background(), klogga.WithName(name))
+	}
+	return t.rootCtx
+}
+
+func (t *fxTracer) finishPhase(err error) {
+	for key, spans := range t.running {
+		for _, span := range spans {
+			span.Warn(errors.New("not finished before the end of the phase")).FlushTo(t.trs)
+		}
+		delete(t.running, key)
+	}
+	if t.rollback != nil {
+		t.rollback.FlushTo(t.trs)
+		t.rollback, t.rollbackCtx = nil, nil
 	}
+	t.root.ErrSpan(err).FlushTo(t.trs)
+	t.root, t.rootCtx = nil, nil
+}
+
+// leaf creates an instant span in the current phase
+func (t *fxTracer) leaf(name, eventType string) *klogga.Span {
+	return klogga.StartLeaf(t.phase(appStartSpanName), klogga.WithName(name)).Tag("event", eventType)
+}
+
+func (t *fxTracer) startChild(phaseName, name, key string) *klogga.Span {
+	span := klogga.StartLeaf(t.phase(phaseName), klogga.WithName(name))
+	t.running[name+":"+key] = append(t.running[name+":"+key], span)
+	return span
+}
+
+// finishChild returns the earliest span started by startChild with the same name and key, the caller writes it
+// if the span was not started, it is restored from the runtime in the phase of the event
+func (t *fxTracer) finishChild(phaseName, name, key string, runtime time.Duration) *klogga.Span {
+	if spans := t.running[name+":"+key]; len(spans) > 0 {
+		if len(spans) == 1 {
+			delete(t.running, name+":"+key)
+		} else {
+			t.running[name+":"+key] = spans[1:]
+		}
+		return spans[0]
+	}
+	return klogga.StartLeaf(
+		t.phase(phaseName),
+		klogga.WithName(name),
+		klogga.WithDone(time.Now().Add(-runtime), runtime),
+	)
 }
 
 // Module send fx logs to standard tracer
 func Module(tf klogga.TracerProvider) fx.Option {
-	fxTrs := &fxTracer{trs: tf.Named(Component)}
+	fxTrs := newFxTracer(tf.Named(Component))
 	return fx.Options(
 		fx.WithLogger(
 			func() (fxevent.Logger, error) {
@@ -80,15 +191,17 @@ func Module(tf klogga.TracerProvider) fx.Option {
 
 // Full Set up the default logging for the app
 // registering logging and the klogga factory,
-// that later can be reconfigured with more loggers via fx.Decorate
+// that later can be reconfigured with more loggers via fx.Decorate.
+// Constructors can take klogga.Tracer directly, see TracerSettings and NamedModule.
+// The factory is shut down once the app is stopped and the app stop span is written.
 func Full() fx.Option {
 	tf := klogga.NewFactory(golog.New(nil))
+	fxTrs := newFxTracer(tf.Named(Component))
+	fxTrs.shutdown = tf.Shutdown
 	return fx.Options(
-		Module(tf),
+		fx.WithLogger(func() (fxevent.Logger, error) { return fxTrs, nil }),
 		fx.Supply(tf),
 		fx.Provide(func(tf *klogga.Factory) klogga.TracerProvider { return tf }),
-		fx.Invoke(func(tf *klogga.Factory, lc fx.Lifecycle) error {
-			lc.Append(fx.Hook{OnStop: tf.Shutdown})
-			return nil
-		}))
+		fx.Provide(DefaultTracerSettings, NewTracer),
+	)
 }
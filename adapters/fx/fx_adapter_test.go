@@ -2,14 +2,18 @@ package fx
 
 import (
 	"context"
+	"errors"
 	"github.com/KasperskyLab/klogga"
 	"github.com/KasperskyLab/klogga/exporters/golog"
 	"github.com/KasperskyLab/klogga/exporters/spancollector"
 	"github.com/KasperskyLab/klogga/util/testutil"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/fx"
+	"go.uber.org/fx/fxevent"
 	"go.uber.org/fx/fxtest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestFxAdapter(t *testing.T) {
@@ -24,12 +28,111 @@ func TestFxAdapter(t *testing.T) {
 	err = app.Stop(testutil.Timeout())
 	require.NoError(t, err)
 
-	require.Contains(t, collector.Spans[3].Stringify(), "LoggerInitialized")
-	require.Contains(t, collector.Spans[4].Stringify(), "RunTestInvoke")
-	require.Contains(t, collector.Spans[5].Stringify(), "RunTestInvoke")
-	require.Contains(t, collector.Spans[6].Stringify(), "StartSomething")
+	startRoot := findSpan(t, collector.Spans, appStartSpanName, "")
+	require.True(t, startRoot.ParentID().IsZero())
+	for _, name := range []string{"LoggerInitialized", "Invoking"} {
+		child := findSpan(t, collector.Spans, name, "")
+		require.Equal(t, startRoot.TraceID(), child.TraceID(), name)
+		require.Equal(t, startRoot.ID(), child.ParentID(), name)
+	}
+	require.Contains(t, findSpan(t, collector.Spans, "Invoking", "").Stringify(), "RunTestInvoke")
 
-	require.Contains(t, collector.Spans[9].Stringify(), "StopSomething")
+	onStart := findSpan(t, collector.Spans, "OnStartExecuting", "StartSomething")
+	require.Equal(t, startRoot.ID(), onStart.ParentID())
+
+	stopRoot := findSpan(t, collector.Spans, appStopSpanName, "")
+	require.NotEqual(t, startRoot.TraceID(), stopRoot.TraceID())
+	onStop := findSpan(t, collector.Spans, "OnStopExecuting", "StopSomething")
+	require.Equal(t, stopRoot.TraceID(), onStop.TraceID())
+	require.Equal(t, stopRoot.ID(), onStop.ParentID())
+}
+
+func TestFxAdapterStopHookWithoutExecuting(t *testing.T) {
+	collector := spancollector.SpanCollector{}
+	trs := newFxTracer(klogga.NewFactory(&collector).Named(Component))
+	trs.LogEvent(&fxevent.OnStopExecuted{FunctionName: "StopSomething", CallerName: "caller", Runtime: time.Millisecond})
+	trs.LogEvent(&fxevent.Stopped{})
+
+	stopRoot := findSpan(t, collector.Spans, appStopSpanName, "")
+	onStop := findSpan(t, collector.Spans, "OnStopExecuting", "StopSomething")
+	require.Equal(t, stopRoot.ID(), onStop.ParentID(), "restored in the stop phase")
+	require.Equal(t, time.Millisecond, onStop.Duration())
+}
+
+func TestFxAdapterSameHookTwice(t *testing.T) {
+	collector := spancollector.SpanCollector{}
+	trs := newFxTracer(klogga.NewFactory(&collector).Named(Component))
+	trs.LogEvent(&fxevent.OnStartExecuting{FunctionName: "StartSomething", CallerName: "caller"})
+	trs.LogEvent(&fxevent.OnStartExecuting{FunctionName: "StartSomething", CallerName: "caller"})
+	trs.LogEvent(&fxevent.OnStartExecuted{FunctionName: "StartSomething", CallerName: "caller", Err: errors.New("first")})
+	// a restored span would take the runtime
+	trs.LogEvent(&fxevent.OnStartExecuted{FunctionName: "StartSomething", CallerName: "caller", Runtime: time.Hour})
+	trs.LogEvent(&fxevent.Started{})
+
+	var hooks []*klogga.Span
+	for _, span := range collector.Spans {
+		if span.Name() == "OnStartExecuting" {
+			hooks = append(hooks, span)
+		}
+	}
+	require.Len(t, hooks, 2)
+	require.True(t, hooks[0].HasErr())
+	require.False(t, hooks[1].HasErr())
+	for _, span := range hooks {
+		require.Less(t, span.Duration(), time.Hour, "started spans are finished")
+		require.False(t, span.HasWarn(), "both hooks are finished")
+	}
+}
+
+func TestFxAdapterHookDuration(t *testing.T) {
+	collector := spancollector.SpanCollector{}
+	app := fx.New(
+		Module(klogga.NewFactory(&collector)),
+		fx.Invoke(
+			func(lc fx.Lifecycle) {
+				lc.Append(fx.Hook{OnStart: SlowStart})
+			},
+		),
+	)
+	require.NoError(t, app.Start(testutil.Timeout()))
+	require.NoError(t, app.Stop(testutil.Timeout()))
+
+	onStart := findSpan(t, collector.Spans, "OnStartExecuting", "SlowStart")
+	require.GreaterOrEqual(t, onStart.Duration(), 50*time.Millisecond)
+	startRoot := findSpan(t, collector.Spans, appStartSpanName, "")
+	require.GreaterOrEqual(t, startRoot.Duration(), onStart.Duration())
+}
+
+func TestFxAdapterStartFailed(t *testing.T) {
+	collector := spancollector.SpanCollector{}
+	app := fx.New(
+		Module(klogga.NewFactory(&collector)),
+		fx.Invoke(
+			func(lc fx.Lifecycle) {
+				lc.Append(fx.Hook{OnStart: StartSomething, OnStop: StopSomething})
+				lc.Append(fx.Hook{OnStart: FailStart})
+			},
+		),
+	)
+	require.Error(t, app.Start(testutil.Timeout()))
+
+	startRoot := findSpan(t, collector.Spans, appStartSpanName, "")
+	require.True(t, startRoot.HasErr())
+	rollback := findSpan(t, collector.Spans, "RollingBack", "")
+	require.Equal(t, startRoot.ID(), rollback.ParentID())
+	onStop := findSpan(t, collector.Spans, "OnStopExecuting", "StopSomething")
+	require.Equal(t, rollback.ID(), onStop.ParentID())
+}
+
+func findSpan(t *testing.T, spans []*klogga.Span, name, contains string) *klogga.Span {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name() == name && strings.Contains(span.Stringify(), contains) {
+			return span
+		}
+	}
+	require.Failf(t, "span not found", "%s %s", name, contains)
+	return nil
 }
 
 func RunTestInvoke(lf fx.Lifecycle) {
@@ -43,10 +146,18 @@ func RunTestInvoke(lf fx.Lifecycle) {
 
 func StartSomething(context.Context) error { return nil }
 func StopSomething(context.Context) error  { return nil }
+func FailStart(context.Context) error      { return errors.New("start failed") }
+
+func SlowStart(context.Context) error {
+	time.Sleep(50 * time.Millisecond)
+	return nil
+}
 
 func TestFullModule(t *testing.T) {
+	collector := &shutdownCollector{}
 	app := fx.New(
 		Full(),
+		fx.Decorate(func(tf *klogga.Factory) *klogga.Factory { return tf.AddExporter(collector) }),
 		fx.Invoke(
 			func(tf *klogga.Factory) {
 
@@ -57,6 +168,22 @@ func TestFullModule(t *testing.T) {
 	require.NoError(t, err)
 	err = app.Stop(testutil.Timeout())
 	require.NoError(t, err)
+
+	findSpan(t, collector.Spans, appStopSpanName, "")
+	require.Equal(t, 1, collector.shutdowns, "factory is shut down after the app stop span")
+}
+
+func TestFullModuleStartFailed(t *testing.T) {
+	collector := &shutdownCollector{}
+	app := fx.New(
+		Full(),
+		fx.Decorate(func(tf *klogga.Factory) *klogga.Factory { return tf.AddExporter(collector) }),
+		fx.Invoke(func(_ *klogga.Factory, lc fx.Lifecycle) { lc.Append(fx.Hook{OnStart: FailStart}) }),
+	)
+	require.Error(t, app.Start(testutil.Timeout()))
+
+	require.True(t, findSpan(t, collector.Spans, appStartSpanName, "").HasErr())
+	require.Equal(t, 1, collector.shutdowns)
 }
 
 type testRunner struct {
@@ -86,3 +213,121 @@ func TestRunnersGroup(t *testing.T) {
 	require.Equal(t, 1, tr.Started)
 	require.Equal(t, 1, tr.Stopped)
 }
+
+type tracedComponent struct {
+	trs klogga.Tracer
+}
+
+func (c *tracedComponent) Do(level klogga.LogLevel, message string) {
+	klogga.StartLeaf(context.Background()).Level(level).Message(message).FlushTo(c.trs)
+}
+
+type billingComponent struct{ tracedComponent }
+
+type quietComponent struct{ tracedComponent }
+
+type nestedComponent struct{ tracedComponent }
+
+type inheritingComponent struct{ tracedComponent }
+
+type shutdownCollector struct {
+	spancollector.SpanCollector
+	shutdowns int
+}
+
+func (c *shutdownCollector) Shutdown(context.Context) error {
+	c.shutdowns++
+	return nil
+}
+
+func TestTracerInjection(t *testing.T) {
+	collector := &spancollector.SpanCollector{}
+	quietCollector := &shutdownCollector{}
+
+	var root *tracedComponent
+	var billing *billingComponent
+	var quiet *quietComponent
+	var nested *nestedComponent
+	var inheriting *inheritingComponent
+	app := fxtest.New(
+		t,
+		Full(),
+		fx.Decorate(func(tf *klogga.Factory) *klogga.Factory { return tf.AddExporter(collector) }),
+		fx.Provide(func(trs klogga.Tracer) *tracedComponent { return &tracedComponent{trs: trs} }),
+		NamedModule(
+			"billing",
+			fx.Provide(func(trs klogga.Tracer) *billingComponent { return &billingComponent{tracedComponent{trs: trs}} }),
+		),
+		NamedModule(
+			"quiet",
+			fx.Decorate(
+				func(s TracerSettings) TracerSettings {
+					s.Level = Level(klogga.Warn)
+					s.Exporters = []klogga.Exporter{quietCollector}
+					return s
+				},
+			),
+			fx.Provide(func(trs klogga.Tracer) *quietComponent { return &quietComponent{tracedComponent{trs: trs}} }),
+			NamedModule(
+				"nested",
+				// the level is inherited from the parent module
+				fx.Decorate(func() TracerSettings { return TracerSettings{} }),
+				fx.Provide(func(trs klogga.Tracer) *nestedComponent { return &nestedComponent{tracedComponent{trs: trs}} }),
+			),
+			NamedModule(
+				"inheriting",
+				// the exporters are inherited, so the parent module factory is shared
+				fx.Provide(
+					func(trs klogga.Tracer) *inheritingComponent { return &inheritingComponent{tracedComponent{trs: trs}} },
+				),
+			),
+		),
+		fx.Populate(&root, &billing, &quiet, &nested, &inheriting),
+	)
+	app.RequireStart()
+
+	require.Empty(t, root.trs.Name(), "spans are named after their package")
+	root.Do(klogga.Info, "root_message")
+	require.Equal(t, klogga.ComponentName("billing"), billing.trs.Name())
+	billing.Do(klogga.Debug, "billing_message")
+	require.Equal(t, klogga.ComponentName("quiet"), quiet.trs.Name())
+	quiet.Do(klogga.Info, "quiet_info")
+	quiet.Do(klogga.Warn, "quiet_warn")
+	require.Equal(t, klogga.ComponentName("nested"), nested.trs.Name())
+	nested.Do(klogga.Info, "nested_info")
+	nested.Do(klogga.Warn, "nested_warn")
+	require.Equal(t, klogga.ComponentName("inheriting"), inheriting.trs.Name())
+	inheriting.Do(klogga.Info, "inheriting_info")
+	inheriting.Do(klogga.Warn, "inheriting_warn")
+
+	app.RequireStop()
+	require.Equal(t, 1, quietCollector.shutdowns, "the module factory is shut down with the app once")
+
+	require.Equal(t, klogga.ComponentName("fx"), findMessageSpan(t, collector.Spans, "root_message").Component())
+	require.Equal(t, klogga.ComponentName("billing"), findMessageSpan(t, collector.Spans, "billing_message").Component())
+	require.Len(t, quietCollector.Spans, 2)
+	require.Equal(t, "quiet_warn", quietCollector.Spans[0].Vals()["message"])
+	require.Equal(t, klogga.ComponentName("quiet"), quietCollector.Spans[0].Component())
+	require.Equal(t, "inheriting_warn", quietCollector.Spans[1].Vals()["message"])
+	require.Equal(t, klogga.ComponentName("inheriting"), quietCollector.Spans[1].Component())
+	require.Nil(t, findMessageSpanOrNil(collector.Spans, "nested_info"))
+	require.Equal(t, klogga.ComponentName("nested"), findMessageSpan(t, collector.Spans, "nested_warn").Component())
+}
+
+func findMessageSpan(t *testing.T, spans []*klogga.Span, message string) *klogga.Span {
+	t.Helper()
+	span := findMessageSpanOrNil(spans, message)
+	if span == nil {
+		require.Failf(t, "span not found", "message: %s", message)
+	}
+	return span
+}
+
+func findMessageSpanOrNil(spans []*klogga.Span, message string) *klogga.Span {
+	for _, span := range spans {
+		if span.Vals()["message"] == message {
+			return span
+		}
+	}
+	return nil
+}
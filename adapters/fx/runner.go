@@ -42,6 +42,7 @@ func (rr RunnersGroup) Register(lc fx.Lifecycle) {
 }
 
 // RegisterRunnersWithErrors experimental watch for runner errors via channel
+// the app is shut down on the first error, use Supervisor to restart failed runners instead
 func RegisterRunnersWithErrors(r RunnersGroup, tf klogga.TracerProvider, lc fx.Lifecycle, s fx.Shutdowner) {
 	r.RegisterWithErrors(tf, lc, s)
 }
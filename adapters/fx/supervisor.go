@@ -0,0 +1,387 @@
+package fx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/KasperskyLab/klogga"
+	"go.uber.org/fx"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type RestartMode int
+
+const (
+	// RestartNever the failed runner is stopped and left failed
+	RestartNever RestartMode = iota
+	// RestartOnFailure the failed runner is restarted with exponential backoff
+	RestartOnFailure
+)
+
+func (m RestartMode) String() string {
+	switch m {
+	case RestartNever:
+		return "never"
+	case RestartOnFailure:
+		return "on_failure"
+	default:
+		return "unknown"
+	}
+}
+
+// RestartPolicy describes what Supervisor does when a runner reports an error via RunnerErr
+type RestartPolicy struct {
+	Mode RestartMode
+	// InitialBackoff delay before the first restart, doubled for each restart within the Window
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// MaxRestarts within the Window, after that the runner is considered failed, zero means no limit
+	MaxRestarts int
+	Window      time.Duration
+	// AttemptTimeout timeout for each Start and Stop call made on restart
+	AttemptTimeout time.Duration
+	// ShutdownApp shut down the whole app when the runner fails and is not going to be restarted
+	ShutdownApp bool
+}
+
+// DefaultRestartPolicy up to 5 restarts in 10 minutes, then the app is shut down
+func DefaultRestartPolicy() RestartPolicy {
+	return RestartPolicy{
+		Mode:           RestartOnFailure,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+		MaxRestarts:    5,
+		Window:         10 * time.Minute,
+		AttemptTimeout: fx.DefaultTimeout,
+		ShutdownApp:    true,
+	}
+}
+
+func (p RestartPolicy) backoff(restarts int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 0; i < restarts && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+func (p RestartPolicy) attemptTimeout() time.Duration {
+	if p.AttemptTimeout <= 0 {
+		return fx.DefaultTimeout
+	}
+	return p.AttemptTimeout
+}
+
+// PolicyRunner implement on a Runner to override the Supervisor default restart policy
+type PolicyRunner interface {
+	RestartPolicy() RestartPolicy
+}
+
+type RunnerState string
+
+const (
+	RunnerIdle       RunnerState = "idle"
+	RunnerStarting   RunnerState = "starting"
+	RunnerRunning    RunnerState = "running"
+	RunnerRestarting RunnerState = "restarting"
+	RunnerStopping   RunnerState = "stopping"
+	RunnerStopped    RunnerState = "stopped"
+	RunnerFailed     RunnerState = "failed"
+)
+
+// RunnerHealth snapshot of the supervised runner state
+type RunnerHealth struct {
+	Name     string
+	State    RunnerState
+	Restarts int
+	LastErr  error
+	// Since when the runner is in the State
+	Since time.Time
+}
+
+// Supervisor starts and stops runners with the app lifecycle,
+// watches runners that implement RunnerErr and restarts them according to the RestartPolicy.
+// Each start and stop attempt is written as a span.
+type Supervisor struct {
+	trs           klogga.Tracer
+	shutdowner    fx.Shutdowner
+	defaultPolicy RestartPolicy
+
+	mu      sync.Mutex
+	runners []*supervisedRunner
+}
+
+type supervisedRunner struct {
+	runner Runner
+	name   string
+	policy RestartPolicy
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// guarded by Supervisor.mu
+	state        RunnerState
+	since        time.Time
+	lastErr      error
+	restarts     int
+	restartTimes []time.Time
+	// Start succeeded and Stop was not called yet
+	started bool
+}
+
+// NewSupervisor creates supervisor with the DefaultRestartPolicy
+// shutdowner is used for policies with ShutdownApp, can be nil
+func NewSupervisor(tf klogga.TracerProvider, shutdowner fx.Shutdowner) *Supervisor {
+	return &Supervisor{
+		trs:           tf.NamedPkg(),
+		shutdowner:    shutdowner,
+		defaultPolicy: DefaultRestartPolicy(),
+	}
+}
+
+// WithDefaultPolicy sets policy for runners that do not implement PolicyRunner
+func (s *Supervisor) WithDefaultPolicy(policy RestartPolicy) *Supervisor {
+	s.defaultPolicy = policy
+	return s
+}
+
+// RegisterRunnersSupervised registers runners group with the supervisor
+func RegisterRunnersSupervised(r RunnersGroup, s *Supervisor, lc fx.Lifecycle) {
+	r.RegisterSupervised(s, lc)
+}
+
+func (rr RunnersGroup) RegisterSupervised(s *Supervisor, lc fx.Lifecycle) {
+	s.Register(lc, rr.Runners...)
+}
+
+// Register adds runners to the supervisor, they are started and stopped with the lifecycle
+func (s *Supervisor) Register(lc fx.Lifecycle, runners ...Runner) {
+	for _, runner := range runners {
+		policy := s.defaultPolicy
+		if pr, ok := runner.(PolicyRunner); ok {
+			policy = pr.RestartPolicy()
+		}
+		sr := &supervisedRunner{
+			runner: runner,
+			name:   reflect.TypeOf(runner).String(),
+			policy: policy,
+			done:   make(chan struct{}),
+			state:  RunnerIdle,
+			since:  time.Now(),
+		}
+		sr.ctx, sr.cancel = context.WithCancel(context.Background())
+
+		s.mu.Lock()
+		s.runners = append(s.runners, sr)
+		s.mu.Unlock()
+
+		lc.Append(
+			fx.Hook{
+				OnStart: func(ctx context.Context) error { return s.start(ctx, sr) },
+				OnStop:  func(ctx context.Context) error { return s.stop(ctx, sr) },
+			},
+		)
+	}
+}
+
+// Health returns states of all registered runners in the registration order
+func (s *Supervisor) Health() []RunnerHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]RunnerHealth, 0, len(s.runners))
+	for _, sr := range s.runners {
+		res = append(
+			res, RunnerHealth{
+				Name:     sr.name,
+				State:    sr.state,
+				Restarts: sr.restarts,
+				LastErr:  sr.lastErr,
+				Since:    sr.since,
+			},
+		)
+	}
+	return res
+}
+
+func (s *Supervisor) start(ctx context.Context, sr *supervisedRunner) error {
+	if err := s.startAttempt(ctx, sr, 0); err != nil {
+		s.setState(sr, RunnerFailed, err)
+		close(sr.done)
+		return err
+	}
+	go s.watch(sr)
+	return nil
+}
+
+func (s *Supervisor) stop(ctx context.Context, sr *supervisedRunner) error {
+	sr.cancel()
+	select {
+	case <-sr.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.mu.Lock()
+	started := sr.started
+	s.mu.Unlock()
+	if !started {
+		return nil
+	}
+	return s.stopAttempt(ctx, sr, RunnerStopped)
+}
+
+// watch waits for runner errors and restarts the runner until it gives up or the app stops
+func (s *Supervisor) watch(sr *supervisedRunner) {
+	defer close(sr.done)
+	re, ok := sr.runner.(RunnerErr)
+	if !ok {
+		return
+	}
+	for {
+		var err error
+		select {
+		case err = <-re.Error():
+			if err == nil {
+				err = errors.New("<nil error>")
+			}
+		case <-sr.ctx.Done():
+			return
+		}
+		klogga.StartLeaf(sr.ctx, klogga.WithName("RunnerError")).
+			Tag("runner", sr.name).
+			ErrSpan(err).FlushTo(s.trs)
+		s.setState(sr, RunnerRestarting, err)
+		if !s.restart(sr) {
+			return
+		}
+	}
+}
+
+// restart returns true if the runner is running again
+func (s *Supervisor) restart(sr *supervisedRunner) bool {
+	for {
+		backoff, ok := s.nextRestart(sr)
+		if !ok {
+			s.giveUp(sr)
+			return false
+		}
+		select {
+		case <-time.After(backoff):
+		case <-sr.ctx.Done():
+			return false
+		}
+
+		s.mu.Lock()
+		attempt := sr.restarts
+		s.mu.Unlock()
+
+		stopCtx, cancel := context.WithTimeout(sr.ctx, sr.policy.attemptTimeout())
+		_ = s.stopAttempt(stopCtx, sr, RunnerRestarting)
+		cancel()
+
+		startCtx, cancel := context.WithTimeout(sr.ctx, sr.policy.attemptTimeout())
+		err := s.startAttempt(startCtx, sr, attempt)
+		cancel()
+		if err == nil {
+			return true
+		}
+		s.setState(sr, RunnerRestarting, err)
+	}
+}
+
+// nextRestart checks the restart budget and returns backoff for the next restart
+func (s *Supervisor) nextRestart(sr *supervisedRunner) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sr.policy.Mode != RestartOnFailure {
+		return 0, false
+	}
+	now := time.Now()
+	inWindow := sr.restartTimes[:0]
+	for _, ts := range sr.restartTimes {
+		if sr.policy.Window <= 0 || now.Sub(ts) < sr.policy.Window {
+			inWindow = append(inWindow, ts)
+		}
+	}
+	sr.restartTimes = inWindow
+	if sr.policy.MaxRestarts > 0 && len(sr.restartTimes) >= sr.policy.MaxRestarts {
+		return 0, false
+	}
+	backoff := sr.policy.backoff(len(sr.restartTimes))
+	sr.restartTimes = append(sr.restartTimes, now.Add(backoff))
+	sr.restarts++
+	return backoff, true
+}
+
+func (s *Supervisor) giveUp(sr *supervisedRunner) {
+	ctx, cancel := context.WithTimeout(context.Background(), sr.policy.attemptTimeout())
+	defer cancel()
+	s.mu.Lock()
+	started := sr.started
+	lastErr := sr.lastErr
+	s.mu.Unlock()
+	if started {
+		_ = s.stopAttempt(ctx, sr, RunnerFailed)
+	}
+	s.setState(sr, RunnerFailed, lastErr)
+
+	span := klogga.StartLeaf(ctx, klogga.WithName("RunnerFailed")).
+		Tag("runner", sr.name).
+		Tag("policy", sr.policy.Mode.String()).
+		ErrSpan(lastErr)
+	defer span.FlushTo(s.trs)
+	if sr.policy.ShutdownApp && s.shutdowner != nil {
+		span.DeferErr(s.shutdowner.Shutdown())
+	}
+}
+
+func (s *Supervisor) startAttempt(ctx context.Context, sr *supervisedRunner, attempt int) error {
+	span, ctx := klogga.Start(ctx, klogga.WithName("Start"))
+	defer s.trs.Finish(span)
+	span.Tag("runner", sr.name).Val("attempt", attempt)
+
+	s.setState(sr, RunnerStarting, nil)
+	if err := sr.runner.Start(ctx); err != nil {
+		return span.Err(fmt.Errorf("runner %s start failed: %w", sr.name, err))
+	}
+	s.mu.Lock()
+	sr.started = true
+	s.mu.Unlock()
+	s.setState(sr, RunnerRunning, nil)
+	return nil
+}
+
+func (s *Supervisor) stopAttempt(ctx context.Context, sr *supervisedRunner, after RunnerState) error {
+	span, ctx := klogga.Start(ctx, klogga.WithName("Stop"))
+	defer s.trs.Finish(span)
+	span.Tag("runner", sr.name)
+
+	s.setState(sr, RunnerStopping, nil)
+	err := sr.runner.Stop(ctx)
+	s.mu.Lock()
+	sr.started = false
+	s.mu.Unlock()
+	if err != nil {
+		err = span.Err(fmt.Errorf("runner %s stop failed: %w", sr.name, err))
+	}
+	s.setState(sr, after, err)
+	return err
+}
+
+// setState updates the runner state, non-nil err is kept as the last error
+func (s *Supervisor) setState(sr *supervisedRunner, state RunnerState, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sr.state != state {
+		sr.state = state
+		sr.since = time.Now()
+	}
+	if err != nil {
+		sr.lastErr = err
+	}
+}
@@ -0,0 +1,229 @@
+package fx
+
+import (
+	"context"
+	"errors"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/exporters/golog"
+	"github.com/KasperskyLab/klogga/exporters/spancollector"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+	"testing"
+	"time"
+)
+
+type failingRunner struct {
+	errs    chan error
+	started atomic.Int32
+	stopped atomic.Int32
+	policy  *RestartPolicy
+	// errors of the next Start and Stop calls
+	startErrs chan error
+	stopErrs  chan error
+}
+
+func newFailingRunner(policy *RestartPolicy) *failingRunner {
+	return &failingRunner{
+		errs: make(chan error, 10), policy: policy, startErrs: make(chan error, 10), stopErrs: make(chan error, 10),
+	}
+}
+
+func (r *failingRunner) Start(context.Context) error {
+	r.started.Inc()
+	return nextErr(r.startErrs)
+}
+
+func (r *failingRunner) Stop(context.Context) error {
+	r.stopped.Inc()
+	return nextErr(r.stopErrs)
+}
+
+func nextErr(errs chan error) error {
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func (r *failingRunner) Error() <-chan error {
+	return r.errs
+}
+
+type policyRunner struct {
+	*failingRunner
+}
+
+func (r policyRunner) RestartPolicy() RestartPolicy {
+	return *r.policy
+}
+
+func testPolicy() RestartPolicy {
+	return RestartPolicy{
+		Mode:           RestartOnFailure,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     4 * time.Millisecond,
+		MaxRestarts:    2,
+		Window:         time.Minute,
+	}
+}
+
+func newTestSupervisor() *Supervisor {
+	return NewSupervisor(klogga.NewFactory(golog.New(nil)), nil).
+		WithDefaultPolicy(testPolicy())
+}
+
+func requireState(t *testing.T, s *Supervisor, idx int, state RunnerState) RunnerHealth {
+	t.Helper()
+	require.Eventually(
+		t, func() bool { return s.Health()[idx].State == state },
+		time.Second, time.Millisecond, "expected state %s", state,
+	)
+	return s.Health()[idx]
+}
+
+func TestSupervisorRestartOnFailure(t *testing.T) {
+	s := newTestSupervisor()
+	runner := newFailingRunner(nil)
+	lc := fxtest.NewLifecycle(t)
+	s.Register(lc, runner)
+	lc.RequireStart()
+
+	health := requireState(t, s, 0, RunnerRunning)
+	require.Equal(t, "*fx.failingRunner", health.Name)
+
+	runner.errs <- errors.New("failure 1")
+	require.Eventually(t, func() bool { return runner.started.Load() == 2 }, time.Second, time.Millisecond)
+	health = requireState(t, s, 0, RunnerRunning)
+	require.Equal(t, 1, health.Restarts)
+	require.EqualError(t, health.LastErr, "failure 1")
+	require.Equal(t, int32(1), runner.stopped.Load())
+
+	lc.RequireStop()
+	requireState(t, s, 0, RunnerStopped)
+	require.Equal(t, int32(2), runner.stopped.Load())
+}
+
+func TestSupervisorAttemptSpans(t *testing.T) {
+	collector := &spancollector.SpanCollector{}
+	tf := klogga.NewFactory(collector)
+	s := NewSupervisor(tf, nil).WithDefaultPolicy(testPolicy())
+	runner := newFailingRunner(nil)
+	lc := fxtest.NewLifecycle(t)
+	s.Register(lc, runner)
+	lc.RequireStart()
+
+	runner.startErrs <- errors.New("start failure")
+	runner.errs <- errors.New("failure 1")
+	require.Eventually(t, func() bool { return runner.started.Load() == 3 }, time.Second, time.Millisecond)
+	requireState(t, s, 0, RunnerRunning)
+	runner.stopErrs <- errors.New("stop failure")
+	require.Error(t, lc.Stop(testutil.Timeout()))
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+
+	var attempts []interface{}
+	var startErrs, stopErrs []string
+	for _, span := range collector.Spans {
+		switch span.Name() {
+		case "Start":
+			require.Equal(t, "*fx.failingRunner", span.Tags()["runner"])
+			attempts = append(attempts, span.Vals()["attempt"])
+			startErrs = append(startErrs, errString(span.Errs()))
+		case "Stop":
+			require.Equal(t, "*fx.failingRunner", span.Tags()["runner"])
+			stopErrs = append(stopErrs, errString(span.Errs()))
+		}
+	}
+	require.Equal(t, []interface{}{0, 1, 2}, attempts)
+	require.Equal(t, []string{"", "runner *fx.failingRunner start failed: start failure", ""}, startErrs)
+	require.Equal(t, []string{"", "", "runner *fx.failingRunner stop failed: stop failure"}, stopErrs)
+	require.Equal(t, "failure 1", errString(findSpan(t, collector.Spans, "RunnerError", "").Errs()))
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestSupervisorMaxRestarts(t *testing.T) {
+	s := newTestSupervisor()
+	runner := newFailingRunner(nil)
+	lc := fxtest.NewLifecycle(t)
+	s.Register(lc, runner)
+	lc.RequireStart()
+
+	for i := 0; i < 3; i++ {
+		runner.errs <- errors.New("failure")
+	}
+	health := requireState(t, s, 0, RunnerFailed)
+	require.Equal(t, 2, health.Restarts)
+	require.Equal(t, int32(3), runner.started.Load())
+	require.Equal(t, int32(3), runner.stopped.Load())
+
+	lc.RequireStop()
+	require.Equal(t, int32(3), runner.stopped.Load())
+}
+
+func TestSupervisorRunnerPolicy(t *testing.T) {
+	s := newTestSupervisor()
+	never := RestartPolicy{Mode: RestartNever}
+	runner := newFailingRunner(&never)
+	restarted := newFailingRunner(nil)
+	lc := fxtest.NewLifecycle(t)
+	s.Register(lc, policyRunner{runner}, restarted)
+	lc.RequireStart()
+
+	runner.errs <- errors.New("failure")
+	requireState(t, s, 0, RunnerFailed)
+	require.Equal(t, int32(1), runner.started.Load())
+	require.Equal(t, RunnerRunning, s.Health()[1].State)
+
+	lc.RequireStop()
+	requireState(t, s, 1, RunnerStopped)
+}
+
+func TestSupervisorShutdownApp(t *testing.T) {
+	runner := newFailingRunner(nil)
+	var s *Supervisor
+	app := fxtest.New(
+		t,
+		Full(),
+		fx.Provide(
+			func(tf klogga.TracerProvider, sd fx.Shutdowner) *Supervisor {
+				policy := testPolicy()
+				policy.MaxRestarts = 0
+				policy.Mode = RestartNever
+				policy.ShutdownApp = true
+				return NewSupervisor(tf, sd).WithDefaultPolicy(policy)
+			},
+		),
+		fx.Provide(fx.Annotate(func() *failingRunner { return runner }, TagRunner...)),
+		fx.Invoke(RegisterRunnersSupervised),
+		fx.Populate(&s),
+	)
+	app.RequireStart()
+	runner.errs <- errors.New("fatal")
+
+	select {
+	case <-app.Done():
+	case <-time.After(time.Second):
+		require.Fail(t, "app was not shut down")
+	}
+	app.RequireStop()
+	require.Equal(t, RunnerFailed, s.Health()[0].State)
+}
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	p := RestartPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	require.Equal(t, time.Second, p.backoff(0))
+	require.Equal(t, 2*time.Second, p.backoff(1))
+	require.Equal(t, 4*time.Second, p.backoff(2))
+	require.Equal(t, 5*time.Second, p.backoff(3))
+	require.Equal(t, 5*time.Second, p.backoff(30))
+}
@@ -0,0 +1,102 @@
+package fx
+
+import (
+	"github.com/KasperskyLab/klogga"
+	"go.uber.org/fx"
+)
+
+// TracerSettings configures klogga.Tracer injected by Full.
+// Decorate it with fx.Decorate inside NamedModule to override the settings for the module only.
+type TracerSettings struct {
+	// Name component name for the spans, see NamedModule,
+	// if empty each span is named after the package that started it, as with klogga.Factory.Named("")
+	Name klogga.ComponentName
+	// Level spans with a lower level are not written, unless they have errors or warnings
+	// nil inherits the level of the parent scope tracer, everything is written in the root scope
+	Level *klogga.LogLevel
+	// Exporters if set, spans are written to these exporters instead of the factory ones
+	// the exporters are shut down when the app stops, nested modules that inherit them share the parent factory
+	Exporters []klogga.Exporter
+}
+
+// DefaultTracerSettings everything is written to the factory exporters
+func DefaultTracerSettings() TracerSettings {
+	return TracerSettings{}
+}
+
+// Level the level for TracerSettings
+func Level(level klogga.LogLevel) *klogga.LogLevel {
+	return &level
+}
+
+// NewTracer creates the tracer from the settings
+// the factory of TracerSettings.Exporters is shut down on the app stop
+func NewTracer(tf *klogga.Factory, s TracerSettings, lc fx.Lifecycle) klogga.Tracer {
+	return newTracer(nil, tf, s, lc)
+}
+
+// scopeTracer tracer of the fx scope, keeps the settings nested modules inherit
+type scopeTracer struct {
+	klogga.Tracer
+	// nil writes everything
+	level *klogga.LogLevel
+	// factory built for the exporters, nil if the spans are written to the app factory
+	tf        *klogga.Factory
+	exporters []klogga.Exporter
+}
+
+func newTracer(parent *scopeTracer, tf *klogga.Factory, s TracerSettings, lc fx.Lifecycle) klogga.Tracer {
+	res := &scopeTracer{level: s.Level}
+	if res.level == nil && parent != nil {
+		res.level = parent.level
+	}
+	if len(s.Exporters) > 0 {
+		if parent != nil && parent.tf != nil && sameSlice(parent.exporters, s.Exporters) {
+			res.tf = parent.tf
+		} else {
+			res.tf = klogga.NewFactory(s.Exporters...)
+			lc.Append(fx.Hook{OnStop: res.tf.Shutdown})
+		}
+		res.exporters = s.Exporters
+		tf = res.tf
+	}
+	res.Tracer = tf.Named(s.Name)
+	if res.level != nil && *res.level > klogga.Debug {
+		res.Tracer = klogga.NewLevelTracer(res.Tracer, *res.level)
+	}
+	return res
+}
+
+// sameSlice the settings exporters are inherited from the parent scope, not set anew
+func sameSlice(a, b []klogga.Exporter) bool {
+	return len(a) == len(b) && len(a) > 0 && &a[0] == &b[0]
+}
+
+// NamedModule fx.Module where the injected klogga.Tracer is named after the module,
+// unless the name is set explicitly in the module TracerSettings.
+// Requires Full or any other setup that provides *klogga.Factory and TracerSettings.
+func NamedModule(name string, opts ...fx.Option) fx.Option {
+	return fx.Module(
+		name,
+		append(
+			[]fx.Option{
+				fx.Decorate(
+					func(parent klogga.Tracer, tf *klogga.Factory, s TracerSettings, lc fx.Lifecycle) klogga.Tracer {
+						if s.Name == "" {
+							s.Name = klogga.ComponentName(name)
+						}
+						scope, ok := parent.(*scopeTracer)
+						if !ok {
+							scope = &scopeTracer{}
+							if lt, ok := parent.(*klogga.LevelTracer); ok {
+								scope.level = Level(lt.Level())
+							}
+						}
+						return newTracer(scope, tf, s, lc)
+					},
+				),
+			},
+			opts...,
+		)...,
+	)
+}
@@ -22,8 +22,8 @@ type AdapterRawMessage struct {
 	trs klogga.Tracer
 }
 
-func NewAdapterRawMessage(trs klogga.TracerProvider) *AdapterSplitter {
-	return &AdapterSplitter{trs: trs.Named("temporal")}
+func NewAdapterRawMessage(trs klogga.TracerProvider) *AdapterRawMessage {
+	return &AdapterRawMessage{trs: trs.Named("temporal")}
 }
 
 func (t *AdapterRawMessage) trace(level klogga.LogLevel, msg string, keyvals ...interface{}) {
@@ -33,7 +33,7 @@ func (t *AdapterRawMessage) trace(level klogga.LogLevel, msg string, keyvals ...
 }
 
 func (t *AdapterRawMessage) Debug(msg string, keyvals ...interface{}) {
-	t.trace(klogga.Info, msg, keyvals...)
+	t.trace(klogga.Debug, msg, keyvals...)
 }
 
 func (t *AdapterRawMessage) Info(msg string, keyvals ...interface{}) {
@@ -28,7 +28,11 @@ func NewAdapterSplitter(trs klogga.TracerProvider) *AdapterSplitter {
 func (t *AdapterSplitter) trace(level klogga.LogLevel, msg string, keyvals ...interface{}) {
 	span := klogga.StartLeaf(context.Background()).Level(level)
 	defer t.trs.Finish(span)
+	splitKeyvals(span, msg, keyvals...)
+}
 
+// splitKeyvals writes (key,value) pairs to the span vals
+func splitKeyvals(span *klogga.Span, msg string, keyvals ...interface{}) {
 	var key string
 	for i, keyVal := range keyvals {
 		if i%2 == 0 {
@@ -42,7 +46,7 @@ func (t *AdapterSplitter) trace(level klogga.LogLevel, msg string, keyvals ...in
 }
 
 func (t *AdapterSplitter) Debug(msg string, keyvals ...interface{}) {
-	t.trace(klogga.Info, msg, keyvals...)
+	t.trace(klogga.Debug, msg, keyvals...)
 }
 
 func (t *AdapterSplitter) Info(msg string, keyvals ...interface{}) {
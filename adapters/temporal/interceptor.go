@@ -0,0 +1,346 @@
+package temporal
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"github.com/KasperskyLab/klogga"
+	"github.com/google/uuid"
+	commonpb "go.temporal.io/api/common/v1"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/interceptor"
+	"go.temporal.io/sdk/log"
+	"go.temporal.io/sdk/workflow"
+)
+
+// HeaderKey temporal header where the trace context is passed
+const HeaderKey = "klogga"
+
+const (
+	headerTraceID = "trace_id"
+	headerSpanID  = "span_id"
+)
+
+// Interceptor creates spans for workflow and activity executions
+// and passes the trace context through temporal headers.
+// Register it both in client.Options.Interceptors and worker.Options.Interceptors.
+//
+// Workflow code is replayed by temporal, so workflow spans have deterministic ids
+// and nothing is written by the workflow span or the workflow logger during replay.
+type Interceptor struct {
+	interceptor.InterceptorBase
+	trs klogga.Tracer
+}
+
+func NewInterceptor(tf klogga.TracerProvider) *Interceptor {
+	return &Interceptor{trs: tf.Named("temporal")}
+}
+
+func (i *Interceptor) InterceptClient(next interceptor.ClientOutboundInterceptor) interceptor.ClientOutboundInterceptor {
+	res := &clientOutbound{root: i}
+	res.Next = next
+	return res
+}
+
+func (i *Interceptor) InterceptActivity(
+	_ context.Context,
+	next interceptor.ActivityInboundInterceptor,
+) interceptor.ActivityInboundInterceptor {
+	res := &activityInbound{root: i}
+	res.Next = next
+	return res
+}
+
+func (i *Interceptor) InterceptWorkflow(
+	_ workflow.Context,
+	next interceptor.WorkflowInboundInterceptor,
+) interceptor.WorkflowInboundInterceptor {
+	res := &workflowInbound{root: i}
+	res.Next = next
+	return res
+}
+
+type workflowSpanKey struct{}
+
+// WorkflowSpan returns the span of the current workflow execution
+// the span is written when the workflow completes, so tags added here appear on it
+func WorkflowSpan(ctx workflow.Context) *klogga.Span {
+	if span, ok := ctx.Value(workflowSpanKey{}).(*klogga.Span); ok {
+		return span
+	}
+	return nil
+}
+
+type clientOutbound struct {
+	interceptor.ClientOutboundInterceptorBase
+	root *Interceptor
+}
+
+func (c *clientOutbound) ExecuteWorkflow(
+	ctx context.Context,
+	in *interceptor.ClientExecuteWorkflowInput,
+) (client.WorkflowRun, error) {
+	span, ctx := klogga.Start(ctx, klogga.WithName("ExecuteWorkflow"))
+	defer c.root.trs.Finish(span)
+	span.Tag("workflow_type", in.WorkflowType)
+	if in.Options != nil {
+		span.Tag("workflow_id", in.Options.ID)
+	}
+
+	if err := writeHeader(interceptor.Header(ctx), span); err != nil {
+		return nil, span.Err(err)
+	}
+	run, err := c.Next.ExecuteWorkflow(ctx, in)
+	if err != nil {
+		return nil, span.Err(err)
+	}
+	span.Tag("workflow_id", run.GetID()).Tag("run_id", run.GetRunID())
+	return run, nil
+}
+
+func (c *clientOutbound) SignalWorkflow(ctx context.Context, in *interceptor.ClientSignalWorkflowInput) error {
+	span, ctx := klogga.Start(ctx, klogga.WithName("SignalWorkflow"))
+	defer c.root.trs.Finish(span)
+	span.Tag("workflow_id", in.WorkflowID).Tag("run_id", in.RunID).Tag("signal", in.SignalName)
+
+	if err := writeHeader(interceptor.Header(ctx), span); err != nil {
+		return span.Err(err)
+	}
+	return span.Err(c.Next.SignalWorkflow(ctx, in))
+}
+
+type workflowInbound struct {
+	interceptor.WorkflowInboundInterceptorBase
+	root *Interceptor
+}
+
+func (w *workflowInbound) Init(outbound interceptor.WorkflowOutboundInterceptor) error {
+	res := &workflowOutbound{root: w.root}
+	res.Next = outbound
+	return w.Next.Init(res)
+}
+
+func (w *workflowInbound) ExecuteWorkflow(ctx workflow.Context, in *interceptor.ExecuteWorkflowInput) (interface{}, error) {
+	info := workflow.GetInfo(ctx)
+	runKey := info.WorkflowExecution.ID + "/" + info.WorkflowExecution.RunID
+
+	opts := []klogga.SpanOption{
+		klogga.WithName(info.WorkflowType.Name),
+		klogga.WithSpanID(deterministicSpanID(runKey)),
+		klogga.WithTraceID(klogga.TraceID(uuid.NewSHA1(uuid.NameSpaceOID, []byte(runKey)))),
+	}
+	if !info.WorkflowStartTime.IsZero() {
+		opts = append(opts, klogga.WithTimestamp(info.WorkflowStartTime))
+	}
+	parentOpts, headerErr := readHeader(interceptor.WorkflowHeader(ctx))
+	opts = append(opts, parentOpts...)
+
+	span := klogga.StartLeaf(context.Background(), opts...)
+	span.Tag("workflow_id", info.WorkflowExecution.ID).
+		Tag("run_id", info.WorkflowExecution.RunID).
+		Val("attempt", info.Attempt).
+		Warn(headerErr)
+
+	res, err := w.Next.ExecuteWorkflow(workflow.WithValue(ctx, workflowSpanKey{}, span), in)
+	var continueAsNew *workflow.ContinueAsNewError
+	if errors.As(err, &continueAsNew) {
+		span.Tag("continued_as_new", true)
+	} else {
+		span.ErrVoid(err)
+	}
+	// completion is replayed only when it was already written by the original execution
+	if !workflow.IsReplaying(ctx) {
+		w.root.trs.Finish(span)
+	}
+	return res, err
+}
+
+type workflowOutbound struct {
+	interceptor.WorkflowOutboundInterceptorBase
+	root *Interceptor
+}
+
+func (w *workflowOutbound) ExecuteActivity(ctx workflow.Context, activityType string, args ...interface{}) workflow.Future {
+	w.propagate(ctx)
+	return w.Next.ExecuteActivity(ctx, activityType, args...)
+}
+
+func (w *workflowOutbound) ExecuteLocalActivity(
+	ctx workflow.Context,
+	activityType string,
+	args ...interface{},
+) workflow.Future {
+	w.propagate(ctx)
+	return w.Next.ExecuteLocalActivity(ctx, activityType, args...)
+}
+
+func (w *workflowOutbound) ExecuteChildWorkflow(
+	ctx workflow.Context,
+	childWorkflowType string,
+	args ...interface{},
+) workflow.ChildWorkflowFuture {
+	w.propagate(ctx)
+	return w.Next.ExecuteChildWorkflow(ctx, childWorkflowType, args...)
+}
+
+// GetLogger replaces temporal workflow logger with spans that are children of the workflow span
+// log calls made during replay are dropped, they were written by the original execution
+func (w *workflowOutbound) GetLogger(ctx workflow.Context) log.Logger {
+	return &spanLogger{
+		trs: w.root.trs,
+		start: func() *klogga.Span {
+			if workflow.IsReplaying(ctx) {
+				return nil
+			}
+			return startChild(WorkflowSpan(ctx))
+		},
+	}
+}
+
+// propagate writes the workflow span as a parent for the scheduled activity or child workflow
+func (w *workflowOutbound) propagate(ctx workflow.Context) {
+	span := WorkflowSpan(ctx)
+	if span == nil {
+		return
+	}
+	if err := writeHeader(interceptor.WorkflowHeader(ctx), span); err != nil && !workflow.IsReplaying(ctx) {
+		startChild(span).ErrSpan(err).FlushTo(w.root.trs)
+	}
+}
+
+type activityInbound struct {
+	interceptor.ActivityInboundInterceptorBase
+	root *Interceptor
+}
+
+func (a *activityInbound) Init(outbound interceptor.ActivityOutboundInterceptor) error {
+	res := &activityOutbound{root: a.root}
+	res.Next = outbound
+	return a.Next.Init(res)
+}
+
+func (a *activityInbound) ExecuteActivity(ctx context.Context, in *interceptor.ExecuteActivityInput) (interface{}, error) {
+	info := activity.GetInfo(ctx)
+	opts := []klogga.SpanOption{klogga.WithName(info.ActivityType.Name)}
+	if !info.StartedTime.IsZero() {
+		opts = append(opts, klogga.WithTimestamp(info.StartedTime))
+	}
+	parentOpts, headerErr := readHeader(interceptor.Header(ctx))
+	opts = append(opts, parentOpts...)
+
+	span, ctx := klogga.Start(ctx, opts...)
+	defer a.root.trs.Finish(span)
+	span.Tag("workflow_id", info.WorkflowExecution.ID).
+		Tag("run_id", info.WorkflowExecution.RunID).
+		Tag("activity_id", info.ActivityID).
+		Val("attempt", info.Attempt).
+		Warn(headerErr)
+
+	res, err := a.Next.ExecuteActivity(ctx, in)
+	span.ErrVoid(err)
+	return res, err
+}
+
+type activityOutbound struct {
+	interceptor.ActivityOutboundInterceptorBase
+	root *Interceptor
+}
+
+// GetLogger replaces temporal activity logger with spans that are children of the activity span
+func (a *activityOutbound) GetLogger(ctx context.Context) log.Logger {
+	return &spanLogger{
+		trs: a.root.trs,
+		start: func() *klogga.Span {
+			return klogga.StartLeaf(ctx)
+		},
+	}
+}
+
+// spanLogger temporal logger that writes each call as a span
+// start returns nil when the call must be skipped
+type spanLogger struct {
+	trs   klogga.Tracer
+	start func() *klogga.Span
+}
+
+func (l *spanLogger) trace(level klogga.LogLevel, msg string, keyvals ...interface{}) {
+	span := l.start()
+	if span == nil {
+		return
+	}
+	defer l.trs.Finish(span)
+	splitKeyvals(span.Level(level), msg, keyvals...)
+}
+
+func (l *spanLogger) Debug(msg string, keyvals ...interface{}) {
+	l.trace(klogga.Debug, msg, keyvals...)
+}
+
+func (l *spanLogger) Info(msg string, keyvals ...interface{}) {
+	l.trace(klogga.Info, msg, keyvals...)
+}
+
+func (l *spanLogger) Warn(msg string, keyvals ...interface{}) {
+	l.trace(klogga.Warn, msg, keyvals...)
+}
+
+func (l *spanLogger) Error(msg string, keyvals ...interface{}) {
+	l.trace(klogga.Error, msg, keyvals...)
+}
+
+func startChild(parent *klogga.Span) *klogga.Span {
+	if parent == nil {
+		return klogga.StartLeaf(context.Background())
+	}
+	return klogga.StartLeaf(
+		context.Background(),
+		klogga.WithTraceID(parent.TraceID()),
+		klogga.WithParentSpanID(parent.ID()),
+	)
+}
+
+func writeHeader(header map[string]*commonpb.Payload, span *klogga.Span) error {
+	if header == nil {
+		return nil
+	}
+	payload, err := converter.GetDefaultDataConverter().ToPayload(
+		map[string]string{
+			headerTraceID: span.TraceID().String(),
+			headerSpanID:  span.ID().String(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	header[HeaderKey] = payload
+	return nil
+}
+
+// readHeader returns span options that make the span a child of the span passed in the header
+func readHeader(header map[string]*commonpb.Payload) ([]klogga.SpanOption, error) {
+	payload := header[HeaderKey]
+	if payload == nil {
+		return nil, nil
+	}
+	var data map[string]string
+	if err := converter.GetDefaultDataConverter().FromPayload(payload, &data); err != nil {
+		return nil, err
+	}
+	traceID, err := klogga.TraceIDFromString(data[headerTraceID])
+	if err != nil {
+		return nil, err
+	}
+	spanID, err := klogga.ParseSpanID(data[headerSpanID])
+	if err != nil {
+		return nil, err
+	}
+	return []klogga.SpanOption{klogga.WithTraceID(traceID), klogga.WithParentSpanID(spanID)}, nil
+}
+
+func deterministicSpanID(key string) (res klogga.SpanID) {
+	hash := sha256.Sum256([]byte(key))
+	copy(res[:], hash[:])
+	return res
+}
@@ -0,0 +1,156 @@
+package temporal
+
+import (
+	"context"
+	"errors"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/exporters/spancollector"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	commonpb "go.temporal.io/api/common/v1"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/interceptor"
+	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/worker"
+	"go.temporal.io/sdk/workflow"
+	"testing"
+	"time"
+)
+
+func greetWorkflow(ctx workflow.Context, name string) (string, error) {
+	workflow.GetLogger(ctx).Info("workflow started", "Name", name)
+	ctx = workflow.WithActivityOptions(ctx, workflow.ActivityOptions{StartToCloseTimeout: time.Minute})
+	var res string
+	err := workflow.ExecuteActivity(ctx, greetActivity, name).Get(ctx, &res)
+	return res, err
+}
+
+func greetActivity(ctx context.Context, name string) (string, error) {
+	activity.GetLogger(ctx).Debug("greeting", "name", name)
+	return "hello " + name, nil
+}
+
+func replayWorkflow(ctx workflow.Context) error {
+	workflow.GetLogger(ctx).Info("must not be written on replay")
+	return nil
+}
+
+func findSpan(t *testing.T, spans []*klogga.Span, name string) *klogga.Span {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name() == name {
+			return span
+		}
+	}
+	require.Failf(t, "span not found", "name: %s", name)
+	return nil
+}
+
+func findMessage(t *testing.T, spans []*klogga.Span, message string) *klogga.Span {
+	t.Helper()
+	for _, span := range spans {
+		if span.Vals()["message"] == message {
+			return span
+		}
+	}
+	require.Failf(t, "span not found", "message: %s", message)
+	return nil
+}
+
+func newTestEnv(tf klogga.TracerProvider) *testsuite.TestWorkflowEnvironment {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	env.SetWorkerOptions(worker.Options{Interceptors: []interceptor.WorkerInterceptor{NewInterceptor(tf)}})
+	env.RegisterWorkflow(greetWorkflow)
+	env.RegisterActivity(greetActivity)
+	return env
+}
+
+func TestInterceptorWorkflowWithActivity(t *testing.T) {
+	collector := &spancollector.SpanCollector{}
+	env := newTestEnv(klogga.NewFactory(collector))
+
+	env.ExecuteWorkflow(greetWorkflow, "klogga")
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	var res string
+	require.NoError(t, env.GetWorkflowResult(&res))
+	require.Equal(t, "hello klogga", res)
+
+	wfSpan := findSpan(t, collector.Spans, "greetWorkflow")
+	require.False(t, wfSpan.HasErr())
+	require.Equal(t, klogga.ComponentName("temporal"), wfSpan.Component())
+
+	activitySpan := findSpan(t, collector.Spans, "greetActivity")
+	require.Equal(t, wfSpan.TraceID(), activitySpan.TraceID())
+	require.Equal(t, wfSpan.ID(), activitySpan.ParentID())
+
+	wfLog := findMessage(t, collector.Spans, "workflow started")
+	require.Equal(t, wfSpan.TraceID(), wfLog.TraceID())
+	require.Equal(t, wfSpan.ID(), wfLog.ParentID())
+	require.Equal(t, "klogga", wfLog.Vals()["name"])
+
+	activityLog := findMessage(t, collector.Spans, "greeting")
+	require.Equal(t, klogga.Debug, activityLog.LevelGet())
+	require.Equal(t, activitySpan.TraceID(), activityLog.TraceID())
+	require.Equal(t, activitySpan.ID(), activityLog.ParentID())
+}
+
+func TestInterceptorTraceFromHeader(t *testing.T) {
+	collector := &spancollector.SpanCollector{}
+	env := newTestEnv(klogga.NewFactory(collector))
+
+	parent := klogga.StartLeaf(context.Background())
+	header := map[string]*commonpb.Payload{}
+	require.NoError(t, writeHeader(header, parent))
+	env.SetHeader(&commonpb.Header{Fields: header})
+
+	env.ExecuteWorkflow(greetWorkflow, "klogga")
+	require.NoError(t, env.GetWorkflowError())
+
+	wfSpan := findSpan(t, collector.Spans, "greetWorkflow")
+	require.Equal(t, parent.TraceID(), wfSpan.TraceID())
+	require.Equal(t, parent.ID(), wfSpan.ParentID())
+	require.Equal(t, parent.TraceID(), findSpan(t, collector.Spans, "greetActivity").TraceID())
+}
+
+func TestInterceptorWorkflowError(t *testing.T) {
+	collector := &spancollector.SpanCollector{}
+	env := newTestEnv(klogga.NewFactory(collector))
+	env.OnActivity(greetActivity, mock.Anything, "klogga").Return("", errors.New("activity failed"))
+
+	env.ExecuteWorkflow(greetWorkflow, "klogga")
+	require.Error(t, env.GetWorkflowError())
+	require.True(t, findSpan(t, collector.Spans, "greetWorkflow").HasErr())
+}
+
+func TestInterceptorSkipsReplay(t *testing.T) {
+	collector := &spancollector.SpanCollector{}
+	replayer, err := worker.NewWorkflowReplayerWithOptions(
+		worker.WorkflowReplayerOptions{
+			Interceptors: []interceptor.WorkerInterceptor{NewInterceptor(klogga.NewFactory(collector))},
+		},
+	)
+	require.NoError(t, err)
+	replayer.RegisterWorkflow(replayWorkflow)
+
+	err = replayer.ReplayWorkflowHistoryFromJSONFile(nil, "testdata/replay_history.json")
+	require.NoError(t, err)
+	require.Empty(t, collector.Spans)
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	span := klogga.StartLeaf(context.Background())
+	header := map[string]*commonpb.Payload{}
+	require.NoError(t, writeHeader(header, span))
+
+	opts, err := readHeader(header)
+	require.NoError(t, err)
+	child := klogga.StartLeaf(context.Background(), opts...)
+	require.Equal(t, span.TraceID(), child.TraceID())
+	require.Equal(t, span.ID(), child.ParentID())
+
+	opts, err = readHeader(nil)
+	require.NoError(t, err)
+	require.Empty(t, opts)
+}
@@ -2,8 +2,11 @@ package batcher
 
 import (
 	"context"
+	"fmt"
 	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/batcher/spool"
 	"github.com/KasperskyLab/klogga/util/errs"
+	"github.com/pkg/errors"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,20 +17,86 @@ type Batcher struct {
 	exporter klogga.Exporter
 	conf     Config
 
-	spans chan *klogga.Span
+	spans chan bufferedSpan
+	// high priority lane with the reserved capacity, drained before spans
+	priority chan bufferedSpan
+	// estimated size of the buffered spans, nil if Config.MaxBufferBytes is not set
+	bytes *byteBudget
+	// spool replaces spans buffer when set, see NewWithSpool
+	spool *spool.Spool
+	// failed writes of the spooled batch at the head of the spool, accessed by the loop only
+	spoolAttempts int
+	// batches writers when Config.Workers is more than one
+	workers   []worker
+	workersWg sync.WaitGroup
 
-	flushedCount uint64
-	erredCount   uint64
-	cond         *sync.Cond
+	flushedCount      uint64
+	erredCount        uint64
+	droppedCount      uint64
+	retriedCount      uint64
+	deadLetteredCount uint64
+	errHandler        atomic.Value
+	batchObserver     atomic.Value
 
-	tm   *time.Timer
-	stop chan struct{}
+	// last drop summary, used by the flushing goroutine only
+	summaryDropped uint64
+	summaryTs      time.Time
+
+	// exporter writes context, cancelled when the Shutdown context is done
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wakes the loop to write full batches
+	wake chan struct{}
+	// Flush requests, the loop replies when the buffered spans are written
+	flushes  chan chan error
+	stop     chan struct{}
+	stopOnce sync.Once
+	// closed when the loop exits after the final drain
+	done chan struct{}
 }
 
 type Config struct {
 	BatchSize  int
-	BufferSize int // how many spans to be buffered before blocking, BatchSize*5 if zero
+	BufferSize int // how many spans to be buffered before OverflowPolicy applies, BatchSize*5 if zero
 	Timeout    time.Duration
+
+	// PriorityBufferSize capacity reserved for the high priority spans on top of BufferSize, BufferSize/4 if zero
+	// high priority spans are written before the rest, they go to the common buffer when the reserved one is full
+	// the order is kept within the lane only, not used in the spool mode
+	PriorityBufferSize int
+	// Priority tells the high priority spans, HighPriority if nil
+	Priority func(span *klogga.Span) bool
+
+	// MaxBatchBytes limits estimated size of the batch (see klogga.Span.EstimatedSize) along with BatchSize,
+	// a span bigger than the limit is written in a batch of its own, no limit if zero
+	MaxBatchBytes int
+	// MaxBufferBytes limits estimated size of the buffered spans along with BufferSize,
+	// OverflowPolicy applies when any of the limits is reached, no limit if zero
+	// byte limits are not used in the spool mode
+	MaxBufferBytes int
+
+	OverflowPolicy OverflowPolicy
+	// BlockTimeout how long Write waits for the buffer space before the span is dropped, no limit if zero
+	// used by OverflowBlock and OverflowDropByLevel
+	BlockTimeout time.Duration
+	// DropSummaryInterval how often a span about dropped spans is written, 10 seconds if zero
+	DropSummaryInterval time.Duration
+
+	// Workers how many batches can be written at the same time, one if zero
+	// spans are split between the workers by ShardBy, not used in the spool mode
+	Workers int
+	ShardBy ShardKey
+
+	Retry RetryPolicy
+	// DeadLetter optional exporter for the batches that failed after all retries
+	// it is shut down with the Batcher
+	DeadLetter klogga.Exporter
+
+	// SpoolMaxAttempts how many times a spooled batch is written to the exporter and DeadLetter
+	// before it is dropped from the spool as lost, 10 if zero, unlimited if negative
+	// writes cancelled by Shutdown are not counted, so the batch stays in the spool for the next run
+	SpoolMaxAttempts int
 }
 
 func (c *Config) GetBatchSize() int {
@@ -37,6 +106,13 @@ func (c *Config) GetBatchSize() int {
 	return c.BatchSize
 }
 
+func (c *Config) GetTimeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return c.Timeout
+}
+
 func (c *Config) GetBufferSize() int {
 	if c.BufferSize > 0 {
 		return c.BufferSize
@@ -44,6 +120,20 @@ func (c *Config) GetBufferSize() int {
 	return c.GetBatchSize() * 5
 }
 
+func (c *Config) GetSpoolMaxAttempts() int {
+	if c.SpoolMaxAttempts == 0 {
+		return 10
+	}
+	return c.SpoolMaxAttempts
+}
+
+func (c *Config) GetDropSummaryInterval() time.Duration {
+	if c.DropSummaryInterval <= 0 {
+		return 10 * time.Second
+	}
+	return c.DropSummaryInterval
+}
+
 // ConfigDefault generates default batcher config
 // non-nil optional config will be used instead
 func ConfigDefault(cc ...*Config) Config {
@@ -58,16 +148,32 @@ func ConfigDefault(cc ...*Config) Config {
 }
 
 // New constructs and starts the Batcher
-// beware that errors from the exporter are ignored, so if you really need them use a decorator or something
+// errors from the exporter are passed to the handler set by SetErrorHandler,
+// klogga.Factory sets it when the Batcher is attached
 func New(exporter klogga.Exporter, conf Config) *Batcher {
+	return newBatcher(exporter, conf, nil)
+}
+
+func newBatcher(exporter klogga.Exporter, conf Config, s *spool.Spool) *Batcher {
 	b := &Batcher{
 		exporter: exporter,
 		conf:     conf,
-		spans:    make(chan *klogga.Span, conf.GetBufferSize()),
-		cond:     sync.NewCond(&sync.Mutex{}),
+		spool:    s,
+		wake:     make(chan struct{}, 1),
+		flushes:  make(chan chan error),
 		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+
+		summaryTs: time.Now(),
+	}
+	if s == nil {
+		b.spans = make(chan bufferedSpan, conf.GetBufferSize())
+		b.priority = make(chan bufferedSpan, conf.GetPriorityBufferSize())
+		b.bytes = newByteBudget(conf.MaxBufferBytes)
 	}
-	go b.start()
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.startWorkers()
+	go b.run()
 
 	return b
 }
@@ -80,77 +186,251 @@ func (b *Batcher) ErredCount() (res uint64) {
 	return atomic.LoadUint64(&b.erredCount)
 }
 
-func (b *Batcher) start() {
-	b.tm = time.AfterFunc(
-		b.conf.Timeout, func() {
-			b.cond.Signal()
-		},
-	)
-	go func() {
-		toFlush := make([]*klogga.Span, 0, b.conf.BatchSize)
-		for {
-		loop:
-			for len(b.spans) > 0 {
-				select {
-				case span := <-b.spans:
-					toFlush = append(toFlush, span)
-					if len(b.spans) == 0 || len(toFlush) >= b.conf.BatchSize {
-						err := b.exporter.Write(context.Background(), toFlush)
-						if err != nil {
-							atomic.AddUint64(&b.erredCount, uint64(len(toFlush)))
-						} else {
-							atomic.AddUint64(&b.flushedCount, uint64(len(toFlush)))
-						}
-						toFlush = toFlush[:0]
-						continue
-					}
-				default:
-					break loop
-				}
-			}
-			select {
-			case <-b.stop:
-				return
-			default:
-			}
+// SetErrorHandler handler is called with the failed batch size and the exporter error
+func (b *Batcher) SetErrorHandler(handler func(spans int, err error)) {
+	b.errHandler.Store(handler)
+}
+
+// SetBatchObserver observer is called after each batch is exported with its size, export duration including retries
+// and the error, if the batch was lost
+func (b *Batcher) SetBatchObserver(observer func(spans int, took time.Duration, err error)) {
+	b.batchObserver.Store(observer)
+}
 
-			b.tm.Reset(b.conf.Timeout)
-			b.cond.L.Lock()
-			b.cond.Wait()
-			b.cond.L.Unlock()
+// QueueLen spans buffered or spooled and not written yet
+func (b *Batcher) QueueLen() int {
+	if b.spool != nil {
+		return b.SpoolPending()
+	}
+	return b.buffered()
+}
+
+// QueueCap how many spans can be buffered including the priority lane, zero in the spool mode
+func (b *Batcher) QueueCap() int {
+	if b.spool != nil {
+		return 0
+	}
+	return cap(b.spans) + cap(b.priority)
+}
+
+func (b *Batcher) String() string {
+	return fmt.Sprintf("batcher(%T)", b.exporter)
+}
+
+// run is the only goroutine that writes to the exporter
+// buffered spans are written when a batch is full, on the Config.Timeout tick, on Flush and on Shutdown
+func (b *Batcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.conf.GetTimeout())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.wake:
+			_ = b.drain(false)
+		case <-ticker.C:
+			_ = b.drain(false)
+		case reply := <-b.flushes:
+			reply <- b.drain(true)
+		case <-b.stop:
+			_ = b.drain(true)
+			b.stopWorkers()
+			return
 		}
-	}()
+	}
 }
 
+// drain writes spans buffered at the moment of the call in batches
+// returns errors of the batches that were lost
+// with the workers, waits for them to write the batches only if wait is set
+func (b *Batcher) drain(wait bool) error {
+	if b.spool != nil {
+		return b.drainSpool()
+	}
+	if len(b.workers) > 0 {
+		return b.drainSharded(wait)
+	}
+	var allErrs error
+	// exporters may keep the batch, so it is not reused
+	current := &batch{}
+	for n := b.buffered(); n > 0; n-- {
+		item, ok := b.take()
+		if !ok {
+			// taken out by OverflowDropOldest
+			break
+		}
+		if b.exceeds(current, item.size) {
+			allErrs = errs.Append(allErrs, b.flush(current.spans))
+			current = &batch{}
+		}
+		current.add(item)
+		if len(current.spans) >= b.conf.GetBatchSize() {
+			allErrs = errs.Append(allErrs, b.flush(current.spans))
+			current = &batch{}
+		}
+	}
+	if len(current.spans) > 0 {
+		allErrs = errs.Append(allErrs, b.flush(current.spans))
+	}
+	return allErrs
+}
+
+// ErrShutdown returned by Write after Shutdown, the spans are counted as dropped
+var ErrShutdown = errors.New("batcher is shut down")
+
+// Write buffers spans, when the buffer is full Config.OverflowPolicy applies
+// in the spool mode spans are appended to the spool instead
 func (b *Batcher) Write(ctx context.Context, spans []*klogga.Span) error {
+	if b.stopped() {
+		atomic.AddUint64(&b.droppedCount, uint64(len(spans)))
+		return ErrShutdown
+	}
+	if b.spool != nil {
+		return b.appendSpool(spans)
+	}
 	for _, span := range spans {
-		select {
-		case b.spans <- span:
-			if len(b.spans) >= b.conf.GetBatchSize() {
-				b.cond.Signal()
-			}
-		case <-ctx.Done():
-			return nil
-		}
+		b.enqueue(ctx, span)
 	}
 	return nil
 }
 
-func (b *Batcher) Shutdown(ctx context.Context) (err error) {
-	b.TriggerFlush()
-	if b.stop == nil {
+// flush adds the drop summary to the batch and exports it
+func (b *Batcher) flush(spans []*klogga.Span) error {
+	if summary := b.dropSummary(); summary != nil {
+		spans = append(spans, summary)
+	}
+	return b.export(spans)
+}
+
+// export writes the batch, returns error if it was written neither to the exporter nor to the dead letter exporter
+func (b *Batcher) export(spans []*klogga.Span) (lost error) {
+	return b.exportBatch(spans, false)
+}
+
+// exportBatch writes the batch to the exporter, or to the dead letter exporter if the exporter fails
+// a spooled batch that is written nowhere stays in the spool to be retried, so it is not reported as erred or lost,
+// only the error is returned
+func (b *Batcher) exportBatch(spans []*klogga.Span, spooled bool) error {
+	start := time.Now()
+	err := b.write(spans)
+	if err == nil {
+		atomic.AddUint64(&b.flushedCount, uint64(len(spans)))
+		b.observe(len(spans), start, nil)
+		return nil
+	}
+	dlErr := b.deadLetter(spans)
+	delivered := b.conf.DeadLetter != nil && dlErr == nil
+	err = errs.Append(err, dlErr)
+	if spooled && !delivered {
+		return err
+	}
+	atomic.AddUint64(&b.erredCount, uint64(len(spans)))
+	b.handleErr(len(spans), err)
+	if delivered {
+		b.observe(len(spans), start, nil)
 		return nil
 	}
+	b.observe(len(spans), start, err)
+	return err
+}
+
+func (b *Batcher) observe(spans int, start time.Time, lost error) {
+	if observer, ok := b.batchObserver.Load().(func(int, time.Duration, error)); ok {
+		observer(spans, time.Since(start), lost)
+	}
+}
+
+func (b *Batcher) handleErr(spans int, err error) {
+	if handler, ok := b.errHandler.Load().(func(int, error)); ok {
+		handler(spans, err)
+	}
+}
+
+// Flush blocks until spans written before the call are exported or failed,
+// returns errors of the batches that were lost
+func (b *Batcher) Flush(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case b.flushes <- reply:
+	case <-b.done:
+		// everything was written on Shutdown
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	select {
-	case b.stop <- struct{}{}:
-		b.stop = nil
+	case err := <-reply:
+		return err
 	case <-ctx.Done():
-		err = ctx.Err()
+		return ctx.Err()
 	}
-	return errs.Append(b.exporter.Shutdown(ctx), err)
 }
 
-// TriggerFlush asynchronously writes queue content to writer
+// Shutdown writes all buffered spans and shuts down the exporter
+// if the context is done before the drain is finished, pending writes are cancelled and the rest of the spans is lost
+// and the exporter is shut down in the background once the writes return
+// safe to call many times and concurrently, only the first call shuts down the exporter
+func (b *Batcher) Shutdown(ctx context.Context) (err error) {
+	first := false
+	b.stopOnce.Do(
+		func() {
+			first = true
+			close(b.stop)
+		},
+	)
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		if first {
+			// stops retries and pending writes, the exporter is shut down once the loop exits
+			b.cancel()
+			go b.shutdownLate()
+		}
+		return ctx.Err()
+	}
+	if !first {
+		return nil
+	}
+	b.cancel()
+	return b.close(ctx)
+}
+
+func (b *Batcher) stopped() bool {
+	select {
+	case <-b.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// close shuts down the exporter, the dead letter exporter and the spool, must be called only after the loop exits
+// spans buffered by the writes racing with Shutdown after the final drain are counted as dropped
+func (b *Batcher) close(ctx context.Context) error {
+	if b.spool == nil {
+		for n := b.buffered(); n > 0; n-- {
+			if _, ok := b.take(); ok {
+				b.drop()
+			}
+		}
+	}
+	return errs.Append(b.exporter.Shutdown(ctx), b.shutdownDeadLetter(ctx), b.closeSpool())
+}
+
+// shutdownLate closes the Batcher after the loop exits when Shutdown timed out,
+// the errors are passed to the error handler
+func (b *Batcher) shutdownLate() {
+	<-b.done
+	ctx, cancel := context.WithTimeout(context.Background(), b.conf.GetTimeout())
+	defer cancel()
+	if err := b.close(ctx); err != nil {
+		b.handleErr(0, errors.Wrap(err, "shutdown failed"))
+	}
+}
+
+// TriggerFlush asynchronously writes queue content to writer, use Flush to wait for the write
 func (b *Batcher) TriggerFlush() {
-	b.cond.Signal()
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
 }
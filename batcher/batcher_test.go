@@ -1,9 +1,12 @@
 package batcher
 
 import (
+	"context"
+	"errors"
 	"github.com/KasperskyLab/klogga"
 	"github.com/KasperskyLab/klogga/util/testutil"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
 	"sync"
 	"testing"
 	"time"
@@ -57,38 +60,68 @@ func TestBatchPerTimer(t *testing.T) {
 
 	rawTracer := New(
 		tw, Config{
-			BatchSize: 5,
-			Timeout:   100 * time.Millisecond,
+			BatchSize: 50,
+			Timeout:   10 * time.Millisecond,
 		},
 	)
 	trs := klogga.NewFactory(rawTracer).NamedPkg()
 	for i := 0; i < 30; i++ {
 		klogga.StartLeaf(testutil.Timeout()).FlushTo(trs)
 	}
-	time.Sleep(150 * time.Millisecond)
-	require.True(t, len(tw.GetSpans()) >= 5)
-	time.Sleep(150 * time.Millisecond)
-	require.True(t, len(tw.GetSpans()) >= 10)
+	require.Eventually(t, func() bool { return len(tw.GetSpans()) == 30 }, time.Second, time.Millisecond)
+	require.NoError(t, rawTracer.Shutdown(testutil.Timeout()))
 }
 
-func TestWriteBeforeStart(t *testing.T) {
+func TestFlush(t *testing.T) {
 	tw := &exporterStub{}
 	rawTracer := New(
 		tw, Config{
 			BatchSize:  5,
 			BufferSize: 40,
-			Timeout:    100 * time.Millisecond,
+			Timeout:    time.Hour,
 		},
 	)
-	trs := klogga.NewFactory(rawTracer).NamedPkg()
+	tf := klogga.NewFactory(rawTracer)
+	trs := tf.NamedPkg()
 
-	for i := 0; i < 30; i++ {
+	for i := 0; i < 32; i++ {
 		klogga.StartLeaf(testutil.Timeout()).FlushTo(trs)
 	}
-	time.Sleep(150 * time.Millisecond)
-	require.True(t, len(tw.GetSpans()) >= 5)
-	time.Sleep(150 * time.Millisecond)
-	require.True(t, len(tw.GetSpans()) >= 10)
+	require.NoError(t, rawTracer.Flush(testutil.Timeout()))
+	require.Len(t, tw.GetSpans(), 32)
+	require.Equal(t, uint64(32), rawTracer.FlushedCount())
+	for _, batch := range tw.Batches {
+		require.LessOrEqual(t, len(batch), 5)
+	}
+
+	klogga.StartLeaf(testutil.Timeout()).FlushTo(trs)
+	require.NoError(t, tf.Flush(testutil.Timeout()))
+	require.Len(t, tw.GetSpans(), 33)
+
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+	require.NoError(t, rawTracer.Flush(testutil.Timeout()))
+}
+
+func TestFlushReturnsLostBatches(t *testing.T) {
+	rawTracer := New(&exporterStub{Err: errors.New("write failed")}, Config{BatchSize: 10, Timeout: time.Hour})
+	writeSpans(t, rawTracer, 5)
+	require.EqualError(t, rawTracer.Flush(testutil.Timeout()), "write failed")
+	require.Equal(t, uint64(5), rawTracer.ErredCount())
+	require.NoError(t, rawTracer.Shutdown(testutil.Timeout()))
+}
+
+func TestFlushTimeout(t *testing.T) {
+	release := make(chan struct{})
+	tw := &hookExporter{Exporter: &exporterStub{}, hook: func() { <-release }}
+	rawTracer := New(tw, Config{BatchSize: 10, Timeout: time.Hour})
+	writeSpans(t, rawTracer, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, rawTracer.Flush(ctx), context.DeadlineExceeded)
+	close(release)
+	require.NoError(t, rawTracer.Shutdown(testutil.Timeout()))
+	require.Equal(t, uint64(10), rawTracer.FlushedCount())
 }
 
 func BenchmarkSpansBatcher(b *testing.B) {
@@ -142,10 +175,9 @@ func TestWriteLotsOfSpans(t *testing.T) {
 	for i := 0; i < 10000; i++ {
 		klogga.StartLeaf(testutil.Timeout()).FlushTo(trs)
 	}
-	time.Sleep(150 * time.Millisecond)
-	require.True(t, len(tw.GetSpans()) >= 5)
-	time.Sleep(150 * time.Millisecond)
-	require.True(t, len(tw.GetSpans()) >= 10)
+	require.NoError(t, tf.Flush(testutil.Timeout()))
+	require.Len(t, tw.GetSpans(), 10000)
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
 }
 
 func TestShutdownTwice(t *testing.T) {
@@ -176,8 +208,8 @@ func TestShutdownManyGoroutines(t *testing.T) {
 
 	wg := sync.WaitGroup{}
 	for i := 0; i < 10; i++ {
+		wg.Add(1)
 		go func() {
-			wg.Add(1)
 			defer wg.Done()
 			err := tf.Shutdown(testutil.Timeout())
 			require.NoError(t, err)
@@ -185,3 +217,71 @@ func TestShutdownManyGoroutines(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestErrorHandler(t *testing.T) {
+	tw := &exporterStub{Err: errors.New("write failed")}
+	bb := New(tw, Config{BatchSize: 10, Timeout: time.Hour})
+	reports := make(chan klogga.ExportError, 10)
+	tf := klogga.NewFactory(bb).SetErrorHandler(func(e klogga.ExportError) { reports <- e })
+	trs := tf.NamedPkg()
+	for i := 0; i < 10; i++ {
+		klogga.StartLeaf(testutil.Timeout()).FlushTo(trs)
+	}
+
+	select {
+	case report := <-reports:
+		require.Equal(t, "batcher(*batcher.exporterStub)", report.Name)
+		require.EqualError(t, report.Err, "write failed")
+		require.Greater(t, report.Spans, 0)
+	case <-time.After(time.Second):
+		require.Fail(t, "error was not reported")
+	}
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+	require.Equal(t, uint64(10), bb.ErredCount())
+}
+
+// stalledExporter blocks writes until release is closed, records whether Shutdown was called mid-write
+type stalledExporter struct {
+	exporterStub
+	release  chan struct{}
+	writing  atomic.Bool
+	shutdown chan bool
+}
+
+func (s *stalledExporter) Write(ctx context.Context, spans []*klogga.Span) error {
+	s.writing.Store(true)
+	defer s.writing.Store(false)
+	<-s.release
+	return s.exporterStub.Write(ctx, spans)
+}
+
+func (s *stalledExporter) Shutdown(context.Context) error {
+	s.shutdown <- s.writing.Load()
+	return nil
+}
+
+func TestShutdownTimeoutClosesAfterWrite(t *testing.T) {
+	exporter := &stalledExporter{release: make(chan struct{}), shutdown: make(chan bool, 1)}
+	b := New(exporter, ConfigDefault())
+	writeSpans(t, b, 10)
+	b.TriggerFlush()
+	require.Eventually(t, exporter.writing.Load, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, b.Shutdown(ctx), context.DeadlineExceeded)
+	select {
+	case <-exporter.shutdown:
+		t.Fatal("exporter is shut down during the write")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(exporter.release)
+	select {
+	case midWrite := <-exporter.shutdown:
+		require.False(t, midWrite)
+	case <-testutil.Timeout().Done():
+		t.Fatal("exporter is not shut down after the write")
+	}
+	require.Len(t, exporter.GetSpans(), 10)
+}
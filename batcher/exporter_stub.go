@@ -10,11 +10,16 @@ type exporterStub struct {
 	m       sync.Mutex
 	Batches [][]*klogga.Span
 	spans   []*klogga.Span
+	// Err returned from Write, spans are not collected then
+	Err error
 }
 
 func (t *exporterStub) Write(ctx context.Context, spans []*klogga.Span) error {
 	t.m.Lock()
 	defer t.m.Unlock()
+	if t.Err != nil {
+		return t.Err
+	}
 	t.Batches = append(t.Batches, spans)
 	t.spans = append(t.spans, spans...)
 	return nil
@@ -29,3 +34,14 @@ func (t *exporterStub) GetSpans() []*klogga.Span {
 func (t *exporterStub) Shutdown(context.Context) error {
 	return nil
 }
+
+// hookExporter calls hook before each write
+type hookExporter struct {
+	klogga.Exporter
+	hook func()
+}
+
+func (h *hookExporter) Write(ctx context.Context, spans []*klogga.Span) error {
+	h.hook()
+	return h.Exporter.Write(ctx, spans)
+}
@@ -0,0 +1,174 @@
+package batcher
+
+import (
+	"context"
+	"github.com/KasperskyLab/klogga"
+	"github.com/pkg/errors"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy what Batcher.Write does when the buffer is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for the buffer space, up to Config.BlockTimeout if it is set
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the span being written
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest buffered span to make room for the new one
+	OverflowDropOldest
+	// OverflowDropByLevel sheds Debug and Info spans without errors and warnings once the buffer is 3/4 full,
+	// the rest of the buffer is kept for the important spans, which block as with OverflowBlock
+	OverflowDropByLevel
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop_newest"
+	case OverflowDropOldest:
+		return "drop_oldest"
+	case OverflowDropByLevel:
+		return "drop_by_level"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseOverflowPolicy parses policy name as returned by OverflowPolicy.String
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	for _, p := range []OverflowPolicy{OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowDropByLevel} {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+	return OverflowBlock, errors.Errorf("unknown overflow policy: %q", s)
+}
+
+// DroppedCount spans dropped by the overflow policy, because the Write context was done or written after Shutdown
+func (b *Batcher) DroppedCount() uint64 {
+	return atomic.LoadUint64(&b.droppedCount)
+}
+
+func (b *Batcher) enqueue(ctx context.Context, span *klogga.Span) {
+	item := b.sized(span)
+	if b.conf.isPriority(span) && b.tryPushPriority(item) {
+		b.triggerOnFull()
+		return
+	}
+	switch b.conf.OverflowPolicy {
+	case OverflowDropNewest:
+		if !b.tryPush(item) {
+			b.drop()
+			return
+		}
+	case OverflowDropOldest:
+		for !b.tryPush(item) {
+			// the priority lane can take the whole byte budget, then there is nothing to drop but the new span
+			if _, ok := b.takeOldest(); !ok {
+				b.drop()
+				return
+			}
+			b.drop()
+		}
+	case OverflowDropByLevel:
+		full := len(b.spans) >= cap(b.spans)*3/4 || b.bytes.usedShare(0.75)
+		if full && span.LevelGet() <= klogga.Info && span.EWState() == "" {
+			b.drop()
+			return
+		}
+		if !b.block(ctx, item) {
+			return
+		}
+	default:
+		if !b.block(ctx, item) {
+			return
+		}
+	}
+	b.triggerOnFull()
+}
+
+func (b *Batcher) triggerOnFull() {
+	if b.buffered() >= b.conf.GetBatchSize() {
+		b.TriggerFlush()
+	}
+}
+
+// tryPush buffers the span if there is space for it
+func (b *Batcher) tryPush(item bufferedSpan) bool {
+	if ok, _ := b.bytes.reserve(item.size); !ok {
+		return false
+	}
+	select {
+	case b.spans <- item:
+		return true
+	default:
+		b.bytes.release(item.size)
+		return false
+	}
+}
+
+func (b *Batcher) block(ctx context.Context, item bufferedSpan) bool {
+	var timeout <-chan time.Time
+	if b.conf.BlockTimeout > 0 {
+		tm := time.NewTimer(b.conf.BlockTimeout)
+		defer tm.Stop()
+		timeout = tm.C
+	}
+	for {
+		ok, freed := b.bytes.reserve(item.size)
+		if ok {
+			break
+		}
+		select {
+		case <-freed:
+			continue
+		case <-ctx.Done():
+		case <-timeout:
+		case <-b.done:
+		}
+		b.drop()
+		return false
+	}
+	select {
+	case b.spans <- item:
+		return true
+	case <-ctx.Done():
+	case <-timeout:
+	case <-b.done:
+	}
+	b.bytes.release(item.size)
+	b.drop()
+	return false
+}
+
+func (b *Batcher) drop() {
+	atomic.AddUint64(&b.droppedCount, 1)
+}
+
+// dropSummary returns span about the spans dropped since the previous summary
+// not more often than Config.DropSummaryInterval, nil if there is nothing to report yet
+func (b *Batcher) dropSummary() *klogga.Span {
+	dropped := b.DroppedCount()
+	if dropped == b.summaryDropped || time.Since(b.summaryTs) < b.conf.GetDropSummaryInterval() {
+		return nil
+	}
+	span := klogga.StartLeaf(
+		context.Background(), klogga.WithName("SpansDropped"), klogga.WithPackageClass("batcher", "Batcher"),
+	)
+	span.SetComponent("batcher")
+	span.Tag("policy", b.conf.OverflowPolicy.String()).
+		Val("dropped", dropped-b.summaryDropped).
+		Val("dropped_total", dropped).
+		Val("since", b.summaryTs).
+		Warn(errors.New("spans dropped on the buffer overflow"))
+	span.Stop()
+
+	b.summaryDropped = dropped
+	b.summaryTs = time.Now()
+	return span
+}
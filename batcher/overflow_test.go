@@ -0,0 +1,166 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// stalledBatcher returns batcher with the full buffer and the exporter stuck on the first span
+func stalledBatcher(t *testing.T, conf Config, buffered ...*klogga.Span) (*Batcher, *exporterStub, chan struct{}) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	exporter := &exporterStub{}
+	conf.BatchSize = 1
+	if conf.BufferSize == 0 {
+		conf.BufferSize = len(buffered)
+	}
+	conf.Timeout = 10 * time.Millisecond
+	conf.DropSummaryInterval = time.Nanosecond
+	b := New(
+		&hookExporter{
+			Exporter: exporter,
+			hook: func() {
+				select {
+				case entered <- struct{}{}:
+					<-release
+				default:
+				}
+			},
+		}, conf,
+	)
+	go func() { _ = b.Write(testutil.Timeout(), []*klogga.Span{span("first")}) }()
+	<-entered
+	require.NoError(t, b.Write(testutil.Timeout(), buffered))
+	require.Equal(t, uint64(0), b.DroppedCount())
+	return b, exporter, release
+}
+
+func span(name string) *klogga.Span {
+	return klogga.StartLeaf(context.Background(), klogga.WithName(name))
+}
+
+// names of the written spans and the drop summary span
+func names(t *testing.T, spans []*klogga.Span) (res []string, summary *klogga.Span) {
+	for _, s := range spans {
+		if s.Name() == "SpansDropped" {
+			require.Nil(t, summary, "single summary expected")
+			summary = s
+			continue
+		}
+		res = append(res, s.Name())
+	}
+	require.NotNil(t, summary)
+	return res, summary
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	b, exporter, release := stalledBatcher(t, Config{OverflowPolicy: OverflowDropNewest}, span("a"), span("b"))
+	require.NoError(t, b.Write(testutil.Timeout(), []*klogga.Span{span("c"), span("d")}))
+	require.Equal(t, uint64(2), b.DroppedCount())
+
+	close(release)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	written, summary := names(t, exporter.GetSpans())
+	require.Equal(t, []string{"first", "a", "b"}, written)
+	require.Equal(t, uint64(2), summary.Vals()["dropped"])
+	require.Equal(t, "drop_newest", summary.Tags()["policy"])
+	require.Equal(t, "W", summary.EWState())
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	b, exporter, release := stalledBatcher(t, Config{OverflowPolicy: OverflowDropOldest}, span("a"), span("b"))
+	require.NoError(t, b.Write(testutil.Timeout(), []*klogga.Span{span("c"), span("d"), span("e")}))
+	require.Equal(t, uint64(3), b.DroppedCount())
+
+	close(release)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	written, _ := names(t, exporter.GetSpans())
+	require.Equal(t, []string{"first", "d", "e"}, written)
+}
+
+func TestOverflowDropOldestPriorityBytes(t *testing.T) {
+	errSpan := func(name string) *klogga.Span { return span(name).ErrSpan(errors.New("err")) }
+	b, exporter, release := stalledBatcher(
+		t, Config{OverflowPolicy: OverflowDropOldest, BufferSize: 4, PriorityBufferSize: 2, MaxBufferBytes: 1},
+		errSpan("err1"), errSpan("err2"),
+	)
+	// the priority spans use up the byte budget while the normal lane is empty
+	done := make(chan struct{})
+	go func() {
+		_ = b.Write(testutil.Timeout(), []*klogga.Span{span("a")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "write is stuck")
+	}
+	require.Equal(t, uint64(1), b.DroppedCount())
+
+	close(release)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	written, _ := names(t, exporter.GetSpans())
+	require.Equal(t, []string{"first", "err1", "err2"}, written)
+}
+
+func TestOverflowDropByLevel(t *testing.T) {
+	b, exporter, release := stalledBatcher(
+		t, Config{OverflowPolicy: OverflowDropByLevel, BlockTimeout: 10 * time.Millisecond, BufferSize: 4, PriorityBufferSize: 1},
+		span("a"), span("b"), span("c"),
+	)
+	// a slot is kept for important spans
+	require.NoError(t, b.Write(testutil.Timeout(), []*klogga.Span{span("debug").Level(klogga.Debug)}))
+	require.Equal(t, uint64(1), b.DroppedCount())
+	// the priority lane takes the first one, the kept slot the second one
+	require.NoError(t, b.Write(testutil.Timeout(), []*klogga.Span{span("warn").Level(klogga.Warn)}))
+	require.NoError(t, b.Write(testutil.Timeout(), []*klogga.Span{span("err").ErrSpan(errors.New("err"))}))
+	require.Equal(t, uint64(1), b.DroppedCount())
+	_ = b.Write(testutil.Timeout(), []*klogga.Span{span("err2").ErrSpan(errors.New("err"))})
+	require.Equal(t, uint64(2), b.DroppedCount())
+
+	close(release)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	written, _ := names(t, exporter.GetSpans())
+	require.Equal(t, []string{"first", "warn", "a", "b", "c", "err"}, written)
+}
+
+func TestOverflowBlockTimeout(t *testing.T) {
+	b, exporter, release := stalledBatcher(
+		t, Config{OverflowPolicy: OverflowBlock, BlockTimeout: 10 * time.Millisecond}, span("a"),
+	)
+	require.NoError(t, b.Write(testutil.Timeout(), []*klogga.Span{span("b")}))
+	require.Equal(t, uint64(1), b.DroppedCount())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, b.Write(ctx, []*klogga.Span{span("c")}))
+	require.Equal(t, uint64(2), b.DroppedCount())
+
+	close(release)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	written, summary := names(t, exporter.GetSpans())
+	require.Equal(t, []string{"first", "a"}, written)
+	require.Equal(t, uint64(2), summary.Vals()["dropped_total"])
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	p, err := ParseOverflowPolicy("Drop_Oldest")
+	require.NoError(t, err)
+	require.Equal(t, OverflowDropOldest, p)
+	_, err = ParseOverflowPolicy("spill")
+	require.Error(t, err)
+}
+
+func TestWriteAfterShutdown(t *testing.T) {
+	exporter := &exporterStub{}
+	b := New(exporter, ConfigDefault())
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+
+	require.ErrorIs(t, b.Write(testutil.Timeout(), []*klogga.Span{span("a"), span("b")}), ErrShutdown)
+	require.Equal(t, uint64(2), b.DroppedCount())
+	require.Empty(t, exporter.GetSpans())
+}
@@ -0,0 +1,62 @@
+package batcher
+
+import (
+	"github.com/KasperskyLab/klogga"
+)
+
+// AuditTag spans with this tag are high priority, see HighPriority
+const AuditTag = "audit"
+
+// HighPriority default Config.Priority: spans with errors or warnings, Warn and above levels and audit spans
+func HighPriority(span *klogga.Span) bool {
+	if span.LevelGet() >= klogga.Warn || span.EWState() != "" {
+		return true
+	}
+	return span.HasTag(AuditTag)
+}
+
+func (c *Config) GetPriorityBufferSize() int {
+	if c.PriorityBufferSize > 0 {
+		return c.PriorityBufferSize
+	}
+	if size := c.GetBufferSize() / 4; size > 0 {
+		return size
+	}
+	return 1
+}
+
+func (c *Config) isPriority(span *klogga.Span) bool {
+	if c.Priority != nil {
+		return c.Priority(span)
+	}
+	return HighPriority(span)
+}
+
+// tryPushPriority buffers the span in the reserved high priority lane if there is space for it
+// the span counts towards Config.MaxBufferBytes but is not limited by it, the lane is bounded by its size
+func (b *Batcher) tryPushPriority(item bufferedSpan) bool {
+	b.bytes.force(item.size)
+	select {
+	case b.priority <- item:
+		return true
+	default:
+		b.bytes.release(item.size)
+		return false
+	}
+}
+
+// buffered spans in both lanes
+func (b *Batcher) buffered() int {
+	return len(b.priority) + len(b.spans)
+}
+
+// take gets the next buffered span without waiting, high priority lane goes first
+func (b *Batcher) take() (bufferedSpan, bool) {
+	select {
+	case item := <-b.priority:
+		b.bytes.release(item.size)
+		return item, true
+	default:
+		return b.takeOldest()
+	}
+}
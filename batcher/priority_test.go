@@ -0,0 +1,59 @@
+package batcher
+
+import (
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPriorityLaneDrainedFirst(t *testing.T) {
+	b, exporter, release := stalledBatcher(
+		t, Config{PriorityBufferSize: 2}, span("a"), span("b"),
+		span("warn").Level(klogga.Warn), span("c"), span("err").ErrSpan(errors.New("err")),
+	)
+	close(release)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	var written []string
+	for _, s := range exporter.GetSpans() {
+		written = append(written, s.Name())
+	}
+	require.Equal(t, []string{"first", "warn", "err", "a", "b", "c"}, written)
+}
+
+func TestPriorityReservedCapacity(t *testing.T) {
+	b, exporter, release := stalledBatcher(
+		t, Config{OverflowPolicy: OverflowDropNewest, BufferSize: 2, PriorityBufferSize: 2}, span("a"), span("b"),
+	)
+	require.NoError(t, b.Write(testutil.Timeout(), []*klogga.Span{span("c")}))
+	require.Equal(t, uint64(1), b.DroppedCount())
+
+	// the common buffer is full, the important spans take the reserved space
+	require.NoError(
+		t, b.Write(
+			testutil.Timeout(), []*klogga.Span{
+				span("err").ErrSpan(errors.New("err")),
+				span("audit").Tag(AuditTag, "login"),
+				span("warn").Level(klogga.Warn),
+			},
+		),
+	)
+	require.Equal(t, uint64(2), b.DroppedCount())
+
+	close(release)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	written, _ := names(t, exporter.GetSpans())
+	require.Equal(t, []string{"first", "err", "audit", "a", "b"}, written)
+}
+
+func TestPriorityCustom(t *testing.T) {
+	conf := Config{Priority: func(span *klogga.Span) bool { return span.Name() == "vip" }}
+	require.True(t, conf.isPriority(span("vip")))
+	require.False(t, conf.isPriority(span("err").ErrSpan(errors.New("err"))))
+	require.True(t, (&Config{}).isPriority(span("err").ErrSpan(errors.New("err"))))
+	require.True(t, HighPriority(span("audit").Tag(AuditTag, "login")))
+	require.False(t, HighPriority(span("info").Val(AuditTag, "login")), "only the tag counts")
+	require.Equal(t, 1, (&Config{BufferSize: 2}).GetPriorityBufferSize())
+	require.Equal(t, 64, (&Config{BatchSize: 64, BufferSize: 256}).GetPriorityBufferSize())
+}
@@ -0,0 +1,99 @@
+package batcher
+
+import (
+	"context"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/errs"
+	"github.com/pkg/errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy how failed batches are retried
+// only errors marked with klogga.Retryable are retried
+type RetryPolicy struct {
+	// MaxAttempts total write attempts for the batch, no retries if less than 2
+	MaxAttempts int
+	// InitialBackoff delay before the first retry, 100ms if zero, doubled for each next retry
+	InitialBackoff time.Duration
+	// MaxBackoff 10s if zero
+	MaxBackoff time.Duration
+	// Jitter random share of the backoff in [0, 1] added or subtracted from it
+	Jitter float64
+}
+
+func (p *RetryPolicy) GetInitialBackoff() time.Duration {
+	if p.InitialBackoff <= 0 {
+		return 100 * time.Millisecond
+	}
+	return p.InitialBackoff
+}
+
+func (p *RetryPolicy) GetMaxBackoff() time.Duration {
+	if p.MaxBackoff <= 0 {
+		return 10 * time.Second
+	}
+	return p.MaxBackoff
+}
+
+// backoff before the retry, retry is 1 for the first retry
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	backoff := p.GetInitialBackoff()
+	for i := 1; i < retry && backoff < p.GetMaxBackoff(); i++ {
+		backoff *= 2
+	}
+	if backoff > p.GetMaxBackoff() {
+		backoff = p.GetMaxBackoff()
+	}
+	if p.Jitter > 0 {
+		backoff += time.Duration(float64(backoff) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return backoff
+}
+
+// RetriedCount write attempts that were retried
+func (b *Batcher) RetriedCount() uint64 {
+	return atomic.LoadUint64(&b.retriedCount)
+}
+
+// DeadLetteredCount spans written to Config.DeadLetter
+func (b *Batcher) DeadLetteredCount() uint64 {
+	return atomic.LoadUint64(&b.deadLetteredCount)
+}
+
+// write tries to write the batch according to the retry policy
+// stops retrying when the Shutdown context is done
+func (b *Batcher) write(spans []*klogga.Span) error {
+	for attempt := 1; ; attempt++ {
+		err := b.exporter.Write(b.ctx, spans)
+		if err == nil || attempt >= b.conf.Retry.MaxAttempts || !klogga.IsRetryable(err) {
+			return err
+		}
+		select {
+		case <-time.After(b.conf.Retry.backoff(attempt)):
+			atomic.AddUint64(&b.retriedCount, 1)
+		case <-b.ctx.Done():
+			return errs.Append(err, errors.Wrap(b.ctx.Err(), "retry aborted by shutdown"))
+		}
+	}
+}
+
+// deadLetter writes the failed batch to Config.DeadLetter, returns its error if any
+func (b *Batcher) deadLetter(spans []*klogga.Span) error {
+	if b.conf.DeadLetter == nil {
+		return nil
+	}
+	if err := b.conf.DeadLetter.Write(b.ctx, spans); err != nil {
+		return errors.Wrap(err, "dead letter write failed")
+	}
+	atomic.AddUint64(&b.deadLetteredCount, uint64(len(spans)))
+	return nil
+}
+
+func (b *Batcher) shutdownDeadLetter(ctx context.Context) error {
+	if b.conf.DeadLetter == nil {
+		return nil
+	}
+	return b.conf.DeadLetter.Shutdown(ctx)
+}
@@ -0,0 +1,128 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyExporter fails the first failures writes
+type flakyExporter struct {
+	exporterStub
+	mu       sync.Mutex
+	failures int
+	err      error
+	attempts int
+}
+
+func (e *flakyExporter) Write(ctx context.Context, spans []*klogga.Span) error {
+	e.mu.Lock()
+	e.attempts++
+	fail := e.attempts <= e.failures
+	e.mu.Unlock()
+	if fail {
+		return e.err
+	}
+	return e.exporterStub.Write(ctx, spans)
+}
+
+func retryBatcher(exporter klogga.Exporter, retry RetryPolicy, deadLetter klogga.Exporter) *Batcher {
+	return New(
+		exporter, Config{BatchSize: 10, Timeout: 10 * time.Millisecond, Retry: retry, DeadLetter: deadLetter},
+	)
+}
+
+func writeSpans(t *testing.T, b *Batcher, count int) {
+	spans := make([]*klogga.Span, 0, count)
+	for i := 0; i < count; i++ {
+		spans = append(spans, klogga.StartLeaf(testutil.Timeout()))
+	}
+	require.NoError(t, b.Write(testutil.Timeout(), spans))
+}
+
+func TestRetrySucceeds(t *testing.T) {
+	exporter := &flakyExporter{failures: 2, err: klogga.Retryable(errors.New("conn refused"))}
+	deadLetter := &exporterStub{}
+	b := retryBatcher(exporter, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Jitter: 0.5}, deadLetter)
+	writeSpans(t, b, 10)
+
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	require.Equal(t, uint64(10), b.FlushedCount())
+	require.Equal(t, uint64(2), b.RetriedCount())
+	require.Equal(t, uint64(0), b.ErredCount())
+	require.Empty(t, deadLetter.GetSpans())
+}
+
+func TestRetryExhaustedDeadLetter(t *testing.T) {
+	exporter := &flakyExporter{failures: 100, err: klogga.Retryable(errors.New("conn refused"))}
+	deadLetter := &exporterStub{}
+	b := retryBatcher(exporter, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}, deadLetter)
+	var reported error
+	b.SetErrorHandler(func(spans int, err error) { reported = err })
+	writeSpans(t, b, 10)
+
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	require.Equal(t, 3, exporter.attempts)
+	require.Equal(t, uint64(10), b.ErredCount())
+	require.Equal(t, uint64(10), b.DeadLetteredCount())
+	require.Len(t, deadLetter.GetSpans(), 10)
+	require.EqualError(t, reported, "conn refused")
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	exporter := &flakyExporter{failures: 1, err: errors.New("bad data")}
+	deadLetter := &exporterStub{Err: errors.New("dead letter is down")}
+	b := retryBatcher(exporter, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}, deadLetter)
+	var reported error
+	b.SetErrorHandler(func(spans int, err error) { reported = err })
+	writeSpans(t, b, 10)
+
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	require.Equal(t, 1, exporter.attempts)
+	require.Equal(t, uint64(0), b.RetriedCount())
+	require.Equal(t, uint64(0), b.DeadLetteredCount())
+	require.Contains(t, reported.Error(), "bad data")
+	require.Contains(t, reported.Error(), "dead letter is down")
+}
+
+func TestRetryAbortedByShutdown(t *testing.T) {
+	exporter := &flakyExporter{failures: 100, err: klogga.Retryable(errors.New("conn refused"))}
+	deadLetter := &exporterStub{}
+	b := retryBatcher(exporter, RetryPolicy{MaxAttempts: 100, InitialBackoff: time.Hour}, deadLetter)
+	writeSpans(t, b, 10)
+	require.Eventually(
+		t, func() bool {
+			exporter.mu.Lock()
+			defer exporter.mu.Unlock()
+			return exporter.attempts > 0
+		}, time.Second, time.Millisecond,
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	require.ErrorIs(t, b.Shutdown(ctx), context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+	require.Eventually(t, func() bool { return b.ErredCount() == 10 }, time.Second, time.Millisecond)
+	require.Len(t, deadLetter.GetSpans(), 10)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	require.Equal(t, time.Second, p.backoff(1))
+	require.Equal(t, 2*time.Second, p.backoff(2))
+	require.Equal(t, 4*time.Second, p.backoff(3))
+	require.Equal(t, 5*time.Second, p.backoff(4))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := p.backoff(1)
+		require.GreaterOrEqual(t, backoff, 500*time.Millisecond)
+		require.LessOrEqual(t, backoff, 1500*time.Millisecond)
+	}
+}
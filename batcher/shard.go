@@ -0,0 +1,152 @@
+package batcher
+
+import (
+	"encoding/binary"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/errs"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// ShardKey what spans are sharded by between Config.Workers
+// spans with the same key are written by the same worker in the order they were written to the Batcher
+type ShardKey int
+
+const (
+	// ShardByComponent keeps each component on its own worker, for exporters with a table per component
+	ShardByComponent ShardKey = iota
+	// ShardByTraceID keeps each trace on its own worker, spreads a single busy component between the workers
+	ShardByTraceID
+)
+
+func (k ShardKey) String() string {
+	switch k {
+	case ShardByComponent:
+		return "component"
+	case ShardByTraceID:
+		return "trace_id"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseShardKey parses key name as returned by ShardKey.String
+func ParseShardKey(s string) (ShardKey, error) {
+	for _, k := range []ShardKey{ShardByComponent, ShardByTraceID} {
+		if strings.EqualFold(s, k.String()) {
+			return k, nil
+		}
+	}
+	return ShardByComponent, errors.Errorf("unknown shard key: %q", s)
+}
+
+// worker writes batches of its shards one after another
+type worker struct {
+	batches chan workerItem
+}
+
+// workerItem either a batch or a barrier, that gets the errors of the batches lost since the previous barrier
+type workerItem struct {
+	spans   []*klogga.Span
+	barrier chan error
+}
+
+func (b *Batcher) startWorkers() {
+	if b.conf.Workers <= 1 || b.spool != nil {
+		return
+	}
+	b.workers = make([]worker, b.conf.Workers)
+	b.workersWg.Add(len(b.workers))
+	for i := range b.workers {
+		b.workers[i].batches = make(chan workerItem, 1)
+		go b.runWorker(b.workers[i])
+	}
+}
+
+func (b *Batcher) runWorker(w worker) {
+	defer b.workersWg.Done()
+	var lost error
+	for item := range w.batches {
+		if item.barrier != nil {
+			item.barrier <- lost
+			lost = nil
+			continue
+		}
+		lost = errs.Append(lost, b.export(item.spans))
+	}
+}
+
+func (b *Batcher) stopWorkers() {
+	for _, w := range b.workers {
+		close(w.batches)
+	}
+	b.workersWg.Wait()
+}
+
+// drainSharded splits spans buffered at the moment of the call between the workers,
+// waits for the workers to write them if wait is set
+func (b *Batcher) drainSharded(wait bool) error {
+	batches := make([]batch, len(b.workers))
+	for n := b.buffered(); n > 0; n-- {
+		item, ok := b.take()
+		if !ok {
+			// taken out by OverflowDropOldest
+			break
+		}
+		shard := b.shard(item.span)
+		if b.exceeds(&batches[shard], item.size) {
+			b.dispatch(shard, batches[shard].spans)
+			batches[shard] = batch{}
+		}
+		batches[shard].add(item)
+		if len(batches[shard].spans) >= b.conf.GetBatchSize() {
+			b.dispatch(shard, batches[shard].spans)
+			batches[shard] = batch{}
+		}
+	}
+	for shard, bt := range batches {
+		if len(bt.spans) > 0 {
+			b.dispatch(shard, bt.spans)
+		}
+	}
+	if !wait {
+		return nil
+	}
+
+	barriers := make([]chan error, len(b.workers))
+	for i, w := range b.workers {
+		barriers[i] = make(chan error, 1)
+		w.batches <- workerItem{barrier: barriers[i]}
+	}
+	var allErrs error
+	for _, barrier := range barriers {
+		allErrs = errs.Append(allErrs, <-barrier)
+	}
+	return allErrs
+}
+
+// dispatch blocks while the worker is busy with the previous batch
+func (b *Batcher) dispatch(shard int, spans []*klogga.Span) {
+	if summary := b.dropSummary(); summary != nil {
+		spans = append(spans, summary)
+	}
+	b.workers[shard].batches <- workerItem{spans: spans}
+}
+
+func (b *Batcher) shard(span *klogga.Span) int {
+	var h uint32
+	if b.conf.ShardBy == ShardByTraceID {
+		// random bytes of uuid v4
+		traceID := span.TraceID()
+		h = binary.BigEndian.Uint32(traceID[12:])
+	} else {
+		// FNV-1a
+		h = 2166136261
+		component := span.Component()
+		for i := 0; i < len(component); i++ {
+			h ^= uint32(component[i])
+			h *= 16777619
+		}
+	}
+	return int(h % uint32(len(b.workers)))
+}
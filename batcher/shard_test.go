@@ -0,0 +1,114 @@
+package batcher
+
+import (
+	"context"
+	"fmt"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func componentSpan(component string, i int) *klogga.Span {
+	span := klogga.StartLeaf(context.Background()).Val("i", i)
+	span.SetComponent(klogga.ComponentName(component))
+	return span
+}
+
+func TestWorkersKeepShardOrder(t *testing.T) {
+	exporter := &exporterStub{}
+	b := New(exporter, Config{BatchSize: 7, BufferSize: 1000, Timeout: time.Hour, Workers: 4})
+	for i := 0; i < 500; i++ {
+		require.NoError(t, b.Write(testutil.Timeout(), []*klogga.Span{componentSpan(fmt.Sprint("c", i%10), i)}))
+	}
+	require.NoError(t, b.Flush(testutil.Timeout()))
+	require.Len(t, exporter.GetSpans(), 500)
+
+	last := map[klogga.ComponentName]int{}
+	for _, span := range exporter.GetSpans() {
+		i := span.Vals()["i"].(int)
+		if prev, ok := last[span.Component()]; ok {
+			require.Greater(t, i, prev, "component %s is reordered", span.Component())
+		}
+		last[span.Component()] = i
+	}
+	for _, batch := range exporter.Batches {
+		require.LessOrEqual(t, len(batch), 7)
+		for _, span := range batch {
+			require.Equal(t, b.shard(batch[0]), b.shard(span))
+		}
+	}
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+}
+
+func TestWorkersInParallel(t *testing.T) {
+	var inFlight, maxInFlight int32
+	release := make(chan struct{})
+	exporter := &hookExporter{
+		Exporter: &exporterStub{},
+		hook: func() {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for m := atomic.LoadInt32(&maxInFlight); n > m; m = atomic.LoadInt32(&maxInFlight) {
+				atomic.CompareAndSwapInt32(&maxInFlight, m, n)
+			}
+			<-release
+		},
+	}
+	b := New(exporter, Config{BatchSize: 10, Timeout: time.Hour, Workers: 2})
+	require.NotEqual(t, b.shard(componentSpan("a", 0)), b.shard(componentSpan("b", 0)))
+	for i := 0; i < 100; i++ {
+		require.NoError(t, b.Write(testutil.Timeout(), []*klogga.Span{componentSpan([]string{"a", "b"}[i%2], i)}))
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&inFlight) == 2 }, time.Second, time.Millisecond)
+	close(release)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	require.Equal(t, uint64(100), b.FlushedCount())
+	require.Equal(t, int32(2), atomic.LoadInt32(&maxInFlight))
+}
+
+func TestShardByTraceID(t *testing.T) {
+	b := &Batcher{conf: Config{ShardBy: ShardByTraceID}, workers: make([]worker, 4)}
+	trace := klogga.StartLeaf(context.Background())
+	shards := map[int]struct{}{}
+	for i := 0; i < 100; i++ {
+		child := klogga.StartLeaf(context.Background(), klogga.WithTraceID(trace.TraceID()))
+		child.SetComponent(klogga.ComponentName(fmt.Sprint("c", i)))
+		require.Equal(t, b.shard(trace), b.shard(child))
+		shards[b.shard(componentSpan("c", i))] = struct{}{}
+	}
+	require.Len(t, shards, 4)
+}
+
+func TestParseShardKey(t *testing.T) {
+	key, err := ParseShardKey("Trace_ID")
+	require.NoError(t, err)
+	require.Equal(t, ShardByTraceID, key)
+	_, err = ParseShardKey("host")
+	require.Error(t, err)
+}
+
+func BenchmarkSpansBatcherWorkers(b *testing.B) {
+	for _, workers := range []int{1, 8} {
+		b.Run(
+			fmt.Sprint("workers_", workers), func(b *testing.B) {
+				exporter := &DelayDrop{Delay: time.Millisecond}
+				bb := New(exporter, Config{BatchSize: 50, Timeout: time.Second, Workers: workers})
+				spans := make([]*klogga.Span, 0, 16)
+				for i := 0; i < cap(spans); i++ {
+					spans = append(spans, componentSpan(fmt.Sprint("c", i), i))
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = bb.Write(testutil.Timeout(), spans[i%len(spans):i%len(spans)+1])
+				}
+				require.NoError(b, bb.Shutdown(testutil.Timeout()))
+				require.Equal(b, int32(b.N), exporter.Count.Load())
+			},
+		)
+	}
+}
@@ -0,0 +1,114 @@
+package batcher
+
+import (
+	"github.com/KasperskyLab/klogga"
+	"sync"
+)
+
+// bufferedSpan span with its klogga.Span.EstimatedSize, size is zero when no byte limits are set
+type bufferedSpan struct {
+	span *klogga.Span
+	size int
+}
+
+// batch being collected by the drain
+type batch struct {
+	spans []*klogga.Span
+	bytes int
+}
+
+func (bt *batch) add(item bufferedSpan) {
+	bt.spans = append(bt.spans, item.span)
+	bt.bytes += item.size
+}
+
+// byteBudget bounds the estimated size of the buffered spans, nil budget has no limit
+type byteBudget struct {
+	max int
+
+	lock sync.Mutex
+	used int
+	// closed and replaced on release if someone waits for the space
+	freed   chan struct{}
+	waiting bool
+}
+
+func newByteBudget(max int) *byteBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &byteBudget{max: max, freed: make(chan struct{})}
+}
+
+// reserve takes size bytes if there is space, a span bigger than the whole budget fits into the empty one
+// returns channel closed when bytes are released, if there is no space
+func (bb *byteBudget) reserve(size int) (bool, <-chan struct{}) {
+	if bb == nil {
+		return true, nil
+	}
+	bb.lock.Lock()
+	defer bb.lock.Unlock()
+	if bb.used == 0 || bb.used+size <= bb.max {
+		bb.used += size
+		return true, nil
+	}
+	bb.waiting = true
+	return false, bb.freed
+}
+
+// force takes size bytes even if there is no space
+func (bb *byteBudget) force(size int) {
+	if bb == nil || size == 0 {
+		return
+	}
+	bb.lock.Lock()
+	defer bb.lock.Unlock()
+	bb.used += size
+}
+
+func (bb *byteBudget) release(size int) {
+	if bb == nil || size == 0 {
+		return
+	}
+	bb.lock.Lock()
+	defer bb.lock.Unlock()
+	bb.used -= size
+	if bb.waiting {
+		close(bb.freed)
+		bb.freed = make(chan struct{})
+		bb.waiting = false
+	}
+}
+
+// usedShare at least share of the budget is used
+func (bb *byteBudget) usedShare(share float64) bool {
+	if bb == nil {
+		return false
+	}
+	bb.lock.Lock()
+	defer bb.lock.Unlock()
+	return float64(bb.used) >= float64(bb.max)*share
+}
+
+func (b *Batcher) sized(span *klogga.Span) bufferedSpan {
+	if b.conf.MaxBatchBytes <= 0 && b.conf.MaxBufferBytes <= 0 {
+		return bufferedSpan{span: span}
+	}
+	return bufferedSpan{span: span, size: span.EstimatedSize()}
+}
+
+// takeOldest gets the next span of the normal lane without waiting
+func (b *Batcher) takeOldest() (bufferedSpan, bool) {
+	select {
+	case item := <-b.spans:
+		b.bytes.release(item.size)
+		return item, true
+	default:
+		return bufferedSpan{}, false
+	}
+}
+
+// exceeds adding size bytes to the non-empty batch exceeds Config.MaxBatchBytes
+func (b *Batcher) exceeds(bt *batch, size int) bool {
+	return b.conf.MaxBatchBytes > 0 && len(bt.spans) > 0 && bt.bytes+size > b.conf.MaxBatchBytes
+}
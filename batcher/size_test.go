@@ -0,0 +1,66 @@
+package batcher
+
+import (
+	"context"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sizedSpan(bodySize int) *klogga.Span {
+	return klogga.StartLeaf(context.Background()).Val("body", strings.Repeat("x", bodySize))
+}
+
+func TestMaxBatchBytes(t *testing.T) {
+	exporter := &exporterStub{}
+	b := New(exporter, Config{BatchSize: 100, Timeout: time.Hour, MaxBatchBytes: 3000})
+	spans := []*klogga.Span{sizedSpan(1000), sizedSpan(1000), sizedSpan(1000), sizedSpan(5000), sizedSpan(10)}
+	require.NoError(t, b.Write(testutil.Timeout(), spans))
+	require.NoError(t, b.Flush(testutil.Timeout()))
+
+	var sizes []int
+	for _, batch := range exporter.Batches {
+		sizes = append(sizes, len(batch))
+	}
+	// the span bigger than the limit goes alone
+	require.Equal(t, []int{2, 1, 1, 1}, sizes)
+	require.True(t, exporter.Batches[2][0] == spans[3])
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	require.Len(t, exporter.GetSpans(), 5)
+}
+
+func TestMaxBufferBytesDrop(t *testing.T) {
+	b, exporter, release := stalledBatcher(
+		t, Config{OverflowPolicy: OverflowDropNewest, BufferSize: 100, MaxBufferBytes: 3000}, sizedSpan(1000),
+	)
+	require.NoError(t, b.Write(testutil.Timeout(), []*klogga.Span{sizedSpan(1000), sizedSpan(1000), sizedSpan(10)}))
+	require.Equal(t, uint64(1), b.DroppedCount())
+
+	close(release)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	written, _ := names(t, exporter.GetSpans())
+	require.Len(t, written, 4)
+}
+
+func TestMaxBufferBytesBlock(t *testing.T) {
+	b, exporter, release := stalledBatcher(t, Config{BufferSize: 100, MaxBufferBytes: 3000}, sizedSpan(2000))
+	written := make(chan struct{})
+	go func() {
+		_ = b.Write(testutil.Timeout(), []*klogga.Span{sizedSpan(2000)})
+		close(written)
+	}()
+	select {
+	case <-written:
+		require.Fail(t, "write is not blocked by the buffer bytes limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	<-written
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	require.Equal(t, uint64(0), b.DroppedCount())
+	require.Len(t, exporter.GetSpans(), 3)
+}
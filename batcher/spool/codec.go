@@ -0,0 +1,314 @@
+package spool
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/KasperskyLab/klogga"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// record on-disk span format, values keep their go types
+type record struct {
+	ID        klogga.SpanID        `json:"id"`
+	TraceID   klogga.TraceID       `json:"trace_id"`
+	ParentID  klogga.SpanID        `json:"parent_id"`
+	Name      string               `json:"name"`
+	Package   string               `json:"package"`
+	Class     string               `json:"class"`
+	Component klogga.ComponentName `json:"component"`
+	Host      string               `json:"host"`
+	Level     klogga.LogLevel      `json:"level"`
+	Started   time.Time            `json:"started"`
+	Finished  time.Time            `json:"finished"`
+	Duration  time.Duration        `json:"duration"`
+	Tags      map[string]value     `json:"tags,omitempty"`
+	Vals      map[string]value     `json:"vals,omitempty"`
+	Errs      *string              `json:"errs,omitempty"`
+	Warns     *string              `json:"warns,omitempty"`
+	DeferErrs *string              `json:"defer_errs,omitempty"`
+}
+
+// value typed span tag or val
+type value struct {
+	Type string          `json:"t"`
+	V    json.RawMessage `json:"v"`
+}
+
+const (
+	typeJSON   = "json"
+	typeError  = "error"
+	typeString = "string"
+	typeCustom = "custom:"
+)
+
+// Encode serializes finished span, so Decode restores it with the same values types.
+// Basic types, time.Time, time.Duration, []byte, net.IP, uuid, klogga ids and the custom types are kept as is,
+// errors are restored with the same message, fmt.Stringer values are restored as their string,
+// klogga.ObjectVal, structs, maps and slices are restored as klogga.ValJson, the rest is stored as fmt %v string.
+// Custom types, e.g. the ones registered in the postgres exporter Conf.Types, must be passed to both Encode and Decode
+// (see Config.Types), otherwise exporters get the string or the json of them from the replayed spans.
+func Encode(span *klogga.Span, types ...reflect.Type) ([]byte, error) {
+	return newCodec(types).encode(span)
+}
+
+// Decode restores span encoded with Encode
+func Decode(data []byte, types ...reflect.Type) (*klogga.Span, error) {
+	return newCodec(types).decode(data)
+}
+
+// codec encodes values of the custom types as json tagged with the type name
+type codec struct {
+	types map[string]reflect.Type
+}
+
+func newCodec(types []reflect.Type) codec {
+	c := codec{types: make(map[string]reflect.Type, len(types))}
+	for _, t := range types {
+		c.types[customType(t)] = t
+	}
+	return c
+}
+
+// customType tag of the custom type value, full package path keeps the same named types of different packages apart
+func customType(t reflect.Type) string {
+	if t.Name() == "" {
+		return typeCustom + t.String()
+	}
+	return typeCustom + t.PkgPath() + "." + t.Name()
+}
+
+func (c codec) encode(span *klogga.Span) ([]byte, error) {
+	r := span.Record()
+	rec := record{
+		ID:        r.ID,
+		TraceID:   r.TraceID,
+		ParentID:  r.ParentID,
+		Name:      r.Name,
+		Package:   r.Package,
+		Class:     r.Class,
+		Component: r.Component,
+		Host:      r.Host,
+		Level:     r.Level,
+		Started:   r.Started,
+		Finished:  r.Finished,
+		Duration:  r.Duration,
+		Tags:      c.encodeValues(r.Tags),
+		Vals:      c.encodeValues(r.Vals),
+		Errs:      errText(r.Errs),
+		Warns:     errText(r.Warns),
+		DeferErrs: errText(r.DeferErrs),
+	}
+	return json.Marshal(rec)
+}
+
+func (c codec) decode(data []byte) (*klogga.Span, error) {
+	rec := record{}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, errors.Wrap(err, "failed to decode span")
+	}
+	tags, err := c.decodeValues(rec.Tags)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := c.decodeValues(rec.Vals)
+	if err != nil {
+		return nil, err
+	}
+	return klogga.SpanFromRecord(
+		klogga.SpanRecord{
+			ID:        rec.ID,
+			TraceID:   rec.TraceID,
+			ParentID:  rec.ParentID,
+			Name:      rec.Name,
+			Package:   rec.Package,
+			Class:     rec.Class,
+			Component: rec.Component,
+			Host:      rec.Host,
+			Level:     rec.Level,
+			Started:   rec.Started,
+			Finished:  rec.Finished,
+			Duration:  rec.Duration,
+			Tags:      tags,
+			Vals:      vals,
+			Errs:      textErr(rec.Errs),
+			Warns:     textErr(rec.Warns),
+			DeferErrs: textErr(rec.DeferErrs),
+		},
+	), nil
+}
+
+func errText(err error) *string {
+	if err == nil {
+		return nil
+	}
+	s := err.Error()
+	return &s
+}
+
+func textErr(s *string) error {
+	if s == nil {
+		return nil
+	}
+	//nolint:goerr113 // restored error keeps only the message
+	return errors.New(*s)
+}
+
+func (c codec) encodeValues(m map[string]interface{}) map[string]value {
+	if len(m) == 0 {
+		return nil
+	}
+	res := make(map[string]value, len(m))
+	for k, v := range m {
+		res[k] = c.encodeValue(v)
+	}
+	return res
+}
+
+func (c codec) encodeValue(v interface{}) value {
+	if t := reflect.TypeOf(v); t != nil {
+		if _, ok := c.types[customType(t)]; ok {
+			if data, err := json.Marshal(v); err == nil {
+				return value{Type: customType(t), V: data}
+			}
+		}
+	}
+	typeName := ""
+	switch v.(type) {
+	case string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+		float32, float64, []byte, time.Time, time.Duration, uuid.UUID, klogga.TraceID, klogga.SpanID, net.IP:
+		typeName = reflect.TypeOf(v).String()
+	case error:
+		data, _ := json.Marshal(v.(error).Error())
+		return value{Type: typeError, V: data}
+	case *klogga.ObjectVal, klogga.ObjectVal:
+		// objects are fmt.Stringer too, they are encoded as json below
+	case fmt.Stringer:
+		data, _ := json.Marshal(v.(fmt.Stringer).String())
+		return value{Type: typeString, V: data}
+	}
+	if typeName == "" {
+		if data, err := json.Marshal(v); err == nil && isObject(v) {
+			return value{Type: typeJSON, V: data}
+		}
+		data, _ := json.Marshal(fmt.Sprintf("%v", v))
+		return value{Type: typeString, V: data}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprintf("%v", v))
+		return value{Type: typeString, V: data}
+	}
+	return value{Type: typeName, V: data}
+}
+
+// isObject values that are written as json by the exporters
+func isObject(v interface{}) bool {
+	switch v.(type) {
+	case *klogga.ObjectVal, klogga.ObjectVal:
+		return true
+	}
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c codec) decodeValues(m map[string]value) (map[string]interface{}, error) {
+	res := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		decoded, err := c.decodeValue(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode %s", k)
+		}
+		res[k] = decoded
+	}
+	return res, nil
+}
+
+func (c codec) decodeValue(v value) (interface{}, error) {
+	if strings.HasPrefix(v.Type, typeCustom) {
+		t, ok := c.types[v.Type]
+		if !ok {
+			// the type is not registered any more, the value is kept as it is written to the spool
+			return klogga.ValJson(string(v.V)), nil
+		}
+		res := reflect.New(t)
+		if err := json.Unmarshal(v.V, res.Interface()); err != nil {
+			return nil, err
+		}
+		return res.Elem().Interface(), nil
+	}
+	switch v.Type {
+	case typeJSON:
+		return klogga.ValJson(string(v.V)), nil
+	case typeError:
+		var s string
+		err := json.Unmarshal(v.V, &s)
+		//nolint:goerr113 // restored error keeps only the message
+		return errors.New(s), err
+	case "string":
+		return unmarshal[string](v.V)
+	case "bool":
+		return unmarshal[bool](v.V)
+	case "int":
+		return unmarshal[int](v.V)
+	case "int8":
+		return unmarshal[int8](v.V)
+	case "int16":
+		return unmarshal[int16](v.V)
+	case "int32":
+		return unmarshal[int32](v.V)
+	case "int64":
+		return unmarshal[int64](v.V)
+	case "uint":
+		return unmarshal[uint](v.V)
+	case "uint8":
+		return unmarshal[uint8](v.V)
+	case "uint16":
+		return unmarshal[uint16](v.V)
+	case "uint32":
+		return unmarshal[uint32](v.V)
+	case "uint64":
+		return unmarshal[uint64](v.V)
+	case "float32":
+		return unmarshal[float32](v.V)
+	case "float64":
+		return unmarshal[float64](v.V)
+	case "[]uint8":
+		return unmarshal[[]byte](v.V)
+	case "time.Time":
+		return unmarshal[time.Time](v.V)
+	case "time.Duration":
+		return unmarshal[time.Duration](v.V)
+	case "uuid.UUID":
+		return unmarshal[uuid.UUID](v.V)
+	case "klogga.TraceID":
+		return unmarshal[klogga.TraceID](v.V)
+	case "klogga.SpanID":
+		return unmarshal[klogga.SpanID](v.V)
+	case "net.IP":
+		return unmarshal[net.IP](v.V)
+	default:
+		return nil, errors.Errorf("unknown value type %q", v.Type)
+	}
+}
+
+func unmarshal[T any](data []byte) (T, error) {
+	var res T
+	err := json.Unmarshal(data, &res)
+	return res, err
+}
@@ -0,0 +1,456 @@
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/errs"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("spool disk quota exceeded")
+	ErrClosed        = errors.New("spool is closed")
+)
+
+const (
+	segmentExt = ".wal"
+	ackFile    = "ack"
+	headerSize = 8
+)
+
+// Config spool settings
+type Config struct {
+	// Dir spool directory, created if missing, must not be shared between spools
+	Dir string
+	// SegmentSize size after which the next segment file is started, 16MB if zero
+	SegmentSize int64
+	// MaxBytes disk quota for all segments, unlimited if zero
+	MaxBytes int64
+	// Sync fsync segments on every Append and the ack file on every Ack
+	Sync bool
+	// Types custom value types restored as is, e.g. postgres.TypeRegistry.GoTypes of the exporter Conf.Types,
+	// the values are kept as json, so the types must round-trip through encoding/json
+	Types []reflect.Type
+}
+
+func (c *Config) GetSegmentSize() int64 {
+	if c.SegmentSize <= 0 {
+		return 16 << 20
+	}
+	return c.SegmentSize
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+type position struct {
+	seq    uint64
+	offset int64
+}
+
+// Spool segmented write-ahead log of finished spans
+// spans are read with Next and stay in the spool until the read is acknowledged with Ack,
+// unacknowledged spans are read again after Rewind or after the spool is reopened
+//
+// each record is: payload length uint32, payload crc32 uint32, payload (see Encode)
+// segments are named by the sequence number, segments fully acknowledged are deleted
+type Spool struct {
+	conf  Config
+	codec codec
+
+	lock     sync.Mutex
+	segments []segment
+	w        *os.File
+	total    int64
+
+	ack     position
+	read    position
+	pending int
+	unacked int
+}
+
+// Open opens or creates the spool in Config.Dir
+// records after the last acknowledged position are kept for reading,
+// a torn record at the end of a segment, left by a crash during Append, is truncated
+func Open(conf Config) (*Spool, error) {
+	if conf.Dir == "" {
+		return nil, errors.New("spool dir is not set")
+	}
+	if err := os.MkdirAll(conf.Dir, 0o750); err != nil {
+		return nil, errors.Wrap(err, "failed to create spool dir")
+	}
+	s := &Spool{conf: conf, codec: newCodec(conf.Types)}
+	if err := s.readAck(); err != nil {
+		return nil, err
+	}
+	if err := s.loadSegments(); err != nil {
+		return nil, err
+	}
+	if err := s.openWriter(); err != nil {
+		return nil, err
+	}
+	if idx := s.segmentIndex(s.ack.seq); idx < 0 {
+		s.ack = position{seq: s.segments[0].seq}
+	} else if s.ack.offset > s.segments[idx].size {
+		s.ack.offset = s.segments[idx].size
+	}
+	s.read = s.ack
+	return s, nil
+}
+
+// Append writes spans to the end of the spool
+// returns number of spans written, the rest are rejected with ErrQuotaExceeded
+func (s *Spool) Append(spans []*klogga.Span) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.w == nil {
+		return 0, ErrClosed
+	}
+
+	written := 0
+	var err error
+	for _, span := range spans {
+		var payload []byte
+		payload, err = s.codec.encode(span)
+		if err != nil {
+			break
+		}
+		size := int64(headerSize + len(payload))
+		if s.conf.MaxBytes > 0 && s.total+size > s.conf.MaxBytes {
+			err = ErrQuotaExceeded
+			break
+		}
+		if last := s.segments[len(s.segments)-1]; last.size > 0 && last.size+size > s.conf.GetSegmentSize() {
+			if err = s.rotate(); err != nil {
+				break
+			}
+		}
+		record := make([]byte, size)
+		binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+		copy(record[headerSize:], payload)
+		if _, err = s.w.Write(record); err != nil {
+			err = errors.Wrap(err, "failed to write spool segment")
+			break
+		}
+		s.segments[len(s.segments)-1].size += size
+		s.total += size
+		s.pending++
+		written++
+	}
+	if s.conf.Sync && written > 0 {
+		err = errs.Append(err, errors.Wrap(s.w.Sync(), "failed to sync spool segment"))
+	}
+	return written, err
+}
+
+// Next reads up to max spans after the previous read
+// records that can't be decoded are skipped, the error about them is returned along with the spans
+func (s *Spool) Next(max int) ([]*klogga.Span, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.w == nil {
+		return nil, ErrClosed
+	}
+
+	var res []*klogga.Span
+	var decodeErr error
+	for len(res) < max {
+		idx := s.segmentIndex(s.read.seq)
+		if idx < 0 {
+			break
+		}
+		if s.read.offset >= s.segments[idx].size {
+			if idx == len(s.segments)-1 {
+				break
+			}
+			s.read = position{seq: s.segments[idx+1].seq}
+			continue
+		}
+		payloads, read, err := s.readSegment(s.segments[idx], s.read.offset, max-len(res))
+		if err != nil {
+			return res, errs.Append(decodeErr, err)
+		}
+		for _, payload := range payloads {
+			span, err := s.codec.decode(payload)
+			if err != nil {
+				decodeErr = errs.Append(decodeErr, err)
+				continue
+			}
+			res = append(res, span)
+		}
+		s.read.offset += read
+		s.unacked += len(payloads)
+	}
+	return res, decodeErr
+}
+
+// Ack marks everything returned by Next as processed
+func (s *Spool) Ack() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.w == nil {
+		return ErrClosed
+	}
+	if s.read == s.ack {
+		return nil
+	}
+	ack := s.read
+	// the fully acknowledged active segment is replaced with a new one, so its bytes stop counting to the quota
+	if last := s.segments[len(s.segments)-1]; ack.seq == last.seq && ack.offset == last.size {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		ack = position{seq: s.segments[len(s.segments)-1].seq}
+	}
+	if err := s.writeAck(ack); err != nil {
+		return err
+	}
+	s.ack = ack
+	s.read = ack
+	s.pending -= s.unacked
+	s.unacked = 0
+
+	var err error
+	for len(s.segments) > 1 && s.segments[0].seq < s.ack.seq {
+		err = errs.Append(err, os.Remove(s.segmentPath(s.segments[0].seq)))
+		s.total -= s.segments[0].size
+		s.segments = s.segments[1:]
+	}
+	return errors.Wrap(err, "failed to remove acknowledged segment")
+}
+
+// Rewind makes Next to read again from the last acknowledged position
+func (s *Spool) Rewind() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.read = s.ack
+	s.unacked = 0
+}
+
+// Pending number of spans not acknowledged yet
+func (s *Spool) Pending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pending
+}
+
+// Size bytes taken by the segments on disk
+func (s *Spool) Size() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.total
+}
+
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	return errors.Wrap(err, "failed to close spool segment")
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.conf.Dir, fmt.Sprintf("%016x%s", seq, segmentExt))
+}
+
+func (s *Spool) segmentIndex(seq uint64) int {
+	for i, seg := range s.segments {
+		if seg.seq == seq {
+			return i
+		}
+	}
+	return -1
+}
+
+// readSegment reads up to max payloads from offset
+// returns payloads and bytes read
+func (s *Spool) readSegment(seg segment, offset int64, max int) ([][]byte, int64, error) {
+	f, err := os.Open(s.segmentPath(seg.seq))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to open spool segment")
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, errors.Wrap(err, "failed to seek spool segment")
+	}
+	r := bufio.NewReader(io.LimitReader(f, seg.size-offset))
+	var res [][]byte
+	var read int64
+	for len(res) < max && offset+read < seg.size {
+		payload, err := readRecord(r)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "spool segment %d is corrupted at %d", seg.seq, offset+read)
+		}
+		res = append(res, payload)
+		read += int64(headerSize + len(payload))
+	}
+	return res, read, nil
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return payload, nil
+}
+
+func (s *Spool) readAck() error {
+	data, err := os.ReadFile(filepath.Join(s.conf.Dir, ackFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read spool ack")
+	}
+	if _, err := fmt.Sscanf(string(data), "%d %d", &s.ack.seq, &s.ack.offset); err != nil {
+		return errors.Wrap(err, "failed to parse spool ack")
+	}
+	return nil
+}
+
+// writeAck replaces the ack file atomically
+func (s *Spool) writeAck(pos position) error {
+	path := filepath.Join(s.conf.Dir, ackFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to write spool ack")
+	}
+	_, err = fmt.Fprintf(f, "%d %d\n", pos.seq, pos.offset)
+	if err == nil && s.conf.Sync {
+		err = f.Sync()
+	}
+	err = errs.Append(err, f.Close())
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return errors.Wrap(err, "failed to write spool ack")
+}
+
+// loadSegments lists segments, deletes the acknowledged ones,
+// counts pending records and truncates the segments at the first damaged record
+func (s *Spool) loadSegments() error {
+	entries, err := os.ReadDir(s.conf.Dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to read spool dir")
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		var seq uint64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, segmentExt), "%x", &seq); err != nil {
+			continue
+		}
+		if seq < s.ack.seq {
+			if err := os.Remove(s.segmentPath(seq)); err != nil {
+				return errors.Wrap(err, "failed to remove acknowledged segment")
+			}
+			continue
+		}
+		s.segments = append(s.segments, segment{seq: seq})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	for i := range s.segments {
+		seg := &s.segments[i]
+		offset := int64(0)
+		if seg.seq == s.ack.seq {
+			offset = s.ack.offset
+		}
+		size, records, err := s.scanSegment(seg.seq, offset)
+		if err != nil {
+			return err
+		}
+		seg.size = size
+		s.total += size
+		s.pending += records
+	}
+	return nil
+}
+
+// scanSegment returns the size of the valid segment part and the number of records after offset
+func (s *Spool) scanSegment(seq uint64, offset int64) (int64, int, error) {
+	path := s.segmentPath(seq)
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to open spool segment")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to stat spool segment")
+	}
+
+	r := bufio.NewReader(f)
+	var valid int64
+	records := 0
+	for valid < info.Size() {
+		payload, err := readRecord(r)
+		if err != nil {
+			break
+		}
+		if valid >= offset {
+			records++
+		}
+		valid += int64(headerSize + len(payload))
+	}
+	if valid < info.Size() {
+		if err := os.Truncate(path, valid); err != nil {
+			return 0, 0, errors.Wrap(err, "failed to truncate damaged spool segment")
+		}
+	}
+	return valid, records, nil
+}
+
+func (s *Spool) openWriter() error {
+	if len(s.segments) == 0 {
+		seq := s.ack.seq
+		if seq == 0 {
+			seq = 1
+		}
+		s.segments = append(s.segments, segment{seq: seq})
+	}
+	f, err := os.OpenFile(s.segmentPath(s.segments[len(s.segments)-1].seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return errors.Wrap(err, "failed to open spool segment")
+	}
+	s.w = f
+	return nil
+}
+
+func (s *Spool) rotate() error {
+	seq := s.segments[len(s.segments)-1].seq + 1
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return errors.Wrap(err, "failed to create spool segment")
+	}
+	err = s.w.Close()
+	s.w = f
+	s.segments = append(s.segments, segment{seq: seq})
+	return errors.Wrap(err, "failed to close spool segment")
+}
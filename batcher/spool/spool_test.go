@@ -0,0 +1,255 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"github.com/KasperskyLab/klogga"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testSpans(count int) []*klogga.Span {
+	res := make([]*klogga.Span, 0, count)
+	for i := 0; i < count; i++ {
+		span := klogga.StartLeaf(context.Background(), klogga.WithName("span")).Val("i", i)
+		span.Stop()
+		res = append(res, span)
+	}
+	return res
+}
+
+func indexes(spans []*klogga.Span) []int {
+	res := make([]int, 0, len(spans))
+	for _, span := range spans {
+		res = append(res, span.Vals()["i"].(int))
+	}
+	return res
+}
+
+// stringer custom type like a decimal, written as text by the exporters
+type stringer struct {
+	V int
+}
+
+func (stringer) String() string {
+	return "stringer"
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	ts := time.Date(2022, 1, 2, 3, 4, 5, 6, time.FixedZone("x", 3600))
+	parent := klogga.StartLeaf(context.Background())
+	span := klogga.StartLeaf(context.Background(), klogga.WithParentSpanID(parent.ID())).
+		Tag("string", "s").Tag("int", 1).Tag("uint8", uint8(2)).Tag("bool", true).
+		Tag("uuid", uuid.New()).Tag("trace", parent.TraceID()).Tag("span_id", parent.ID()).
+		Val("float32", float32(1.5)).Val("float64", 2.5).Val("int64", int64(-3)).Val("uint64", uint64(1<<63)).
+		Val("ts", ts).Val("dur", time.Minute).Val("bytes", []byte{1, 2}).
+		Val("obj", klogga.ValObject(map[string]int{"a": 1})).Val("json", klogga.ValJson(`{"b":2}`)).
+		Val("err", errors.New("val err")).Val("struct", struct{ A int }{A: 1}).Val("chan", make(chan int)).
+		Tag("ip", net.ParseIP("10.0.0.1")).Val("stringer", stringer{}).Val("uint_ptr", new(uint)).
+		Level(klogga.Warn).ErrSpan(errors.New("err")).Warn(errors.New("warn")).DeferErr(errors.New("defer"))
+	span.SetComponent("comp")
+	span.Stop()
+
+	data, err := Encode(span)
+	require.NoError(t, err)
+	restored, err := Decode(data)
+	require.NoError(t, err)
+
+	expected := span.Record()
+	actual := restored.Record()
+	require.Equal(t, expected.Started.UnixNano(), actual.Started.UnixNano())
+	require.Equal(t, expected.Finished.UnixNano(), actual.Finished.UnixNano())
+	require.True(t, ts.Equal(actual.Vals["ts"].(time.Time)))
+	require.Equal(t, klogga.ValJson(`{"a":1}`), actual.Vals["obj"])
+	require.Equal(t, klogga.ValJson(`{"b":2}`), actual.Vals["json"])
+	require.Equal(t, klogga.ValJson(`{"A":1}`), actual.Vals["struct"])
+	require.EqualError(t, actual.Vals["err"].(error), "val err")
+	require.IsType(t, "", actual.Vals["chan"])
+	require.Equal(t, "10.0.0.1", actual.Tags["ip"].(net.IP).String())
+	require.Equal(t, "stringer", actual.Vals["stringer"])
+	require.IsType(t, "", actual.Vals["uint_ptr"])
+	delete(expected.Tags, "ip")
+	delete(actual.Tags, "ip")
+	for _, key := range []string{"ts", "obj", "json", "struct", "err", "chan", "stringer", "uint_ptr"} {
+		delete(expected.Vals, key)
+		delete(actual.Vals, key)
+	}
+	require.Equal(t, expected.Tags, actual.Tags)
+	require.Equal(t, expected.Vals, actual.Vals)
+	require.Equal(t, expected.ID, actual.ID)
+	require.Equal(t, expected.TraceID, actual.TraceID)
+	require.Equal(t, expected.ParentID, actual.ParentID)
+	require.Equal(t, expected.Component, actual.Component)
+	require.Equal(t, expected.Level, actual.Level)
+	require.Equal(t, expected.Duration, actual.Duration)
+	require.Equal(t, expected.Errs.Error(), actual.Errs.Error())
+	require.Equal(t, expected.Warns.Error(), actual.Warns.Error())
+	require.Equal(t, expected.DeferErrs.Error(), actual.DeferErrs.Error())
+}
+
+// amount custom type registered in the exporter, e.g. written to numeric column
+type amount struct {
+	Units int64
+	Scale int
+}
+
+func (amount) String() string {
+	return "amount"
+}
+
+func TestCodecCustomTypes(t *testing.T) {
+	types := []reflect.Type{reflect.TypeOf(amount{}), reflect.TypeOf(stringer{})}
+	span := klogga.StartLeaf(context.Background()).Tag("amount", amount{Units: 15, Scale: 1}).Val("stringer", stringer{V: 2})
+	span.Stop()
+
+	data, err := Encode(span, types...)
+	require.NoError(t, err)
+	restored, err := Decode(data, types...)
+	require.NoError(t, err)
+	require.Equal(t, amount{Units: 15, Scale: 1}, restored.Tags()["amount"])
+	require.Equal(t, stringer{V: 2}, restored.Vals()["stringer"])
+
+	restored, err = Decode(data)
+	require.NoError(t, err)
+	require.Equal(t, klogga.ValJson(`{"Units":15,"Scale":1}`), restored.Tags()["amount"])
+
+	s, err := Open(Config{Dir: t.TempDir(), Types: types})
+	require.NoError(t, err)
+	_, err = s.Append([]*klogga.Span{span})
+	require.NoError(t, err)
+	spans, err := s.Next(1)
+	require.NoError(t, err)
+	require.Equal(t, amount{Units: 15, Scale: 1}, spans[0].Tags()["amount"])
+	require.NoError(t, s.Close())
+}
+
+func TestAckAndReplay(t *testing.T) {
+	conf := Config{Dir: t.TempDir(), SegmentSize: 1024}
+	s, err := Open(conf)
+	require.NoError(t, err)
+	written, err := s.Append(testSpans(30))
+	require.NoError(t, err)
+	require.Equal(t, 30, written)
+	require.Equal(t, 30, s.Pending())
+
+	spans, err := s.Next(10)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, indexes(spans))
+	require.NoError(t, s.Ack())
+	require.Equal(t, 20, s.Pending())
+
+	spans, err = s.Next(10)
+	require.NoError(t, err)
+	require.Equal(t, 10, indexes(spans)[0])
+	s.Rewind()
+	spans, err = s.Next(5)
+	require.NoError(t, err)
+	require.Equal(t, []int{10, 11, 12, 13, 14}, indexes(spans))
+	require.NoError(t, s.Close())
+
+	// unacknowledged spans are read again after reopen
+	s, err = Open(conf)
+	require.NoError(t, err)
+	require.Equal(t, 20, s.Pending())
+	spans, err = s.Next(100)
+	require.NoError(t, err)
+	require.Len(t, spans, 20)
+	require.Equal(t, 10, indexes(spans)[0])
+	require.NoError(t, s.Ack())
+	require.Equal(t, 0, s.Pending())
+
+	// acknowledged segments are deleted
+	segments, err := filepath.Glob(filepath.Join(conf.Dir, "*"+segmentExt))
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+
+	spans, err = s.Next(100)
+	require.NoError(t, err)
+	require.Empty(t, spans)
+	require.NoError(t, s.Close())
+}
+
+func TestQuota(t *testing.T) {
+	s, err := Open(Config{Dir: t.TempDir(), SegmentSize: 1024, MaxBytes: 4096})
+	require.NoError(t, err)
+	defer s.Close()
+
+	written, err := s.Append(testSpans(1000))
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	require.Greater(t, written, 0)
+	require.Less(t, written, 1000)
+	require.LessOrEqual(t, s.Size(), int64(4096))
+
+	// space is freed by acknowledged segments
+	_, err = s.Next(written)
+	require.NoError(t, err)
+	require.NoError(t, s.Ack())
+	written, err = s.Append(testSpans(1))
+	require.NoError(t, err)
+	require.Equal(t, 1, written)
+}
+
+func TestQuotaSingleSegment(t *testing.T) {
+	conf := Config{Dir: t.TempDir(), SegmentSize: 1 << 20, MaxBytes: 1024}
+	s, err := Open(conf)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		written, err := s.Append(testSpans(100))
+		require.ErrorIs(t, err, ErrQuotaExceeded)
+		require.Greater(t, written, 0)
+		spans, err := s.Next(100)
+		require.NoError(t, err)
+		require.Len(t, spans, written)
+		require.NoError(t, s.Ack())
+		require.Equal(t, 0, s.Pending())
+		require.Equal(t, int64(0), s.Size(), "acknowledged bytes don't count")
+	}
+	segments, err := filepath.Glob(filepath.Join(conf.Dir, "*"+segmentExt))
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+
+	// the ack survives the rotation
+	written, err := s.Append(testSpans(1))
+	require.NoError(t, err)
+	require.Equal(t, 1, written)
+	require.NoError(t, s.Close())
+	s, err = Open(conf)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, 1, s.Pending())
+}
+
+func TestTornTail(t *testing.T) {
+	conf := Config{Dir: t.TempDir()}
+	s, err := Open(conf)
+	require.NoError(t, err)
+	_, err = s.Append(testSpans(3))
+	require.NoError(t, err)
+	size := s.Size()
+	require.NoError(t, s.Close())
+
+	// crash in the middle of the record write
+	path := s.segmentPath(1)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, '{'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = Open(conf)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, size, s.Size())
+	_, err = s.Append(testSpans(1))
+	require.NoError(t, err)
+	spans, err := s.Next(10)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2, 0}, indexes(spans))
+}
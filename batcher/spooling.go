@@ -0,0 +1,108 @@
+package batcher
+
+import (
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/batcher/spool"
+	"github.com/KasperskyLab/klogga/util/errs"
+	"github.com/pkg/errors"
+	"sync/atomic"
+	"time"
+)
+
+// NewWithSpool constructs and starts the Batcher that keeps spans in the on-disk spool
+// instead of the memory buffer, so spans survive the process restart:
+// spans are acknowledged in the spool only after the exporter (or Config.DeadLetter) write succeeds,
+// spans left in the spool by the previous run are written first.
+// When the spool quota is exceeded new spans are dropped, Config.OverflowPolicy is not used.
+// Failed batches are retried from the spool on the next Config.Timeout tick, up to Config.SpoolMaxAttempts times.
+func NewWithSpool(exporter klogga.Exporter, conf Config, spoolConf spool.Config) (*Batcher, error) {
+	s, err := spool.Open(spoolConf)
+	if err != nil {
+		return nil, err
+	}
+	return newBatcher(exporter, conf, s), nil
+}
+
+// SpoolPending spans in the spool not written yet, zero if the Batcher has no spool
+func (b *Batcher) SpoolPending() int {
+	if b.spool == nil {
+		return 0
+	}
+	return b.spool.Pending()
+}
+
+func (b *Batcher) appendSpool(spans []*klogga.Span) error {
+	written, err := b.spool.Append(spans)
+	if errors.Is(err, spool.ErrQuotaExceeded) {
+		atomic.AddUint64(&b.droppedCount, uint64(len(spans)-written))
+		err = nil
+	}
+	if b.spool.Pending() >= b.conf.GetBatchSize() {
+		b.TriggerFlush()
+	}
+	return err
+}
+
+// drainSpool writes spool content in batches
+// stops at the first batch that failed, it stays in the spool to be retried and is not reported as lost,
+// its error is returned to Flush only, until the batch runs out of Config.SpoolMaxAttempts,
+// then it is acknowledged and reported as lost, so it doesn't block the spans after it
+func (b *Batcher) drainSpool() error {
+	var lost error
+	for {
+		spans, err := b.spool.Next(b.conf.GetBatchSize())
+		if err != nil {
+			err = errors.Wrap(err, "spool read failed")
+			b.handleErr(len(spans), err)
+		}
+		err = errs.Append(lost, err)
+		if len(spans) == 0 {
+			return err
+		}
+		if summary := b.dropSummary(); summary != nil {
+			spans = append(spans, summary)
+		}
+		retry, flushErr := b.exportSpooled(spans)
+		if retry {
+			b.spool.Rewind()
+			return errs.Append(err, flushErr)
+		}
+		lost = errs.Append(err, flushErr)
+		if ackErr := b.spool.Ack(); ackErr != nil {
+			b.handleErr(len(spans), ackErr)
+			return errs.Append(lost, ackErr)
+		}
+	}
+}
+
+func (b *Batcher) closeSpool() error {
+	if b.spool == nil {
+		return nil
+	}
+	return b.spool.Close()
+}
+
+// exportSpooled writes the spooled batch, retry is set if the batch is to stay in the spool
+// the batch that failed Config.SpoolMaxAttempts times is dropped, it is reported and counted as erred
+func (b *Batcher) exportSpooled(spans []*klogga.Span) (retry bool, err error) {
+	start := time.Now()
+	err = b.exportBatch(spans, true)
+	if err == nil {
+		b.spoolAttempts = 0
+		return false, nil
+	}
+	if b.ctx.Err() != nil {
+		// cancelled by Shutdown, the batch is retried on the next run
+		return true, err
+	}
+	b.spoolAttempts++
+	if maxAttempts := b.conf.GetSpoolMaxAttempts(); maxAttempts < 0 || b.spoolAttempts < maxAttempts {
+		return true, err
+	}
+	b.spoolAttempts = 0
+	err = errors.Wrapf(err, "spooled batch dropped after %d attempts", b.conf.GetSpoolMaxAttempts())
+	atomic.AddUint64(&b.erredCount, uint64(len(spans)))
+	b.handleErr(len(spans), err)
+	b.observe(len(spans), start, err)
+	return false, err
+}
@@ -0,0 +1,99 @@
+package batcher
+
+import (
+	"errors"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/batcher/spool"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSpoolAckAfterWrite(t *testing.T) {
+	spoolConf := spool.Config{Dir: t.TempDir()}
+	conf := Config{BatchSize: 10, Timeout: 10 * time.Millisecond, SpoolMaxAttempts: -1}
+
+	exporter := &exporterStub{Err: errors.New("db is down")}
+	b, err := NewWithSpool(exporter, conf, spoolConf)
+	require.NoError(t, err)
+	reported := 0
+	b.SetErrorHandler(func(int, error) { reported++ })
+	b.SetBatchObserver(func(_ int, _ time.Duration, err error) { require.NoError(t, err, "the batch is not lost") })
+	writeSpans(t, b, 15)
+	require.EqualError(t, b.Flush(testutil.Timeout()), "db is down")
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	require.Equal(t, uint64(0), b.FlushedCount())
+	require.Equal(t, uint64(0), b.ErredCount(), "retained in the spool")
+	require.Equal(t, 0, reported)
+	require.Equal(t, 15, b.SpoolPending())
+
+	// spans are replayed after restart
+	exporter = &exporterStub{}
+	b, err = NewWithSpool(exporter, conf, spoolConf)
+	require.NoError(t, err)
+	require.NoError(t, b.Flush(testutil.Timeout()))
+	require.Equal(t, uint64(15), b.FlushedCount())
+	writeSpans(t, b, 5)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	require.Equal(t, uint64(20), b.FlushedCount())
+	require.Len(t, exporter.GetSpans(), 20)
+	require.Equal(t, 0, b.SpoolPending())
+}
+
+func TestSpoolDeadLetterAcks(t *testing.T) {
+	deadLetter := &exporterStub{}
+	b, err := NewWithSpool(
+		&exporterStub{Err: errors.New("bad data")},
+		Config{BatchSize: 10, Timeout: 10 * time.Millisecond, DeadLetter: deadLetter},
+		spool.Config{Dir: t.TempDir()},
+	)
+	require.NoError(t, err)
+	writeSpans(t, b, 10)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	require.Len(t, deadLetter.GetSpans(), 10)
+	require.Equal(t, 0, b.SpoolPending())
+}
+
+func TestSpoolQuotaDrops(t *testing.T) {
+	exporter := &exporterStub{}
+	b, err := NewWithSpool(
+		exporter, Config{BatchSize: 1000, Timeout: time.Hour}, spool.Config{Dir: t.TempDir(), MaxBytes: 4096},
+	)
+	require.NoError(t, err)
+	writeSpans(t, b, 100)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	require.Greater(t, b.DroppedCount(), uint64(0))
+	require.Equal(t, 100, int(b.DroppedCount())+len(exporter.GetSpans()))
+	for _, span := range exporter.GetSpans() {
+		require.IsType(t, &klogga.Span{}, span)
+	}
+}
+
+func TestSpoolMaxAttempts(t *testing.T) {
+	exporter := &exporterStub{Err: errors.New("bad data")}
+	b, err := NewWithSpool(
+		exporter, Config{BatchSize: 20, Timeout: time.Hour, SpoolMaxAttempts: 3}, spool.Config{Dir: t.TempDir()},
+	)
+	require.NoError(t, err)
+	var reported error
+	b.SetErrorHandler(func(_ int, err error) { reported = err })
+	writeSpans(t, b, 10)
+	require.EqualError(t, b.Flush(testutil.Timeout()), "bad data")
+	require.EqualError(t, b.Flush(testutil.Timeout()), "bad data")
+	require.Equal(t, 10, b.SpoolPending())
+	require.Nil(t, reported)
+
+	// the third attempt drops the batch, so the next spans are not blocked by it
+	require.EqualError(t, b.Flush(testutil.Timeout()), "spooled batch dropped after 3 attempts: bad data")
+	require.EqualError(t, reported, "spooled batch dropped after 3 attempts: bad data")
+	require.Equal(t, uint64(10), b.ErredCount())
+	require.Equal(t, 0, b.SpoolPending())
+
+	exporter.m.Lock()
+	exporter.Err = nil
+	exporter.m.Unlock()
+	writeSpans(t, b, 5)
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	require.Len(t, exporter.GetSpans(), 5)
+}
@@ -0,0 +1,348 @@
+package config
+
+import (
+	"context"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/batcher"
+	"github.com/KasperskyLab/klogga/batcher/spool"
+	"github.com/KasperskyLab/klogga/metrics"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Config declarative description of the klogga.Factory
+// can be loaded from YAML or JSON (see Parse, LoadFile) or from KLOGGA_* env variables (see FromEnv)
+//
+//	hostname: my-host
+//	level: info
+//	components:
+//	  noisy_component: warn
+//	sampling:
+//	  ratio: 0.1
+//	batcher:
+//	  batch_size: 512
+//	  timeout: 5s
+//	exporters:
+//	  - type: golog
+//	  - type: postgres
+//	    batch: true
+//	    params:
+//	      connection_string: postgres://localhost:5432/klogga
+type Config struct {
+	// Hostname written on spans, os hostname is used when empty
+	Hostname string `yaml:"hostname"`
+	// Level minimal level of the written spans, spans with errors or warnings are always written
+	// all spans are written when empty
+	Level string `yaml:"level"`
+	// Components per-component minimal levels, override Level
+	Components map[string]string `yaml:"components"`
+	Sampling   Sampling          `yaml:"sampling"`
+	// Batcher default settings for the exporters with batching enabled
+	Batcher   *Batcher   `yaml:"batcher"`
+	Exporters []Exporter `yaml:"exporters"`
+	// Metrics optional, measures the exporters and the batchers labeled with the exporter names
+	Metrics *metrics.Metrics `yaml:"-"`
+	// Registerer exporters that are prometheus collectors, e.g. spanmetrics, are registered here by Build,
+	// prometheus.DefaultRegisterer if nil, they are unregistered if Build fails
+	Registerer prometheus.Registerer `yaml:"-"`
+}
+
+// Sampling writes only a share of traces, the decision is made by the trace id
+// so the trace is either written whole or not written at all
+// spans with errors or warnings are always written
+type Sampling struct {
+	// Ratio share of the traces to be written, zero or one means everything is written
+	Ratio float64 `yaml:"ratio"`
+}
+
+// Batcher batcher.Config counterpart, zero fields are taken from batcher.ConfigDefault
+type Batcher struct {
+	BatchSize  int           `yaml:"batch_size"`
+	BufferSize int           `yaml:"buffer_size"`
+	Timeout    time.Duration `yaml:"timeout"`
+	// PriorityBufferSize capacity reserved for errors, warnings and audit spans, see batcher.HighPriority
+	PriorityBufferSize int `yaml:"priority_buffer_size"`
+	// MaxBatchBytes, MaxBufferBytes estimated size limits, see batcher.Config
+	MaxBatchBytes  int `yaml:"max_batch_bytes"`
+	MaxBufferBytes int `yaml:"max_buffer_bytes"`
+	// OverflowPolicy block, drop_newest, drop_oldest or drop_by_level, see batcher.OverflowPolicy
+	OverflowPolicy string        `yaml:"overflow_policy"`
+	BlockTimeout   time.Duration `yaml:"block_timeout"`
+	Workers        int           `yaml:"workers"`
+	// ShardBy component or trace_id, see batcher.ShardKey
+	ShardBy string `yaml:"shard_by"`
+	Retry   *Retry `yaml:"retry"`
+	// Spool keep spans on disk until written, see batcher.NewWithSpool
+	Spool *Spool `yaml:"spool"`
+}
+
+// Retry batcher.RetryPolicy counterpart
+type Retry struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	Jitter         float64       `yaml:"jitter"`
+}
+
+// Spool spool.Config counterpart
+// each exporter spools to its own subdirectory of Dir named after the exporter
+type Spool struct {
+	Dir         string `yaml:"dir"`
+	SegmentSize int64  `yaml:"segment_size"`
+	MaxBytes    int64  `yaml:"max_bytes"`
+	Sync        bool   `yaml:"sync"`
+	// MaxAttempts batcher.Config.SpoolMaxAttempts
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+// Exporter describes a single exporter
+type Exporter struct {
+	// Type name the exporter builder is registered with, see Register
+	Type string `yaml:"type"`
+	// Name to identify the exporter, Type is used when empty
+	Name string `yaml:"name"`
+	// Level minimal level of the spans written to this exporter
+	Level string `yaml:"level"`
+	// Batch wrap the exporter in batcher.Batcher with the default batcher settings
+	Batch bool `yaml:"batch"`
+	// Batcher overrides the default batcher settings, implies Batch
+	Batcher *Batcher `yaml:"batcher"`
+	// Params are passed to the exporter builder
+	Params Params `yaml:"params"`
+}
+
+func (e *Exporter) GetName() string {
+	if e.Name == "" {
+		return e.Type
+	}
+	return e.Name
+}
+
+// Parse reads config from YAML or JSON
+func Parse(data []byte) (*Config, error) {
+	res := &Config{}
+	if err := yaml.Unmarshal(data, res); err != nil {
+		return nil, errors.Wrap(err, "failed to parse klogga config")
+	}
+	return res, nil
+}
+
+// LoadFile reads config from YAML or JSON file
+func LoadFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read klogga config")
+	}
+	return Parse(data)
+}
+
+// Build creates exporters and the factory
+// hostname is set globally, as klogga.SetHostname does
+func (c *Config) Build() (*klogga.Factory, error) {
+	filter, err := c.filter()
+	if err != nil {
+		return nil, err
+	}
+
+	exporters := make(klogga.ExportersSlice, 0, len(c.Exporters))
+	var collectors []prometheus.Collector
+	names := map[string]struct{}{}
+	for i := range c.Exporters {
+		ec := &c.Exporters[i]
+		if _, ok := names[ec.GetName()]; ok {
+			err = errors.Errorf("duplicate exporter name: %s", ec.GetName())
+			break
+		}
+		names[ec.GetName()] = struct{}{}
+
+		var exporter klogga.Exporter
+		var collector prometheus.Collector
+		exporter, collector, err = c.buildExporter(ec)
+		if err != nil {
+			break
+		}
+		if collector != nil {
+			collectors = append(collectors, collector)
+		}
+		if filter != nil {
+			exporter = filter.wrap(exporter)
+		}
+		exporters = append(exporters, exporter)
+	}
+	if err != nil {
+		for _, collector := range collectors {
+			c.registerer().Unregister(collector)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = exporters.Shutdown(ctx)
+		return nil, err
+	}
+
+	if c.Hostname != "" {
+		klogga.SetHostname(c.Hostname)
+	} else {
+		klogga.InitHostname()
+	}
+
+	return klogga.NewFactory(exporters...), nil
+}
+
+func (c *Config) registerer() prometheus.Registerer {
+	if c.Registerer == nil {
+		return prometheus.DefaultRegisterer
+	}
+	return c.Registerer
+}
+
+func (c *Config) filter() (*filterExporter, error) {
+	res := &filterExporter{level: klogga.Debug, ratio: c.Sampling.Ratio}
+	if c.Sampling.Ratio < 0 || c.Sampling.Ratio > 1 {
+		return nil, errors.Errorf("sampling ratio must be in [0, 1], got %v", c.Sampling.Ratio)
+	}
+	if c.Level != "" {
+		level, err := klogga.ParseLogLevel(c.Level)
+		if err != nil {
+			return nil, err
+		}
+		res.level = level
+	}
+	if len(c.Components) > 0 {
+		res.components = make(map[klogga.ComponentName]klogga.LogLevel, len(c.Components))
+		for component, levelStr := range c.Components {
+			level, err := klogga.ParseLogLevel(levelStr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "component %s", component)
+			}
+			res.components[klogga.ComponentName(component)] = level
+		}
+	}
+	if res.passAll() {
+		return nil, nil
+	}
+	return res, nil
+}
+
+// buildExporter returns the exporter with its collector, if it is registered in Config.Registerer
+func (c *Config) buildExporter(ec *Exporter) (klogga.Exporter, prometheus.Collector, error) {
+	builder, ok := lookup(ec.Type)
+	if !ok {
+		return nil, nil, errors.Errorf("exporter %s: unknown type %q", ec.GetName(), ec.Type)
+	}
+	var level klogga.LogLevel
+	if ec.Level != "" {
+		var err error
+		if level, err = klogga.ParseLogLevel(ec.Level); err != nil {
+			return nil, nil, errors.Wrapf(err, "exporter %s", ec.GetName())
+		}
+	}
+
+	res, err := builder(ec.Params)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "exporter %s", ec.GetName())
+	}
+	collector, _ := res.(prometheus.Collector)
+	if collector != nil {
+		if err := c.registerer().Register(collector); err != nil {
+			_ = res.Shutdown(context.Background())
+			return nil, nil, errors.Wrapf(err, "exporter %s: failed to register metrics", ec.GetName())
+		}
+	}
+	res, err = c.wrapExporter(ec, res)
+	if err != nil {
+		if collector != nil {
+			c.registerer().Unregister(collector)
+		}
+		return nil, nil, err
+	}
+	if ec.Level != "" {
+		res = &filterExporter{next: res, level: level}
+	}
+	return res, collector, nil
+}
+
+// wrapExporter adds the metrics and the batcher, the exporter is shut down if it fails
+func (c *Config) wrapExporter(ec *Exporter, res klogga.Exporter) (klogga.Exporter, error) {
+	if c.Metrics != nil {
+		res = c.Metrics.Exporter(ec.GetName(), res)
+	}
+	if ec.Batch || ec.Batcher != nil {
+		bc := c.Batcher
+		if ec.Batcher != nil {
+			bc = ec.Batcher
+		}
+		conf, err := bc.config()
+		if err != nil {
+			_ = res.Shutdown(context.Background())
+			return nil, errors.Wrapf(err, "exporter %s", ec.GetName())
+		}
+		var b *batcher.Batcher
+		if bc != nil && bc.Spool != nil {
+			spoolConf := spool.Config{
+				Dir:         filepath.Join(bc.Spool.Dir, ec.GetName()),
+				SegmentSize: bc.Spool.SegmentSize,
+				MaxBytes:    bc.Spool.MaxBytes,
+				Sync:        bc.Spool.Sync,
+			}
+			conf.SpoolMaxAttempts = bc.Spool.MaxAttempts
+			b, err = batcher.NewWithSpool(res, conf, spoolConf)
+			if err != nil {
+				_ = res.Shutdown(context.Background())
+				return nil, errors.Wrapf(err, "exporter %s", ec.GetName())
+			}
+		} else {
+			b = batcher.New(res, conf)
+		}
+		if c.Metrics != nil {
+			if err := c.Metrics.AddBatcher(ec.GetName(), b); err != nil {
+				_ = b.Shutdown(context.Background())
+				return nil, errors.Wrapf(err, "exporter %s", ec.GetName())
+			}
+		}
+		res = b
+	}
+	return res, nil
+}
+
+func (b *Batcher) config() (batcher.Config, error) {
+	res := batcher.ConfigDefault()
+	if b == nil {
+		return res, nil
+	}
+	if b.BatchSize > 0 {
+		res.BatchSize = b.BatchSize
+	}
+	if b.BufferSize > 0 {
+		res.BufferSize = b.BufferSize
+	}
+	if b.Timeout > 0 {
+		res.Timeout = b.Timeout
+	}
+	if b.OverflowPolicy != "" {
+		policy, err := batcher.ParseOverflowPolicy(b.OverflowPolicy)
+		if err != nil {
+			return res, err
+		}
+		res.OverflowPolicy = policy
+	}
+	res.PriorityBufferSize = b.PriorityBufferSize
+	res.MaxBatchBytes = b.MaxBatchBytes
+	res.MaxBufferBytes = b.MaxBufferBytes
+	res.BlockTimeout = b.BlockTimeout
+	res.Workers = b.Workers
+	if b.ShardBy != "" {
+		key, err := batcher.ParseShardKey(b.ShardBy)
+		if err != nil {
+			return res, err
+		}
+		res.ShardBy = key
+	}
+	if b.Retry != nil {
+		res.Retry = batcher.RetryPolicy(*b.Retry)
+	}
+	return res, nil
+}
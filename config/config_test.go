@@ -0,0 +1,311 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/batcher"
+	"github.com/KasperskyLab/klogga/exporters/postgres"
+	"github.com/KasperskyLab/klogga/exporters/postgres/pgconnector"
+	"github.com/KasperskyLab/klogga/exporters/spancollector"
+	"github.com/KasperskyLab/klogga/metrics"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testCollectors = map[string]*spancollector.SpanCollector{}
+
+type testParams struct {
+	ID       string        `yaml:"id"`
+	Port     int           `yaml:"port"`
+	Period   time.Duration `yaml:"period"`
+	Password string        `yaml:"password"`
+	Host     string        `yaml:"host"`
+	Enabled  bool          `yaml:"enabled"`
+	Name     string        `yaml:"name"`
+}
+
+func init() {
+	Register(
+		"test_collector", func(params Params) (klogga.Exporter, error) {
+			p := testParams{}
+			if err := params.Decode(&p); err != nil {
+				return nil, err
+			}
+			collector := &spancollector.SpanCollector{}
+			testCollectors[p.ID] = collector
+			return collector, nil
+		},
+	)
+}
+
+const testYAML = `
+hostname: config-test-host
+level: info
+components:
+  noisy: error
+batcher:
+  batch_size: 10
+  timeout: 1h
+exporters:
+  - type: test_collector
+    name: all
+    params:
+      id: all
+  - type: test_collector
+    name: warns
+    level: warn
+    batch: true
+    params:
+      id: warns
+`
+
+func TestBuildFromYAML(t *testing.T) {
+	conf, err := Parse([]byte(testYAML))
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, conf.Batcher.Timeout)
+
+	tf, err := conf.Build()
+	require.NoError(t, err)
+	trs := tf.Named("test")
+	noisy := tf.Named("noisy")
+
+	trs.Finish(klogga.StartLeaf(context.Background(), klogga.WithName("debug")).Level(klogga.Debug))
+	trs.Finish(klogga.StartLeaf(context.Background(), klogga.WithName("info")))
+	trs.Finish(klogga.StartLeaf(context.Background(), klogga.WithName("warn")).Level(klogga.Warn))
+	trs.Finish(klogga.StartLeaf(context.Background(), klogga.WithName("debug_err")).Level(klogga.Debug).ErrSpan(errors.New("err")))
+	noisy.Finish(klogga.StartLeaf(context.Background(), klogga.WithName("noisy_warn")).Level(klogga.Warn))
+	require.Len(t, tf.Exporters(), 2, "each exporter is filtered separately")
+
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+
+	var names []string
+	for _, span := range testCollectors["all"].Spans {
+		names = append(names, span.Name())
+		require.Equal(t, "config-test-host", span.Host())
+	}
+	require.Equal(t, []string{"info", "warn", "debug_err"}, names)
+
+	names = nil
+	for _, span := range testCollectors["warns"].Spans {
+		names = append(names, span.Name())
+	}
+	require.Equal(t, []string{"warn", "debug_err"}, names)
+}
+
+func TestParseJSON(t *testing.T) {
+	conf, err := Parse(
+		[]byte(`{"level": "warn", "batcher": {"timeout": "2s", "overflow_policy": "drop_oldest", "max_batch_bytes": 65536, "priority_buffer_size": 32, "workers": 4, "shard_by": "trace_id", "retry": {"max_attempts": 3}}, "exporters": [{"type": "golog", "batch": true}]}`),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "warn", conf.Level)
+	bc, err := conf.Batcher.config()
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, bc.Timeout)
+	require.Equal(t, batcher.ConfigDefault().BatchSize, bc.BatchSize)
+	require.Equal(t, batcher.OverflowDropOldest, bc.OverflowPolicy)
+	require.Equal(t, 3, bc.Retry.MaxAttempts)
+	require.Equal(t, 65536, bc.MaxBatchBytes)
+	require.Equal(t, 32, bc.PriorityBufferSize)
+	require.Equal(t, 4, bc.Workers)
+	require.Equal(t, batcher.ShardByTraceID, bc.ShardBy)
+	require.Equal(t, "golog", conf.Exporters[0].GetName())
+
+	tf, err := conf.Build()
+	require.NoError(t, err)
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+}
+
+func TestBuildErrors(t *testing.T) {
+	for name, yml := range map[string]string{
+		"unknown type":    `exporters: [{type: unknown}]`,
+		"duplicate name":  `exporters: [{type: golog}, {type: golog}]`,
+		"bad level":       `level: loud`,
+		"bad exp level":   `exporters: [{type: golog, level: loud}]`,
+		"bad ratio":       `sampling: {ratio: 2}`,
+		"builder error":   `exporters: [{type: postgres}]`,
+		"bad golog param": `exporters: [{type: golog, params: {output: file}}]`,
+		"bad overflow":    `exporters: [{type: golog, batcher: {overflow_policy: spill}}]`,
+		"bad shard key":   `exporters: [{type: golog, batcher: {shard_by: host}}]`,
+		"bad conflicts":   `exporters: [{type: postgres, params: {connection_string: "postgres://localhost", conflict_strategy: drop}}]`,
+		"bad driver":      `exporters: [{type: postgres, params: {connection_string: "postgres://localhost", driver: odbc}}]`,
+	} {
+		t.Run(
+			name, func(t *testing.T) {
+				conf, err := Parse([]byte(yml))
+				require.NoError(t, err)
+				_, err = conf.Build()
+				require.Error(t, err)
+			},
+		)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("KLOGGA_LEVEL", "warn")
+	t.Setenv("KLOGGA_COMPONENTS", "a=debug, b=error")
+	t.Setenv("KLOGGA_SAMPLING_RATIO", "0.5")
+	t.Setenv("KLOGGA_BATCHER_BATCH_SIZE", "100")
+	t.Setenv("KLOGGA_BATCHER_TIMEOUT", "3s")
+	t.Setenv("KLOGGA_BATCHER_OVERFLOW_POLICY", "drop_newest")
+	t.Setenv("KLOGGA_EXPORTERS", "log, env, env_err")
+	t.Setenv("KLOGGA_EXPORTER_LOG_TYPE", "golog")
+	t.Setenv("KLOGGA_EXPORTER_ENV_TYPE", "test_collector")
+	t.Setenv("KLOGGA_EXPORTER_ENV_BATCH", "true")
+	t.Setenv("KLOGGA_EXPORTER_ENV_ID", "12")
+	t.Setenv("KLOGGA_EXPORTER_ENV_PORT", "5432")
+	t.Setenv("KLOGGA_EXPORTER_ENV_PERIOD", "1m")
+	t.Setenv("KLOGGA_EXPORTER_ENV_PASSWORD", "0123")
+	t.Setenv("KLOGGA_EXPORTER_ENV_HOST", "0x10")
+	t.Setenv("KLOGGA_EXPORTER_ENV_ENABLED", "true")
+	t.Setenv("KLOGGA_EXPORTER_ENV_ERR_TYPE", "test_collector")
+	t.Setenv("KLOGGA_EXPORTER_ENV_ERR_NAME", "1e3")
+
+	conf, err := FromEnv()
+	require.NoError(t, err)
+	require.Equal(t, "warn", conf.Level)
+	require.Equal(t, map[string]string{"a": "debug", "b": "error"}, conf.Components)
+	require.Equal(t, 0.5, conf.Sampling.Ratio)
+	require.Equal(t, &Batcher{BatchSize: 100, Timeout: 3 * time.Second, OverflowPolicy: "drop_newest"}, conf.Batcher)
+	require.Len(t, conf.Exporters, 3)
+	require.Equal(t, "golog", conf.Exporters[0].Type)
+	require.Equal(t, "env", conf.Exporters[1].Name)
+	require.True(t, conf.Exporters[1].Batch)
+
+	p := testParams{}
+	require.NoError(t, conf.Exporters[1].Params.Decode(&p))
+	require.Equal(
+		t, testParams{ID: "12", Port: 5432, Period: time.Minute, Password: "0123", Host: "0x10", Enabled: true}, p,
+	)
+	p = testParams{}
+	require.NoError(t, conf.Exporters[2].Params.Decode(&p))
+	require.Equal(t, testParams{Name: "1e3"}, p)
+	require.NotContains(t, conf.Exporters[1].Params, "err_name", "params of env_err don't leak into env")
+	require.Equal(t, "test_collector", conf.Exporters[2].Type)
+
+	tf, err := conf.Build()
+	require.NoError(t, err)
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+}
+
+func TestSampling(t *testing.T) {
+	f := &filterExporter{next: &spancollector.SpanCollector{}, ratio: 0.3}
+	written := 0
+	const total = 10000
+	for i := 0; i < total; i++ {
+		parent := klogga.StartLeaf(context.Background())
+		child := klogga.StartLeaf(context.Background(), klogga.WithTraceID(parent.TraceID()))
+		require.Equal(t, f.pass(parent), f.pass(child))
+		if f.pass(parent) {
+			written++
+		}
+	}
+	require.InDelta(t, 0.3, float64(written)/total, 0.03)
+
+	errSpan := klogga.StartLeaf(context.Background()).ErrSpan(errors.New("err"))
+	require.True(t, (&filterExporter{ratio: 0.000001}).pass(errSpan))
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	require.Panics(t, func() { Register("golog", buildGolog) })
+	require.Contains(t, Types(), "test_collector")
+}
+
+func TestRegisterPostgresDriver(t *testing.T) {
+	var got PostgresConnParams
+	RegisterPostgresDriver(
+		"test_driver", func(p PostgresConnParams) postgres.Connector {
+			got = p
+			return &pgconnector.PgConnector{ConnectionString: p.ConnectionString}
+		},
+	)
+	require.Panics(t, func() { RegisterPostgresDriver("pq", nil) })
+
+	exp, err := buildPostgres(Params{"connection_string": "postgres://localhost", "driver": "test_driver", "max_open_connections": 3})
+	require.NoError(t, err)
+	require.NotNil(t, exp)
+	require.Equal(t, PostgresConnParams{ConnectionString: "postgres://localhost", MaxOpenConnections: 3}, got)
+}
+
+func TestBuildSpool(t *testing.T) {
+	dir := t.TempDir()
+	conf, err := Parse([]byte(`{"batcher": {"spool": {"dir": "` + dir + `", "max_bytes": 1048576}}, "exporters": [{"type": "golog", "batch": true}]}`))
+	require.NoError(t, err)
+	require.Equal(t, int64(1<<20), conf.Batcher.Spool.MaxBytes)
+
+	tf, err := conf.Build()
+	require.NoError(t, err)
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+	require.DirExists(t, filepath.Join(dir, "golog"))
+}
+
+func TestBuildMetrics(t *testing.T) {
+	conf, err := Parse([]byte(testYAML))
+	require.NoError(t, err)
+	conf.Metrics = metrics.New()
+
+	tf, err := conf.Build()
+	require.NoError(t, err)
+	tf.Named("test").Finish(klogga.StartLeaf(context.Background()).Level(klogga.Warn))
+	require.NoError(t, tf.Flush(testutil.Timeout()))
+	require.Equal(t, 1, promtest.CollectAndCount(conf.Metrics, "klogga_batcher_queue_depth"))
+	require.NoError(
+		t, promtest.CollectAndCompare(
+			conf.Metrics, strings.NewReader(
+				`
+# HELP klogga_exporter_written_spans_total Spans passed to the exporter Write.
+# TYPE klogga_exporter_written_spans_total counter
+klogga_exporter_written_spans_total{exporter="all"} 1
+klogga_exporter_written_spans_total{exporter="warns"} 1
+`,
+			), "klogga_exporter_written_spans_total",
+		),
+	)
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+
+	_, err = conf.Build()
+	require.Error(t, err, "batchers names are taken")
+}
+
+func TestBuildSpanMetrics(t *testing.T) {
+	conf, err := Parse([]byte(`exporters: [{type: spanmetrics, params: {namespace: config_test, label_tags: [method]}}]`))
+	require.NoError(t, err)
+	tf, err := conf.Build()
+	require.NoError(t, err)
+	tf.Named("api").Finish(klogga.StartLeaf(context.Background()).Tag("method", "GET"))
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+
+	count, err := promtest.GatherAndCount(prometheus.DefaultGatherer, "config_test_spans_total")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	_, err = conf.Build()
+	require.Error(t, err, "metrics are registered already")
+}
+
+func TestBuildSpanMetricsRegisterer(t *testing.T) {
+	conf, err := Parse([]byte(`exporters: [{type: spanmetrics, params: {namespace: registerer_test}}]`))
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		conf.Registerer = prometheus.NewRegistry()
+		tf, err := conf.Build()
+		require.NoError(t, err)
+		require.NoError(t, tf.Shutdown(testutil.Timeout()))
+	}
+
+	registry := prometheus.NewRegistry()
+	conf, err = Parse([]byte(`exporters: [{type: spanmetrics, params: {namespace: registerer_test}}, {type: unknown}]`))
+	require.NoError(t, err)
+	conf.Registerer = registry
+	_, err = conf.Build()
+	require.Error(t, err)
+	conf.Exporters = conf.Exporters[:1]
+	tf, err := conf.Build()
+	require.NoError(t, err, "unregistered on the failed build")
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+}
@@ -0,0 +1,176 @@
+package config
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix prefix of the env variables read by FromEnv
+const EnvPrefix = "KLOGGA_"
+
+// FromEnv reads config from env variables:
+//
+//	KLOGGA_HOSTNAME
+//	KLOGGA_LEVEL
+//	KLOGGA_COMPONENTS=component_a=warn,component_b=debug
+//	KLOGGA_SAMPLING_RATIO
+//	KLOGGA_BATCHER_BATCH_SIZE, KLOGGA_BATCHER_BUFFER_SIZE, KLOGGA_BATCHER_TIMEOUT
+//	KLOGGA_BATCHER_PRIORITY_BUFFER_SIZE
+//	KLOGGA_BATCHER_MAX_BATCH_BYTES, KLOGGA_BATCHER_MAX_BUFFER_BYTES
+//	KLOGGA_BATCHER_OVERFLOW_POLICY, KLOGGA_BATCHER_BLOCK_TIMEOUT
+//	KLOGGA_BATCHER_WORKERS, KLOGGA_BATCHER_SHARD_BY
+//	KLOGGA_BATCHER_SPOOL_DIR - enables the spool with the default settings
+//	KLOGGA_EXPORTERS=golog,pg - comma separated exporter names
+//	KLOGGA_EXPORTER_<NAME>_TYPE - exporter type, the name is used when not set
+//	KLOGGA_EXPORTER_<NAME>_LEVEL, KLOGGA_EXPORTER_<NAME>_BATCH
+//	KLOGGA_EXPORTER_<NAME>_<PARAM> - exporter param in lower case, e.g. KLOGGA_EXPORTER_PG_CONNECTION_STRING
+func FromEnv() (*Config, error) {
+	res := &Config{
+		Hostname: os.Getenv(EnvPrefix + "HOSTNAME"),
+		Level:    os.Getenv(EnvPrefix + "LEVEL"),
+	}
+
+	if components := os.Getenv(EnvPrefix + "COMPONENTS"); components != "" {
+		res.Components = map[string]string{}
+		for _, pair := range strings.Split(components, ",") {
+			component, level, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, errors.Errorf("%sCOMPONENTS: invalid pair %q", EnvPrefix, pair)
+			}
+			res.Components[strings.TrimSpace(component)] = strings.TrimSpace(level)
+		}
+	}
+
+	if ratio := os.Getenv(EnvPrefix + "SAMPLING_RATIO"); ratio != "" {
+		var err error
+		if res.Sampling.Ratio, err = strconv.ParseFloat(ratio, 64); err != nil {
+			return nil, errors.Wrapf(err, "%sSAMPLING_RATIO", EnvPrefix)
+		}
+	}
+
+	bc, err := batcherFromEnv(EnvPrefix + "BATCHER_")
+	if err != nil {
+		return nil, err
+	}
+	res.Batcher = bc
+
+	var names []string
+	for _, name := range strings.Split(os.Getenv(EnvPrefix+"EXPORTERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		ec, err := exporterFromEnv(name, names)
+		if err != nil {
+			return nil, err
+		}
+		res.Exporters = append(res.Exporters, ec)
+	}
+	return res, nil
+}
+
+func batcherFromEnv(prefix string) (*Batcher, error) {
+	res := &Batcher{}
+	found := false
+	for key, target := range map[string]*int{
+		"BATCH_SIZE": &res.BatchSize, "BUFFER_SIZE": &res.BufferSize, "WORKERS": &res.Workers,
+		"PRIORITY_BUFFER_SIZE": &res.PriorityBufferSize,
+		"MAX_BATCH_BYTES":      &res.MaxBatchBytes, "MAX_BUFFER_BYTES": &res.MaxBufferBytes,
+	} {
+		if val := os.Getenv(prefix + key); val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, errors.Wrap(err, prefix+key)
+			}
+			*target = n
+			found = true
+		}
+	}
+	for key, target := range map[string]*time.Duration{"TIMEOUT": &res.Timeout, "BLOCK_TIMEOUT": &res.BlockTimeout} {
+		if val := os.Getenv(prefix + key); val != "" {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, errors.Wrap(err, prefix+key)
+			}
+			*target = d
+			found = true
+		}
+	}
+	if val := os.Getenv(prefix + "OVERFLOW_POLICY"); val != "" {
+		res.OverflowPolicy = val
+		found = true
+	}
+	if val := os.Getenv(prefix + "SHARD_BY"); val != "" {
+		res.ShardBy = val
+		found = true
+	}
+	if val := os.Getenv(prefix + "SPOOL_DIR"); val != "" {
+		res.Spool = &Spool{Dir: val}
+		found = true
+	}
+	if !found {
+		return nil, nil
+	}
+	return res, nil
+}
+
+func exporterEnvPrefix(name string) string {
+	return EnvPrefix + "EXPORTER_" + strings.ToUpper(name) + "_"
+}
+
+// envExporter name of the exporter the env variable belongs to, the longest matching name wins,
+// so KLOGGA_EXPORTER_PG_ERR_TYPE belongs to PG_ERR, not to PG
+func envExporter(key string, names []string) string {
+	res := ""
+	for _, name := range names {
+		if strings.HasPrefix(key, exporterEnvPrefix(name)) && len(name) > len(res) {
+			res = name
+		}
+	}
+	return res
+}
+
+// envValue exporter param from env, encoded as a plain yaml scalar, so Params.Decode types it by the target field:
+// 0123 stays a string for a string field and is a number for an int field
+type envValue string
+
+func (v envValue) MarshalYAML() (interface{}, error) {
+	node := &yaml.Node{Kind: yaml.ScalarNode, Value: string(v)}
+	if node.ShortTag() == "!!null" {
+		// empty or null string is still a string
+		node.Tag = "!!str"
+	}
+	return node, nil
+}
+
+func exporterFromEnv(name string, names []string) (Exporter, error) {
+	prefix := exporterEnvPrefix(name)
+	res := Exporter{Name: name, Type: name, Params: Params{}}
+	for _, kv := range os.Environ() {
+		key, val, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, prefix) || envExporter(key, names) != name {
+			continue
+		}
+		param := strings.ToLower(strings.TrimPrefix(key, prefix))
+		switch param {
+		case "type":
+			res.Type = val
+		case "level":
+			res.Level = val
+		case "batch":
+			batch, err := strconv.ParseBool(val)
+			if err != nil {
+				return res, errors.Wrap(err, key)
+			}
+			res.Batch = batch
+		default:
+			res.Params[param] = envValue(val)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/KasperskyLab/klogga"
+	"math"
+)
+
+// filterExporter drops spans below the configured levels and spans of not sampled traces
+// spans with errors or warnings always pass
+type filterExporter struct {
+	next       klogga.Exporter
+	level      klogga.LogLevel
+	components map[klogga.ComponentName]klogga.LogLevel
+	ratio      float64
+}
+
+// wrap filters the exporter with the same settings
+func (f *filterExporter) wrap(next klogga.Exporter) klogga.Exporter {
+	res := *f
+	res.next = next
+	return &res
+}
+
+func (f *filterExporter) passAll() bool {
+	return f.level <= klogga.Debug && len(f.components) == 0 && (f.ratio == 0 || f.ratio >= 1)
+}
+
+func (f *filterExporter) Write(ctx context.Context, spans []*klogga.Span) error {
+	filtered := make([]*klogga.Span, 0, len(spans))
+	for _, span := range spans {
+		if f.pass(span) {
+			filtered = append(filtered, span)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+	return f.next.Write(ctx, filtered)
+}
+
+func (f *filterExporter) pass(span *klogga.Span) bool {
+	if span.EWState() != "" {
+		return true
+	}
+	level, ok := f.components[span.Component()]
+	if !ok {
+		level = f.level
+	}
+	if span.LevelGet() < level {
+		return false
+	}
+	return f.ratio == 0 || f.ratio >= 1 || sampled(span.TraceID(), f.ratio)
+}
+
+func (f *filterExporter) Flush(ctx context.Context) error {
+	if flusher, ok := f.next.(klogga.Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+func (f *filterExporter) Shutdown(ctx context.Context) error {
+	return f.next.Shutdown(ctx)
+}
+
+// SetErrorHandler the factory gets the background errors of the filtered exporter, e.g. of the batcher
+func (f *filterExporter) SetErrorHandler(handler func(spans int, err error)) {
+	if async, ok := f.next.(klogga.AsyncExporter); ok {
+		async.SetErrorHandler(handler)
+	}
+}
+
+// String the filtered exporter name, so its errors are reported under it
+func (f *filterExporter) String() string {
+	if s, ok := f.next.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", f.next)
+}
+
+// sampled uses the trace id, so all spans of the trace get the same decision
+// leading bytes are used, their high bits are random in uuid v4
+func sampled(traceID klogga.TraceID, ratio float64) bool {
+	return float64(binary.BigEndian.Uint64(traceID[:8])) < ratio*math.MaxUint64
+}
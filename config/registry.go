@@ -0,0 +1,284 @@
+package config
+
+import (
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/exporters/golog"
+	"github.com/KasperskyLab/klogga/exporters/influxdb18"
+	"github.com/KasperskyLab/klogga/exporters/postgres"
+	"github.com/KasperskyLab/klogga/exporters/postgres/pgconnector"
+	"github.com/KasperskyLab/klogga/exporters/spanmetrics"
+	influxClient "github.com/influxdata/influxdb1-client"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// ExporterBuilder creates exporter from the params of the config
+type ExporterBuilder func(params Params) (klogga.Exporter, error)
+
+// Params exporter parameters as they are in the config
+type Params map[string]interface{}
+
+// Decode decodes params into a struct with yaml tags
+func (p Params) Decode(target interface{}) error {
+	data, err := yaml.Marshal(map[string]interface{}(p))
+	if err != nil {
+		return errors.Wrap(err, "failed to encode params")
+	}
+	if err := yaml.Unmarshal(data, target); err != nil {
+		return errors.Wrap(err, "failed to decode params")
+	}
+	return nil
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]ExporterBuilder{}
+)
+
+// Register makes the exporter type available for the config
+// panics if the type is already registered, same as sql.Register
+func Register(exporterType string, builder ExporterBuilder) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if builder == nil {
+		panic("klogga config: nil builder for " + exporterType)
+	}
+	if _, ok := registry[exporterType]; ok {
+		panic("klogga config: exporter type already registered " + exporterType)
+	}
+	registry[exporterType] = builder
+}
+
+// Types registered exporter types
+func Types() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	res := make([]string, 0, len(registry))
+	for exporterType := range registry {
+		res = append(res, exporterType)
+	}
+	return res
+}
+
+func lookup(exporterType string) (ExporterBuilder, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	builder, ok := registry[exporterType]
+	return builder, ok
+}
+
+// PostgresDriver creates the postgres connector of the driver param,
+// connection params are those of the postgres exporter config
+type PostgresDriver func(p PostgresConnParams) postgres.Connector
+
+// PostgresConnParams connection part of the postgres exporter params
+type PostgresConnParams struct {
+	ConnectionString   string
+	MaxOpenConnections int
+	MaxIdleConnections int
+}
+
+var pgDrivers = map[string]PostgresDriver{}
+
+// RegisterPostgresDriver makes the postgres driver available for the driver param of the postgres exporter,
+// e.g. pgx from the separate pgxconnector module, pq is always available
+// panics if the driver is already registered
+func RegisterPostgresDriver(driver string, builder PostgresDriver) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if builder == nil {
+		panic("klogga config: nil postgres driver " + driver)
+	}
+	if _, ok := pgDrivers[driver]; ok {
+		panic("klogga config: postgres driver already registered " + driver)
+	}
+	pgDrivers[driver] = builder
+}
+
+func lookupPostgresDriver(driver string) (PostgresDriver, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	builder, ok := pgDrivers[driver]
+	return builder, ok
+}
+
+func init() {
+	RegisterPostgresDriver("pq", func(p PostgresConnParams) postgres.Connector {
+		return &pgconnector.PgConnector{
+			ConnectionString:   p.ConnectionString,
+			MaxOpenConnections: p.MaxOpenConnections,
+			MaxIdleConnections: p.MaxIdleConnections,
+		}
+	})
+	Register("golog", buildGolog)
+	Register("postgres", buildPostgres)
+	Register("influxdb18", buildInfluxdb18)
+	Register("spanmetrics", buildSpanMetrics)
+}
+
+type gologParams struct {
+	// Output stderr or stdout
+	Output string `yaml:"output"`
+}
+
+func buildGolog(params Params) (klogga.Exporter, error) {
+	p := gologParams{}
+	if err := params.Decode(&p); err != nil {
+		return nil, err
+	}
+	switch p.Output {
+	case "", "stderr":
+		return golog.New(nil), nil
+	case "stdout":
+		return golog.New(log.New(os.Stdout, "", 0)), nil
+	default:
+		return nil, errors.Errorf("unknown golog output: %s", p.Output)
+	}
+}
+
+type postgresParams struct {
+	ConnectionString   string        `yaml:"connection_string"`
+	MaxOpenConnections int           `yaml:"max_open_connections"`
+	MaxIdleConnections int           `yaml:"max_idle_connections"`
+	Schema             string        `yaml:"schema"`
+	WriteTimeout       time.Duration `yaml:"write_timeout"`
+	SkipSchemaCreation bool          `yaml:"skip_schema_creation"`
+	UseTimescale       bool          `yaml:"use_timescale"`
+	// Driver pq (default) or the one added with RegisterPostgresDriver
+	Driver string `yaml:"driver"`
+	// CommonTypes writes uuids, ips and durations to native PG types, see postgres.CommonTypes
+	CommonTypes bool `yaml:"common_types"`
+	// ConflictStrategy reject, suffix, coerce or widen, see postgres.ConflictStrategy
+	ConflictStrategy string `yaml:"conflict_strategy"`
+	// PartitionInterval partitions the created tables by time, daily if 24h, see postgres.PartitionConf
+	PartitionInterval time.Duration `yaml:"partition_interval"`
+	PartitionPremake  int           `yaml:"partition_premake"`
+	// Retention of all the tables, TableRetention overrides it per table, see postgres.RetentionConf
+	Retention           time.Duration            `yaml:"retention"`
+	TableRetention      map[string]time.Duration `yaml:"table_retention"`
+	CompressAfter       time.Duration            `yaml:"compress_after"`
+	MaintenanceInterval time.Duration            `yaml:"maintenance_interval"`
+	// Indexes creates indexes of the tag columns, IndexAllow and IndexDeny imply it, see postgres.IndexConf
+	Indexes            bool     `yaml:"indexes"`
+	IndexAllow         []string `yaml:"index_allow"`
+	IndexDeny          []string `yaml:"index_deny"`
+	MaxIndexesPerTable int      `yaml:"max_indexes_per_table"`
+}
+
+func buildPostgres(params Params) (klogga.Exporter, error) {
+	p := postgresParams{}
+	if err := params.Decode(&p); err != nil {
+		return nil, err
+	}
+	if p.ConnectionString == "" {
+		return nil, errors.New("connection_string is required")
+	}
+	conf := &postgres.Conf{
+		SchemaName:         p.Schema,
+		WriteTimeout:       p.WriteTimeout,
+		SkipSchemaCreation: p.SkipSchemaCreation,
+		UseTimescale:       p.UseTimescale,
+
+		CompressAfter:       p.CompressAfter,
+		MaintenanceInterval: p.MaintenanceInterval,
+	}
+	if p.PartitionInterval > 0 {
+		conf.Partitioning = &postgres.PartitionConf{Interval: p.PartitionInterval, Premake: p.PartitionPremake}
+	}
+	if p.Indexes || len(p.IndexAllow) > 0 || len(p.IndexDeny) > 0 || p.MaxIndexesPerTable > 0 {
+		conf.Indexes = &postgres.IndexConf{Allow: p.IndexAllow, Deny: p.IndexDeny, MaxPerTable: p.MaxIndexesPerTable}
+	}
+	if p.Retention > 0 || len(p.TableRetention) > 0 {
+		conf.Retention = &postgres.RetentionConf{Default: p.Retention, Tables: p.TableRetention}
+	}
+	if p.CommonTypes {
+		conf.Types = postgres.CommonTypes()
+	}
+	if p.ConflictStrategy != "" {
+		cs, err := postgres.ParseConflictStrategy(p.ConflictStrategy)
+		if err != nil {
+			return nil, err
+		}
+		conf.ConflictStrategy = cs
+	}
+	if p.Driver == "" {
+		p.Driver = "pq"
+	}
+	driver, ok := lookupPostgresDriver(p.Driver)
+	if !ok {
+		return nil, errors.Errorf("unknown postgres driver: %s", p.Driver)
+	}
+	connector := driver(
+		PostgresConnParams{
+			ConnectionString:   p.ConnectionString,
+			MaxOpenConnections: p.MaxOpenConnections,
+			MaxIdleConnections: p.MaxIdleConnections,
+		},
+	)
+	return postgres.New(conf, connector, klogga.NewFactory(golog.New(nil)).Named("pg_exporter")), nil
+}
+
+type influxdb18Params struct {
+	URL                string        `yaml:"url"`
+	Username           string        `yaml:"username"`
+	Password           string        `yaml:"password"`
+	Timeout            time.Duration `yaml:"timeout"`
+	Database           string        `yaml:"database"`
+	Precision          string        `yaml:"precision"`
+	Prefix             string        `yaml:"prefix"`
+	DefaultMeasurement string        `yaml:"default_measurement"`
+}
+
+func buildInfluxdb18(params Params) (klogga.Exporter, error) {
+	p := influxdb18Params{}
+	if err := params.Decode(&p); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil || p.URL == "" {
+		return nil, errors.Errorf("invalid url: %q", p.URL)
+	}
+	client, err := influxClient.NewClient(
+		influxClient.Config{URL: *u, Username: p.Username, Password: p.Password, Timeout: p.Timeout},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create influx client")
+	}
+	return influxdb18.New(
+		&influxdb18.Conf{
+			DefaultMeasurement: p.DefaultMeasurement,
+			Prefix:             p.Prefix,
+			Database:           p.Database,
+			Precision:          p.Precision,
+		},
+		client,
+		klogga.NewFactory(golog.New(nil)).Named("influx_exporter"),
+	), nil
+}
+
+type spanMetricsParams struct {
+	Namespace string    `yaml:"namespace"`
+	LabelTags []string  `yaml:"label_tags"`
+	Buckets   []float64 `yaml:"buckets"`
+	MaxSeries int       `yaml:"max_series"`
+}
+
+// buildSpanMetrics the exporter is registered in Config.Registerer by Build
+func buildSpanMetrics(params Params) (klogga.Exporter, error) {
+	p := spanMetricsParams{}
+	if err := params.Decode(&p); err != nil {
+		return nil, err
+	}
+	exporter, err := spanmetrics.New(
+		&spanmetrics.Conf{Namespace: p.Namespace, LabelTags: p.LabelTags, Buckets: p.Buckets, MaxSeries: p.MaxSeries},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return exporter, nil
+}
@@ -14,8 +14,11 @@ func main() {
 
 func CreateApp() fx.Option {
 	return fx.Options(
-		fx.Provide(NewRunner,
-			fx.Annotate(func(r *Runner) fxAdapter.Runner { return r }, fxAdapter.TagRunner...)),
+		// klogga.Tracer injected into the module constructors is named after the module
+		fxAdapter.NamedModule("runner_a",
+			fx.Provide(NewRunner,
+				fx.Annotate(func(r *Runner) fxAdapter.Runner { return r }, fxAdapter.TagRunner...)),
+		),
 		fxAdapter.Full(),
 		fx.Invoke(fxAdapter.RegisterRunners), // register runnerA
 	)
@@ -26,9 +29,9 @@ type Runner struct {
 	stop chan struct{}
 }
 
-func NewRunner(trsFactory klogga.TracerProvider) *Runner {
+func NewRunner(trs klogga.Tracer) *Runner {
 	return &Runner{
-		trs: trsFactory.Named("runner_a"),
+		trs: trs,
 	}
 }
 
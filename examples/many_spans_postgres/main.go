@@ -7,6 +7,7 @@ import (
 	"github.com/KasperskyLab/klogga/exporters/golog"
 	"github.com/KasperskyLab/klogga/exporters/postgres"
 	"github.com/KasperskyLab/klogga/exporters/postgres/pgconnector"
+	"github.com/KasperskyLab/klogga/exporters/postgres/pgxconnector"
 	"go.uber.org/fx"
 	"net/http"
 	"os"
@@ -27,13 +28,13 @@ func createApp() fx.Option {
 				// so klogga doesn't have to have its own init() method
 				klogga.InitHostname()
 
-				conn := pgconnector.PgConnector{ConnectionString: os.Getenv("KLOGGA_PG_CONNECTION_STRING")}
+				conn := newConnector(os.Getenv("KLOGGA_PG_CONNECTION_STRING"))
 
 				err := conn.CreateSchemaIfNotExists(context.Background(), postgres.DefaultSchema)
 				if err != nil {
 					return nil, err
 				}
-				pgBatcher := batcher.New(postgres.New(&postgres.Conf{}, &conn, nil), batcher.ConfigDefault())
+				pgBatcher := batcher.New(postgres.New(&postgres.Conf{}, conn, nil), batcher.ConfigDefault())
 				return klogga.NewFactory(pgBatcher, golog.New(nil)), nil
 			},
 			NewRunner,
@@ -62,6 +63,19 @@ func createApp() fx.Option {
 	)
 }
 
+type connector interface {
+	postgres.Connector
+	CreateSchemaIfNotExists(ctx context.Context, schema string) error
+}
+
+// newConnector KLOGGA_PG_CONNECTOR=pgx switches to the binary COPY, to compare throughput with lib/pq
+func newConnector(connectionString string) connector {
+	if os.Getenv("KLOGGA_PG_CONNECTOR") == "pgx" {
+		return &pgxconnector.PgxConnector{ConnectionString: connectionString}
+	}
+	return &pgconnector.PgConnector{ConnectionString: connectionString}
+}
+
 type Runner struct {
 	trs  klogga.Tracer
 	stop chan struct{}
@@ -7,6 +7,8 @@ import (
 	"github.com/KasperskyLab/klogga/batcher"
 	"github.com/KasperskyLab/klogga/exporters/postgres"
 	"github.com/KasperskyLab/klogga/exporters/postgres/pgconnector"
+	"github.com/KasperskyLab/klogga/metrics"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/fx"
 	"net/http"
@@ -35,10 +37,15 @@ func createApp() fx.Option {
 				if err != nil {
 					return nil, err
 				}
+				m := metrics.New()
+				prometheus.MustRegister(m)
 				pgBatcher := batcher.New(
-					postgres.New(&postgres.Conf{UseTimescale: true}, &conn, nil),
+					m.Exporter("postgres", postgres.New(&postgres.Conf{UseTimescale: true}, &conn, nil)),
 					batcher.Config{BatchSize: 1000, Timeout: 500 * time.Millisecond},
 				)
+				if err := m.AddBatcher("postgres", pgBatcher); err != nil {
+					return nil, err
+				}
 				return klogga.NewFactory(pgBatcher), nil
 			},
 			NewRunner,
@@ -8,6 +8,7 @@ import (
 // Exporter generic tracer interface, should not be used outside implementations
 // to be more generic accepts batches right away
 type Exporter interface {
+	// Write spans are shared with the other exporters written at the same time and must not be changed
 	Write(ctx context.Context, spans []*Span) error
 
 	// Shutdown is called to cleanup the exporter. Exporter cannot be used after that.
@@ -0,0 +1,275 @@
+package postgres
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultWidenMaxTableSize of Conf.WidenMaxTableSize
+const defaultWidenMaxTableSize = 64 << 20
+
+// ConflictStrategy what happens to a span when its tag or val type doesn't match the existing column
+type ConflictStrategy int
+
+const (
+	// ConflictReject writes the span to error_postgres only
+	ConflictReject ConflictStrategy = iota
+	// ConflictSuffix writes the value to a sibling column named by the type, e.g. status_text
+	ConflictSuffix
+	// ConflictCoerce converts the value to the column type if it can be done without loss, rejects the span otherwise
+	ConflictCoerce
+	// ConflictWiden changes bigint, float8 and boolean columns to text, float8 columns take exact integers as they are,
+	// the conversions that lose precision or the type (bigint -> float8, jsonb, timestamp or uuid -> text)
+	// are not done and the value goes to the suffix column as with ConflictSuffix, bytea is never widened
+	// ALTER COLUMN TYPE holds ACCESS EXCLUSIVE lock of the table while it rewrites the table and its indexes,
+	// so the tables larger than Conf.WidenMaxTableSize and compressed hypertables are not widened either
+	ConflictWiden
+)
+
+func (s ConflictStrategy) String() string {
+	switch s {
+	case ConflictReject:
+		return "reject"
+	case ConflictSuffix:
+		return "suffix"
+	case ConflictCoerce:
+		return "coerce"
+	case ConflictWiden:
+		return "widen"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseConflictStrategy parses strategy name as returned by ConflictStrategy.String
+func ParseConflictStrategy(s string) (ConflictStrategy, error) {
+	for _, cs := range []ConflictStrategy{ConflictReject, ConflictSuffix, ConflictCoerce, ConflictWiden} {
+		if strings.EqualFold(s, cs.String()) {
+			return cs, nil
+		}
+	}
+	return ConflictReject, errors.Errorf("unknown conflict strategy: %q", s)
+}
+
+// pgTypeAliases names reported by information_schema for the types klogga creates
+var pgTypeAliases = map[string]string{
+	"double precision": "float8",
+	"int8":             "bigint",
+	"bool":             "boolean",
+	"timestamp":        "timestamp without time zone",
+}
+
+func normPgType(pgType string) string {
+	pgType = strings.ToLower(pgType)
+	if alias, ok := pgTypeAliases[pgType]; ok {
+		return alias
+	}
+	return pgType
+}
+
+func samePgType(a, b string) bool {
+	return normPgType(a) == normPgType(b)
+}
+
+// typeSuffix column name suffix for the ConflictSuffix sibling column
+func typeSuffix(pgType string) string {
+	switch pgType = normPgType(pgType); pgType {
+	case "boolean":
+		return "bool"
+	case "timestamp without time zone":
+		return "timestamp"
+	default:
+		return strings.Map(
+			func(r rune) rune {
+				if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+					return r
+				}
+				return '_'
+			}, pgType,
+		)
+	}
+}
+
+// textWidened column types that are changed to text by ConflictWiden, their values are kept as they are
+var textWidened = map[string]bool{"bigint": true, "float8": true, "boolean": true}
+
+// widerType the type of the known column that the values of the type can be stored in for ConflictWiden,
+// empty if the column can't be changed without loss
+func widerType(known, valType string) string {
+	known, valType = normPgType(known), normPgType(valType)
+	switch {
+	case known == valType:
+		return known
+	case known == "bytea" || valType == "bytea":
+		return ""
+	case known == "float8" && valType == "bigint":
+		return known
+	case known == PgTextTypeName || textWidened[known]:
+		return PgTextTypeName
+	default:
+		return ""
+	}
+}
+
+// maxExactFloat integers up to this are exactly represented by float8
+const maxExactFloat = 1 << 53
+
+// coerce converts the value of pgType, as returned by GetPgTypeVal, to the target type
+// returns false if the value can't be converted without loss
+func coerce(pgType string, val interface{}, target string) (interface{}, bool) {
+	pgType, target = normPgType(pgType), normPgType(target)
+	if pgType == target || val == nil {
+		return val, true
+	}
+	rv := reflect.ValueOf(val)
+	switch target {
+	case PgTextTypeName:
+		switch v := val.(type) {
+		case string:
+			return v, true
+		case []byte:
+			// json is text, arbitrary bytes are not
+			return string(v), pgType == PgJsonbTypeName
+		case time.Time:
+			return v.Format(time.RFC3339Nano), true
+		}
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return strconv.FormatInt(rv.Int(), 10), true
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return strconv.FormatUint(rv.Uint(), 10), true
+		case reflect.Float32, reflect.Float64:
+			return strconv.FormatFloat(rv.Float(), 'g', -1, 64), true
+		case reflect.Bool:
+			return strconv.FormatBool(rv.Bool()), true
+		}
+		return fmt.Sprintf("%v", val), true
+	case "float8":
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			i := rv.Int()
+			return float64(i), i >= -maxExactFloat && i <= maxExactFloat
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			u := rv.Uint()
+			return float64(u), u <= maxExactFloat
+		case reflect.String:
+			f, err := strconv.ParseFloat(rv.String(), 64)
+			return f, err == nil && strconv.FormatFloat(f, 'g', -1, 64) == rv.String()
+		}
+	case "bigint":
+		switch rv.Kind() {
+		case reflect.Float32, reflect.Float64:
+			f := rv.Float()
+			return int64(f), f == math.Trunc(f) && math.Abs(f) <= maxExactFloat
+		case reflect.String:
+			i, err := strconv.ParseInt(rv.String(), 10, 64)
+			return i, err == nil && strconv.FormatInt(i, 10) == rv.String()
+		}
+	case "boolean":
+		if rv.Kind() == reflect.String {
+			b, err := strconv.ParseBool(rv.String())
+			return b, err == nil && strconv.FormatBool(b) == rv.String()
+		}
+	}
+	return nil, false
+}
+
+// resolution of the span column, applied to the record set only if the whole span can be written
+type resolution struct {
+	col ColumnSchema
+	val interface{}
+	// converts values of the record set rows when the column is widened
+	widen func()
+	// the value is a span tag
+	tag bool
+}
+
+// resolveConflict finds where the value goes according to Conf.ConflictStrategy
+// known is the column the record set or the table already has, col is the column of the value
+func (e *Exporter) resolveConflict(
+	tableName string, dataset *RecordSet, table *TableSchema, known *ColumnSchema, col ColumnSchema, val interface{},
+) (resolution, bool) {
+	switch e.cfg.ConflictStrategy {
+	case ConflictSuffix:
+		return suffixResolution(dataset, table, col, val)
+	case ConflictCoerce:
+		v, ok := coerce(col.DataType, val, known.DataType)
+		return resolution{col: ColumnSchema{Name: col.Name, DataType: known.DataType}, val: v}, ok
+	case ConflictWiden:
+		if res, ok := e.widenResolution(tableName, dataset, table, known, col, val); ok {
+			return res, true
+		}
+		return suffixResolution(dataset, table, col, val)
+	default:
+		return resolution{}, false
+	}
+}
+
+// suffixResolution the value goes to the sibling column named by its type
+func suffixResolution(dataset *RecordSet, table *TableSchema, col ColumnSchema, val interface{}) (resolution, bool) {
+	sibling := ColumnSchema{Name: identifierWithSuffix(col.Name, "_"+typeSuffix(col.DataType)), DataType: col.DataType}
+	if existing, ok := knownColumn(dataset, table, sibling.Name); ok {
+		if !samePgType(existing.DataType, col.DataType) {
+			return resolution{}, false
+		}
+		sibling.DataType = existing.DataType
+	}
+	return resolution{col: sibling, val: val}, true
+}
+
+// widenResolution the value stays in the known column, the column is widened if it's needed and can be done
+func (e *Exporter) widenResolution(
+	tableName string, dataset *RecordSet, table *TableSchema, known *ColumnSchema, col ColumnSchema, val interface{},
+) (resolution, bool) {
+	wider := widerType(known.DataType, col.DataType)
+	if wider == "" {
+		return resolution{}, false
+	}
+	v, ok := coerce(col.DataType, val, wider)
+	if !ok {
+		return resolution{}, false
+	}
+	res := resolution{col: ColumnSchema{Name: col.Name, DataType: known.DataType}, val: v}
+	if samePgType(wider, known.DataType) {
+		return res, true
+	}
+	if table != nil {
+		if _, inTable := table.Column(col.Name); inTable {
+			if _, ok := e.notWidened[tableName]; ok {
+				return resolution{}, false
+			}
+		}
+	}
+	// values of the previous spans of the record set are converted too
+	converted := make(map[int]interface{})
+	for i, row := range dataset.rows {
+		if rowVal, ok := row[col.Name]; ok {
+			if converted[i], ok = coerce(known.DataType, rowVal, wider); !ok {
+				return resolution{}, false
+			}
+		}
+	}
+	res.col.DataType = wider
+	res.widen = func() {
+		for i, v := range converted {
+			dataset.rows[i][col.Name] = v
+		}
+	}
+	return res, true
+}
+
+// knownColumn column of the record set, or of the table if the record set doesn't have it yet
+func knownColumn(dataset *RecordSet, table *TableSchema, name string) (*ColumnSchema, bool) {
+	if col, ok := dataset.Schema.Column(name); ok {
+		return col, true
+	}
+	if table != nil {
+		return table.Column(name)
+	}
+	return nil, false
+}
@@ -0,0 +1,170 @@
+package postgres
+
+import (
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func statusSpan(component klogga.ComponentName, status interface{}) *klogga.Span {
+	span := klogga.StartLeaf(testutil.Timeout()).Tag("status", status)
+	span.SetComponent(component)
+	return span
+}
+
+func TestConflictRejectKeepsOtherSpans(t *testing.T) {
+	spans := []*klogga.Span{
+		statusSpan("pg_test", "ok"),
+		statusSpan("pg_test", 1),
+		statusSpan("pg_test", "failed"),
+		statusSpan("pg_other", 2),
+	}
+	pg := New(&Conf{}, nil, klogga.NilExporterTracer{})
+	datasets, errSpans := pg.createRecordSets(spans...)
+	require.Len(t, errSpans, 1)
+	require.Equal(t, spans[1], errSpans[0].Span)
+	require.Equal(t, []*klogga.Span{spans[0], spans[2]}, datasets["pg_test"].Spans)
+	require.Equal(t, []*klogga.Span{spans[3]}, datasets["pg_other"].Spans)
+}
+
+func TestConflictSuffix(t *testing.T) {
+	pg := New(&Conf{ConflictStrategy: ConflictSuffix}, nil, klogga.NilExporterTracer{})
+	datasets, errSpans := pg.createRecordSets(statusSpan("pg_test", "ok"), statusSpan("pg_test", 1))
+	require.Empty(t, errSpans)
+	dataset := datasets["pg_test"]
+	col, ok := dataset.Schema.Column("status_bigint")
+	require.True(t, ok)
+	require.Equal(t, "bigint", col.DataType)
+	require.Equal(t, "ok", dataset.rows[0]["status"])
+	require.Equal(t, 1, dataset.rows[1]["status_bigint"])
+	require.NotContains(t, dataset.rows[1], "status")
+}
+
+func TestConflictCoerce(t *testing.T) {
+	pg := New(&Conf{ConflictStrategy: ConflictCoerce}, nil, klogga.NilExporterTracer{})
+	pg.tables["pg_test"] = NewTableSchema([]*ColumnSchema{{Name: "status", DataType: "bigint"}})
+	datasets, errSpans := pg.createRecordSets(
+		statusSpan("pg_test", "42"), statusSpan("pg_test", 2.0), statusSpan("pg_test", "x"), statusSpan("pg_test", 1.5),
+	)
+	require.Len(t, errSpans, 2)
+	dataset := datasets["pg_test"]
+	require.Len(t, dataset.Spans, 2)
+	require.Equal(t, int64(42), dataset.rows[0]["status"])
+	require.Equal(t, int64(2), dataset.rows[1]["status"])
+	col, _ := dataset.Schema.Column("status")
+	require.Equal(t, "bigint", col.DataType)
+}
+
+func TestConflictWidenInBatch(t *testing.T) {
+	pg := New(&Conf{ConflictStrategy: ConflictWiden}, nil, klogga.NilExporterTracer{})
+	datasets, errSpans := pg.createRecordSets(
+		statusSpan("pg_test", 5), statusSpan("pg_test", 1.5), statusSpan("pg_test", 7), statusSpan("pg_test", "x"),
+	)
+	require.Empty(t, errSpans)
+	dataset := datasets["pg_test"]
+	col, _ := dataset.Schema.Column("status")
+	require.Equal(t, PgTextTypeName, col.DataType)
+	var statuses []interface{}
+	for _, row := range dataset.rows {
+		statuses = append(statuses, row["status"])
+	}
+	require.Equal(t, []interface{}{"5", "1.5", "7", "x"}, statuses)
+
+	datasets, errSpans = pg.createRecordSets(statusSpan("pg_test", []byte{1}), statusSpan("pg_test", 1))
+	require.Empty(t, errSpans)
+	require.Equal(t, 1, datasets["pg_test"].rows[1]["status_bigint"], "bytea is not widened")
+
+	now := time.Now().UTC()
+	datasets, errSpans = pg.createRecordSets(statusSpan("pg_test", now), statusSpan("pg_test", "x"))
+	require.Empty(t, errSpans)
+	dataset = datasets["pg_test"]
+	require.Equal(t, now, dataset.rows[0]["status"], "timestamp is not widened to text")
+	require.Equal(t, "x", dataset.rows[1]["status_text"])
+}
+
+func TestConflictWidenTable(t *testing.T) {
+	pg := New(&Conf{ConflictStrategy: ConflictWiden}, nil, klogga.NilExporterTracer{})
+	pg.tables["pg_test"] = pg.sysCols.Merge([]*ColumnSchema{{Name: "status", DataType: "double precision"}})
+	datasets, errSpans := pg.createRecordSets(statusSpan("pg_test", 1), statusSpan("pg_test", "x"))
+	require.Empty(t, errSpans)
+	dataset := datasets["pg_test"]
+	require.Equal(t, "1", dataset.rows[0]["status"])
+
+	alter, widen, failures := pg.tables["pg_test"].GetAlterSchema(dataset)
+	require.Empty(t, failures)
+	require.True(t, alter.IsZero())
+	require.Equal(t, []string{"status"}, widen.ColumnNames())
+	require.Equal(
+		t, "ALTER TABLE \"audit\".\"pg_test\"\n  ALTER COLUMN \"status\" TYPE text USING \"status\"::text;\n",
+		widen.AlterColumnTypeStatement(DefaultSchema, "pg_test"),
+	)
+	col, _ := pg.tables["pg_test"].Column("status")
+	require.Equal(t, "double precision", col.DataType, "table schema is not changed until the table is altered")
+
+	datasets, errSpans = pg.createRecordSets(statusSpan("pg_test", 1<<53+1))
+	require.Empty(t, errSpans)
+	require.Equal(t, 1<<53+1, datasets["pg_test"].rows[0]["status_bigint"], "float8 doesn't take the integer exactly")
+}
+
+func TestConflictWidenNotWidenedTable(t *testing.T) {
+	pg := New(&Conf{ConflictStrategy: ConflictWiden}, nil, klogga.NilExporterTracer{})
+	pg.tables["pg_test"] = pg.sysCols.Merge([]*ColumnSchema{{Name: "status", DataType: "bigint"}})
+	datasets, errSpans := pg.createRecordSets(statusSpan("pg_test", 1), statusSpan("pg_test", "x"), statusSpan("pg_test", 2))
+	require.Empty(t, errSpans)
+	col, _ := datasets["pg_test"].Schema.Column("status")
+	require.Equal(t, PgTextTypeName, col.DataType)
+
+	// the table is found too large when the schema is updated
+	pg.notWidened["pg_test"] = struct{}{}
+	dataset, errSpans := pg.recreateRecordSet("pg_test", datasets["pg_test"])
+	require.Empty(t, errSpans)
+	require.Equal(t, 1, dataset.rows[0]["status"])
+	require.Equal(t, "x", dataset.rows[1]["status_text"])
+	require.Equal(t, 2, dataset.rows[2]["status"])
+	alter, widen, failures := pg.tables["pg_test"].GetAlterSchema(dataset)
+	require.Empty(t, failures)
+	require.True(t, widen.IsZero())
+	require.Equal(t, []string{"status_text"}, alter.ColumnNames())
+}
+
+func TestCoerce(t *testing.T) {
+	for _, tc := range []struct {
+		from   string
+		val    interface{}
+		target string
+		res    interface{}
+		ok     bool
+	}{
+		{"bigint", int64(5), "float8", float64(5), true},
+		{"bigint", int64(1<<53 + 1), "float8", nil, false},
+		{"float8", 5.0, "bigint", int64(5), true},
+		{"float8", 5.5, "bigint", nil, false},
+		{"text", "007", "bigint", nil, false},
+		{"text", "0.25", "float8", 0.25, true},
+		{"text", "true", "boolean", true, true},
+		{"boolean", true, "text", "true", true},
+		{"jsonb", []byte(`{"a":1}`), "text", `{"a":1}`, true},
+		{"bytea", []byte{0xff}, "text", nil, false},
+		{"bigint", int64(1), "double precision", float64(1), true},
+	} {
+		res, ok := coerce(tc.from, tc.val, tc.target)
+		require.Equal(t, tc.ok, ok, "%v %v -> %v", tc.from, tc.val, tc.target)
+		if ok {
+			require.Equal(t, tc.res, res)
+		}
+	}
+}
+
+func TestParseConflictStrategy(t *testing.T) {
+	cs, err := ParseConflictStrategy("Widen")
+	require.NoError(t, err)
+	require.Equal(t, ConflictWiden, cs)
+	_, err = ParseConflictStrategy("drop")
+	require.Error(t, err)
+	require.Equal(t, "float8", widerType("double precision", "bigint"))
+	require.Equal(t, PgTextTypeName, widerType("bigint", "double precision"))
+	require.Empty(t, widerType("jsonb", "text"))
+	require.Equal(t, "timestamp", typeSuffix("timestamp without time zone"))
+}
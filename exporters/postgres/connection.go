@@ -13,6 +13,20 @@ type Connection interface {
 	Close() error
 }
 
+// CopyFromConnection connection that writes rows with its own COPY implementation, e.g. binary COPY of pgx,
+// the exporter uses it instead of the lib/pq text COPY in a transaction
+type CopyFromConnection interface {
+	Connection
+	// CopyFrom writes all the rows or none of them, values are go values as they are passed to the lib/pq COPY
+	CopyFrom(ctx context.Context, schema, tableName string, columns []string, rows [][]interface{}) (int64, error)
+}
+
+// TableCacheConnection connection that caches the structure of the tables, e.g. the column types for CopyFrom,
+// the exporter invalidates the table after it creates or alters the table
+type TableCacheConnection interface {
+	InvalidateTable(schema, tableName string)
+}
+
 // Connector provides PG connections in an abstract way
 type Connector interface {
 	GetConnection(ctx context.Context) (Connection, error)
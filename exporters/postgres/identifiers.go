@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	"hash/fnv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxIdentifierLen PG silently truncates identifiers longer than this many bytes
+const MaxIdentifierLen = 63
+
+// identifierHashLen length of the hash suffix of the shortened identifiers, with the underscore
+const identifierHashLen = 9
+
+// NormalizeIdentifier converts tag or component name to a PG identifier
+// the name is lowercased, everything but letters, digits, underscores and dollar signs is replaced with underscores,
+// names longer than MaxIdentifierLen are shortened deterministically
+// different names can be normalized to the same identifier, e.g. "a.b" and "a_b"
+// names of letters, digits, underscores, dollar signs and dashes up to MaxIdentifierLen are mapped as before,
+// lowercased with dashes replaced
+func NormalizeIdentifier(name string) string {
+	return normalizeIdentifier(name, false)
+}
+
+// normalizeIdentifier truncate - long names are truncated as PG does, see Conf.TruncateLongNames
+func normalizeIdentifier(name string, truncate bool) string {
+	normalized := strings.Map(
+		func(r rune) rune {
+			lower := unicode.ToLower(r)
+			switch {
+			case r == utf8.RuneError:
+				return '_'
+			case unicode.IsDigit(r) || r == '$':
+				return r
+			case unicode.IsLetter(lower) && !unicode.IsUpper(lower):
+				// some upper case letters don't have lower case
+				return lower
+			default:
+				return '_'
+			}
+		}, name,
+	)
+	if normalized == "" {
+		normalized = "_"
+	}
+	if truncate {
+		return truncateIdentifier(normalized, MaxIdentifierLen)
+	}
+	return shortenIdentifier(normalized, MaxIdentifierLen)
+}
+
+// truncateIdentifier cuts the name to maxLen bytes on the character boundary, as PG does with long identifiers
+func truncateIdentifier(name string, maxLen int) string {
+	if len(name) <= maxLen {
+		return name
+	}
+	cut := maxLen
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut]
+}
+
+// shortenIdentifier cuts the name to maxLen bytes, replacing the end of the name with its hash
+// so different long names don't collide
+func shortenIdentifier(name string, maxLen int) string {
+	if len(name) <= maxLen {
+		return name
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	cut := maxLen - identifierHashLen
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s_%08x", name[:cut], h.Sum32())
+}
+
+// identifierWithSuffix derived identifier, e.g. of a partition or an index, the suffix is kept intact
+func identifierWithSuffix(name, suffix string) string {
+	return shortenIdentifier(name, MaxIdentifierLen-len(suffix)) + suffix
+}
+
+// quoteTable schema qualified quoted table name
+func quoteTable(schema, tableName string) string {
+	return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(tableName)
+}
+
+// quoteRegclass table name as a string literal, e.g. for timescale functions
+func quoteRegclass(schema, tableName string) string {
+	return pq.QuoteLiteral(quoteTable(schema, tableName))
+}
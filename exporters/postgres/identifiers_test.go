@@ -0,0 +1,168 @@
+package postgres
+
+import (
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/exporters/spancollector"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestNormalizeIdentifier(t *testing.T) {
+	for name, expected := range map[string]string{
+		"tag":                     "tag",
+		"Some-Name":               "some_name",
+		"a.b c":                   "a_b_c",
+		`x"; DROP TABLE audit.x;`: "x___drop_table_audit_x_",
+		"имя":                     "имя",
+		"":                        "_",
+		"\xff":                    "_",
+		"Price$":                  "price$",
+	} {
+		require.Equal(t, expected, NormalizeIdentifier(name), name)
+	}
+
+	long := strings.Repeat("a", 100)
+	normalized := NormalizeIdentifier(long)
+	require.Len(t, normalized, MaxIdentifierLen)
+	require.Equal(t, normalized, NormalizeIdentifier(long), "deterministic")
+	require.NotEqual(t, normalized, NormalizeIdentifier(long+"b"))
+	require.True(t, strings.HasPrefix(normalized, strings.Repeat("a", MaxIdentifierLen-identifierHashLen)+"_"))
+
+	cyrillic := NormalizeIdentifier(strings.Repeat("я", 40))
+	require.True(t, utf8.ValidString(cyrillic))
+	require.LessOrEqual(t, len(cyrillic), MaxIdentifierLen)
+
+	require.Equal(t, strings.Repeat("a", MaxIdentifierLen), normalizeIdentifier(long, true), "truncated as PG does")
+	require.Equal(t, strings.Repeat("я", 31), normalizeIdentifier(strings.Repeat("Я", 40), true))
+
+	require.Equal(t, "comp_p20220310", partitionName("comp", day(10), defaultPartitionInterval))
+	partition := partitionName(long, day(10), defaultPartitionInterval)
+	require.Len(t, partition, MaxIdentifierLen)
+	require.True(t, strings.HasSuffix(partition, "_p20220310"))
+}
+
+func TestQuoteTable(t *testing.T) {
+	require.Equal(t, `"audit"."comp"`, quoteTable(DefaultSchema, "comp"))
+	require.Equal(t, `"a""b"."c"`, quoteTable(`a"b`, "c"))
+	require.Equal(t, `'"audit"."it''s"'`, quoteRegclass(DefaultSchema, "it's"))
+}
+
+func TestKeyCollisions(t *testing.T) {
+	span := klogga.StartLeaf(testutil.Timeout()).
+		Tag("a_b", "underscore").Tag("a.b", "dot").Tag("A-B", "dash").Tag("Time", "tag").Tag("ok", 1)
+	span.SetComponent("pg.test")
+	pg := New(&Conf{}, nil, klogga.NilExporterTracer{})
+	datasets, errSpans := pg.createRecordSets(span)
+	require.Empty(t, errSpans)
+	dataset, ok := datasets["pg_test"]
+	require.True(t, ok, "table name is normalized")
+	require.Equal(t, map[string]interface{}{"a_b": "dash", "ok": 1}, dataset.rows[0], "the first key by order wins")
+	require.Equal(t, pg.sysCols.ColumnsCount()+2, dataset.Schema.ColumnsCount())
+}
+
+func TestKeyCollisionsReportedOnce(t *testing.T) {
+	collector := &spancollector.SpanCollector{}
+	tf := klogga.NewFactory(collector)
+	pg := New(&Conf{}, nil, tf.NamedPkg())
+	for i := 0; i < 3; i++ {
+		span := klogga.StartLeaf(testutil.Timeout()).Tag("a_b", "underscore").Tag("a.b", "dot").Tag("A.B", "upper")
+		span.SetComponent("pg_test")
+		_, errSpans := pg.createRecordSets(span)
+		require.Empty(t, errSpans)
+	}
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+	require.Len(t, collector.Spans, 1, "once per table column")
+	require.Equal(t, "a_b", collector.Spans[0].Tags()["column"])
+}
+
+// unquoteTable parses quoteTable result, returns false if it is not exactly two quoted identifiers
+func unquoteTable(s string) ([]string, bool) {
+	var parts []string
+	for len(parts) < 2 {
+		if !strings.HasPrefix(s, `"`) {
+			return nil, false
+		}
+		s = s[1:]
+		b := strings.Builder{}
+		for {
+			i := strings.IndexByte(s, '"')
+			if i < 0 {
+				return nil, false
+			}
+			b.WriteString(s[:i])
+			s = s[i+1:]
+			if !strings.HasPrefix(s, `"`) {
+				break
+			}
+			b.WriteByte('"')
+			s = s[1:]
+		}
+		parts = append(parts, b.String())
+		if len(parts) == 1 {
+			if !strings.HasPrefix(s, ".") {
+				return nil, false
+			}
+			s = s[1:]
+		}
+	}
+	return parts, s == ""
+}
+
+func FuzzNormalizeIdentifier(f *testing.F) {
+	for _, seed := range []string{
+		"tag", `"; DROP TABLE x; --`, "a.b", "with space", "'quote'", strings.Repeat("long", 30),
+		strings.Repeat("я", 40), "\x00", "\xff\xfe", `\"`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(
+		func(t *testing.T, name string) {
+			normalized := NormalizeIdentifier(name)
+			require.NotEmpty(t, normalized)
+			require.LessOrEqual(t, len(normalized), MaxIdentifierLen)
+			require.True(t, utf8.ValidString(normalized))
+			for _, r := range normalized {
+				require.True(
+					t, r == '_' || r == '$' || unicode.IsDigit(r) || unicode.IsLetter(r) && !unicode.IsUpper(r), "%q", r,
+				)
+			}
+			require.Equal(t, normalized, NormalizeIdentifier(normalized), "idempotent")
+
+			parts, ok := unquoteTable(quoteTable(normalized, normalized))
+			require.True(t, ok)
+			require.Equal(t, []string{normalized, normalized}, parts)
+		},
+	)
+}
+
+func FuzzSpanKeys(f *testing.F) {
+	f.Add("comp", "a.b", "a_b")
+	f.Add(`c"; --`, `x" text); DROP TABLE y; --`, "Time")
+	f.Add("", strings.Repeat("k", 70), strings.Repeat("k", 71))
+	f.Fuzz(
+		func(t *testing.T, component, key1, key2 string) {
+			span := klogga.StartLeaf(testutil.Timeout()).Tag(key1, "v1").Val(key2, "v2")
+			span.SetComponent(klogga.ComponentName(component))
+			pg := New(&Conf{}, nil, klogga.NilExporterTracer{})
+			datasets, errSpans := pg.createRecordSets(span)
+			require.Empty(t, errSpans)
+			require.Len(t, datasets, 1)
+			for tableName, dataset := range datasets {
+				require.Equal(t, tableName, NormalizeIdentifier(tableName))
+				seen := map[string]struct{}{}
+				for _, name := range dataset.Schema.ColumnNames() {
+					require.Equal(t, name, NormalizeIdentifier(name))
+					require.NotContains(t, seen, name)
+					seen[name] = struct{}{}
+				}
+				q := dataset.Schema.CreateTableStatement(pg.cfg.SchemaName, tableName, pg.timeCol, false, false)
+				require.Equal(t, dataset.Schema.ColumnsCount()+2, strings.Count(q, "\n"))
+				require.Equal(t, 0, strings.Count(q, `"`)%2)
+			}
+		},
+	)
+}
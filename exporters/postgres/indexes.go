@@ -0,0 +1,327 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/constants"
+	"github.com/KasperskyLab/klogga/constants/vals"
+	"github.com/KasperskyLab/klogga/util/errs"
+	"github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+const defaultMaxIndexesPerTable = 16
+
+// IndexConf indexes of the columns created by the exporter
+// by default tag columns, trace_id and parent get btree, time gets BRIN and jsonb vals get GIN,
+// the rest of the vals are not indexed, time is not indexed with UseTimescale as hypertables have their own index
+type IndexConf struct {
+	// Allow if not empty only these columns are indexed, vals included
+	Allow []string
+	// Deny columns that are never indexed, overrides Allow
+	Deny []string
+	// MaxPerTable cap of the indexes of a table, indexes that are not created by klogga count too, 16 by default
+	MaxPerTable int
+}
+
+func (c IndexConf) maxPerTable() int {
+	if c.MaxPerTable <= 0 {
+		return defaultMaxIndexesPerTable
+	}
+	return c.MaxPerTable
+}
+
+// index of a single column
+type index struct {
+	name   string
+	column string
+	method string
+}
+
+// indexMode how the index is created
+type indexMode int
+
+const (
+	// indexPlain for the tables that are just created and empty
+	indexPlain indexMode = iota
+	// indexConcurrently doesn't block the writers, not supported by the partitioned tables and hypertables
+	indexConcurrently
+	// indexPerChunk timescale builds the index chunk by chunk, locking one chunk at a time
+	indexPerChunk
+	// indexPerPartition the invalid index of the partitioned table only, the partitions are indexed concurrently
+	// and attached to it, the index is valid when all the partitions are attached
+	indexPerPartition
+)
+
+func (i index) CreateStatement(schema, tableName string, mode indexMode) string {
+	concurrently, only := "", ""
+	switch mode {
+	case indexConcurrently:
+		concurrently = "CONCURRENTLY "
+	case indexPerPartition:
+		only = "ONLY "
+	}
+	q := fmt.Sprintf(
+		"CREATE INDEX %sIF NOT EXISTS %s ON %s%s USING %s (%s)",
+		concurrently, pq.QuoteIdentifier(i.name), only, quoteTable(schema, tableName), i.method, pq.QuoteIdentifier(i.column),
+	)
+	if mode == indexPerChunk {
+		q += " WITH (timescaledb.transaction_per_chunk)"
+	}
+	return q + ";\n"
+}
+
+// forPartition index of the same column of the partition
+func (i index) forPartition(partition string) index {
+	return index{name: indexName(partition, i.column), column: i.column, method: i.method}
+}
+
+// AttachStatement attaches the index of the partition to the index of the partitioned table
+func (i index) AttachStatement(schema string, partitionIndex index) string {
+	return fmt.Sprintf(
+		"ALTER INDEX %s ATTACH PARTITION %s;\n", quoteTable(schema, i.name), quoteTable(schema, partitionIndex.name),
+	)
+}
+
+func indexName(tableName, column string) string {
+	return identifierWithSuffix(tableName+"_"+column, "_idx")
+}
+
+// indexMethod of the column, empty if the column is not indexed by default
+func (e *Exporter) indexMethod(col *ColumnSchema, isTag bool) string {
+	switch {
+	case col.Name == e.timeCol.Name:
+		if e.cfg.UseTimescale {
+			return ""
+		}
+		return "brin"
+	case col.Name == constants.TraceID || col.Name == "parent":
+		return "btree"
+	case normPgType(col.DataType) == PgJsonbTypeName:
+		return "gin"
+	case isTag:
+		return "btree"
+	default:
+		return ""
+	}
+}
+
+// planIndexes indexes of the new columns of the table, system columns first and the rest by name, up to the cap
+// existing number of indexes the table already has
+func (e *Exporter) planIndexes(tableName string, cols []*ColumnSchema, tags map[string]struct{}, existing int) []index {
+	conf := e.cfg.Indexes
+	if conf == nil {
+		return nil
+	}
+	allow := stringSet(conf.Allow)
+	deny := stringSet(conf.Deny)
+	cols = append([]*ColumnSchema{}, cols...)
+	sort.SliceStable(
+		cols, func(i, j int) bool {
+			_, iSys := e.sysCols.Column(cols[i].Name)
+			_, jSys := e.sysCols.Column(cols[j].Name)
+			if iSys || jSys {
+				return iSys && !jSys
+			}
+			return cols[i].Name < cols[j].Name
+		},
+	)
+
+	res := make([]index, 0)
+	for _, col := range cols {
+		if existing+len(res) >= conf.maxPerTable() {
+			break
+		}
+		if _, denied := deny[col.Name]; denied {
+			continue
+		}
+		_, isTag := tags[col.Name]
+		method := e.indexMethod(col, isTag)
+		if len(allow) > 0 {
+			if _, allowed := allow[col.Name]; !allowed {
+				continue
+			}
+			if method == "" {
+				method = "btree"
+			}
+		}
+		if method == "" {
+			continue
+		}
+		res = append(res, index{name: indexName(tableName, col.Name), column: col.Name, method: method})
+	}
+	return res
+}
+
+func stringSet(ss []string) map[string]struct{} {
+	res := make(map[string]struct{}, len(ss))
+	for _, s := range ss {
+		res[s] = struct{}{}
+	}
+	return res
+}
+
+// createIndexStatements indexes of the newly created empty table, created in the same statement as the table
+func createIndexStatements(schema, tableName string, indexes []index) string {
+	b := strings.Builder{}
+	for _, i := range indexes {
+		b.WriteString(i.CreateStatement(schema, tableName, indexPlain))
+	}
+	return b.String()
+}
+
+// addIndexes indexes of the columns added to the existing table, built in background
+// not to block the writes, must be called under tablesLock
+func (e *Exporter) addIndexes(tableName string, cols []*ColumnSchema, tags map[string]struct{}) {
+	e.buildIndexes(tableName, e.planIndexes(tableName, cols, tags, e.indexCount[tableName]))
+}
+
+// buildIndexes builds the indexes in background, must be called under tablesLock
+// failed builds are logged and retried by Maintain, nothing is built after Shutdown
+func (e *Exporter) buildIndexes(tableName string, indexes []index) {
+	if len(indexes) == 0 || e.bgCtx.Err() != nil {
+		return
+	}
+	e.indexCount[tableName] += len(indexes)
+	mode := indexConcurrently
+	switch {
+	case e.cfg.UseTimescale:
+		mode = indexPerChunk
+	case e.cfg.Partitioning != nil:
+		mode = indexPerPartition
+	}
+	e.bg.Add(1)
+	go func() {
+		defer e.bg.Done()
+		for _, i := range indexes {
+			if err := e.createIndex(e.bgCtx, tableName, i, mode); err != nil {
+				e.tablesLock.Lock()
+				e.indexCount[tableName]--
+				e.failedIndexes[tableName] = append(e.failedIndexes[tableName], i)
+				e.tablesLock.Unlock()
+			}
+		}
+	}()
+}
+
+// retryIndexes builds the indexes that failed to build again, up to the cap of the table
+func (e *Exporter) retryIndexes() {
+	e.tablesLock.Lock()
+	defer e.tablesLock.Unlock()
+	for tableName, failed := range e.failedIndexes {
+		delete(e.failedIndexes, tableName)
+		free := e.cfg.Indexes.maxPerTable() - e.indexCount[tableName]
+		if free < 0 {
+			free = 0
+		}
+		if len(failed) > free {
+			failed = failed[:free]
+		}
+		e.buildIndexes(tableName, failed)
+	}
+}
+
+func (e *Exporter) createIndex(ctx context.Context, tableName string, i index, mode indexMode) error {
+	span, ctx := klogga.Start(ctx)
+	defer e.trs.Finish(span)
+
+	q := i.CreateStatement(e.cfg.SchemaName, tableName, mode)
+	span.Tag("table", tableName).Tag("index", i.name).Val(vals.Query, q)
+
+	conn, err := e.connFactory.GetConnection(ctx)
+	if err != nil {
+		return span.Err(errors.Wrap(err, messageUnableToConnectPG))
+	}
+	defer func() { span.DeferErr(conn.Close()) }()
+	if mode == indexConcurrently {
+		return span.Err(e.createIndexConcurrently(ctx, conn, tableName, i))
+	}
+	if _, err := conn.ExecContext(ctx, q); err != nil {
+		return span.Err(errors.Wrap(err, messageUnableToExec))
+	}
+	if mode != indexPerPartition {
+		return nil
+	}
+
+	partitions, err := e.loadPartitionNames(ctx, conn, tableName)
+	if err != nil {
+		return span.Err(err)
+	}
+	span.Val("partitions", len(partitions))
+	for _, partition := range partitions {
+		partitionIndex := i.forPartition(partition)
+		if err := e.createIndexConcurrently(ctx, conn, partition, partitionIndex); err != nil {
+			return span.Err(err)
+		}
+		if _, err := conn.ExecContext(ctx, i.AttachStatement(e.cfg.SchemaName, partitionIndex)); err != nil {
+			return span.Err(errors.Wrapf(err, "unable to attach index %s", partitionIndex.name))
+		}
+	}
+	return nil
+}
+
+// createIndexConcurrently builds the index without blocking the writers
+// failed concurrent build leaves an invalid index, that would be skipped by IF NOT EXISTS forever, so it's dropped
+func (e *Exporter) createIndexConcurrently(ctx context.Context, conn Connection, tableName string, i index) error {
+	if _, err := conn.ExecContext(ctx, i.CreateStatement(e.cfg.SchemaName, tableName, indexConcurrently)); err != nil {
+		dropCtx, cancel := context.WithTimeout(context.Background(), e.cfg.WriteTimeout)
+		defer cancel()
+		_, dropErr := conn.ExecContext(
+			dropCtx, fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s;", quoteTable(e.cfg.SchemaName, i.name)),
+		)
+		return errs.Append(errors.Wrapf(err, "unable to build index %s", i.name), dropErr)
+	}
+	return nil
+}
+
+// loadPartitionNames partitions of the partitioned table
+func (e *Exporter) loadPartitionNames(ctx context.Context, conn Connection, tableName string) ([]string, error) {
+	query, args := e.psql.Select("c.relname").
+		From("pg_inherits i").
+		Join("pg_class c ON c.oid = i.inhrelid").
+		Where("i.inhparent = ?::regclass", quoteTable(e.cfg.SchemaName, tableName)).
+		OrderBy("c.relname").
+		MustSql()
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, messageUnableToQuery)
+	}
+	defer func() { _ = rows.Close() }()
+	res := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, errors.Wrap(err, messageUnableToScan)
+		}
+		res = append(res, name)
+	}
+	return res, errors.Wrap(rows.Err(), messageUnableToQuery)
+}
+
+// loadIndexCount number of indexes of the tables of the schema
+func (e *Exporter) loadIndexCount(ctx context.Context, conn Connection) (map[string]int, error) {
+	query, args := e.psql.Select("tablename", "count(*)").
+		From("pg_indexes").
+		Where(squirrel.Eq{"schemaname": e.cfg.SchemaName}).
+		GroupBy("tablename").
+		MustSql()
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, messageUnableToQuery)
+	}
+	defer func() { _ = rows.Close() }()
+	res := map[string]int{}
+	for rows.Next() {
+		var tableName string
+		var count int
+		if err := rows.Scan(&tableName, &count); err != nil {
+			return nil, errors.Wrap(err, messageUnableToScan)
+		}
+		res[tableName] = count
+	}
+	return res, errors.Wrap(rows.Err(), messageUnableToQuery)
+}
@@ -0,0 +1,135 @@
+package postgres
+
+import (
+	"context"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func indexedColumns(indexes []index) map[string]string {
+	res := map[string]string{}
+	for _, i := range indexes {
+		res[i.column] = i.method
+	}
+	return res
+}
+
+func plannedIndexes(t *testing.T, conf *Conf, existing int) []index {
+	t.Helper()
+	span := klogga.StartLeaf(testutil.Timeout()).
+		Tag("user", "u").Tag("tagged_val", 1).Val("tagged_val", 2).
+		Val("count", 3).ValAsObj("payload", map[string]int{"a": 1})
+	span.SetComponent("pg_test")
+	pg := New(conf, nil, klogga.NilExporterTracer{})
+	datasets, errSpans := pg.createRecordSets(span)
+	require.Empty(t, errSpans)
+	dataset := datasets["pg_test"]
+	return pg.planIndexes("pg_test", pg.sysCols.Merge(dataset.Schema.Columns()).Columns(), dataset.tags, existing)
+}
+
+func TestPlanIndexesDefault(t *testing.T) {
+	require.Empty(t, plannedIndexes(t, &Conf{}, 0), "disabled by default")
+
+	indexes := plannedIndexes(t, &Conf{Indexes: &IndexConf{}}, 0)
+	require.Equal(
+		t, map[string]string{"time": "brin", "trace_id": "btree", "parent": "btree", "user": "btree", "payload": "gin"},
+		indexedColumns(indexes),
+	)
+	require.Equal(t, "pg_test_time_idx", indexes[0].name)
+	require.Equal(t, "payload", indexes[3].column, "system columns first, the rest by name")
+
+	indexes = plannedIndexes(t, &Conf{UseTimescale: true, Indexes: &IndexConf{}}, 0)
+	require.NotContains(t, indexedColumns(indexes), "time", "hypertable has its own time index")
+}
+
+func TestPlanIndexesAllowDeny(t *testing.T) {
+	indexes := plannedIndexes(
+		t, &Conf{Indexes: &IndexConf{Allow: []string{"user", "count", "payload", "parent"}, Deny: []string{"parent"}}}, 0,
+	)
+	require.Equal(t, map[string]string{"user": "btree", "count": "btree", "payload": "gin"}, indexedColumns(indexes))
+}
+
+func TestPlanIndexesCap(t *testing.T) {
+	indexes := plannedIndexes(t, &Conf{Indexes: &IndexConf{MaxPerTable: 4}}, 1)
+	require.Equal(t, map[string]string{"time": "brin", "trace_id": "btree", "parent": "btree"}, indexedColumns(indexes))
+	require.Empty(t, plannedIndexes(t, &Conf{Indexes: &IndexConf{MaxPerTable: 4}}, 4))
+}
+
+func TestIndexStatements(t *testing.T) {
+	i := index{name: "pg_test_user_idx", column: "user", method: "btree"}
+	require.Equal(
+		t, "CREATE INDEX IF NOT EXISTS \"pg_test_user_idx\" ON \"audit\".\"pg_test\" USING btree (\"user\");\n",
+		i.CreateStatement(DefaultSchema, "pg_test", indexPlain),
+	)
+	require.Equal(
+		t, "CREATE INDEX CONCURRENTLY IF NOT EXISTS \"pg_test_user_idx\" ON \"audit\".\"pg_test\" USING btree (\"user\");\n",
+		i.CreateStatement(DefaultSchema, "pg_test", indexConcurrently),
+	)
+	require.Equal(
+		t, "CREATE INDEX IF NOT EXISTS \"pg_test_user_idx\" ON \"audit\".\"pg_test\" USING btree (\"user\")"+
+			" WITH (timescaledb.transaction_per_chunk);\n",
+		i.CreateStatement(DefaultSchema, "pg_test", indexPerChunk),
+	)
+	require.Equal(
+		t, "CREATE INDEX IF NOT EXISTS \"pg_test_user_idx\" ON ONLY \"audit\".\"pg_test\" USING btree (\"user\");\n",
+		i.CreateStatement(DefaultSchema, "pg_test", indexPerPartition),
+	)
+	require.Equal(
+		t, "ALTER INDEX \"audit\".\"pg_test_user_idx\" ATTACH PARTITION \"audit\".\"pg_test_default_user_idx\";\n",
+		i.AttachStatement(DefaultSchema, i.forPartition("pg_test_default")),
+	)
+}
+
+type failingConnector struct{}
+
+func (failingConnector) GetConnection(context.Context) (Connection, error) {
+	return nil, errors.New("no connection")
+}
+
+func (failingConnector) Stop(context.Context) error {
+	return nil
+}
+
+func TestRetryIndexes(t *testing.T) {
+	pg := New(&Conf{Indexes: &IndexConf{MaxPerTable: 3}}, failingConnector{}, klogga.NilExporterTracer{})
+	defer func() { require.NoError(t, pg.Shutdown(testutil.Timeout())) }()
+	failed := func() int {
+		pg.tablesLock.Lock()
+		defer pg.tablesLock.Unlock()
+		return len(pg.failedIndexes["pg_test"])
+	}
+
+	pg.tablesLock.Lock()
+	pg.indexCount["pg_test"] = 1
+	pg.buildIndexes(
+		"pg_test", []index{
+			{name: "pg_test_user_idx", column: "user", method: "btree"},
+			{name: "pg_test_session_idx", column: "session", method: "btree"},
+		},
+	)
+	pg.tablesLock.Unlock()
+	require.Eventually(t, func() bool { return failed() == 2 }, time.Second, time.Millisecond)
+
+	pg.tablesLock.Lock()
+	pg.indexCount["pg_test"] = 2
+	pg.tablesLock.Unlock()
+	require.NoError(t, pg.Maintain(testutil.Timeout()))
+	require.Eventually(t, func() bool { return failed() == 1 }, time.Second, time.Millisecond, "retried up to the cap")
+}
+
+func TestNoIndexBuildsAfterShutdown(t *testing.T) {
+	pg := New(&Conf{Indexes: &IndexConf{MaxPerTable: 3}}, failingConnector{}, klogga.NilExporterTracer{})
+	require.NoError(t, pg.Shutdown(testutil.Timeout()))
+
+	pg.tablesLock.Lock()
+	pg.buildIndexes("pg_test", []index{{name: "pg_test_user_idx", column: "user", method: "btree"}})
+	count := pg.indexCount["pg_test"]
+	pg.tablesLock.Unlock()
+	require.Zero(t, count)
+	pg.bg.Wait()
+	require.Empty(t, pg.failedIndexes)
+}
@@ -0,0 +1,489 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/constants/vals"
+	"github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPartitionInterval   = 24 * time.Hour
+	defaultPartitionPremake    = 2
+	defaultMaintenanceInterval = time.Hour
+
+	// pgTimestampLayout of the partition bounds as they are returned by pg_get_expr
+	pgTimestampLayout = "2006-01-02 15:04:05"
+)
+
+// PartitionConf native declarative range partitioning by time of the automatically created tables
+// rows that don't fit any partition go to the <table>_default partition,
+// they are moved to the partition of their range when it is created, and dropped by the retention
+type PartitionConf struct {
+	// Interval time range of a partition, a day by default
+	// partitions are aligned to the unix epoch, so daily partitions start at 00:00 UTC
+	Interval time.Duration
+	// Premake number of the future partitions kept created ahead, 2 by default
+	Premake int
+}
+
+func (c PartitionConf) withDefaults() PartitionConf {
+	if c.Interval <= 0 {
+		c.Interval = defaultPartitionInterval
+	}
+	if c.Premake <= 0 {
+		c.Premake = defaultPartitionPremake
+	}
+	return c
+}
+
+// RetentionConf how long the data is kept, zero keeps it forever
+type RetentionConf struct {
+	// Default retention of every table of the schema
+	Default time.Duration
+	// Tables retention per table, overrides Default, negative keeps the table data forever
+	Tables map[string]time.Duration
+}
+
+// For retention of the table, zero if the data is kept forever
+func (c *RetentionConf) For(tableName string) time.Duration {
+	if c == nil {
+		return 0
+	}
+	retention, ok := c.Tables[tableName]
+	if !ok {
+		retention = c.Default
+	}
+	if retention < 0 {
+		return 0
+	}
+	return retention
+}
+
+// partition of the table, from inclusive, to exclusive
+type partition struct {
+	name      string
+	from, to  time.Time
+	isDefault bool
+}
+
+func partitionName(tableName string, from time.Time, interval time.Duration) string {
+	layout := "20060102"
+	if interval%(24*time.Hour) != 0 {
+		layout = "20060102_1504"
+	}
+	return identifierWithSuffix(tableName, "_p"+from.Format(layout))
+}
+
+func defaultPartitionName(tableName string) string {
+	return identifierWithSuffix(tableName, "_default")
+}
+
+// planPartitions partitions to create so the current and the premade ones exist,
+// and the partitions to drop that are entirely older than the retention
+func planPartitions(
+	tableName string, now time.Time, conf PartitionConf, retention time.Duration, existing []partition,
+) (create []partition, drop []partition) {
+	conf = conf.withDefaults()
+	now = now.UTC()
+	hasDefault := false
+	for _, p := range existing {
+		if p.isDefault {
+			hasDefault = true
+			continue
+		}
+		if retention > 0 && !p.to.After(now.Add(-retention)) {
+			drop = append(drop, p)
+		}
+	}
+	if !hasDefault {
+		create = append(create, partition{name: defaultPartitionName(tableName), isDefault: true})
+	}
+
+	start := now.Truncate(conf.Interval)
+	for i := 0; i <= conf.Premake; i++ {
+		from := start.Add(time.Duration(i) * conf.Interval)
+		p := partition{name: partitionName(tableName, from, conf.Interval), from: from, to: from.Add(conf.Interval)}
+		if !overlaps(p, existing) {
+			create = append(create, p)
+		}
+	}
+	return create, drop
+}
+
+func overlaps(p partition, existing []partition) bool {
+	for _, e := range existing {
+		if !e.isDefault && p.from.Before(e.to) && e.from.Before(p.to) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeCondition rows of the partition range
+func (p partition) rangeCondition(timeCol string) string {
+	return fmt.Sprintf(
+		"%s >= %s AND %s < %s", pq.QuoteIdentifier(timeCol), pq.QuoteLiteral(p.from.Format(pgTimestampLayout)),
+		pq.QuoteIdentifier(timeCol), pq.QuoteLiteral(p.to.Format(pgTimestampLayout)),
+	)
+}
+
+// MoveFromDefaultStatement creates the partition after its rows are moved out of the default partition,
+// postgres refuses to create the partition while the default one has rows of its range
+// is run in a transaction, the moved rows are kept in a temporary table until the partition is created
+func (p partition) MoveFromDefaultStatement(schema, tableName, defaultName, timeCol string) string {
+	cond := p.rangeCondition(timeCol)
+	return fmt.Sprintf(
+		"CREATE TEMPORARY TABLE klogga_moved ON COMMIT DROP AS SELECT * FROM %[1]s WHERE %[2]s;\n"+
+			"DELETE FROM %[1]s WHERE %[2]s;\n"+
+			"%[3]s"+
+			"INSERT INTO %[4]s SELECT * FROM klogga_moved;\n",
+		quoteTable(schema, defaultName), cond, p.CreateStatement(schema, tableName), quoteTable(schema, tableName),
+	)
+}
+
+func (p partition) CreateStatement(schema, tableName string) string {
+	if p.isDefault {
+		return fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s PARTITION OF %s DEFAULT;\n",
+			quoteTable(schema, p.name), quoteTable(schema, tableName),
+		)
+	}
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s');\n",
+		quoteTable(schema, p.name), quoteTable(schema, tableName),
+		p.from.Format(pgTimestampLayout), p.to.Format(pgTimestampLayout),
+	)
+}
+
+var partitionBoundRe = regexp.MustCompile(`FROM \('([^']+)'\) TO \('([^']+)'\)`)
+
+// parsePartition parses partition bound as returned by pg_get_expr(relpartbound, oid)
+// partitions with bounds not created by klogga, e.g. MINVALUE, are not parsed
+func parsePartition(name, bound string) (partition, bool) {
+	if bound == "DEFAULT" {
+		return partition{name: name, isDefault: true}, true
+	}
+	m := partitionBoundRe.FindStringSubmatch(bound)
+	if m == nil {
+		return partition{}, false
+	}
+	from, err := time.Parse(pgTimestampLayout, m[1])
+	if err != nil {
+		return partition{}, false
+	}
+	to, err := time.Parse(pgTimestampLayout, m[2])
+	if err != nil {
+		return partition{}, false
+	}
+	return partition{name: name, from: from, to: to}, true
+}
+
+// pgInterval interval literal with microsecond precision of PG
+func pgInterval(d time.Duration) string {
+	return fmt.Sprintf("INTERVAL '%d microseconds'", d.Microseconds())
+}
+
+// timescalePolicyStatements retention and compression policies of the hypertable
+// compressionEnabled - the hypertable is already set up for compression
+func (e *Exporter) timescalePolicyStatements(tableName string, compressionEnabled bool) string {
+	b := strings.Builder{}
+	regclass := quoteRegclass(e.cfg.SchemaName, tableName)
+	if retention := e.cfg.Retention.For(tableName); retention > 0 {
+		b.WriteString(
+			fmt.Sprintf("SELECT add_retention_policy(%s, %s, if_not_exists => true);\n", regclass, pgInterval(retention)),
+		)
+	}
+	if e.cfg.CompressAfter > 0 {
+		if !compressionEnabled {
+			b.WriteString(
+				fmt.Sprintf(
+					"ALTER TABLE %s SET (timescaledb.compress, timescaledb.compress_orderby = %s);\n",
+					quoteTable(e.cfg.SchemaName, tableName), pq.QuoteLiteral(pq.QuoteIdentifier(e.timeCol.Name)+" DESC"),
+				),
+			)
+		}
+		b.WriteString(
+			fmt.Sprintf(
+				"SELECT add_compression_policy(%s, %s, if_not_exists => true);\n", regclass, pgInterval(e.cfg.CompressAfter),
+			),
+		)
+	}
+	return b.String()
+}
+
+// tableSetupStatements partitions or timescale policies of the newly created table
+func (e *Exporter) tableSetupStatements(tableName string, now time.Time) string {
+	if e.cfg.UseTimescale {
+		return e.timescalePolicyStatements(tableName, false)
+	}
+	if e.cfg.Partitioning == nil {
+		return ""
+	}
+	b := strings.Builder{}
+	create, _ := planPartitions(tableName, now, *e.cfg.Partitioning, 0, nil)
+	for _, p := range create {
+		b.WriteString(p.CreateStatement(e.cfg.SchemaName, tableName))
+	}
+	return b.String()
+}
+
+func (e *Exporter) needsMaintenance() bool {
+	return e.maintainsTables() || e.cfg.Indexes != nil
+}
+
+// maintainsTables partitions or timescale policies are maintained
+func (e *Exporter) maintainsTables() bool {
+	if e.cfg.UseTimescale {
+		return e.cfg.Retention != nil || e.cfg.CompressAfter > 0
+	}
+	return e.cfg.Partitioning != nil
+}
+
+// runMaintenance runs Maintain every MaintenanceInterval until Shutdown
+// the tables created by the exporter are set up on creation, so the first run is after the interval too
+func (e *Exporter) runMaintenance(ctx context.Context) {
+	defer e.bg.Done()
+	ticker := time.NewTicker(e.cfg.MaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = e.Maintain(ctx)
+		}
+	}
+}
+
+// Maintain creates the future partitions and drops the expired ones,
+// or sets up timescale policies of the hypertables created before the policies were configured,
+// and retries the failed index builds
+// is called by the background maintenance loop, can be called manually
+// tables without klogga system columns are not touched
+func (e *Exporter) Maintain(ctx context.Context) error {
+	if !e.needsMaintenance() {
+		return nil
+	}
+	span, ctx := klogga.Start(ctx)
+	defer e.trs.Finish(span)
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.LoadSchemaTimeout)
+	defer cancel()
+
+	e.retryIndexes()
+	if !e.maintainsTables() {
+		return nil
+	}
+	conn, err := e.connFactory.GetConnection(ctx)
+	if err != nil {
+		return span.Err(errors.Wrap(err, messageUnableToConnectPG))
+	}
+	defer func() { span.DeferErr(conn.Close()) }()
+
+	// the tables are checked against the schema cache
+	e.loadSchemasOnce(ctx)
+	if e.cfg.UseTimescale {
+		return span.Err(e.maintainHypertables(ctx, span, conn))
+	}
+	return span.Err(e.maintainPartitions(ctx, span, conn))
+}
+
+func (e *Exporter) maintainHypertables(ctx context.Context, span *klogga.Span, conn Connection) error {
+	query, args := e.psql.Select("hypertable_name", "compression_enabled").
+		From("timescaledb_information.hypertables").
+		Where(squirrel.Eq{"hypertable_schema": e.cfg.SchemaName}).
+		MustSql()
+	span.Val(vals.Query, query)
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return errors.Wrap(err, messageUnableToQuery)
+	}
+	hypertables := map[string]bool{}
+	for rows.Next() {
+		var name string
+		var compressionEnabled bool
+		if err := rows.Scan(&name, &compressionEnabled); err != nil {
+			span.DeferErr(rows.Close())
+			return errors.Wrap(err, messageUnableToScan)
+		}
+		hypertables[name] = compressionEnabled
+	}
+	if err := rows.Close(); err != nil {
+		return errors.Wrap(err, messageUnableToQuery)
+	}
+	span.Val("hypertables", len(hypertables))
+
+	for _, name := range sortedKeys(hypertables) {
+		if !e.isKloggaTable(name) {
+			continue
+		}
+		q := e.timescalePolicyStatements(name, hypertables[name])
+		if q == "" {
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, q); err != nil {
+			span.ErrVoid(errors.Wrapf(err, "unable to set up policies of %s", name))
+		}
+	}
+	return nil
+}
+
+// isKloggaTable the table has klogga system columns, other tables of the schema are not maintained
+func (e *Exporter) isKloggaTable(tableName string) bool {
+	e.tablesLock.Lock()
+	schema, ok := e.tables[tableName]
+	e.tablesLock.Unlock()
+	return ok && e.hasSysCols(schema)
+}
+
+func (e *Exporter) hasSysCols(schema *TableSchema) bool {
+	for _, col := range e.sysCols.Columns() {
+		if _, ok := schema.Column(col.Name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// maintainPartitions tables of the schema partitioned by range of the time column, the ones klogga created
+func (e *Exporter) maintainPartitions(ctx context.Context, span *klogga.Span, conn Connection) error {
+	query := `SELECT parent.relname, COALESCE(child.relname, ''), COALESCE(pg_get_expr(child.relpartbound, child.oid), '')
+FROM pg_class parent
+JOIN pg_namespace ns ON ns.oid = parent.relnamespace
+JOIN pg_partitioned_table pt ON pt.partrelid = parent.oid
+JOIN pg_attribute a ON a.attrelid = parent.oid AND a.attnum = pt.partattrs[0]
+LEFT JOIN pg_inherits i ON i.inhparent = parent.oid
+LEFT JOIN pg_class child ON child.oid = i.inhrelid
+WHERE ns.nspname = $1 AND parent.relkind = 'p' AND pt.partstrat = 'r' AND pt.partnatts = 1 AND a.attname = $2`
+	span.Val(vals.Query, query)
+	rows, err := conn.QueryContext(ctx, query, e.cfg.SchemaName, e.timeCol.Name)
+	if err != nil {
+		return errors.Wrap(err, messageUnableToQuery)
+	}
+	tables := map[string][]partition{}
+	for rows.Next() {
+		var tableName, name, bound string
+		if err := rows.Scan(&tableName, &name, &bound); err != nil {
+			span.DeferErr(rows.Close())
+			return errors.Wrap(err, messageUnableToScan)
+		}
+		if !e.isKloggaTable(tableName) {
+			continue
+		}
+		if _, ok := tables[tableName]; !ok {
+			tables[tableName] = nil
+		}
+		if p, ok := parsePartition(name, bound); ok {
+			tables[tableName] = append(tables[tableName], p)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return errors.Wrap(err, messageUnableToQuery)
+	}
+	span.Val("tables", len(tables))
+
+	now := time.Now()
+	created, dropped, pruned := 0, 0, int64(0)
+	for _, tableName := range sortedKeys(tables) {
+		retention := e.cfg.Retention.For(tableName)
+		create, drop := planPartitions(tableName, now, *e.cfg.Partitioning, retention, tables[tableName])
+		defaultName := ""
+		for _, p := range tables[tableName] {
+			if p.isDefault {
+				defaultName = p.name
+			}
+		}
+		for _, p := range create {
+			if err := e.createPartition(ctx, conn, tableName, defaultName, p); err != nil {
+				span.ErrVoid(err)
+				continue
+			}
+			created++
+		}
+		if defaultName != "" && retention > 0 {
+			n, err := e.pruneDefault(ctx, conn, defaultName, now.Add(-retention))
+			if err != nil {
+				span.ErrVoid(errors.Wrapf(err, "unable to delete expired rows of %s", defaultName))
+			}
+			pruned += n
+		}
+		for _, p := range drop {
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s;", quoteTable(e.cfg.SchemaName, p.name))); err != nil {
+				span.ErrVoid(errors.Wrapf(err, "unable to drop partition %s", p.name))
+				continue
+			}
+			dropped++
+		}
+	}
+	span.Val("created", created).Val("dropped", dropped).Val("pruned", pruned)
+	return nil
+}
+
+// createPartition moves the rows of the partition range out of the default partition if there are any
+func (e *Exporter) createPartition(ctx context.Context, conn Connection, tableName, defaultName string, p partition) error {
+	hasRows := false
+	if defaultName != "" && !p.isDefault {
+		query := fmt.Sprintf(
+			"SELECT EXISTS (SELECT 1 FROM %s WHERE %s)",
+			quoteTable(e.cfg.SchemaName, defaultName), p.rangeCondition(e.timeCol.Name),
+		)
+		rows, err := conn.QueryContext(ctx, query)
+		if err != nil {
+			return errors.Wrapf(err, "unable to check rows of %s", defaultName)
+		}
+		for rows.Next() {
+			if err := rows.Scan(&hasRows); err != nil {
+				_ = rows.Close()
+				return errors.Wrap(err, messageUnableToScan)
+			}
+		}
+		if err := rows.Close(); err != nil {
+			return errors.Wrapf(err, "unable to check rows of %s", defaultName)
+		}
+	}
+	if !hasRows {
+		_, err := conn.ExecContext(ctx, p.CreateStatement(e.cfg.SchemaName, tableName))
+		return errors.Wrapf(err, "unable to create partition %s", p.name)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, messageUnableToBeginTx)
+	}
+	query := p.MoveFromDefaultStatement(e.cfg.SchemaName, tableName, defaultName, e.timeCol.Name)
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "unable to move rows of the default partition %s to %s", defaultName, p.name)
+	}
+	return errors.Wrap(tx.Commit(), messageUnableToCommitTx)
+}
+
+// pruneDefault deletes the rows of the default partition older than the retention
+func (e *Exporter) pruneDefault(ctx context.Context, conn Connection, defaultName string, before time.Time) (int64, error) {
+	res, err := conn.ExecContext(
+		ctx, fmt.Sprintf(
+			"DELETE FROM %s WHERE %s < %s;", quoteTable(e.cfg.SchemaName, defaultName),
+			pq.QuoteIdentifier(e.timeCol.Name), pq.QuoteLiteral(before.UTC().Format(pgTimestampLayout)),
+		),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,128 @@
+package postgres
+
+import (
+	"github.com/KasperskyLab/klogga"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func day(d int) time.Time {
+	return time.Date(2022, 3, d, 0, 0, 0, 0, time.UTC)
+}
+
+func names(partitions []partition) []string {
+	res := make([]string, 0, len(partitions))
+	for _, p := range partitions {
+		res = append(res, p.name)
+	}
+	return res
+}
+
+func TestPlanPartitionsNewTable(t *testing.T) {
+	create, drop := planPartitions("comp", day(10).Add(15*time.Hour), PartitionConf{}, 0, nil)
+	require.Empty(t, drop)
+	require.Equal(t, []string{"comp_default", "comp_p20220310", "comp_p20220311", "comp_p20220312"}, names(create))
+	require.Equal(t, day(10), create[1].from)
+	require.Equal(t, day(11), create[1].to)
+}
+
+func TestPlanPartitionsRetention(t *testing.T) {
+	existing := []partition{
+		{name: "comp_default", isDefault: true},
+		{name: "comp_p20220307", from: day(7), to: day(8)},
+		{name: "comp_p20220308", from: day(8), to: day(9)},
+		{name: "comp_p20220309", from: day(9), to: day(10)},
+		{name: "comp_p20220310", from: day(10), to: day(11)},
+	}
+	create, drop := planPartitions(
+		"comp", day(10).Add(time.Hour), PartitionConf{Interval: 24 * time.Hour, Premake: 1}, 2*24*time.Hour, existing,
+	)
+	require.Equal(t, []string{"comp_p20220311"}, names(create))
+	require.Equal(t, []string{"comp_p20220307"}, names(drop))
+}
+
+func TestPlanPartitionsSkipsOverlapping(t *testing.T) {
+	existing := []partition{{name: "comp_weekly", from: day(7), to: day(14)}}
+	create, _ := planPartitions("comp", day(10), PartitionConf{Interval: 6 * time.Hour, Premake: 30}, 0, existing)
+	require.Equal(t, "comp_default", create[0].name)
+	require.Equal(t, "comp_p20220314_0000", create[1].name)
+	require.Equal(t, day(14), create[1].from)
+}
+
+func TestParsePartition(t *testing.T) {
+	p, ok := parsePartition("comp_p20220310", "FOR VALUES FROM ('2022-03-10 00:00:00') TO ('2022-03-11 00:00:00')")
+	require.True(t, ok)
+	require.Equal(t, partition{name: "comp_p20220310", from: day(10), to: day(11)}, p)
+	require.Equal(
+		t,
+		"CREATE TABLE IF NOT EXISTS \"audit\".\"comp_p20220310\" PARTITION OF \"audit\".\"comp\" "+
+			"FOR VALUES FROM ('2022-03-10 00:00:00') TO ('2022-03-11 00:00:00');\n",
+		p.CreateStatement(DefaultSchema, "comp"),
+	)
+
+	p, ok = parsePartition("comp_default", "DEFAULT")
+	require.True(t, ok)
+	require.True(t, p.isDefault)
+	require.Equal(
+		t, "CREATE TABLE IF NOT EXISTS \"audit\".\"comp_default\" PARTITION OF \"audit\".\"comp\" DEFAULT;\n",
+		p.CreateStatement(DefaultSchema, "comp"),
+	)
+
+	_, ok = parsePartition("comp_old", "FOR VALUES FROM (MINVALUE) TO ('2022-03-11 00:00:00')")
+	require.False(t, ok)
+}
+
+func TestRetentionFor(t *testing.T) {
+	var conf *RetentionConf
+	require.Zero(t, conf.For("comp"))
+	conf = &RetentionConf{Default: time.Hour, Tables: map[string]time.Duration{"audit": -1, "short": time.Minute}}
+	require.Equal(t, time.Hour, conf.For("comp"))
+	require.Zero(t, conf.For("audit"))
+	require.Equal(t, time.Minute, conf.For("short"))
+}
+
+func TestTableSetupStatements(t *testing.T) {
+	pg := New(&Conf{Partitioning: &PartitionConf{Premake: 1}}, nil, klogga.NilExporterTracer{})
+	q := pg.sysCols.CreateTableStatement(DefaultSchema, "comp", pg.timeCol, false, true) +
+		pg.tableSetupStatements("comp", day(10))
+	require.Contains(t, q, ") PARTITION BY RANGE (\"time\");\n")
+	require.Contains(t, q, "CREATE TABLE IF NOT EXISTS \"audit\".\"comp_default\" PARTITION OF \"audit\".\"comp\" DEFAULT;\n")
+	require.Contains(t, q, "\"audit\".\"comp_p20220311\" PARTITION OF")
+
+	pg = New(
+		&Conf{UseTimescale: true, Retention: &RetentionConf{Default: time.Hour}, CompressAfter: time.Minute},
+		nil, klogga.NilExporterTracer{},
+	)
+	require.Equal(
+		t,
+		"SELECT add_retention_policy('\"audit\".\"comp\"', INTERVAL '3600000000 microseconds', if_not_exists => true);\n"+
+			"ALTER TABLE \"audit\".\"comp\" SET (timescaledb.compress, timescaledb.compress_orderby = '\"time\" DESC');\n"+
+			"SELECT add_compression_policy('\"audit\".\"comp\"', INTERVAL '60000000 microseconds', if_not_exists => true);\n",
+		pg.tableSetupStatements("comp", day(10)),
+	)
+	require.NotContains(t, pg.timescalePolicyStatements("comp", true), "ALTER TABLE")
+}
+
+func TestIsKloggaTable(t *testing.T) {
+	pg := New(&Conf{Partitioning: &PartitionConf{}}, nil, klogga.NilExporterTracer{})
+	pg.tables["comp"] = pg.sysCols.Merge([]*ColumnSchema{{"user", "text", "", true}})
+	pg.tables["user_table"] = NewTableSchema([]*ColumnSchema{pg.timeCol, {"amount", "bigint", "", true}})
+	require.True(t, pg.isKloggaTable("comp"))
+	require.False(t, pg.isKloggaTable("user_table"))
+	require.False(t, pg.isKloggaTable("missing"))
+}
+
+func TestMoveFromDefaultStatement(t *testing.T) {
+	p := partition{name: "comp_p20220310", from: day(10), to: day(11)}
+	require.Equal(
+		t,
+		"CREATE TEMPORARY TABLE klogga_moved ON COMMIT DROP AS SELECT * FROM \"audit\".\"comp_default\" "+
+			"WHERE \"time\" >= '2022-03-10 00:00:00' AND \"time\" < '2022-03-11 00:00:00';\n"+
+			"DELETE FROM \"audit\".\"comp_default\" "+
+			"WHERE \"time\" >= '2022-03-10 00:00:00' AND \"time\" < '2022-03-11 00:00:00';\n"+
+			p.CreateStatement(DefaultSchema, "comp")+
+			"INSERT INTO \"audit\".\"comp\" SELECT * FROM klogga_moved;\n",
+		p.MoveFromDefaultStatement(DefaultSchema, "comp", "comp_default", "time"),
+	)
+}
@@ -2,6 +2,7 @@ package postgres
 
 import (
 	"context"
+	"fmt"
 	"github.com/KasperskyLab/klogga"
 	"github.com/KasperskyLab/klogga/constants"
 	"github.com/KasperskyLab/klogga/constants/vals"
@@ -49,6 +50,37 @@ type Conf struct {
 	LoadSchemaTimeout time.Duration
 	// automatically created tables are declared as timescale hypertables
 	UseTimescale bool
+
+	// Types custom go to PG type mapping for tags and vals, e.g. CommonTypes, GetPgTypeVal is used if nil
+	// changing the mapping of a type doesn't change the already created columns
+	Types *TypeRegistry
+
+	// ConflictStrategy what to do with a value that doesn't match the column type, ConflictReject by default
+	ConflictStrategy ConflictStrategy
+	// TruncateLongNames table and column names longer than MaxIdentifierLen are truncated as PG does,
+	// instead of shortened with a hash, for the tables created by klogga before the names were hashed, see readme
+	// different long names that only differ after the limit share the column
+	TruncateLongNames bool
+	// WidenMaxTableSize ConflictWiden doesn't rewrite tables larger than this, in bytes with indexes and partitions, 64MB by default
+	WidenMaxTableSize int64
+
+	// Partitioning automatically created tables are partitioned by time, ignored with UseTimescale
+	// existing tables are not converted
+	Partitioning *PartitionConf
+	// Retention drops partitions, or timescale chunks with UseTimescale, with data older than the retention
+	// tables that are neither partitioned nor hypertables are not affected
+	Retention *RetentionConf
+	// CompressAfter timescale compression policy of the hypertables, zero disables compression
+	CompressAfter time.Duration
+	// Indexes indexes the tag columns of the created and altered tables, see IndexConf, nothing is indexed if nil
+	Indexes *IndexConf
+
+	// MaintenanceInterval how often partitions are created and dropped and timescale policies are checked, hour by default
+	// the maintenance loop runs only if Partitioning, or Retention or CompressAfter with UseTimescale, or Indexes is set
+	MaintenanceInterval time.Duration
+	// SchemaReloadInterval how old the schema cache can be for FindSpans, a minute by default
+	// the cache is reloaded earlier if the requested components are not found
+	SchemaReloadInterval time.Duration
 }
 
 // Exporter writes Spans to postgres
@@ -63,9 +95,34 @@ type Exporter struct {
 	sysCols  *TableSchema
 	errTable *TableSchema
 
-	tables         map[string]*TableSchema
-	tablesLock     *sync.Mutex
+	tables     map[string]*TableSchema
+	tablesLock *sync.Mutex
+	// replaced to reload the schema, guarded by tablesLock
 	loadSchemaOnce *sync.Once
+
+	// number of indexes per table, guarded by tablesLock
+	indexCount map[string]int
+	// indexes that failed to build, retried by Maintain, guarded by tablesLock
+	failedIndexes map[string][]index
+	// columns of the span tags per table, the rest are vals, guarded by tablesLock
+	tagColumns map[string]map[string]struct{}
+	// partitions of the partitioned tables, they are in tables too, guarded by tablesLock
+	partitions map[string]struct{}
+	// table columns the key collisions were reported for, and the reports not written yet, guarded by tablesLock
+	collisions        map[string]struct{}
+	pendingCollisions []*klogga.Span
+	// tables too large or compressed for ConflictWiden, guarded by tablesLock
+	notWidened map[string]struct{}
+	// when the cache was loaded, and the count of the schema changes made by the exporter, guarded by tablesLock
+	schemaLoaded time.Time
+	schemaGen    uint64
+	// readers that found the cache stale wait for the same reload, see reloadSchemas
+	reloadLock *sync.Mutex
+
+	// background maintenance and index builds, stopped on Shutdown under tablesLock
+	bgCtx  context.Context
+	stopBg context.CancelFunc
+	bg     *sync.WaitGroup
 }
 
 // New to be used with batcher
@@ -83,12 +140,22 @@ func New(cfg *Conf, connFactory Connector, trs klogga.Tracer) *Exporter {
 	if cfg.SchemaName == "" {
 		cfg.SchemaName = DefaultSchema
 	}
+	cfg.SchemaName = normalizeIdentifier(cfg.SchemaName, cfg.TruncateLongNames)
 	if cfg.WriteTimeout <= 0 {
 		cfg.WriteTimeout = defaultWriteTimeout
 	}
 	if cfg.LoadSchemaTimeout <= 0 {
 		cfg.LoadSchemaTimeout = defaultWriteTimeout * 10
 	}
+	if cfg.MaintenanceInterval <= 0 {
+		cfg.MaintenanceInterval = defaultMaintenanceInterval
+	}
+	if cfg.SchemaReloadInterval <= 0 {
+		cfg.SchemaReloadInterval = defaultSchemaReloadInterval
+	}
+	if cfg.WidenMaxTableSize <= 0 {
+		cfg.WidenMaxTableSize = defaultWidenMaxTableSize
+	}
 
 	// base set of columns for each table
 	timeCol := &ColumnSchema{"time", "timestamp without time zone", "", false}
@@ -106,6 +173,7 @@ func New(cfg *Conf, connFactory Connector, trs klogga.Tracer) *Exporter {
 			{"duration", "bigint", "", false},
 		},
 	)
+	// system columns are written as is, Conf.Types maps only the tags and vals
 	errTable := NewTableSchema(
 		append(
 			sysCols.Columns(), &ColumnSchema{
@@ -114,7 +182,7 @@ func New(cfg *Conf, connFactory Connector, trs klogga.Tracer) *Exporter {
 		),
 	)
 
-	return &Exporter{
+	e := &Exporter{
 		cfg:            cfg,
 		connFactory:    connFactory,
 		psql:           squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
@@ -125,7 +193,21 @@ func New(cfg *Conf, connFactory Connector, trs klogga.Tracer) *Exporter {
 		tables:         make(map[string]*TableSchema),
 		tablesLock:     &sync.Mutex{},
 		loadSchemaOnce: &sync.Once{},
-	}
+		reloadLock:     &sync.Mutex{},
+		indexCount:     make(map[string]int),
+		failedIndexes:  make(map[string][]index),
+		tagColumns:     make(map[string]map[string]struct{}),
+		partitions:     make(map[string]struct{}),
+		collisions:     make(map[string]struct{}),
+		notWidened:     make(map[string]struct{}),
+		bg:             &sync.WaitGroup{},
+	}
+	e.bgCtx, e.stopBg = context.WithCancel(context.Background())
+	if connFactory != nil && e.needsMaintenance() {
+		e.bg.Add(1)
+		go e.runMaintenance(e.bgCtx)
+	}
+	return e
 }
 
 // Start for compatibility with Start / Stop interface
@@ -145,6 +227,20 @@ func (e *Exporter) ConnFactory() Connector {
 func (e *Exporter) Shutdown(ctx context.Context) error {
 	span, ctx := klogga.Start(ctx)
 	defer e.trs.Finish(span)
+	// index builds are started under tablesLock, so none is started after the stop
+	e.tablesLock.Lock()
+	e.stopBg()
+	e.tablesLock.Unlock()
+	bgDone := make(chan struct{})
+	go func() {
+		e.bg.Wait()
+		close(bgDone)
+	}()
+	select {
+	case <-bgDone:
+	case <-ctx.Done():
+		return span.Err(ctx.Err())
+	}
 	pgErr := e.connFactory.Stop(ctx)
 	return span.Err(pgErr)
 }
@@ -158,14 +254,7 @@ func (e *Exporter) Write(ctx context.Context, spans []*klogga.Span) error {
 	}
 
 	// On first write cache schema
-	e.loadSchemaOnce.Do(
-		func() {
-			err := e.loadSchemas(ctx)
-			if err != nil {
-				e.loadSchemaOnce = &sync.Once{}
-			}
-		},
-	)
+	e.loadSchemasOnce(ctx)
 
 	recordSets, errDescriptors := e.createRecordSets(spans...)
 	for i := 0; i < len(errDescriptors); i++ {
@@ -174,7 +263,8 @@ func (e *Exporter) Write(ctx context.Context, spans []*klogga.Span) error {
 
 	for tableName, recordSet := range recordSets {
 		if !e.cfg.SkipSchemaCreation {
-			err := e.updateSchema(ctx, tableName, recordSet)
+			var err error
+			recordSet, err = e.updateSchema(ctx, tableName, recordSet)
 			if span.Err(err) != nil {
 				continue
 			}
@@ -183,13 +273,15 @@ func (e *Exporter) Write(ctx context.Context, spans []*klogga.Span) error {
 	}
 	if span.HasErr() {
 		// on any errors gotta trigger schema reload
-		e.loadSchemaOnce = &sync.Once{}
+		e.resetSchemaOnce()
 	}
 
 	return nil
 }
 
-func (e *Exporter) updateSchema(ctx context.Context, tableName string, dataset RecordSet) error {
+// updateSchema creates or alters the table for the dataset
+// returns the dataset without the spans that still can't be written
+func (e *Exporter) updateSchema(ctx context.Context, tableName string, dataset RecordSet) (RecordSet, error) {
 	span, ctx := klogga.Start(ctx)
 	defer e.writeIfErr(span)
 
@@ -198,32 +290,55 @@ func (e *Exporter) updateSchema(ctx context.Context, tableName string, dataset R
 	defer e.tablesLock.Unlock()
 	schema, found := e.tables[tableName]
 	if !found {
-		err := e.createTable(ctx, tableName, e.sysCols.Merge(dataset.Schema.Columns()))
+		err := e.createTable(ctx, tableName, e.sysCols.Merge(dataset.Schema.Columns()), dataset.tags)
 		if err != nil {
-			return span.Err(err)
+			return dataset, span.Err(err)
 		}
 		e.tables[tableName] = dataset.Schema
-	} else {
-		alterSchema, failures := schema.GetAlterSchema(dataset)
-		if len(failures) > 0 {
-			for i := 0; i < len(failures); i++ {
-				e.writeErr(ctx, failures[i].Span)
-			}
-			return span.Err(
-				errors.Errorf(
-					"alter table failed (%v failures), first failure: %v", len(failures), failures[0].Err(),
-				),
-			)
+		delete(e.notWidened, tableName)
+		return dataset, nil
+	}
+
+	alterSchema, widenSchema, failures := schema.GetAlterSchema(dataset)
+	if !widenSchema.IsZero() {
+		canWiden, err := e.canWiden(ctx, tableName)
+		if err != nil {
+			return dataset, span.Err(err)
 		}
-		if alterSchema.IsZero() {
-			return nil
+		if !canWiden {
+			// the conflicting values go to the suffix columns instead
+			e.notWidened[tableName] = struct{}{}
+			var rejected []ErrDescriptor
+			dataset, rejected = e.recreateRecordSet(tableName, dataset)
+			alterSchema, widenSchema, failures = schema.GetAlterSchema(dataset)
+			failures = append(rejected, failures...)
 		}
-		if err := e.alterTable(ctx, tableName, alterSchema); err != nil {
-			return span.Err(err)
+	}
+	if len(failures) > 0 {
+		for i := 0; i < len(failures); i++ {
+			e.writeErr(ctx, failures[i].Span)
+		}
+		span.Val("failures", len(failures)).Val("first_failure", failures[0].Err().Error())
+		dataset = dataset.without(failures)
+	}
+	if !alterSchema.IsZero() {
+		q := alterSchema.AlterTableStatement(e.cfg.SchemaName, tableName) +
+			alterSchema.TagCommentStatements(e.cfg.SchemaName, tableName, dataset.tags)
+		if err := e.alterTable(ctx, tableName, q); err != nil {
+			return dataset, span.Err(err)
 		}
 		e.tables[tableName] = e.tables[tableName].Merge(alterSchema.Columns())
+		e.addTagColumns(tableName, alterSchema.Columns(), dataset.tags)
+		e.addIndexes(tableName, alterSchema.Columns(), dataset.tags)
 	}
-	return nil
+	if !widenSchema.IsZero() {
+		q := widenSchema.AlterColumnTypeStatement(e.cfg.SchemaName, tableName)
+		if err := e.alterTable(ctx, tableName, q); err != nil {
+			return dataset, span.Err(err)
+		}
+		e.tables[tableName] = e.tables[tableName].Merge(widenSchema.Columns())
+	}
+	return dataset, nil
 }
 
 func (e *Exporter) writeRecordSet(ctx context.Context, tableName string, recordSet RecordSet) {
@@ -242,6 +357,18 @@ func (e *Exporter) writeRecordSet(ctx context.Context, tableName string, recordS
 	}
 	defer func() { span.DeferErr(conn.Close()) }()
 
+	if copier, ok := conn.(CopyFromConnection); ok {
+		rows := make([][]interface{}, 0, len(recordSet.Spans))
+		for i, span := range recordSet.Spans {
+			rows = append(rows, e.spanRow(span, recordSet, i))
+		}
+		span.Val("columns_count", recordSet.Schema.ColumnsCount())
+		if _, err := copier.CopyFrom(ctx, e.cfg.SchemaName, tableName, recordSet.Schema.ColumnNames(), rows); err != nil {
+			span.ErrVoid(errors.Wrap(err, "unable to COPY"))
+		}
+		return
+	}
+
 	isCommitted := false
 	tx, err := conn.BeginTx(ctx, nil)
 	if err != nil {
@@ -266,40 +393,8 @@ func (e *Exporter) writeRecordSet(ctx context.Context, tableName string, recordS
 		span.DeferErr(errors.Wrap(stmt.Close(), "unable to close statement"))
 	}()
 
-	for _, span := range recordSet.Spans {
-		strErr := ""
-		if sErr := errs.Append(span.Errs(), span.DeferErrs()); sErr != nil {
-			strErr = sErr.Error()
-		}
-		strWarn := ""
-		if sErr := span.Warns(); sErr != nil {
-			strWarn = sErr.Error()
-		}
-
-		vv := []any{
-			span.StartedTs().UTC(),
-			span.ID().Bytes(),
-			span.TraceID().AsUUID(),
-			span.Host(),
-			span.PackageClass(),
-			span.Name(),
-			span.ParentID().AsNullableBytes(),
-			strErr,
-			strWarn,
-			span.Duration(),
-		}
-
-		for _, colName := range recordSet.Schema.ColumnNames()[e.sysCols.ColumnsCount():] {
-			val := findColumnValue(span, colName)
-			if reflectutil.IsNil(val) {
-				vv = append(vv, nil)
-				continue
-			}
-			_, pgVal := GetPgTypeVal(val)
-			vv = append(vv, pgVal)
-		}
-
-		if _, err := stmt.ExecContext(ctx, vv...); err != nil {
+	for i, span := range recordSet.Spans {
+		if _, err := stmt.ExecContext(ctx, e.spanRow(span, recordSet, i)...); err != nil {
 			span.ErrVoid(errors.Wrap(err, messageUnableToExec))
 			continue
 		}
@@ -316,11 +411,47 @@ func (e *Exporter) writeRecordSet(ctx context.Context, tableName string, recordS
 	isCommitted = true
 }
 
-func (e *Exporter) createTable(ctx context.Context, tableName string, schema *TableSchema) error {
+// spanRow values of the i-th span of the record set, in the order of the record set columns
+func (e *Exporter) spanRow(span *klogga.Span, recordSet RecordSet, i int) []interface{} {
+	strErr := ""
+	if sErr := errs.Append(span.Errs(), span.DeferErrs()); sErr != nil {
+		strErr = sErr.Error()
+	}
+	strWarn := ""
+	if sErr := span.Warns(); sErr != nil {
+		strWarn = sErr.Error()
+	}
+
+	vv := []any{
+		span.StartedTs().UTC(),
+		span.ID().Bytes(),
+		span.TraceID().AsUUID(),
+		span.Host(),
+		span.PackageClass(),
+		span.Name(),
+		span.ParentID().AsNullableBytes(),
+		strErr,
+		strWarn,
+		span.Duration(),
+	}
+
+	for _, colName := range recordSet.Schema.ColumnNames()[e.sysCols.ColumnsCount():] {
+		vv = append(vv, recordSet.rows[i][colName])
+	}
+	return vv
+}
+
+// createTable with its partitions, policies and indexes, must be called under tablesLock
+// tags columns of the span tags, to be indexed
+func (e *Exporter) createTable(ctx context.Context, tableName string, schema *TableSchema, tags map[string]struct{}) error {
 	span, ctx := klogga.Start(ctx)
 	defer e.trs.Finish(span)
 
-	q := schema.CreateTableStatement(e.cfg.SchemaName, tableName, e.timeCol, e.cfg.UseTimescale)
+	indexes := e.planIndexes(tableName, schema.Columns(), tags, 0)
+	q := schema.CreateTableStatement(
+		e.cfg.SchemaName, tableName, e.timeCol, e.cfg.UseTimescale, e.cfg.Partitioning != nil,
+	) + schema.TagCommentStatements(e.cfg.SchemaName, tableName, tags) +
+		e.tableSetupStatements(tableName, time.Now()) + createIndexStatements(e.cfg.SchemaName, tableName, indexes)
 	span.
 		Tag("table", tableName).
 		Val("columns_count", schema.ColumnsCount()).
@@ -336,20 +467,32 @@ func (e *Exporter) createTable(ctx context.Context, tableName string, schema *Ta
 		span.Val(vals.Query, q)
 		return span.Err(errors.Wrap(err, messageUnableToExec))
 	}
+	e.invalidateTable(conn, tableName)
+	e.indexCount[tableName] = len(indexes)
+	e.addTagColumns(tableName, schema.Columns(), tags)
+	e.schemaGen++
 	return nil
 }
 
-func (e *Exporter) alterTable(ctx context.Context, tableName string, schema *TableSchema) error {
+// addTagColumns remembers the columns of the span tags, must be called under tablesLock
+func (e *Exporter) addTagColumns(tableName string, cols []*ColumnSchema, tags map[string]struct{}) {
+	for _, col := range cols {
+		if _, ok := tags[col.Name]; !ok {
+			continue
+		}
+		if e.tagColumns[tableName] == nil {
+			e.tagColumns[tableName] = make(map[string]struct{})
+		}
+		e.tagColumns[tableName][col.Name] = struct{}{}
+	}
+}
+
+func (e *Exporter) alterTable(ctx context.Context, tableName string, q string) error {
 	span, ctx := klogga.Start(ctx)
 	defer e.trs.Finish(span)
-	if schema.IsZero() {
-		return nil
-	}
 
-	q := schema.AlterTableStatement(e.cfg.SchemaName, tableName)
 	span.
 		Tag("table", tableName).
-		Val("columns_count", schema.ColumnsCount()).
 		Val(vals.Query, q)
 
 	conn, err := e.connFactory.GetConnection(ctx)
@@ -360,13 +503,92 @@ func (e *Exporter) alterTable(ctx context.Context, tableName string, schema *Tab
 	if _, err := conn.ExecContext(ctx, q); err != nil {
 		return span.Err(errors.Wrap(err, messageUnableToExec))
 	}
+	e.invalidateTable(conn, tableName)
+	e.schemaGen++
 	return nil
 }
 
+// invalidateTable the cached structure of the changed table, if the connection caches it
+func (e *Exporter) invalidateTable(conn Connection, tableName string) {
+	if cache, ok := conn.(TableCacheConnection); ok {
+		cache.InvalidateTable(e.cfg.SchemaName, tableName)
+	}
+}
+
+// canWiden the table is small enough for ConflictWiden to rewrite it and is not compressed
+func (e *Exporter) canWiden(ctx context.Context, tableName string) (bool, error) {
+	span, ctx := klogga.Start(ctx)
+	defer e.writeIfErr(span)
+
+	regclass := quoteRegclass(e.cfg.SchemaName, tableName)
+	compressed := "false"
+	if e.cfg.UseTimescale {
+		compressed = fmt.Sprintf(
+			"EXISTS (SELECT FROM timescaledb_information.hypertables "+
+				"WHERE hypertable_schema = %s AND hypertable_name = %s AND compression_enabled)",
+			pq.QuoteLiteral(e.cfg.SchemaName), pq.QuoteLiteral(tableName),
+		)
+	}
+	q := fmt.Sprintf(
+		"SELECT COALESCE(sum(pg_total_relation_size(c.oid)), 0)::bigint, %s FROM pg_class c "+
+			"WHERE c.oid = %s::regclass OR c.oid IN (SELECT inhrelid FROM pg_inherits WHERE inhparent = %s::regclass)",
+		compressed, regclass, regclass,
+	)
+	span.Tag("table", tableName).Val(vals.Query, q)
+
+	conn, err := e.connFactory.GetConnection(ctx)
+	if err != nil {
+		return false, span.Err(errors.Wrap(err, messageUnableToConnectPG))
+	}
+	defer func() { span.DeferErr(conn.Close()) }()
+	rows, err := conn.QueryContext(ctx, q)
+	if err != nil {
+		return false, span.Err(errors.Wrap(err, messageUnableToQuery))
+	}
+	defer func() { span.DeferErr(rows.Close()) }()
+	var size int64
+	var isCompressed bool
+	if rows.Next() {
+		if err := rows.Scan(&size, &isCompressed); err != nil {
+			return false, span.Err(errors.Wrap(err, messageUnableToScan))
+		}
+	}
+	span.Val("size", size).Val("compressed", isCompressed)
+	return size <= e.cfg.WidenMaxTableSize && !isCompressed, nil
+}
+
+// loadSchemasOnce caches the schema on the first call, retried on the next call if it fails
+func (e *Exporter) loadSchemasOnce(ctx context.Context) {
+	e.tablesLock.Lock()
+	once := e.loadSchemaOnce
+	e.tablesLock.Unlock()
+	once.Do(
+		func() {
+			err := e.loadSchemas(ctx)
+			if err != nil {
+				e.resetSchemaOnce()
+			}
+		},
+	)
+}
+
+// resetSchemaOnce the schema is reloaded by the next loadSchemasOnce call
+func (e *Exporter) resetSchemaOnce() {
+	e.tablesLock.Lock()
+	defer e.tablesLock.Unlock()
+	e.loadSchemaOnce = &sync.Once{}
+}
+
 // loadSchemas loads schema to cache from postgres
+// the cache is locked only to be replaced, the changes the exporter made while the schema was queried are kept
 func (e *Exporter) loadSchemas(ctx context.Context) error {
 	span, ctx := klogga.Start(ctx)
 	defer e.trs.Finish(span)
+	e.tablesLock.Lock()
+	gen := e.schemaGen
+	e.tablesLock.Unlock()
+	// the cache is as old as the query, not the merge
+	started := time.Now()
 	span.Val("timeout", e.cfg.LoadSchemaTimeout)
 	ctx, cancel := context.WithTimeout(ctx, e.cfg.LoadSchemaTimeout)
 	defer cancel()
@@ -376,9 +598,15 @@ func (e *Exporter) loadSchemas(ctx context.Context) error {
 	}
 	defer func() { span.DeferErr(conn.Close()) }()
 
-	query, args := e.psql.Select("table_name", "column_name", "data_type").
-		From("information_schema.columns").
-		Where(squirrel.Eq{"table_schema": e.cfg.SchemaName}).
+	// tag columns are marked with comments, partitions are read along with their parent tables
+	query, args := e.psql.Select(
+		"c.table_name", "c.column_name", "c.data_type",
+		"coalesce(col_description(t.oid, c.ordinal_position), '')", "t.relispartition",
+	).
+		From("information_schema.columns c").
+		Join("pg_namespace n ON n.nspname = c.table_schema").
+		Join("pg_class t ON t.relnamespace = n.oid AND t.relname = c.table_name").
+		Where(squirrel.Eq{"c.table_schema": e.cfg.SchemaName}).
 		MustSql()
 
 	span.Val(vals.Query, query)
@@ -395,22 +623,37 @@ func (e *Exporter) loadSchemas(ctx context.Context) error {
 	}()
 
 	tables := map[string]*TableSchema{}
+	tagColumns := map[string]map[string]struct{}{}
+	partitions := map[string]struct{}{}
 	for rows.Next() {
-		var tableName string
+		var tableName, comment string
+		var isPartition bool
 		var colSchema ColumnSchema
-		if err := rows.Scan(&tableName, &colSchema.Name, &colSchema.DataType); err != nil {
+		if err := rows.Scan(&tableName, &colSchema.Name, &colSchema.DataType, &comment, &isPartition); err != nil {
 			return span.Err(errors.Wrap(err, messageUnableToScan))
 		}
 		if _, found := tables[tableName]; !found {
 			tables[tableName] = NewTableSchema([]*ColumnSchema{})
 		}
 		tables[tableName].AddColumn(colSchema)
+		if comment == tagColumnComment {
+			if tagColumns[tableName] == nil {
+				tagColumns[tableName] = make(map[string]struct{})
+			}
+			tagColumns[tableName][colSchema.Name] = struct{}{}
+		}
+		if isPartition {
+			partitions[tableName] = struct{}{}
+		}
 	}
-	_, ok := tables[ErrorPostgresTableName]
-	if !ok {
-		err := e.createTable(ctx, ErrorPostgresTableName, e.errTable)
+	if err := rows.Err(); err != nil {
+		return span.Err(errors.Wrap(err, messageUnableToQuery))
+	}
+	var indexCount map[string]int
+	if e.cfg.Indexes != nil {
+		indexCount, err = e.loadIndexCount(ctx, conn)
 		if err != nil {
-			span.ErrVoid(errors.Wrapf(err, "failed to create table for errors: %s", ErrorPostgresTable))
+			return span.Err(err)
 		}
 	}
 
@@ -420,10 +663,61 @@ func (e *Exporter) loadSchemas(ctx context.Context) error {
 	}
 	span.Val("tables", strings.Join(names, ","))
 	span.Val("count", len(tables))
+
+	e.tablesLock.Lock()
+	defer e.tablesLock.Unlock()
+	if e.schemaGen != gen {
+		span.Val("merged", true)
+		e.mergeLoaded(tables, tagColumns, partitions, indexCount)
+	}
 	e.tables = tables
+	e.tagColumns = tagColumns
+	e.partitions = partitions
+	if indexCount != nil {
+		e.indexCount = indexCount
+	}
+	e.schemaLoaded = started
+
+	if _, ok := tables[ErrorPostgresTableName]; !ok {
+		err := e.createTable(ctx, ErrorPostgresTableName, e.errTable, nil)
+		if err != nil {
+			span.ErrVoid(errors.Wrapf(err, "failed to create table for errors: %s", ErrorPostgresTable))
+		}
+	}
 	return nil
 }
 
+// mergeLoaded adds the cached tables and columns to the loaded ones, must be called under tablesLock
+// the cache is newer for the tables the exporter changed during the load
+func (e *Exporter) mergeLoaded(
+	tables map[string]*TableSchema, tagColumns map[string]map[string]struct{}, partitions map[string]struct{},
+	indexCount map[string]int,
+) {
+	for name, schema := range e.tables {
+		if loaded, ok := tables[name]; ok {
+			tables[name] = loaded.Merge(schema.Columns())
+		} else {
+			tables[name] = schema
+		}
+	}
+	for name, cols := range e.tagColumns {
+		if tagColumns[name] == nil {
+			tagColumns[name] = make(map[string]struct{}, len(cols))
+		}
+		for col := range cols {
+			tagColumns[name][col] = struct{}{}
+		}
+	}
+	for name := range e.partitions {
+		partitions[name] = struct{}{}
+	}
+	for name, count := range e.indexCount {
+		if indexCount != nil && count > indexCount[name] {
+			indexCount[name] = count
+		}
+	}
+}
+
 func (e *Exporter) writeErr(ctx context.Context, errSpan *klogga.Span) {
 	span, ctx := klogga.Start(ctx)
 	defer e.writeIfErr(span)
@@ -469,80 +763,200 @@ func (e *Exporter) writeErr(ctx context.Context, errSpan *klogga.Span) {
 type RecordSet struct {
 	Schema *TableSchema
 	Spans  []*klogga.Span
+	// column values of the spans, after Conf.Types conversion and conflicts resolution
+	rows []map[string]interface{}
+	// columns of the span tags, the rest are vals
+	tags map[string]struct{}
+}
+
+// without the spans of the failures
+func (r RecordSet) without(failures []ErrDescriptor) RecordSet {
+	failed := make(map[*klogga.Span]struct{}, len(failures))
+	for _, f := range failures {
+		failed[f.Span] = struct{}{}
+	}
+	res := RecordSet{Schema: r.Schema, tags: r.tags}
+	for i, span := range r.Spans {
+		if _, ok := failed[span]; !ok {
+			res.Spans = append(res.Spans, span)
+			res.rows = append(res.rows, r.rows[i])
+		}
+	}
+	return res
 }
 
 // createRecordSets creates record sets from spans, grouped by table name
-// if span column can't be placed in the structure, it is added to []ErrDescriptor
+// if span column can't be placed in the structure according to Conf.ConflictStrategy, the span is added to []ErrDescriptor
 // (this happens when span has a data type in tag/val that is different from the expected type
-// in the existing structure)
+// in the batch or in the existing table), the rest of the spans are written
 func (e *Exporter) createRecordSets(spans ...*klogga.Span) (map[string]RecordSet, []ErrDescriptor) {
 	datasets := make(map[string]RecordSet)
 	errSpans := make([]ErrDescriptor, 0)
 
+	e.tablesLock.Lock()
 	for _, span := range spans {
-		tableName := spanTableName(span)
+		tableName := e.spanTableName(span)
 		dataset, found := datasets[tableName]
 		if !found {
-			dataset = RecordSet{
-				Schema: NewTableSchema(e.sysCols.Columns()),
-				Spans:  make([]*klogga.Span, 0),
-			}
+			dataset = e.newRecordSet()
 		}
 
-		for name, val := range e.getSpanVals(span) {
-			name = toPgColumnName(name)
-			existingCol, found := dataset.Schema.Column(name)
-			valType, _ := GetPgTypeVal(val)
-			newCol := ColumnSchema{
-				Name:     name,
-				DataType: valType,
-			}
-			if !found {
-				dataset.Schema.AddColumn(newCol)
-				continue
-			}
-			if existingCol.DataType != valType {
-				errSpans = append(errSpans, newErrDescriptor("", span, newCol, *existingCol))
-			}
+		row, failure := e.createRow(tableName, &dataset, span)
+		if failure != nil {
+			errSpans = append(errSpans, *failure)
+			continue
 		}
+		dataset.Spans = append(dataset.Spans, span)
+		dataset.rows = append(dataset.rows, row)
+		datasets[tableName] = dataset
+	}
+	collisions := e.pendingCollisions
+	e.pendingCollisions = nil
+	e.tablesLock.Unlock()
+
+	for _, warning := range collisions {
+		warning.FlushTo(e.trs)
+	}
+	return datasets, errSpans
+}
+
+func (e *Exporter) newRecordSet() RecordSet {
+	return RecordSet{
+		Schema: NewTableSchema(e.sysCols.Columns()),
+		Spans:  make([]*klogga.Span, 0),
+		tags:   make(map[string]struct{}),
+	}
+}
 
-		if len(errSpans) == 0 {
-			dataset.Spans = append(dataset.Spans, span)
+// recreateRecordSet resolves the spans of the record set again, must be called under tablesLock
+func (e *Exporter) recreateRecordSet(tableName string, dataset RecordSet) (RecordSet, []ErrDescriptor) {
+	res := e.newRecordSet()
+	errSpans := make([]ErrDescriptor, 0)
+	for _, span := range dataset.Spans {
+		row, failure := e.createRow(tableName, &res, span)
+		if failure != nil {
+			errSpans = append(errSpans, *failure)
+			continue
 		}
+		res.Spans = append(res.Spans, span)
+		res.rows = append(res.rows, row)
+	}
+	return res, errSpans
+}
 
-		datasets[tableName] = dataset
+// createRow column values of the span, adds the new columns to the dataset schema
+// the dataset is not changed if the span can't be written
+func (e *Exporter) createRow(tableName string, dataset *RecordSet, span *klogga.Span) (map[string]interface{}, *ErrDescriptor) {
+	table := e.tables[tableName]
+	row := make(map[string]interface{})
+	resolutions := make([]resolution, 0)
+	spanVals, tags := e.getSpanVals(span)
+	keys := make(map[string]string, len(spanVals))
+	for _, key := range sortedKeys(spanVals) {
+		val := spanVals[key]
+		if reflectutil.IsNil(val) {
+			continue
+		}
+		_, isTag := tags[key]
+		name := e.identifier(key)
+		if other, collides := keys[name]; collides {
+			e.warnCollision(tableName, name, other, key)
+			continue
+		}
+		if _, isSysCol := e.sysCols.Column(name); isSysCol {
+			e.warnCollision(tableName, name, name, key)
+			continue
+		}
+		keys[name] = key
+		valType, pgVal := e.cfg.Types.PgTypeVal(val)
+		newCol := ColumnSchema{
+			Name:     name,
+			DataType: valType,
+		}
+		existingCol, found := knownColumn(dataset, table, name)
+		if found && samePgType(existingCol.DataType, valType) {
+			newCol.DataType = existingCol.DataType
+		}
+		if !found || samePgType(existingCol.DataType, valType) {
+			resolutions = append(resolutions, resolution{col: newCol, val: pgVal, tag: isTag})
+			continue
+		}
+		res, ok := e.resolveConflict(tableName, dataset, table, existingCol, newCol, pgVal)
+		if !ok {
+			failure := newErrDescriptor(tableName, span, newCol, *existingCol)
+			return nil, &failure
+		}
+		res.tag = isTag
+		resolutions = append(resolutions, res)
 	}
 
-	return datasets, errSpans
+	for _, res := range resolutions {
+		if res.widen != nil {
+			res.widen()
+		}
+		if col, ok := dataset.Schema.Column(res.col.Name); !ok || col.DataType != res.col.DataType {
+			dataset.Schema.SetColumn(res.col)
+		}
+		if res.tag {
+			dataset.tags[res.col.Name] = struct{}{}
+		}
+		row[res.col.Name] = res.val
+	}
+	return row, nil
 }
 
-func spanTableName(span *klogga.Span) string {
+func (e *Exporter) spanTableName(span *klogga.Span) string {
 	table := span.Component().String()
 	if table == "" {
 		table = span.Package()
 	}
-	table = stringutil.ToSnakeCase(table)
-	return table
+	return e.identifier(stringutil.ToSnakeCase(table))
+}
+
+// identifier table or column name, see NormalizeIdentifier and Conf.TruncateLongNames
+func (e *Exporter) identifier(name string) string {
+	return normalizeIdentifier(name, e.cfg.TruncateLongNames)
+}
+
+// warnCollision the span key is normalized to the column name that is already taken
+// by another key of the span or by a system column, the value of the key is not written
+// reported once per table column, must be called under tablesLock, the report is written after the lock is released
+func (e *Exporter) warnCollision(tableName, column, taken, key string) {
+	id := tableName + "." + column
+	if _, reported := e.collisions[id]; reported {
+		return
+	}
+	e.collisions[id] = struct{}{}
+	warning := klogga.StartLeaf(context.Background()).
+		Tag("table", tableName).
+		Tag("column", column).
+		Val("taken_by", taken).
+		Val("key", key).
+		Warn(errors.New("span keys collide after normalization, the value is skipped"))
+	e.pendingCollisions = append(e.pendingCollisions, warning)
 }
 
 // merges span tabs and values into a single map
 // excludes system columns
-// converts column name to a standard PG name
-func (e *Exporter) getSpanVals(span *klogga.Span) map[string]interface{} {
+// returns names of the tags too, a val with the same name overrides the tag
+func (e *Exporter) getSpanVals(span *klogga.Span) (map[string]interface{}, map[string]struct{}) {
 	result := make(map[string]interface{})
+	tags := make(map[string]struct{})
 	for name, val := range span.Tags() {
 		if _, isSysCol := e.sysCols.Column(name); isSysCol {
 			continue
 		}
 		result[name] = val
+		tags[name] = struct{}{}
 	}
 	for name, val := range span.Vals() {
 		if _, isSysCol := e.sysCols.Column(name); isSysCol {
 			continue
 		}
 		result[name] = val
+		delete(tags, name)
 	}
-	return result
+	return result, tags
 }
 
 func (e *Exporter) writeIfErr(span *klogga.Span) {
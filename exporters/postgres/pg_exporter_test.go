@@ -1,10 +1,15 @@
 package postgres
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"github.com/KasperskyLab/klogga"
 	"github.com/KasperskyLab/klogga/util/testutil"
 	"github.com/stretchr/testify/require"
+	"sync"
 	"testing"
 )
 
@@ -128,3 +133,55 @@ func TestArrayType(t *testing.T) {
 	pgt, _ := GetPgTypeVal([]int{2, 3, 4})
 	require.Equal(t, PgJsonbTypeName, pgt)
 }
+
+// brokenConnector connections fail the queries and the transactions, statements succeed
+type brokenConnector struct{}
+
+func (brokenConnector) GetConnection(context.Context) (Connection, error) {
+	return brokenConn{}, nil
+}
+
+func (brokenConnector) Stop(context.Context) error {
+	return nil
+}
+
+type brokenConn struct{}
+
+func (brokenConn) ExecContext(context.Context, string, ...interface{}) (sql.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+func (brokenConn) QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error) {
+	return nil, errors.New("broken")
+}
+
+func (brokenConn) BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error) {
+	return nil, errors.New("broken")
+}
+
+func (brokenConn) Close() error {
+	return nil
+}
+
+func TestSchemaReloadConcurrentWithMaintain(t *testing.T) {
+	pg := New(&Conf{Partitioning: &PartitionConf{}}, brokenConnector{}, klogga.NilExporterTracer{})
+	defer func() { _ = pg.Shutdown(testutil.Timeout()) }()
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			span := klogga.StartLeaf(testutil.Timeout())
+			span.SetComponent("reload_test")
+			_ = pg.Write(testutil.Timeout(), []*klogga.Span{span})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			_ = pg.Maintain(testutil.Timeout())
+		}
+	}()
+	wg.Wait()
+}
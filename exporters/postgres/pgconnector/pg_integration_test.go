@@ -6,8 +6,14 @@ import (
 	"github.com/KasperskyLab/klogga/constants/vals"
 	"github.com/KasperskyLab/klogga/exporters/postgres"
 	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -251,6 +257,34 @@ func TestWritePgTypes(t *testing.T) {
 	require.Equal(t, 1*time.Second, dur)
 }
 
+func TestWriteCommonTypes(t *testing.T) {
+	pg, conn := PgConnConf(t, &postgres.Conf{Types: postgres.CommonTypes()})
+	conn.DropIfExists("audit.component")
+
+	id := uuid.New()
+	span, _ := klogga.Start(testutil.Timeout())
+	span.SetComponent("component")
+	span.Tag("uid", id).Tag("ip", net.ParseIP("10.0.0.1")).Val("took", 1500*time.Millisecond)
+
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+
+	rows, err := psql.Select("uid", "ip", "extract(epoch from took)").From("audit.component").
+		RunWith(conn).Query()
+	require.NoError(t, err)
+	require.True(t, rows.Next())
+	types, err := rows.ColumnTypes()
+	require.NoError(t, err)
+	require.Equal(t, "UUID", types[0].DatabaseTypeName())
+	require.Equal(t, "INET", types[1].DatabaseTypeName())
+	var uid, ip string
+	var took float64
+	require.NoError(t, rows.Scan(&uid, &ip, &took))
+	require.NoError(t, rows.Close())
+	require.Equal(t, id.String(), uid)
+	require.Equal(t, "10.0.0.1", ip)
+	require.Equal(t, 1.5, took)
+}
+
 func TestWritePgReservedColumnName(t *testing.T) {
 	pg, conn := PgConn(t)
 	conn.DropIfExists("audit.component")
@@ -293,3 +327,478 @@ func TestIncompatibleSchemaInOneBatch(t *testing.T) {
 		RunWith(conn).QueryRow()
 	require.Equal(t, 1, conn.ScanInt(row))
 }
+
+func TestConflictWiden(t *testing.T) {
+	pg, conn := PgConnConf(t, &postgres.Conf{ConflictStrategy: postgres.ConflictWiden})
+	conn.DropIfExists("audit.component")
+
+	span1, _ := klogga.Start(testutil.Timeout())
+	span1.SetComponent("component")
+	span1.Tag("status", 200)
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span1}))
+
+	span2, _ := klogga.Start(testutil.Timeout())
+	span2.SetComponent("component")
+	span2.Tag("status", "timeout")
+	span3, _ := klogga.Start(testutil.Timeout())
+	span3.SetComponent("component")
+	span3.Tag("status", 500)
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span2, span3}))
+
+	rows, err := psql.Select("status").From("audit.component").OrderBy("time").
+		RunWith(conn).Query()
+	require.NoError(t, err)
+	var statuses []string
+	for rows.Next() {
+		var status string
+		require.NoError(t, rows.Scan(&status))
+		statuses = append(statuses, status)
+	}
+	require.NoError(t, rows.Close())
+	require.Equal(t, []string{"200", "timeout", "500"}, statuses)
+}
+
+func TestConflictWidenLargeTable(t *testing.T) {
+	pg, conn := PgConnConf(t, &postgres.Conf{ConflictStrategy: postgres.ConflictWiden, WidenMaxTableSize: 1})
+	conn.DropIfExists("audit.component")
+
+	span1, _ := klogga.Start(testutil.Timeout())
+	span1.SetComponent("component")
+	span1.Tag("status", 200)
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span1}))
+
+	span2, _ := klogga.Start(testutil.Timeout())
+	span2.SetComponent("component")
+	span2.Tag("status", "timeout")
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span2}))
+
+	countText := psql.Select("count(*)").From("audit.component").Where("status_text = 'timeout'")
+	require.Equal(t, 1, conn.ScanInt(countText.RunWith(conn).QueryRow()), "the table is too large to be widened")
+}
+
+func TestConflictWidenPartitioned(t *testing.T) {
+	pg, conn := PgConnConf(
+		t, &postgres.Conf{
+			ConflictStrategy: postgres.ConflictWiden,
+			Partitioning:     &postgres.PartitionConf{Premake: 1},
+			Indexes:          &postgres.IndexConf{Allow: []string{"status"}},
+		},
+	)
+	defer func() { require.NoError(t, pg.Shutdown(testutil.Timeout())) }()
+	conn.DropIfExists("audit.widened_partitioned")
+
+	span1, _ := klogga.Start(testutil.Timeout())
+	span1.SetComponent("widened_partitioned")
+	span1.Tag("status", 200)
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span1}))
+
+	span2, _ := klogga.Start(testutil.Timeout())
+	span2.SetComponent("widened_partitioned")
+	span2.Tag("status", "timeout")
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span2}))
+
+	// the partitions are widened along with the partitioned table
+	textColumns := psql.Select("count(*)").From("information_schema.columns").
+		Where(squirrel.Eq{"table_schema": "audit", "column_name": "status", "data_type": "text"}).
+		Where("table_name LIKE 'widened_partitioned%'")
+	require.Equal(t, 4, conn.ScanInt(textColumns.RunWith(conn).QueryRow()), "table, default, today, tomorrow")
+	countText := psql.Select("count(*)").From("audit.widened_partitioned").Where("status IN ('200', 'timeout')")
+	require.Equal(t, 2, conn.ScanInt(countText.RunWith(conn).QueryRow()))
+	valid := psql.Select("count(*)").From("pg_index").
+		Where("indexrelid = 'audit.widened_partitioned_status_idx'::regclass AND indisvalid")
+	require.Equal(t, 1, conn.ScanInt(valid.RunWith(conn).QueryRow()), "the index is rebuilt by the widening")
+}
+
+func TestPartitioning(t *testing.T) {
+	pg, conn := PgConnConf(
+		t, &postgres.Conf{
+			Partitioning: &postgres.PartitionConf{Premake: 1},
+			Retention:    &postgres.RetentionConf{Default: 24 * time.Hour},
+		},
+	)
+	defer func() { require.NoError(t, pg.Shutdown(testutil.Timeout())) }()
+	conn.DropIfExists("audit.partitioned").DropIfExists("audit.user_partitioned")
+	// not created by klogga, is not maintained
+	_, err := conn.Exec(`CREATE TABLE audit.user_partitioned ("time" timestamp, amount bigint) PARTITION BY RANGE ("time")`)
+	require.NoError(t, err)
+
+	span, _ := klogga.Start(testutil.Timeout())
+	span.SetComponent("partitioned")
+	span.Tag("tag", "val")
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+
+	_, err = conn.Exec(
+		"CREATE TABLE audit.partitioned_p20000101 PARTITION OF audit.partitioned " +
+			"FOR VALUES FROM ('2000-01-01 00:00:00') TO ('2000-01-02 00:00:00')",
+	)
+	require.NoError(t, err)
+	require.NoError(t, pg.Maintain(testutil.Timeout()))
+
+	countPartitions := psql.Select("count(*)").From("pg_inherits").
+		Where("inhparent = 'audit.partitioned'::regclass")
+	require.Equal(t, 3, conn.ScanInt(countPartitions.RunWith(conn).QueryRow()), "default, today, tomorrow")
+	countUserPartitions := psql.Select("count(*)").From("pg_inherits").
+		Where("inhparent = 'audit.user_partitioned'::regclass")
+	require.Zero(t, conn.ScanInt(countUserPartitions.RunWith(conn).QueryRow()))
+	require.Equal(
+		t, 1, conn.ScanInt(psql.Select("count(*)").From("audit.partitioned").RunWith(conn).QueryRow()),
+	)
+
+	// rows out of the partitions go to the default partition
+	for _, shift := range []string{"2 days", "-10 days"} {
+		span, _ = klogga.Start(testutil.Timeout())
+		span.SetComponent("partitioned")
+		require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+		_, err = conn.Exec(
+			`UPDATE audit.partitioned SET "time" = "time" + $1::interval WHERE id = $2`, shift, span.ID().Bytes(),
+		)
+		require.NoError(t, err)
+	}
+	countDefault := psql.Select("count(*)").From("audit.partitioned_default")
+	require.Equal(t, 2, conn.ScanInt(countDefault.RunWith(conn).QueryRow()))
+
+	// the expired row is deleted, the other one is moved to the created partition
+	pgPremake, _ := PgConnConf(
+		t, &postgres.Conf{
+			Partitioning: &postgres.PartitionConf{Premake: 2},
+			Retention:    &postgres.RetentionConf{Default: 24 * time.Hour},
+		},
+	)
+	defer func() { require.NoError(t, pgPremake.Shutdown(testutil.Timeout())) }()
+	require.NoError(t, pgPremake.Maintain(testutil.Timeout()))
+	require.Zero(t, conn.ScanInt(countDefault.RunWith(conn).QueryRow()))
+	require.Equal(t, 4, conn.ScanInt(countPartitions.RunWith(conn).QueryRow()))
+	require.Equal(
+		t, 2, conn.ScanInt(psql.Select("count(*)").From("audit.partitioned").RunWith(conn).QueryRow()),
+	)
+}
+
+func TestPartitionRetention(t *testing.T) {
+	pg, conn := PgConnConf(
+		t, &postgres.Conf{
+			Partitioning: &postgres.PartitionConf{Premake: 1},
+			Retention: &postgres.RetentionConf{
+				Default: 48 * time.Hour,
+				Tables:  map[string]time.Duration{"kept_forever": -1},
+			},
+		},
+	)
+	defer func() { require.NoError(t, pg.Shutdown(testutil.Timeout())) }()
+	conn.DropIfExists("audit.retained").DropIfExists("audit.kept_forever")
+
+	for _, table := range []string{"retained", "kept_forever"} {
+		span, _ := klogga.Start(testutil.Timeout())
+		span.SetComponent(klogga.ComponentName(table))
+		require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+		_, err := conn.Exec(
+			"CREATE TABLE audit." + table + "_p20000101 PARTITION OF audit." + table +
+				" FOR VALUES FROM ('2000-01-01 00:00:00') TO ('2000-01-02 00:00:00')",
+		)
+		require.NoError(t, err)
+	}
+	// the row older than the retention is deleted from the default partition too
+	_, err := conn.Exec(`UPDATE audit.retained SET "time" = "time" - interval '10 days'`)
+	require.NoError(t, err)
+	require.NoError(t, pg.Maintain(testutil.Timeout()))
+
+	countTable := func(name string) int {
+		return conn.ScanInt(
+			psql.Select("count(*)").From("pg_class").Where(squirrel.Eq{"relname": name}).RunWith(conn).QueryRow(),
+		)
+	}
+	require.Zero(t, countTable("retained_p20000101"), "dropped by the default retention")
+	require.Equal(t, 1, countTable("kept_forever_p20000101"), "kept by the table retention")
+	require.Zero(t, conn.ScanInt(psql.Select("count(*)").From("audit.retained").RunWith(conn).QueryRow()))
+	require.Equal(t, 1, conn.ScanInt(psql.Select("count(*)").From("audit.kept_forever").RunWith(conn).QueryRow()))
+}
+
+func TestMaintainConcurrentWithReads(t *testing.T) {
+	pg, conn := PgConnConf(
+		t, &postgres.Conf{
+			Partitioning:         &postgres.PartitionConf{Premake: 1},
+			Indexes:              &postgres.IndexConf{},
+			SchemaReloadInterval: time.Nanosecond,
+		},
+	)
+	defer func() { require.NoError(t, pg.Shutdown(testutil.Timeout())) }()
+	conn.DropIfExists("audit.maintained")
+
+	// the goroutines report the errors, the test fails in its own goroutine
+	errs := make(chan error, 30)
+	wg := sync.WaitGroup{}
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			span, _ := klogga.Start(testutil.Timeout())
+			span.SetComponent("maintained")
+			span.Tag("tag"+strconv.Itoa(i), i)
+			errs <- pg.Write(testutil.Timeout(), klogga.SpanSlice{span})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			errs <- pg.Maintain(testutil.Timeout())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			_, err := pg.FindSpans(testutil.Timeout(), postgres.SpanQuery{Components: []klogga.ComponentName{"maintained"}})
+			errs <- err
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	spans, err := pg.FindSpans(testutil.Timeout(), postgres.SpanQuery{Components: []klogga.ComponentName{"maintained"}})
+	require.NoError(t, err)
+	require.Len(t, spans, 10)
+}
+
+func TestIndexes(t *testing.T) {
+	pg, conn := PgConnConf(t, &postgres.Conf{Indexes: &postgres.IndexConf{Deny: []string{"parent"}}})
+	conn.DropIfExists("audit.indexed")
+
+	span, _ := klogga.Start(testutil.Timeout())
+	span.SetComponent("indexed")
+	span.Tag("user", "u").Val("count", 1)
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+
+	span, _ = klogga.Start(testutil.Timeout())
+	span.SetComponent("indexed")
+	span.Tag("session", "s").ValAsObj("payload", map[string]int{"a": 1})
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+
+	indexes := func() []string {
+		rows, err := psql.Select("indexname").From("pg_indexes").
+			Where(squirrel.Eq{"schemaname": "audit", "tablename": "indexed"}).OrderBy("indexname").
+			RunWith(conn).Query()
+		require.NoError(t, err)
+		var res []string
+		for rows.Next() {
+			var name string
+			require.NoError(t, rows.Scan(&name))
+			res = append(res, name)
+		}
+		require.NoError(t, rows.Close())
+		return res
+	}
+	expected := []string{
+		"indexed_payload_idx", "indexed_session_idx", "indexed_time_idx", "indexed_trace_id_idx", "indexed_user_idx",
+	}
+	// indexes of the added columns are built in background
+	require.Eventually(
+		t, func() bool { return len(indexes()) == len(expected) }, 5*time.Second, 50*time.Millisecond,
+	)
+	require.Equal(t, expected, indexes())
+}
+
+func TestIndexesPartitioned(t *testing.T) {
+	pg, conn := PgConnConf(
+		t, &postgres.Conf{
+			Partitioning: &postgres.PartitionConf{Premake: 1},
+			Indexes:      &postgres.IndexConf{Allow: []string{"user"}},
+		},
+	)
+	defer func() { require.NoError(t, pg.Shutdown(testutil.Timeout())) }()
+	conn.DropIfExists("audit.indexed_partitioned")
+
+	span, _ := klogga.Start(testutil.Timeout())
+	span.SetComponent("indexed_partitioned")
+	span.Val("count", 1)
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+
+	span, _ = klogga.Start(testutil.Timeout())
+	span.SetComponent("indexed_partitioned")
+	span.Tag("user", "u")
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+
+	// the index of the partitioned table is valid when the indexes of all the partitions are attached
+	valid := psql.Select("count(*)").From("pg_index").
+		Where("indexrelid = 'audit.indexed_partitioned_user_idx'::regclass AND indisvalid")
+	require.Eventually(
+		t, func() bool { return conn.ScanInt(valid.RunWith(conn).QueryRow()) == 1 }, 5*time.Second, 50*time.Millisecond,
+	)
+	attached := psql.Select("count(*)").From("pg_inherits").
+		Where("inhparent = 'audit.indexed_partitioned_user_idx'::regclass")
+	require.Equal(t, 3, conn.ScanInt(attached.RunWith(conn).QueryRow()), "default, today, tomorrow")
+}
+
+func TestIndexesPartitionedMaintain(t *testing.T) {
+	pg, conn := PgConnConf(
+		t, &postgres.Conf{
+			Partitioning: &postgres.PartitionConf{Premake: 1},
+			Indexes:      &postgres.IndexConf{Allow: []string{"user"}},
+		},
+	)
+	defer func() { require.NoError(t, pg.Shutdown(testutil.Timeout())) }()
+	conn.DropIfExists("audit.indexed_maintained")
+
+	span, _ := klogga.Start(testutil.Timeout())
+	span.SetComponent("indexed_maintained")
+	span.Val("count", 1)
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+
+	span, _ = klogga.Start(testutil.Timeout())
+	span.SetComponent("indexed_maintained")
+	span.Tag("user", "u")
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+
+	valid := psql.Select("count(*)").From("pg_index").
+		Where("indexrelid = 'audit.indexed_maintained_user_idx'::regclass AND indisvalid")
+	require.Eventually(
+		t, func() bool { return conn.ScanInt(valid.RunWith(conn).QueryRow()) == 1 }, 5*time.Second, 50*time.Millisecond,
+	)
+	// the row of the day after tomorrow is in the default partition until its partition is created
+	_, err := conn.Exec(`UPDATE audit.indexed_maintained SET "time" = "time" + interval '2 days' WHERE id = $1`, span.ID().Bytes())
+	require.NoError(t, err)
+
+	// the partition created by the maintenance gets the index attached, the moved row is kept
+	pgPremake, _ := PgConnConf(
+		t, &postgres.Conf{
+			Partitioning: &postgres.PartitionConf{Premake: 2},
+			Indexes:      &postgres.IndexConf{Allow: []string{"user"}},
+		},
+	)
+	defer func() { require.NoError(t, pgPremake.Shutdown(testutil.Timeout())) }()
+	require.NoError(t, pgPremake.Maintain(testutil.Timeout()))
+
+	attached := psql.Select("count(*)").From("pg_inherits").
+		Where("inhparent = 'audit.indexed_maintained_user_idx'::regclass")
+	require.Equal(t, 4, conn.ScanInt(attached.RunWith(conn).QueryRow()), "default and 3 days")
+	require.Equal(t, 1, conn.ScanInt(valid.RunWith(conn).QueryRow()))
+	require.Zero(t, conn.ScanInt(psql.Select("count(*)").From("audit.indexed_maintained_default").RunWith(conn).QueryRow()))
+	require.Equal(
+		t, 2, conn.ScanInt(psql.Select("count(*)").From("audit.indexed_maintained").RunWith(conn).QueryRow()),
+	)
+}
+
+func TestShutdownDuringIndexBuild(t *testing.T) {
+	pg, conn := PgConnConf(t, &postgres.Conf{Indexes: &postgres.IndexConf{}})
+	conn.DropIfExists("audit.indexed_shutdown")
+
+	span, _ := klogga.Start(testutil.Timeout())
+	span.SetComponent("indexed_shutdown")
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+	span, _ = klogga.Start(testutil.Timeout())
+	span.SetComponent("indexed_shutdown")
+	span.Tag("user", "u").Tag("session", "s")
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+	require.NoError(t, pg.Shutdown(testutil.Timeout()))
+	// the connection of the exporter is closed by Shutdown
+	_, conn = PgConnConf(t, &postgres.Conf{})
+
+	// the build is either finished or cancelled and its invalid index dropped, nothing is built later
+	invalid := psql.Select("count(*)").From("pg_index").
+		Where("indrelid = 'audit.indexed_shutdown'::regclass AND NOT indisvalid")
+	require.Zero(t, conn.ScanInt(invalid.RunWith(conn).QueryRow()))
+	indexes := psql.Select("count(*)").From("pg_indexes").
+		Where(squirrel.Eq{"schemaname": "audit", "tablename": "indexed_shutdown"})
+	count := conn.ScanInt(indexes.RunWith(conn).QueryRow())
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, count, conn.ScanInt(indexes.RunWith(conn).QueryRow()))
+}
+
+func TestHostileNames(t *testing.T) {
+	pg, conn := PgConn(t)
+	table := `audit."evil___drop_table_audit_error_postgres____"`
+	conn.DropIfExists(table)
+
+	span, _ := klogga.Start(testutil.Timeout())
+	span.SetComponent(`evil"; DROP TABLE audit.error_postgres; --`)
+	span.Tag(`x" text); DROP TABLE audit.error_postgres; --`, "val").Tag("a.b", 1).Tag(strings.Repeat("long", 20), 2)
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+
+	count := psql.Select("count(*)").From(table).
+		Where(squirrel.Eq{"a_b": 1, postgres.NormalizeIdentifier(strings.Repeat("long", 20)): 2})
+	require.Equal(t, 1, conn.ScanInt(count.RunWith(conn).QueryRow()))
+	require.Equal(
+		t, 0, conn.ScanInt(psql.Select("count(*)").From(postgres.ErrorPostgresTable).
+			Where(squirrel.Eq{"id": span.ID().Bytes()}).RunWith(conn).QueryRow()),
+	)
+}
+
+func TestTrace(t *testing.T) {
+	pg, conn := PgConnConf(t, &postgres.Conf{Types: postgres.CommonTypes()})
+	conn.DropIfExists("audit.trace_front").DropIfExists("audit.trace_back")
+
+	id := uuid.New()
+	front, ctx := klogga.Start(testutil.Timeout())
+	front.SetComponent("trace_front")
+	front.Tag("uid", id).Val("took", 1500*time.Millisecond)
+	back, _ := klogga.Start(ctx)
+	back.SetComponent("trace_back")
+	back.Tag("uid", id).Tag("ip", net.ParseIP("10.0.0.1")).ValAsObj("payload", map[string]int{"a": 1})
+	back.ErrVoid(errors.New("boom"))
+	other := klogga.StartLeaf(testutil.Timeout())
+	other.SetComponent("trace_back")
+	other.Tag("uid", uuid.New())
+	back.Stop()
+	front.Stop()
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{front, back, other}))
+
+	spans, err := pg.Trace(testutil.Timeout(), front.TraceID())
+	require.NoError(t, err)
+	require.Len(t, spans, 2)
+	require.Equal(t, front.ID(), spans[0].ID())
+	require.Equal(t, klogga.ComponentName("trace_front"), spans[0].Component())
+	require.Equal(t, front.Duration(), spans[0].Duration())
+	require.Equal(t, map[string]interface{}{"uid": id}, spans[0].Tags())
+	require.Equal(t, map[string]interface{}{"took": 1500 * time.Millisecond}, spans[0].Vals())
+	require.Equal(t, back.ID(), spans[1].ID())
+	require.Equal(t, front.ID(), spans[1].ParentID())
+	require.Equal(t, back.PackageClass(), spans[1].PackageClass())
+	require.Equal(t, map[string]interface{}{"uid": id, "ip": net.ParseIP("10.0.0.1")}, spans[1].Tags())
+	require.JSONEq(t, `{"a":1}`, spans[1].Vals()["payload"].(*klogga.ObjectVal).String())
+	require.EqualError(t, spans[1].Errs(), "boom")
+
+	spans, err = pg.FindSpans(
+		testutil.Timeout(), postgres.SpanQuery{
+			From:       front.StartedTs().Add(-time.Minute),
+			Components: []klogga.ComponentName{"trace_back"},
+			Tags:       map[string]interface{}{"uid": id},
+			Errors:     postgres.WithErr,
+		},
+	)
+	require.NoError(t, err)
+	require.Len(t, spans, 1)
+	require.Equal(t, back.ID(), spans[0].ID())
+
+	spans, err = pg.FindSpans(
+		testutil.Timeout(), postgres.SpanQuery{
+			Components: []klogga.ComponentName{"trace_front", "trace_back"},
+			Errors:     postgres.WithoutErr,
+		},
+	)
+	require.NoError(t, err)
+	require.Len(t, spans, 2)
+	require.Equal(t, front.ID(), spans[0].ID())
+	require.Equal(t, other.ID(), spans[1].ID())
+}
+
+func TestTraceDurationWithTypes(t *testing.T) {
+	pg, conn := PgConnConf(t, &postgres.Conf{Types: postgres.CommonTypes()})
+	conn.DropIfExists("audit.trace_duration")
+
+	// the system column keeps nanoseconds, the interval val is rounded to microseconds
+	duration := 1500*time.Millisecond + 1234*time.Nanosecond
+	span := klogga.StartLeaf(testutil.Timeout(), klogga.WithDone(time.Now().Add(-duration), duration))
+	span.SetComponent("trace_duration")
+	span.Val("took", duration)
+	require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+
+	row := psql.Select("data_type").From("information_schema.columns").
+		Where(squirrel.Eq{"table_schema": "audit", "table_name": "trace_duration", "column_name": "took"}).
+		RunWith(conn).QueryRow()
+	require.Equal(t, "interval", conn.ScanString(row))
+	spans, err := pg.Trace(testutil.Timeout(), span.TraceID())
+	require.NoError(t, err)
+	require.Len(t, spans, 1)
+	require.Equal(t, duration, spans[0].Duration())
+	require.Equal(t, duration.Truncate(time.Microsecond), spans[0].Vals()["took"])
+}
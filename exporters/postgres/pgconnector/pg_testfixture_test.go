@@ -39,6 +39,11 @@ func (sql SQLTestEx) ScanString(row squirrel.RowScanner) (res string) {
 }
 
 func PgConn(t *testing.T) (*postgres.Exporter, SQLTestEx) {
+	t.Helper()
+	return PgConnConf(t, &postgres.Conf{})
+}
+
+func PgConnConf(t *testing.T, conf *postgres.Conf) (*postgres.Exporter, SQLTestEx) {
 	t.Helper()
 	if testing.Short() {
 		t.Skip("longer integration test")
@@ -51,7 +56,7 @@ func PgConn(t *testing.T) (*postgres.Exporter, SQLTestEx) {
 	require.NoError(t, err)
 
 	return postgres.New(
-		&postgres.Conf{},
+		conf,
 		pgConn,
 		klogga.NewTestErrTracker(t, klogga.NewFactory(golog.New(nil)).NamedPkg()),
 	), SQLTestEx{conn, t}
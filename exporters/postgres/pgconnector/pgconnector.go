@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/KasperskyLab/klogga/exporters/postgres"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"sync"
 )
@@ -80,6 +81,6 @@ func (p *PgConnector) CreateSchemaIfNotExists(ctx context.Context, schema string
 	if err != nil {
 		return err
 	}
-	_, err = conn.Exec("create schema if not exists " + schema)
+	_, err = conn.Exec("create schema if not exists " + pq.QuoteIdentifier(schema))
 	return err
 }
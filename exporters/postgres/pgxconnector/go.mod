@@ -0,0 +1,34 @@
+module github.com/KasperskyLab/klogga/exporters/postgres/pgxconnector
+
+go 1.18
+
+require (
+	github.com/KasperskyLab/klogga v0.0.0-00010101000000-000000000000
+	github.com/google/uuid v1.3.0
+	github.com/jackc/pgx/v5 v5.2.0
+	github.com/pkg/errors v0.9.1
+	github.com/stretchr/testify v1.8.1
+	go.uber.org/atomic v1.10.0
+)
+
+require (
+	github.com/Masterminds/squirrel v1.5.3 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/mock v1.6.0 // indirect
+	github.com/hashicorp/errwrap v1.1.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	github.com/hashicorp/go-version v1.6.0 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20200714003250-2b9c44734f2b // indirect
+	github.com/jackc/puddle/v2 v2.1.2 // indirect
+	github.com/lann/builder v0.0.0-20180802200727-47ae307949d0 // indirect
+	github.com/lann/ps v0.0.0-20150810152359-62de8c46ede0 // indirect
+	github.com/lib/pq v1.10.4 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/crypto v0.0.0-20220829220503-c86fa9a7ed90 // indirect
+	golang.org/x/sync v0.0.0-20220929204114-8fcdb60fdcc0 // indirect
+	golang.org/x/text v0.4.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/KasperskyLab/klogga => ../../..
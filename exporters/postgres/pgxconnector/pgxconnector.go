@@ -0,0 +1,224 @@
+package pgxconnector
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/KasperskyLab/klogga/exporters/postgres"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PgxConnector postgres.Connector based on pgx, spans are written with the binary COPY through the pgx pool
+// the pool checks idle connections every HealthCheckPeriod and drops the broken ones
+// schema queries go through database/sql with the pgx driver, as postgres.Connection is database/sql based
+// Start doesn't need to be explicitly called, but it is preferred to check connections
+// the connector can't be used after Stop
+type PgxConnector struct {
+	// ConnectionString pgx connection string, pool_* params of pgxpool are supported too
+	ConnectionString string
+	// MaxConns of the pool and of the database/sql connections each, pgxpool default if zero
+	MaxConns int32
+	// HealthCheckPeriod of the idle pool connections, pgxpool default if zero
+	HealthCheckPeriod time.Duration
+
+	connLock sync.Mutex
+	conn     *Connection
+	stopped  bool
+}
+
+var errStopped = errors.New("pgx connector is stopped")
+
+// Connection postgres.CopyFromConnection and postgres.TableCacheConnection, Close doesn't close the pool
+type Connection struct {
+	*sql.DB
+	Pool *pgxpool.Pool
+
+	// column OIDs of the tables per column list, guarded by oidsLock
+	oidsLock sync.Mutex
+	oids     map[string]map[string][]uint32
+	stopped  atomic.Bool
+}
+
+func newConnection(db *sql.DB, pool *pgxpool.Pool) *Connection {
+	return &Connection{DB: db, Pool: pool, oids: map[string]map[string][]uint32{}}
+}
+
+func (c *Connection) Close() error {
+	return nil
+}
+
+// CopyFrom binary COPY of the rows, values that pgx can't write in binary format,
+// like strings for uuid or inet columns, are parsed from text, the rows are changed in place
+// column types are cached until the table is invalidated or the COPY fails
+func (c *Connection) CopyFrom(
+	ctx context.Context, schema, tableName string, columns []string, rows [][]interface{},
+) (int64, error) {
+	if c.stopped.Load() {
+		return 0, errStopped
+	}
+	conn, err := c.Pool.Acquire(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to acquire connection")
+	}
+	defer conn.Release()
+
+	table := pgx.Identifier{schema, tableName}.Sanitize()
+	quoted := make([]string, 0, len(columns))
+	for _, col := range columns {
+		quoted = append(quoted, pgx.Identifier{col}.Sanitize())
+	}
+	oids, err := c.columnOids(
+		table, strings.Join(quoted, ","), func() ([]uint32, error) {
+			sd, err := conn.Conn().Prepare(ctx, "", fmt.Sprintf("select %s from %s", strings.Join(quoted, ","), table))
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to describe columns")
+			}
+			oids := make([]uint32, 0, len(sd.Fields))
+			for _, f := range sd.Fields {
+				oids = append(oids, f.DataTypeOID)
+			}
+			return oids, nil
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	if err := binaryValues(conn.Conn().TypeMap(), columns, oids, rows); err != nil {
+		c.InvalidateTable(schema, tableName)
+		return 0, err
+	}
+	n, err := conn.CopyFrom(ctx, pgx.Identifier{schema, tableName}, columns, pgx.CopyFromRows(rows))
+	if err != nil {
+		// the table could be changed by someone else
+		c.InvalidateTable(schema, tableName)
+	}
+	return n, err
+}
+
+// columnOids cached OIDs of the columns of the table, describe is called if they are not cached
+func (c *Connection) columnOids(table, columns string, describe func() ([]uint32, error)) ([]uint32, error) {
+	c.oidsLock.Lock()
+	oids, ok := c.oids[table][columns]
+	c.oidsLock.Unlock()
+	if ok {
+		return oids, nil
+	}
+	oids, err := describe()
+	if err != nil {
+		return nil, err
+	}
+	c.oidsLock.Lock()
+	defer c.oidsLock.Unlock()
+	if c.oids[table] == nil {
+		c.oids[table] = map[string][]uint32{}
+	}
+	c.oids[table][columns] = oids
+	return oids, nil
+}
+
+// InvalidateTable drops the cached column types of the table
+func (c *Connection) InvalidateTable(schema, tableName string) {
+	c.oidsLock.Lock()
+	defer c.oidsLock.Unlock()
+	delete(c.oids, pgx.Identifier{schema, tableName}.Sanitize())
+}
+
+// binaryValues parses text representation of the values that can't be encoded in binary format as is
+func binaryValues(m *pgtype.Map, columns []string, oids []uint32, rows [][]interface{}) error {
+	for _, row := range rows {
+		for i, val := range row {
+			s, ok := val.(string)
+			if !ok || m.PlanEncode(oids[i], pgx.BinaryFormatCode, val) != nil {
+				continue
+			}
+			dt, ok := m.TypeForOID(oids[i])
+			if !ok {
+				continue
+			}
+			parsed, err := dt.Codec.DecodeValue(m, oids[i], pgx.TextFormatCode, []byte(s))
+			if err != nil {
+				return errors.Wrapf(err, "unable to parse %s value of %s", dt.Name, columns[i])
+			}
+			row[i] = parsed
+		}
+	}
+	return nil
+}
+
+func (p *PgxConnector) Start(ctx context.Context) error {
+	conn, err := p.tryInitConnection(ctx)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(conn.Pool.Ping(ctx), "pg ping failed")
+}
+
+func (p *PgxConnector) tryInitConnection(ctx context.Context) (*Connection, error) {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	if p.stopped {
+		return nil, errStopped
+	}
+	if p.conn != nil {
+		return p.conn, nil
+	}
+	config, err := pgxpool.ParseConfig(p.ConnectionString)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad pg connection string")
+	}
+	if p.MaxConns > 0 {
+		config.MaxConns = p.MaxConns
+	}
+	if p.HealthCheckPeriod > 0 {
+		config.HealthCheckPeriod = p.HealthCheckPeriod
+	}
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "pg connect failed: %s", config.ConnConfig.Host)
+	}
+	db := stdlib.OpenDB(*config.ConnConfig.Copy())
+	db.SetMaxOpenConns(int(config.MaxConns))
+	p.conn = newConnection(db, pool)
+	return p.conn, nil
+}
+
+func (p *PgxConnector) GetConnection(ctx context.Context) (postgres.Connection, error) {
+	conn, err := p.tryInitConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Stop closes the pool, the connections that are still used by the exporter fail
+func (p *PgxConnector) Stop(_ context.Context) error {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	p.stopped = true
+	if p.conn == nil {
+		return nil
+	}
+	p.conn.stopped.Store(true)
+	p.conn.Pool.Close()
+	err := p.conn.DB.Close()
+	p.conn = nil
+	return err
+}
+
+// CreateSchemaIfNotExists shorthand to create schema, if you don't want to do in manually
+func (p *PgxConnector) CreateSchemaIfNotExists(ctx context.Context, schema string) error {
+	conn, err := p.tryInitConnection(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Pool.Exec(ctx, "create schema if not exists "+pgx.Identifier{schema}.Sanitize())
+	return err
+}
@@ -0,0 +1,159 @@
+package pgxconnector
+
+import (
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/exporters/golog"
+	"github.com/KasperskyLab/klogga/exporters/postgres"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBinaryValues(t *testing.T) {
+	m := pgtype.NewMap()
+	oid := func(name string) uint32 {
+		dt, ok := m.TypeForName(name)
+		require.True(t, ok)
+		return dt.OID
+	}
+	id := uuid.New()
+	columns := []string{"uid", "ip", "took", "text", "count", "empty"}
+	oids := []uint32{oid("uuid"), oid("inet"), oid("interval"), oid("text"), oid("int8"), oid("uuid")}
+	rows := [][]interface{}{{id.String(), "10.0.0.1", "00:00:01.500000", "text", 5, nil}}
+	require.NoError(t, binaryValues(m, columns, oids, rows))
+	require.Equal(
+		t, []interface{}{
+			[16]byte(id), netip.MustParsePrefix("10.0.0.1/32"), pgtype.Interval{Microseconds: 1500000, Valid: true},
+			"text", 5, nil,
+		}, rows[0],
+	)
+	for i, val := range rows[0] {
+		_, err := m.Encode(oids[i], pgtype.BinaryFormatCode, val, nil)
+		require.NoError(t, err, columns[i])
+	}
+
+	err := binaryValues(m, columns[:1], oids[:1], [][]interface{}{{"not a uuid"}})
+	require.ErrorContains(t, err, "unable to parse uuid value of uid")
+}
+
+func TestColumnOidsCache(t *testing.T) {
+	c := newConnection(nil, nil)
+	describes := 0
+	describe := func() ([]uint32, error) {
+		describes++
+		return []uint32{uint32(describes)}, nil
+	}
+	table := pgx.Identifier{postgres.DefaultSchema, "comp"}.Sanitize()
+	oids, err := c.columnOids(table, `"a"`, describe)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{1}, oids)
+	oids, err = c.columnOids(table, `"a"`, describe)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{1}, oids, "cached")
+	oids, err = c.columnOids(table, `"a","b"`, describe)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{2}, oids, "per column list")
+
+	c.InvalidateTable(postgres.DefaultSchema, "comp")
+	oids, err = c.columnOids(table, `"a"`, describe)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{3}, oids, "described again after the table is changed")
+}
+
+func TestUseAfterStop(t *testing.T) {
+	// the pool connects lazily
+	connector := &PgxConnector{ConnectionString: "postgres://localhost:1/klogga"}
+	conn, err := connector.GetConnection(testutil.Timeout())
+	require.NoError(t, err)
+	require.NoError(t, connector.Stop(testutil.Timeout()))
+
+	_, err = conn.(postgres.CopyFromConnection).CopyFrom(testutil.Timeout(), "audit", "comp", []string{"a"}, nil)
+	require.ErrorIs(t, err, errStopped)
+	_, err = connector.GetConnection(testutil.Timeout())
+	require.ErrorIs(t, err, errStopped)
+	require.ErrorIs(t, connector.Start(testutil.Timeout()), errStopped)
+	require.NoError(t, connector.Stop(testutil.Timeout()))
+}
+
+func TestWrite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("longer integration test")
+	}
+	connector := &PgxConnector{ConnectionString: testutil.IntegrationEnv(t, "KLOGGA_PG_CONNECTION_STRING")}
+	require.NoError(t, connector.Start(testutil.Timeout()))
+	defer func() { require.NoError(t, connector.Stop(testutil.Timeout())) }()
+	require.NoError(t, connector.CreateSchemaIfNotExists(testutil.Timeout(), postgres.DefaultSchema))
+	conn := connector.conn
+	_, err := conn.ExecContext(testutil.Timeout(), "DROP TABLE IF EXISTS audit.pgx_component")
+	require.NoError(t, err)
+
+	pg := postgres.New(
+		&postgres.Conf{Types: postgres.CommonTypes()}, connector,
+		klogga.NewTestErrTracker(t, klogga.NewFactory(golog.New(nil)).NamedPkg()),
+	)
+	id := uuid.New()
+	spans := klogga.SpanSlice{}
+	for i := 0; i < 10; i++ {
+		span, _ := klogga.Start(testutil.Timeout())
+		span.SetComponent("pgx_component")
+		span.Tag("uid", id).Tag("ip", net.ParseIP("10.0.0.1")).Val("took", 1500*time.Millisecond).Val("i", i)
+		span.ValAsObj("payload", map[string]int{"i": i})
+		spans = append(spans, span)
+	}
+	require.NoError(t, pg.Write(testutil.Timeout(), spans))
+
+	var count, sum int
+	var took float64
+	var uid, ip string
+	require.NoError(
+		t, conn.QueryRowContext(
+			testutil.Timeout(),
+			"SELECT count(*), sum(i), max(extract(epoch from took)), min(uid::text), min(host(ip)) FROM audit.pgx_component "+
+				"WHERE (payload->>'i')::int = i",
+		).Scan(&count, &sum, &took, &uid, &ip),
+	)
+	require.Equal(t, 10, count)
+	require.Equal(t, 45, sum)
+	require.Equal(t, 1.5, took)
+	require.Equal(t, id.String(), uid)
+	require.Equal(t, "10.0.0.1", ip)
+}
+
+func TestWriteWidened(t *testing.T) {
+	if testing.Short() {
+		t.Skip("longer integration test")
+	}
+	connector := &PgxConnector{ConnectionString: testutil.IntegrationEnv(t, "KLOGGA_PG_CONNECTION_STRING")}
+	require.NoError(t, connector.Start(testutil.Timeout()))
+	defer func() { require.NoError(t, connector.Stop(testutil.Timeout())) }()
+	require.NoError(t, connector.CreateSchemaIfNotExists(testutil.Timeout(), postgres.DefaultSchema))
+	conn := connector.conn
+	_, err := conn.ExecContext(testutil.Timeout(), "DROP TABLE IF EXISTS audit.pgx_widened")
+	require.NoError(t, err)
+
+	pg := postgres.New(
+		&postgres.Conf{ConflictStrategy: postgres.ConflictWiden}, connector,
+		klogga.NewTestErrTracker(t, klogga.NewFactory(golog.New(nil)).NamedPkg()),
+	)
+	for _, status := range []interface{}{200, "timeout"} {
+		span, _ := klogga.Start(testutil.Timeout())
+		span.SetComponent("pgx_widened")
+		span.Tag("status", status)
+		require.NoError(t, pg.Write(testutil.Timeout(), klogga.SpanSlice{span}))
+	}
+
+	// the cached bigint type of the column is invalidated when the column is widened
+	var statuses string
+	require.NoError(
+		t, conn.QueryRowContext(
+			testutil.Timeout(), "SELECT string_agg(status, ',' ORDER BY time) FROM audit.pgx_widened",
+		).Scan(&statuses),
+	)
+	require.Equal(t, "200,timeout", statuses)
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/KasperskyLab/klogga"
 	"github.com/pkg/errors"
 	"reflect"
-	"strings"
 	"time"
 )
 
@@ -105,7 +104,3 @@ func (e *ErrDescriptor) Err() error {
 func (e *ErrDescriptor) Warn() error {
 	return e.Span.Warns()
 }
-
-func toPgColumnName(name string) string {
-	return strings.ToLower(strings.ReplaceAll(name, "-", "_"))
-}
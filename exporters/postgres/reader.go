@@ -0,0 +1,337 @@
+package postgres
+
+import (
+	"context"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/constants"
+	"github.com/KasperskyLab/klogga/util/stringutil"
+	"github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultSchemaReloadInterval = time.Minute
+
+// ErrFilter error state of the spans found by FindSpans
+type ErrFilter int
+
+const (
+	// AnyErr spans with and without errors
+	AnyErr ErrFilter = iota
+	// WithErr only spans with errors, deferred errors included
+	WithErr
+	// WithoutErr only spans without errors
+	WithoutErr
+)
+
+// SpanQuery filters of FindSpans, zero fields match everything
+type SpanQuery struct {
+	TraceID klogga.TraceID
+	// From inclusive and To exclusive bounds of the span start time
+	From time.Time
+	To   time.Time
+	// Components tables to search in, all the tables of the schema if empty
+	Components []klogga.ComponentName
+	// Tags values of the span tags or vals, converted with Conf.Types, tables without these columns are skipped
+	Tags   map[string]interface{}
+	Errors ErrFilter
+	// Limit of the spans, the earliest spans are returned, no limit if zero
+	Limit int
+}
+
+// readTable snapshot of the cached table schema
+type readTable struct {
+	name   string
+	schema *TableSchema
+	tags   map[string]struct{}
+}
+
+// Trace spans of the trace from all the tables of the schema, ordered by start time
+func (e *Exporter) Trace(ctx context.Context, traceID klogga.TraceID) ([]*klogga.Span, error) {
+	return e.FindSpans(ctx, SpanQuery{TraceID: traceID})
+}
+
+// FindSpans spans of all the tables that match the query, ordered by start time
+// tables and columns are taken from the schema cache, it is reloaded after Conf.SchemaReloadInterval
+// or when the requested components are not in it, tables without klogga system columns are skipped
+// spans are restored with the tags and vals typed after the column types, parents are referenced by ParentID only,
+// columns created before the tags were marked are read as vals
+func (e *Exporter) FindSpans(ctx context.Context, q SpanQuery) ([]*klogga.Span, error) {
+	span, ctx := klogga.Start(ctx)
+	defer e.trs.Finish(span)
+
+	stale := time.Now()
+	tables, fresh := e.readTables(q.Components, stale)
+	if !fresh {
+		span.Val("reload", true)
+		if err := e.reloadSchemas(ctx, stale); err != nil {
+			return nil, span.Err(err)
+		}
+		tables, _ = e.readTables(q.Components, time.Now())
+	}
+	span.Val("tables_count", len(tables))
+
+	conn, err := e.connFactory.GetConnection(ctx)
+	if err != nil {
+		return nil, span.Err(errors.Wrap(err, messageUnableToConnectPG))
+	}
+	defer func() { span.DeferErr(conn.Close()) }()
+
+	res := make([]*klogga.Span, 0)
+	for _, table := range tables {
+		spans, err := e.findInTable(ctx, conn, table, q)
+		if err != nil {
+			return nil, span.Err(errors.Wrapf(err, "unable to read %s", table.name))
+		}
+		res = append(res, spans...)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].StartedTs().Before(res[j].StartedTs()) })
+	if q.Limit > 0 && len(res) > q.Limit {
+		res = res[:q.Limit]
+	}
+	span.Val("count", len(res))
+	return res, nil
+}
+
+// reloadSchemas loads the schemas unless they were loaded after the cache was found stale,
+// so the readers that find the cache stale at the same time reload it once
+func (e *Exporter) reloadSchemas(ctx context.Context, stale time.Time) error {
+	e.reloadLock.Lock()
+	defer e.reloadLock.Unlock()
+	e.tablesLock.Lock()
+	loaded := e.schemaLoaded
+	e.tablesLock.Unlock()
+	if loaded.After(stale) {
+		return nil
+	}
+	return e.loadSchemas(ctx)
+}
+
+// readTables snapshot of the tables of the components, or all of them, partitions are read through their parents
+// not fresh if the cache is older than the reload interval or some of the components are not in it
+func (e *Exporter) readTables(components []klogga.ComponentName, now time.Time) (_ []readTable, fresh bool) {
+	names := make(map[string]struct{}, len(components))
+	for _, c := range components {
+		names[e.identifier(stringutil.ToSnakeCase(c.String()))] = struct{}{}
+	}
+	e.tablesLock.Lock()
+	defer e.tablesLock.Unlock()
+	fresh = now.Sub(e.schemaLoaded) < e.cfg.SchemaReloadInterval
+	for name := range names {
+		if _, ok := e.tables[name]; !ok {
+			fresh = false
+		}
+	}
+	res := make([]readTable, 0, len(e.tables))
+	for _, name := range sortedKeys(e.tables) {
+		if _, ok := e.partitions[name]; ok {
+			continue
+		}
+		if _, ok := names[name]; len(names) > 0 && !ok {
+			continue
+		}
+		// tag columns are added under the lock, the snapshot gets a copy
+		tags := make(map[string]struct{}, len(e.tagColumns[name]))
+		for col := range e.tagColumns[name] {
+			tags[col] = struct{}{}
+		}
+		res = append(res, readTable{name: name, schema: e.tables[name], tags: tags})
+	}
+	return res, fresh
+}
+
+// spanQuerySql select of the table spans, false if the table can't have the spans of the query
+func (e *Exporter) spanQuerySql(table readTable, q SpanQuery) (string, []interface{}, bool) {
+	if !e.hasSysCols(table.schema) {
+		return "", nil, false
+	}
+	exprs := make([]string, 0, table.schema.ColumnsCount())
+	for _, col := range table.schema.Columns() {
+		exprs = append(exprs, selectExpr(col))
+	}
+	timeCol := pq.QuoteIdentifier(e.timeCol.Name)
+	sel := e.psql.Select(exprs...).From(quoteTable(e.cfg.SchemaName, table.name)).OrderBy(timeCol)
+	if !q.TraceID.IsZero() {
+		sel = sel.Where(squirrel.Eq{pq.QuoteIdentifier(constants.TraceID): q.TraceID.AsUUID()})
+	}
+	if !q.From.IsZero() {
+		sel = sel.Where(squirrel.GtOrEq{timeCol: q.From.UTC()})
+	}
+	if !q.To.IsZero() {
+		sel = sel.Where(squirrel.Lt{timeCol: q.To.UTC()})
+	}
+	for _, key := range sortedKeys(q.Tags) {
+		name := e.identifier(key)
+		if _, ok := table.schema.Column(name); !ok {
+			return "", nil, false
+		}
+		_, val := e.cfg.Types.PgTypeVal(q.Tags[key])
+		sel = sel.Where(squirrel.Eq{pq.QuoteIdentifier(name): val})
+	}
+	switch q.Errors {
+	case WithErr:
+		sel = sel.Where(squirrel.NotEq{`coalesce("error", '')`: ""})
+	case WithoutErr:
+		sel = sel.Where(squirrel.Eq{`coalesce("error", '')`: ""})
+	}
+	if q.Limit > 0 {
+		sel = sel.Limit(uint64(q.Limit))
+	}
+	query, args := sel.MustSql()
+	return query, args, true
+}
+
+func (e *Exporter) findInTable(ctx context.Context, conn Connection, table readTable, q SpanQuery) ([]*klogga.Span, error) {
+	query, args, ok := e.spanQuerySql(table, q)
+	if !ok {
+		return nil, nil
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, messageUnableToQuery)
+	}
+	defer func() { _ = rows.Close() }()
+
+	res := make([]*klogga.Span, 0)
+	for rows.Next() {
+		values := make([]interface{}, table.schema.ColumnsCount())
+		ptrs := make([]interface{}, len(values))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, errors.Wrap(err, messageUnableToScan)
+		}
+		span, err := e.spanFromRow(table, values)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, span)
+	}
+	return res, errors.Wrap(rows.Err(), messageUnableToQuery)
+}
+
+// spanFromRow restores the span from the values of the table columns
+func (e *Exporter) spanFromRow(table readTable, values []interface{}) (*klogga.Span, error) {
+	r := klogga.SpanRecord{
+		Component: klogga.ComponentName(table.name),
+		Tags:      map[string]interface{}{},
+		Vals:      map[string]interface{}{},
+	}
+	for i, col := range table.schema.Columns() {
+		val, err := readValue(col.DataType, values[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad value of %s", col.Name)
+		}
+		if val == nil {
+			continue
+		}
+		s, _ := val.(string)
+		bb, _ := val.([]byte)
+		switch col.Name {
+		case e.timeCol.Name:
+			r.Started, _ = val.(time.Time)
+		case "id":
+			r.ID = klogga.SpanIDFromBytesOrZero(bb)
+		case constants.TraceID:
+			id, _ := val.(uuid.UUID)
+			r.TraceID = klogga.TraceID(id)
+		case "host":
+			r.Host = s
+		case "pkg_class":
+			if i := strings.LastIndex(s, "."); i >= 0 {
+				r.Package, r.Class = s[:i], s[i+1:]
+			} else {
+				r.Package = s
+			}
+		case "name":
+			r.Name = s
+		case "parent":
+			r.ParentID = klogga.SpanIDFromBytesOrZero(bb)
+		case "error":
+			if s != "" {
+				r.Errs = errors.New(s)
+			}
+		case "warn":
+			if s != "" {
+				r.Warns = errors.New(s)
+			}
+		case "duration":
+			// bigint nanoseconds as written, interval if the table was created by another writer
+			switch d := val.(type) {
+			case int64:
+				r.Duration = time.Duration(d)
+			case time.Duration:
+				r.Duration = d
+			}
+		case "component":
+			if table.name == ErrorPostgresTableName && s != "" {
+				r.Component = klogga.ComponentName(s)
+				continue
+			}
+			fallthrough
+		default:
+			if _, isTag := table.tags[col.Name]; isTag {
+				r.Tags[col.Name] = val
+			} else {
+				r.Vals[col.Name] = val
+			}
+		}
+	}
+	r.Finished = r.Started.Add(r.Duration)
+	return klogga.SpanFromRecord(r), nil
+}
+
+// selectExpr column expression that database/sql drivers scan to the values readValue understands
+func selectExpr(col *ColumnSchema) string {
+	name := pq.QuoteIdentifier(col.Name)
+	switch col.DataType {
+	case "bigint", "integer", "smallint", "double precision", "real", "boolean", "bytea",
+		"text", "character varying", "timestamp without time zone", "timestamp with time zone":
+		return name
+	case "inet", "cidr":
+		return "host(" + name + ")"
+	case "interval":
+		return "(extract(epoch from " + name + ") * 1000000)::bigint"
+	default:
+		return name + "::text"
+	}
+}
+
+// readValue go value of the scanned column, the types are the ones Conf.Types and GetPgTypeVal write
+func readValue(dataType string, val interface{}) (interface{}, error) {
+	if bb, ok := val.([]byte); ok && dataType != "bytea" {
+		val = string(bb)
+	}
+	switch v := val.(type) {
+	case time.Time:
+		return v.UTC(), nil
+	case int64:
+		if dataType == "interval" {
+			return time.Duration(v) * time.Microsecond, nil
+		}
+	case string:
+		switch dataType {
+		case "uuid":
+			id, err := uuid.Parse(v)
+			if err != nil {
+				return nil, err
+			}
+			return id, nil
+		case "inet", "cidr":
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, errors.Errorf("bad ip: %s", v)
+			}
+			return ip, nil
+		case PgJsonbTypeName, "json":
+			return klogga.ValJson(v), nil
+		}
+	}
+	return val, nil
+}
@@ -0,0 +1,186 @@
+package postgres
+
+import (
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func readTestTable(pg *Exporter) readTable {
+	return readTable{
+		name: "pg_test",
+		schema: pg.sysCols.Merge(
+			[]*ColumnSchema{
+				{"user", "text", "", true}, {"uid", "uuid", "", true}, {"took", "interval", "", true},
+				{"payload", "jsonb", "", true}, {"count", "bigint", "", true},
+			},
+		),
+		tags: map[string]struct{}{"user": {}, "uid": {}},
+	}
+}
+
+func TestSpanFromRow(t *testing.T) {
+	pg := New(&Conf{Types: CommonTypes()}, nil, klogga.NilExporterTracer{})
+	ts := time.Date(2022, 3, 10, 12, 0, 0, 0, time.UTC)
+	id, parentID, traceID, uid := klogga.NewSpanID(), klogga.NewSpanID(), klogga.NewTraceID(), uuid.New()
+	span, err := pg.spanFromRow(
+		readTestTable(pg), []interface{}{
+			ts, id.Bytes(), traceID.AsUUID().String(), "host", "postgres.Exporter", "Write", parentID.Bytes(),
+			"boom", nil, int64(5 * time.Second), "u", []byte(uid.String()), int64(1500000), `{"a":1}`, int64(3),
+		},
+	)
+	require.NoError(t, err)
+
+	require.Equal(t, id, span.ID())
+	require.Equal(t, traceID, span.TraceID())
+	require.Equal(t, parentID, span.ParentID())
+	require.Equal(t, ts, span.StartedTs())
+	require.Equal(t, ts.Add(5*time.Second), span.FinishedTs())
+	require.Equal(t, klogga.ComponentName("pg_test"), span.Component())
+	require.Equal(t, "postgres", span.Package())
+	require.Equal(t, "Exporter", span.Class())
+	require.Equal(t, "Write", span.Name())
+	require.EqualError(t, span.Errs(), "boom")
+	require.False(t, span.HasWarn())
+	require.Equal(t, map[string]interface{}{"user": "u", "uid": uid}, span.Tags())
+	require.Equal(
+		t, map[string]interface{}{"took": 1500 * time.Millisecond, "payload": klogga.ValJson(`{"a":1}`), "count": int64(3)},
+		span.Vals(),
+	)
+}
+
+func TestSpanFromRowIntervalDuration(t *testing.T) {
+	pg := New(&Conf{Types: CommonTypes()}, nil, klogga.NilExporterTracer{})
+	cols := make([]*ColumnSchema, 0, pg.sysCols.ColumnsCount())
+	for _, col := range pg.sysCols.Columns() {
+		c := *col
+		if c.Name == "duration" {
+			c.DataType = "interval"
+		}
+		cols = append(cols, &c)
+	}
+	ts := time.Date(2022, 3, 10, 12, 0, 0, 0, time.UTC)
+	span, err := pg.spanFromRow(
+		readTable{name: "pg_test", schema: NewTableSchema(cols)}, []interface{}{
+			ts, klogga.NewSpanID().Bytes(), klogga.NewTraceID().AsUUID().String(), "host", "postgres.Exporter", "Write", nil,
+			nil, nil, int64(1500000),
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, 1500*time.Millisecond, span.Duration())
+}
+
+func TestReloadSchemasOnce(t *testing.T) {
+	pg := New(&Conf{}, brokenConnector{}, klogga.NilExporterTracer{})
+	now := time.Now()
+	pg.schemaLoaded = now
+	require.NoError(t, pg.reloadSchemas(testutil.Timeout(), now.Add(-time.Second)), "loaded by another reader")
+	require.Error(t, pg.reloadSchemas(testutil.Timeout(), now.Add(time.Second)), "loaded with the broken connector")
+}
+
+func TestReadValue(t *testing.T) {
+	ip, err := readValue("inet", "10.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, net.ParseIP("10.0.0.1"), ip)
+
+	ts, err := readValue("timestamp without time zone", time.Date(2022, 3, 10, 15, 0, 0, 0, time.FixedZone("", 3*3600)))
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2022, 3, 10, 12, 0, 0, 0, time.UTC), ts)
+
+	bb, err := readValue("bytea", []byte("bytes"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("bytes"), bb)
+
+	_, err = readValue("uuid", "not a uuid")
+	require.Error(t, err)
+	_, err = readValue("inet", "not an ip")
+	require.Error(t, err)
+}
+
+func TestSpanQuerySql(t *testing.T) {
+	pg := New(&Conf{Types: CommonTypes()}, nil, klogga.NilExporterTracer{})
+	table := readTestTable(pg)
+	traceID, uid := klogga.NewTraceID(), uuid.New()
+	from := time.Date(2022, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	query, args, ok := pg.spanQuerySql(
+		table, SpanQuery{
+			TraceID: traceID,
+			From:    from,
+			To:      from.Add(time.Hour),
+			Tags:    map[string]interface{}{"User": "u", "uid": uid},
+			Errors:  WithErr,
+			Limit:   10,
+		},
+	)
+	require.True(t, ok)
+	require.Equal(
+		t, `SELECT "time", "id", "trace_id"::text, "host", "pkg_class", "name", "parent", "error", "warn", "duration", `+
+			`"user", "uid"::text, (extract(epoch from "took") * 1000000)::bigint, "payload"::text, "count" `+
+			`FROM "audit"."pg_test" WHERE "trace_id" = $1 AND "time" >= $2 AND "time" < $3 AND "user" = $4 AND "uid" = $5 `+
+			`AND coalesce("error", '') <> $6 ORDER BY "time" LIMIT 10`,
+		query,
+	)
+	require.Equal(
+		t, []interface{}{traceID.AsUUID().String(), from, from.Add(time.Hour), "u", uid.String(), ""}, args,
+	)
+
+	_, _, ok = pg.spanQuerySql(table, SpanQuery{Tags: map[string]interface{}{"missing": 1}})
+	require.False(t, ok, "table without the tag column")
+	_, _, ok = pg.spanQuerySql(readTable{name: "other", schema: NewTableSchema(nil)}, SpanQuery{})
+	require.False(t, ok, "not a klogga table")
+}
+
+func TestReadTables(t *testing.T) {
+	pg := New(&Conf{}, nil, klogga.NilExporterTracer{})
+	for _, name := range []string{"comp", "comp_p20220310", "comp_default", "other_comp", ErrorPostgresTableName} {
+		pg.tables[name] = pg.sysCols
+	}
+	pg.partitions = map[string]struct{}{"comp_p20220310": {}, "comp_default": {}}
+	now := time.Now()
+	pg.schemaLoaded = now.Add(-time.Second)
+	names := func(components ...klogga.ComponentName) (res []string) {
+		tables, fresh := pg.readTables(components, now)
+		require.True(t, fresh)
+		for _, table := range tables {
+			res = append(res, table.name)
+		}
+		return res
+	}
+	require.Equal(t, []string{"comp", ErrorPostgresTableName, "other_comp"}, names())
+	require.Equal(t, []string{"other_comp"}, names("OtherComp"))
+
+	_, fresh := pg.readTables([]klogga.ComponentName{"comp", "missing"}, now)
+	require.False(t, fresh, "reloaded on a miss")
+	_, fresh = pg.readTables(nil, now.Add(pg.cfg.SchemaReloadInterval))
+	require.False(t, fresh, "reloaded after the interval")
+}
+
+func TestTagCommentStatements(t *testing.T) {
+	schema := NewTableSchema([]*ColumnSchema{{"user", "text", "", true}, {"count", "bigint", "", true}})
+	require.Equal(
+		t, `COMMENT ON COLUMN "audit"."pg_test"."user" IS 'tag';`+"\n",
+		schema.TagCommentStatements(DefaultSchema, "pg_test", map[string]struct{}{"user": {}, "missing": {}}),
+	)
+	require.Empty(t, schema.TagCommentStatements(DefaultSchema, "pg_test", nil))
+}
+
+func TestMergeLoaded(t *testing.T) {
+	pg := New(&Conf{}, nil, klogga.NilExporterTracer{})
+	// created and altered by the exporter while the schema was queried
+	pg.tables["created"] = pg.sysCols
+	pg.tables["altered"] = pg.sysCols.Merge([]*ColumnSchema{{"added", "text", "", true}})
+	pg.tagColumns["altered"] = map[string]struct{}{"added": {}}
+
+	tables := map[string]*TableSchema{"altered": pg.sysCols, "other": pg.sysCols}
+	tagColumns := map[string]map[string]struct{}{}
+	pg.mergeLoaded(tables, tagColumns, map[string]struct{}{}, nil)
+	require.Equal(t, []string{"altered", "created", "other"}, sortedKeys(tables))
+	_, ok := tables["altered"].Column("added")
+	require.True(t, ok)
+	require.Equal(t, map[string]struct{}{"added": {}}, tagColumns["altered"])
+}
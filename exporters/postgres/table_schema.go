@@ -2,6 +2,7 @@ package postgres
 
 import (
 	"fmt"
+	"github.com/lib/pq"
 	"strings"
 )
 
@@ -34,10 +35,12 @@ func (t *TableSchema) ColumnNames() []string {
 	return t.columnsNames
 }
 
-// GetAlterSchema returns missing columns' schema
-// returns spans that cannot be written just by adding columns
-func (t *TableSchema) GetAlterSchema(dataset RecordSet) (*TableSchema, []ErrDescriptor) {
+// GetAlterSchema returns missing columns' schema and the columns to be widened to the dataset types
+// returns spans that cannot be written just by adding or widening columns,
+// it happens when the table was changed after the dataset was created
+func (t *TableSchema) GetAlterSchema(dataset RecordSet) (*TableSchema, *TableSchema, []ErrDescriptor) {
 	alterSchema := NewTableSchema([]*ColumnSchema{})
+	widenSchema := NewTableSchema([]*ColumnSchema{})
 	errDescriptors := make([]ErrDescriptor, 0)
 
 	for _, colSchema := range dataset.Schema.Columns() {
@@ -45,29 +48,32 @@ func (t *TableSchema) GetAlterSchema(dataset RecordSet) (*TableSchema, []ErrDesc
 		if !found {
 			alterSchema.AddColumn(
 				ColumnSchema{
-					Name:     toPgColumnName(colSchema.Name),
+					Name:     colSchema.Name,
 					DataType: colSchema.DataType,
 				},
 			)
 			continue
 		}
-		if existingColSchema.DataType != colSchema.DataType {
-			for _, span := range dataset.Spans {
-				val := findColumnValue(span, colSchema.Name)
-				pgType, _ := GetPgTypeVal(val)
-				if !strings.EqualFold(pgType, existingColSchema.DataType) {
-					errDescriptors = append(errDescriptors, newErrDescriptor("", span, *colSchema, *existingColSchema))
-				}
+		if samePgType(existingColSchema.DataType, colSchema.DataType) {
+			continue
+		}
+		if samePgType(widerType(existingColSchema.DataType, colSchema.DataType), colSchema.DataType) {
+			widenSchema.AddColumn(*colSchema)
+			continue
+		}
+		for i, span := range dataset.Spans {
+			if _, ok := dataset.rows[i][colSchema.Name]; ok {
+				errDescriptors = append(errDescriptors, newErrDescriptor("", span, *colSchema, *existingColSchema))
 			}
 		}
 	}
-	return alterSchema, errDescriptors
+	return alterSchema, widenSchema, errDescriptors
 }
 
 func (t *TableSchema) Merge(newCols []*ColumnSchema) *TableSchema {
 	tCopy := NewTableSchema(t.columns)
 	for _, colSchema := range newCols {
-		tCopy.AddColumn(*colSchema)
+		tCopy.SetColumn(*colSchema)
 	}
 	return tCopy
 }
@@ -85,53 +91,83 @@ func (t *TableSchema) AddColumn(col ColumnSchema) {
 	t.mm[col.Name] = &col
 }
 
+// SetColumn adds the column or replaces the column with the same name
+// the replaced column is not changed, as it may be shared with other schemas
+func (t *TableSchema) SetColumn(col ColumnSchema) {
+	if _, ok := t.Column(col.Name); !ok {
+		t.AddColumn(col)
+		return
+	}
+	for i, c := range t.columns {
+		if c.Name == col.Name {
+			t.columns[i] = &col
+		}
+	}
+	t.mm[col.Name] = &col
+}
+
 func (t *TableSchema) Columns() []*ColumnSchema {
 	return t.columns
 }
 
-// InsertStatement NOT injection safe
+// InsertStatement identifiers are quoted, values are passed as parameters
 func (t *TableSchema) InsertStatement(schema string, tableName string) string {
 	paramsStr := "$1"
 	for i := 2; i <= t.ColumnsCount(); i++ {
 		paramsStr += fmt.Sprintf(",$%v", i)
 	}
+	columns := make([]string, 0, t.ColumnsCount())
+	for _, name := range t.ColumnNames() {
+		columns = append(columns, pq.QuoteIdentifier(name))
+	}
 	return fmt.Sprintf(
-		"INSERT INTO %v.%v (%s) VALUES (%s)",
-		schema, tableName,
-		strings.Join(t.ColumnNames(), ","),
+		"INSERT INTO %s (%s) VALUES (%s)",
+		quoteTable(schema, tableName),
+		strings.Join(columns, ","),
 		paramsStr,
 	)
 }
 
-// CreateTableStatement NOT injection safe
-func (t *TableSchema) CreateTableStatement(schema, tableName string, timeCol *ColumnSchema, useTimescale bool) string {
+// CreateTableStatement identifiers are quoted, data types are not, they come from the code or Conf.Types
+// partitioned declares the table partitioned by range of timeCol, partitions are created separately
+func (t *TableSchema) CreateTableStatement(
+	schema, tableName string, timeCol *ColumnSchema, useTimescale bool, partitioned bool,
+) string {
 	b := strings.Builder{}
 
-	b.WriteString(fmt.Sprintf("CREATE TABLE %s.%s\n", schema, tableName))
+	b.WriteString(fmt.Sprintf("CREATE TABLE %s\n", quoteTable(schema, tableName)))
 	b.WriteString("(\n")
 
 	for i, column := range t.columns {
 		if i != 0 {
 			b.WriteString(",\n")
 		}
-		b.WriteString(fmt.Sprintf("\"%v\" %v", column.Name, column.DataType))
+		b.WriteString(fmt.Sprintf("%s %v", pq.QuoteIdentifier(column.Name), column.DataType))
+	}
+	b.WriteString(")")
+	if partitioned && !useTimescale {
+		b.WriteString(fmt.Sprintf(" PARTITION BY RANGE (%s)", pq.QuoteIdentifier(timeCol.Name)))
 	}
-	b.WriteString(");\n")
+	b.WriteString(";\n")
 
 	if useTimescale {
-		b.WriteString(fmt.Sprintf("SELECT create_hypertable('%v.%v','%s');\n", schema, tableName, timeCol.Name))
+		b.WriteString(
+			fmt.Sprintf(
+				"SELECT create_hypertable(%s, %s);\n", quoteRegclass(schema, tableName), pq.QuoteLiteral(timeCol.Name),
+			),
+		)
 	}
 
 	return b.String()
 }
 
-// AlterTableStatement NOT injection safe
+// AlterTableStatement identifiers are quoted
 func (t *TableSchema) AlterTableStatement(schema, tableName string) string {
 	b := strings.Builder{}
-	b.WriteString(fmt.Sprintf("ALTER TABLE %v.%v\n", schema, tableName))
+	b.WriteString(fmt.Sprintf("ALTER TABLE %s\n", quoteTable(schema, tableName)))
 
 	for i, column := range t.columns {
-		b.WriteString(fmt.Sprintf("  ADD COLUMN \"%v\" %v", column.Name, column.DataType))
+		b.WriteString(fmt.Sprintf("  ADD COLUMN %s %v", pq.QuoteIdentifier(column.Name), column.DataType))
 		if i == len(t.columns)-1 {
 			b.WriteString(";\n")
 		} else {
@@ -141,6 +177,46 @@ func (t *TableSchema) AlterTableStatement(schema, tableName string) string {
 	return b.String()
 }
 
+// AlterColumnTypeStatement changes types of the table columns to the types of the schema
+// identifiers are quoted
+func (t *TableSchema) AlterColumnTypeStatement(schema, tableName string) string {
+	b := strings.Builder{}
+	b.WriteString(fmt.Sprintf("ALTER TABLE %s\n", quoteTable(schema, tableName)))
+
+	for i, column := range t.columns {
+		name := pq.QuoteIdentifier(column.Name)
+		b.WriteString(
+			fmt.Sprintf("  ALTER COLUMN %s TYPE %v USING %s::%v", name, column.DataType, name, column.DataType),
+		)
+		if i == len(t.columns)-1 {
+			b.WriteString(";\n")
+		} else {
+			b.WriteString(",\n")
+		}
+	}
+	return b.String()
+}
+
+// tagColumnComment marks the columns created for the span tags, to tell them from the vals when reading
+const tagColumnComment = "tag"
+
+// TagCommentStatements marks the columns of the schema that are in tags, identifiers are quoted
+func (t *TableSchema) TagCommentStatements(schema, tableName string, tags map[string]struct{}) string {
+	b := strings.Builder{}
+	for _, column := range t.columns {
+		if _, ok := tags[column.Name]; !ok {
+			continue
+		}
+		b.WriteString(
+			fmt.Sprintf(
+				"COMMENT ON COLUMN %s.%s IS %s;\n",
+				quoteTable(schema, tableName), pq.QuoteIdentifier(column.Name), pq.QuoteLiteral(tagColumnComment),
+			),
+		)
+	}
+	return b.String()
+}
+
 func (t *TableSchema) IsZero() bool {
 	return t.ColumnsCount() <= 0
 }
@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// TypeMapping PG type of the column and the conversion of the go value to the value written by COPY
+type TypeMapping struct {
+	// PgType as it is reported by information_schema.columns.data_type, e.g. uuid, inet, interval, numeric
+	PgType  string
+	Convert func(val interface{}) interface{}
+}
+
+// TypeRegistry customizes go to PG type mapping, types that are not registered are mapped by GetPgTypeVal
+// types are matched exactly, so a registered type doesn't affect pointers to it or interfaces it implements
+// nil registry is valid and maps everything with GetPgTypeVal
+type TypeRegistry struct {
+	lock  sync.RWMutex
+	types map[reflect.Type]TypeMapping
+}
+
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{types: map[reflect.Type]TypeMapping{}}
+}
+
+// RegisterType maps go type T to the pgType column, convert prepares the value for COPY
+// e.g. a decimal type is written to numeric with
+//
+//	RegisterType(types, "numeric", func(d decimal.Decimal) interface{} { return d.String() })
+func RegisterType[T any](r *TypeRegistry, pgType string, convert func(val T) interface{}) *TypeRegistry {
+	return r.Register(
+		reflect.TypeOf((*T)(nil)).Elem(), TypeMapping{
+			PgType:  pgType,
+			Convert: func(val interface{}) interface{} { return convert(val.(T)) },
+		},
+	)
+}
+
+// Register maps go type t, replaces the previous mapping of the type if any
+func (r *TypeRegistry) Register(t reflect.Type, mapping TypeMapping) *TypeRegistry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.types[t] = mapping
+	return r
+}
+
+// PgTypeVal GetPgTypeVal with the registered mappings
+func (r *TypeRegistry) PgTypeVal(val interface{}) (string, interface{}) {
+	if r != nil && val != nil {
+		r.lock.RLock()
+		mapping, ok := r.types[reflect.TypeOf(val)]
+		r.lock.RUnlock()
+		if ok {
+			return mapping.PgType, mapping.Convert(val)
+		}
+	}
+	return GetPgTypeVal(val)
+}
+
+// GoTypes registered go types, e.g. for the batcher spool.Config.Types, so the spooled values keep their types
+func (r *TypeRegistry) GoTypes() []reflect.Type {
+	if r == nil {
+		return nil
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	res := make([]reflect.Type, 0, len(r.types))
+	for t := range r.types {
+		res = append(res, t)
+	}
+	return res
+}
+
+// CommonTypes registry with native PG types for uuid.UUID, net.IP and time.Duration
+func CommonTypes() *TypeRegistry {
+	r := NewTypeRegistry()
+	RegisterType(r, "uuid", func(val uuid.UUID) interface{} { return val.String() })
+	RegisterType(r, "inet", func(val net.IP) interface{} { return val.String() })
+	RegisterType(
+		r, "interval", func(val time.Duration) interface{} {
+			// PG interval has microsecond precision, hh:mm:ss is parsed by both PG and pgx
+			us := val.Microseconds()
+			sign := ""
+			if us < 0 {
+				sign, us = "-", -us
+			}
+			return fmt.Sprintf("%s%02d:%02d:%02d.%06d", sign, us/3600e6, us/60e6%60, us/1e6%60, us%1e6)
+		},
+	)
+	return r
+}
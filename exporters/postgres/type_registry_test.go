@@ -0,0 +1,77 @@
+package postgres
+
+import (
+	"fmt"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type money int64
+
+func TestCommonTypes(t *testing.T) {
+	types := CommonTypes()
+	id := uuid.New()
+	pgt, v := types.PgTypeVal(id)
+	require.Equal(t, "uuid", pgt)
+	require.Equal(t, id.String(), v)
+
+	pgt, v = types.PgTypeVal(net.ParseIP("10.0.0.1"))
+	require.Equal(t, "inet", pgt)
+	require.Equal(t, "10.0.0.1", v)
+
+	pgt, v = types.PgTypeVal(1500 * time.Millisecond)
+	require.Equal(t, "interval", pgt)
+	require.Equal(t, "00:00:01.500000", v)
+	_, v = types.PgTypeVal(-49*time.Hour - time.Microsecond)
+	require.Equal(t, "-49:00:00.000001", v)
+
+	pgt, v = types.PgTypeVal("text")
+	require.Equal(t, PgTextTypeName, pgt)
+	require.Equal(t, "text", v)
+}
+
+func TestRegisterType(t *testing.T) {
+	types := RegisterType(
+		NewTypeRegistry(), "numeric", func(val money) interface{} {
+			return fmt.Sprintf("%d.%02d", val/100, val%100)
+		},
+	)
+	pgt, v := types.PgTypeVal(money(5))
+	require.Equal(t, "numeric", pgt)
+	require.Equal(t, "0.05", v)
+
+	// nil registry falls back to the default mapping
+	var nilTypes *TypeRegistry
+	pgt, _ = nilTypes.PgTypeVal(money(5))
+	require.Equal(t, PgTextTypeName, pgt)
+	pgt, _ = nilTypes.PgTypeVal(uuid.New())
+	require.Equal(t, PgTextTypeName, pgt)
+
+	require.Equal(t, []reflect.Type{reflect.TypeOf(money(0))}, types.GoTypes())
+	require.Empty(t, nilTypes.GoTypes())
+}
+
+func TestRecordSetsUseTypes(t *testing.T) {
+	span := klogga.StartLeaf(testutil.Timeout()).Tag("ip", net.ParseIP("::1")).Val("took", time.Second)
+	span.SetComponent("types_test")
+
+	pg := New(&Conf{Types: CommonTypes()}, nil, klogga.NilExporterTracer{})
+	datasets, errSpans := pg.createRecordSets(span)
+	require.Empty(t, errSpans)
+	col, ok := datasets["types_test"].Schema.Column("ip")
+	require.True(t, ok)
+	require.Equal(t, "inet", col.DataType)
+	col, ok = datasets["types_test"].Schema.Column("took")
+	require.True(t, ok)
+	require.Equal(t, "interval", col.DataType)
+
+	existing := NewTableSchema([]*ColumnSchema{{Name: "ip", DataType: "inet"}, {Name: "took", DataType: "bigint"}})
+	_, _, failures := existing.GetAlterSchema(datasets["types_test"])
+	require.Len(t, failures, 1)
+}
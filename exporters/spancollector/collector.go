@@ -12,10 +12,8 @@ type SpanCollector struct {
 }
 
 func (s *SpanCollector) Write(_ context.Context, spans []*klogga.Span) error {
-	for _, span := range spans {
-		span.Val("span_index", len(s.Spans))
-		s.Spans = append(s.Spans, span)
-	}
+	// spans are shared with the other exporters, the index in Spans is not written to them
+	s.Spans = append(s.Spans, spans...)
 	return nil
 }
 
@@ -0,0 +1,220 @@
+package spanmetrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/constants"
+	"github.com/KasperskyLab/klogga/util/stringutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// OverflowValue all labels of the spans that don't fit into Conf.MaxSeries get this value
+const OverflowValue = "overflow"
+
+var baseLabels = []string{"component", "class", "name"}
+
+// maxLabelValueLen tag values are cut to keep the series small
+const maxLabelValueLen = 128
+
+type Conf struct {
+	// Namespace metrics names prefix, klogga if empty
+	Namespace string
+	// LabelTags tag keys added to the labels, spans without the tag get an empty value
+	// keys are converted to valid label names
+	LabelTags []string
+	// Buckets duration histogram buckets in seconds, prometheus.DefBuckets if empty
+	Buckets []float64
+	// MaxSeries limits distinct label sets, spans of the new sets go to the OverflowValue set, 1000 if zero
+	MaxSeries int
+}
+
+func (c *Conf) GetNamespace() string {
+	if c.Namespace == "" {
+		return "klogga"
+	}
+	return c.Namespace
+}
+
+func (c *Conf) GetBuckets() []float64 {
+	if len(c.Buckets) == 0 {
+		return prometheus.DefBuckets
+	}
+	return c.Buckets
+}
+
+func (c *Conf) GetMaxSeries() int {
+	if c.MaxSeries <= 0 {
+		return 1000
+	}
+	return c.MaxSeries
+}
+
+// Exporter turns finished spans into request rate, error rate and duration metrics (RED)
+// per component, class, name and the configured tags
+// it is a prometheus.Collector, register it or serve it with Handler
+// counters and histograms carry exemplars with the trace id, they are exposed in the OpenMetrics format only
+type Exporter struct {
+	conf      Conf
+	labelTags []string
+
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	overflow prometheus.Counter
+
+	seriesLock sync.Mutex
+	series     map[string]struct{}
+
+	registry *prometheus.Registry
+}
+
+// New creates the exporter, conf may be nil
+func New(conf *Conf) (*Exporter, error) {
+	if conf == nil {
+		conf = &Conf{}
+	}
+	labels := append([]string(nil), baseLabels...)
+	for _, tag := range conf.LabelTags {
+		label := labelName(tag)
+		for _, l := range labels {
+			if l == label {
+				return nil, errors.Errorf("tag %q label %q is duplicated", tag, label)
+			}
+		}
+		labels = append(labels, label)
+	}
+
+	ns := conf.GetNamespace()
+	e := &Exporter{
+		conf:      *conf,
+		labelTags: conf.LabelTags,
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{Namespace: ns, Name: "spans_total", Help: "Finished spans."}, labels,
+		),
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{Namespace: ns, Name: "span_errors_total", Help: "Finished spans with errors."}, labels,
+		),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns, Name: "span_duration_seconds", Help: "Spans duration.", Buckets: conf.GetBuckets(),
+			}, labels,
+		),
+		overflow: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: ns, Name: "span_metrics_overflow_total",
+				Help: "Spans counted in the overflow series because of the series limit.",
+			},
+		),
+		series:   map[string]struct{}{},
+		registry: prometheus.NewRegistry(),
+	}
+	if err := e.registry.Register(e); err != nil {
+		return nil, errors.Wrap(err, "failed to register span metrics")
+	}
+	return e, nil
+}
+
+func (e *Exporter) Write(_ context.Context, spans []*klogga.Span) error {
+	for _, span := range spans {
+		e.observe(span)
+	}
+	return nil
+}
+
+func (e *Exporter) observe(span *klogga.Span) {
+	labels := e.labels(span)
+	var exemplar prometheus.Labels
+	if traceID := span.TraceID(); !traceID.IsZero() {
+		exemplar = prometheus.Labels{constants.TraceID: traceID.String()}
+	}
+
+	add(e.requests.WithLabelValues(labels...), exemplar)
+	if span.Errs() != nil || span.DeferErrs() != nil {
+		add(e.errors.WithLabelValues(labels...), exemplar)
+	}
+	observer := e.duration.WithLabelValues(labels...)
+	seconds := span.Duration().Seconds()
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok && exemplar != nil {
+		eo.ObserveWithExemplar(seconds, exemplar)
+	} else {
+		observer.Observe(seconds)
+	}
+}
+
+func add(counter prometheus.Counter, exemplar prometheus.Labels) {
+	if ea, ok := counter.(prometheus.ExemplarAdder); ok && exemplar != nil {
+		ea.AddWithExemplar(1, exemplar)
+		return
+	}
+	counter.Inc()
+}
+
+// labels label values of the span, OverflowValue for all of them if the series limit is reached
+func (e *Exporter) labels(span *klogga.Span) []string {
+	values := make([]string, 0, len(baseLabels)+len(e.labelTags))
+	values = append(values, span.Component().String(), span.PackageClass(), span.Name())
+	for _, tag := range e.labelTags {
+		if v, ok := span.TagGet(tag); ok && v != nil {
+			values = append(values, stringutil.MaxLen(fmt.Sprint(v), maxLabelValueLen))
+		} else {
+			values = append(values, "")
+		}
+	}
+
+	key := strings.Join(values, "\xff")
+	e.seriesLock.Lock()
+	defer e.seriesLock.Unlock()
+	if _, ok := e.series[key]; ok {
+		return values
+	}
+	if len(e.series) < e.conf.GetMaxSeries() {
+		e.series[key] = struct{}{}
+		return values
+	}
+	e.overflow.Inc()
+	for i := range values {
+		values[i] = OverflowValue
+	}
+	return values
+}
+
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	e.requests.Describe(ch)
+	e.errors.Describe(ch)
+	e.duration.Describe(ch)
+	e.overflow.Describe(ch)
+}
+
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.requests.Collect(ch)
+	e.errors.Collect(ch)
+	e.duration.Collect(ch)
+	e.overflow.Collect(ch)
+}
+
+// Handler serves the exporter metrics only, in the OpenMetrics format with exemplars when it is accepted
+func (e *Exporter) Handler() http.Handler {
+	return promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
+
+func (e *Exporter) Shutdown(context.Context) error {
+	return nil
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// labelName converts the tag key to a valid prometheus label name
+func labelName(tag string) string {
+	res := invalidLabelChars.ReplaceAllString(tag, "_")
+	if res == "" || (res[0] >= '0' && res[0] <= '9') || strings.HasPrefix(res, "__") {
+		res = "tag_" + res
+	}
+	return res
+}
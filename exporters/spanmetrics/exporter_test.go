@@ -0,0 +1,107 @@
+package spanmetrics
+
+import (
+	"context"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/pkg/errors"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func finished(name string, duration time.Duration) *klogga.Span {
+	span := klogga.StartLeaf(
+		context.Background(), klogga.WithName(name), klogga.WithPackageClass("pkg", "Handler"),
+		klogga.WithDone(time.Now(), duration),
+	)
+	span.SetComponent("api")
+	return span
+}
+
+func TestREDMetrics(t *testing.T) {
+	e, err := New(&Conf{LabelTags: []string{"http.method"}, Buckets: []float64{0.1, 1}})
+	require.NoError(t, err)
+
+	require.NoError(
+		t, e.Write(
+			testutil.Timeout(), []*klogga.Span{
+				finished("get", 50*time.Millisecond).Tag("http.method", "GET"),
+				finished("get", 500*time.Millisecond).Tag("http.method", "GET").ErrSpan(errors.New("failed")),
+				finished("get", 2*time.Second),
+			},
+		),
+	)
+	require.NoError(
+		t, promtest.CollectAndCompare(
+			e, strings.NewReader(
+				`
+# HELP klogga_spans_total Finished spans.
+# TYPE klogga_spans_total counter
+klogga_spans_total{class="pkg.Handler",component="api",http_method="",name="get"} 1
+klogga_spans_total{class="pkg.Handler",component="api",http_method="GET",name="get"} 2
+# HELP klogga_span_errors_total Finished spans with errors.
+# TYPE klogga_span_errors_total counter
+klogga_span_errors_total{class="pkg.Handler",component="api",http_method="GET",name="get"} 1
+# HELP klogga_span_duration_seconds Spans duration.
+# TYPE klogga_span_duration_seconds histogram
+klogga_span_duration_seconds_bucket{class="pkg.Handler",component="api",http_method="",name="get",le="0.1"} 0
+klogga_span_duration_seconds_bucket{class="pkg.Handler",component="api",http_method="",name="get",le="1"} 0
+klogga_span_duration_seconds_bucket{class="pkg.Handler",component="api",http_method="",name="get",le="+Inf"} 1
+klogga_span_duration_seconds_sum{class="pkg.Handler",component="api",http_method="",name="get"} 2
+klogga_span_duration_seconds_count{class="pkg.Handler",component="api",http_method="",name="get"} 1
+klogga_span_duration_seconds_bucket{class="pkg.Handler",component="api",http_method="GET",name="get",le="0.1"} 1
+klogga_span_duration_seconds_bucket{class="pkg.Handler",component="api",http_method="GET",name="get",le="1"} 2
+klogga_span_duration_seconds_bucket{class="pkg.Handler",component="api",http_method="GET",name="get",le="+Inf"} 2
+klogga_span_duration_seconds_sum{class="pkg.Handler",component="api",http_method="GET",name="get"} 0.55
+klogga_span_duration_seconds_count{class="pkg.Handler",component="api",http_method="GET",name="get"} 2
+`,
+			), "klogga_spans_total", "klogga_span_errors_total", "klogga_span_duration_seconds",
+		),
+	)
+}
+
+func TestMaxSeries(t *testing.T) {
+	e, err := New(&Conf{LabelTags: []string{"user"}, MaxSeries: 2})
+	require.NoError(t, err)
+	for _, user := range []string{"a", "b", "c", "d", "a"} {
+		require.NoError(t, e.Write(testutil.Timeout(), []*klogga.Span{finished("get", time.Millisecond).Tag("user", user)}))
+	}
+	require.Equal(t, 3, promtest.CollectAndCount(e, "klogga_spans_total"))
+	require.Equal(t, float64(2), promtest.ToFloat64(e.requests.WithLabelValues("api", "pkg.Handler", "get", "a")))
+	require.Equal(
+		t, float64(2),
+		promtest.ToFloat64(e.requests.WithLabelValues(OverflowValue, OverflowValue, OverflowValue, OverflowValue)),
+	)
+	require.Equal(t, float64(2), promtest.ToFloat64(e.overflow))
+}
+
+func TestExemplars(t *testing.T) {
+	e, err := New(nil)
+	require.NoError(t, err)
+	span := finished("get", time.Millisecond)
+	require.NoError(t, e.Write(testutil.Timeout(), []*klogga.Span{span}))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	rec := httptest.NewRecorder()
+	e.Handler().ServeHTTP(rec, req)
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `# {trace_id="`+span.TraceID().String()+`"} 1`)
+}
+
+func TestLabelTags(t *testing.T) {
+	require.Equal(t, "http_method", labelName("http.method"))
+	require.Equal(t, "tag_1st", labelName("1st"))
+	require.Equal(t, "tag___name", labelName("__name"))
+	_, err := New(&Conf{LabelTags: []string{"component"}})
+	require.Error(t, err)
+	_, err = New(&Conf{LabelTags: []string{"a.b", "a_b"}})
+	require.Error(t, err)
+}
@@ -4,17 +4,25 @@ import (
 	"context"
 	"github.com/KasperskyLab/klogga/util/errs"
 	"github.com/KasperskyLab/klogga/util/reflectutil"
+	"sync"
+	"sync/atomic"
 )
 
 // Factory combines different exporters
 // constructs tracers with proper names
+// exporters are written one after another in the Finish call, unless SetFanOutConfig gives each its own worker
 type Factory struct {
-	// exporters where all spans are sent
-	exporters ExportersSlice
+	// exporters where all spans are sent, holds *exportersSnapshot
+	// replaced as a whole on every change, so writes never see a partially changed set
+	exporters atomic.Value
+	// serializes exporters changes
+	exportersLock sync.Mutex
+	nextHandleID  uint64
+	// exporters are written by the workers when set
+	fanOut *FanOutConfig
 
-	// any errors are sent here
-	// TBD
-	// errExporter Exporter
+	// write errors are reported here
+	exportErrs exportErrors
 }
 
 // TracerProvider use to allow components/adapters to have name overrides
@@ -25,7 +33,11 @@ type TracerProvider interface {
 }
 
 func NewFactory(exporters ...Exporter) *Factory {
-	return &Factory{exporters: exporters}
+	tf := &Factory{}
+	for _, exporter := range exporters {
+		tf.AttachExporter(exporter)
+	}
+	return tf
 }
 
 // Named creates a named tracer for specified component
@@ -39,27 +51,286 @@ func (tf *Factory) NamedPkg() Tracer {
 	return tf.Named(ComponentName(p))
 }
 
+// SetFanOutConfig starts a worker with its own queue and write timeout for each exporter, as FanOut does,
+// workers of the attached exporters are replaced after their queues are drained.
+// Writes wait for the exporters, but not longer than the timeout,
+// a stalled exporter doesn't delay writes to the others.
+// The workers are stopped by Shutdown.
+func (tf *Factory) SetFanOutConfig(conf FanOutConfig) *Factory {
+	tf.stop(
+		tf.update(
+			func(next *exportersSnapshot) {
+				tf.fanOut = &conf
+				for i := range next.entries {
+					next.entries[i].worker = tf.newWorker(next.entries[i])
+				}
+			},
+		),
+	)
+	return tf
+}
+
+// Shutdown waits for the writes in progress and shuts down all exporters including the error exporter,
+// the exporters are detached from the factory
 func (tf *Factory) Shutdown(ctx context.Context) error {
-	return tf.exporters.Shutdown(ctx)
+	var direct ExportersSlice
+	removed := tf.update(
+		func(next *exportersSnapshot) {
+			for _, entry := range next.entries {
+				if entry.worker == nil {
+					direct = append(direct, entry.exporter)
+				}
+			}
+			next.entries = nil
+		},
+	)
+	return errs.Append(shutdownWorkers(ctx, removed, direct), tf.exportErrs.shutdown(ctx))
+}
+
+// Exporters current exporters of the factory
+func (tf *Factory) Exporters() ExportersSlice {
+	return tf.snapshot().exporters()
 }
 
 // AddExporter adds another exporter to the factory.
-// All  previously created tracers as well as new tracers will write to all exporters.
-// Do not use for concurrently executing goroutines that write spans.
-// Intended to be used in the sequential app initialization.
+// All previously created tracers as well as new tracers will write to all exporters.
+// Safe to call while spans are written, use AttachExporter to be able to remove the exporter later.
 func (tf *Factory) AddExporter(exporter Exporter) *Factory {
-	tf.exporters = append(tf.exporters, exporter)
+	tf.AttachExporter(exporter)
+	return tf
+}
+
+// AttachExporter adds exporter to the factory, same as AddExporter
+// the returned handle removes or replaces this exporter only
+func (tf *Factory) AttachExporter(exporter Exporter) *ExporterHandle {
+	return tf.AttachExporterTo(DefaultGroup, exporter)
+}
+
+// AddExporterTo adds exporter to the named group, see SetRoutes
+func (tf *Factory) AddExporterTo(group string, exporter Exporter) *Factory {
+	tf.AttachExporterTo(group, exporter)
 	return tf
 }
 
+// AttachExporterTo adds exporter to the named group, see SetRoutes
+// the returned handle removes or replaces this exporter only
+func (tf *Factory) AttachExporterTo(group string, exporter Exporter) *ExporterHandle {
+	h := &ExporterHandle{tf: tf}
+	tf.update(
+		func(next *exportersSnapshot) {
+			tf.nextHandleID++
+			h.id = tf.nextHandleID
+			entry := exporterEntry{id: h.id, group: group, exporter: exporter}
+			entry.worker = tf.newWorker(entry)
+			tf.watchAsync(entry)
+			next.entries = append(next.entries, entry)
+		},
+	)
+	return h
+}
+
 // RemoveAllExporters clear exporters list, nothing will be exported
+// removed exporters are not shut down, when it returns they get no more writes
 func (tf *Factory) RemoveAllExporters() *Factory {
-	tf.exporters = []Exporter{}
+	tf.stop(tf.update(func(next *exportersSnapshot) { next.entries = nil }))
+	return tf
+}
+
+// SetRoutes replaces routing rules, each span is sent to the groups of all matched routes,
+// spans that match no route are sent to the DefaultGroup.
+// Without routes all spans are sent to the DefaultGroup.
+func (tf *Factory) SetRoutes(routes ...Route) *Factory {
+	tf.update(func(next *exportersSnapshot) { next.routes = routes })
 	return tf
 }
 
 func (tf *Factory) write(ctx context.Context, spans []*Span) error {
-	return tf.exporters.Write(ctx, spans)
+	var pending []pendingWrite
+	for {
+		snap := tf.snapshot()
+		snap.lock.RLock()
+		if snap.retired {
+			// exporters were changed after the snapshot was loaded, the new set gets the spans
+			snap.lock.RUnlock()
+			continue
+		}
+		pending = snap.write(ctx, spans)
+		snap.lock.RUnlock()
+		break
+	}
+
+	// reported without the lock, the error handler may write spans or change exporters
+	var allErrs error
+	for _, p := range pending {
+		if err := p.wait(ctx); err != nil {
+			tf.reportError(p.entry, p.spans, err)
+			allErrs = errs.Append(allErrs, err)
+		}
+	}
+	return allErrs
+}
+
+func (tf *Factory) reportError(entry exporterEntry, spans int, err error) {
+	tf.exportErrs.report(
+		entry.id, ExportError{
+			Exporter: entry.exporter,
+			Name:     exporterName(entry.exporter),
+			Group:    entry.group,
+			Spans:    spans,
+			Err:      err,
+		},
+	)
+}
+
+// watchAsync passes background write errors of the exporter to the error handler
+func (tf *Factory) watchAsync(entry exporterEntry) {
+	if async, ok := entry.exporter.(AsyncExporter); ok {
+		async.SetErrorHandler(
+			func(spans int, err error) {
+				tf.reportError(entry, spans, err)
+			},
+		)
+	}
+}
+
+// newWorker nil if the exporters are written without workers
+func (tf *Factory) newWorker(entry exporterEntry) *exportWorker {
+	if tf.fanOut == nil {
+		return nil
+	}
+	return newExportWorker(
+		entry.exporter, *tf.fanOut, func(_ *exportWorker, spans int, err error) {
+			tf.reportError(entry, spans, err)
+		},
+	)
+}
+
+// stop waits until the removed workers write the queued batches
+func (tf *Factory) stop(removed []*exportWorker) {
+	for _, w := range removed {
+		w.stop()
+	}
+	for _, w := range removed {
+		<-w.done
+	}
+}
+
+func (tf *Factory) snapshot() *exportersSnapshot {
+	if snap, ok := tf.exporters.Load().(*exportersSnapshot); ok {
+		return snap
+	}
+	return emptySnapshot
+}
+
+// update replaces the exporters set with the changed copy
+// returns when writes to the previous set are queued, with the workers that are no longer used
+func (tf *Factory) update(change func(next *exportersSnapshot)) []*exportWorker {
+	tf.exportersLock.Lock()
+	defer tf.exportersLock.Unlock()
+
+	prev := tf.snapshot()
+	next := &exportersSnapshot{
+		entries: append([]exporterEntry(nil), prev.entries...),
+		routes:  prev.routes,
+	}
+	change(next)
+	next.groups = make(map[string][]exporterEntry)
+	for _, entry := range next.entries {
+		next.groups[entry.group] = append(next.groups[entry.group], entry)
+	}
+	tf.exporters.Store(next)
+	if prev == emptySnapshot {
+		return nil
+	}
+	prev.lock.Lock()
+	prev.retired = true
+	prev.lock.Unlock()
+
+	used := make(map[*exportWorker]struct{}, len(next.entries))
+	for _, entry := range next.entries {
+		used[entry.worker] = struct{}{}
+	}
+	var removed []*exportWorker
+	for _, entry := range prev.entries {
+		if _, ok := used[entry.worker]; !ok && entry.worker != nil {
+			removed = append(removed, entry.worker)
+		}
+	}
+	return removed
+}
+
+var emptySnapshot = &exportersSnapshot{}
+
+// exportersSnapshot immutable exporters set
+// writes hold the read lock, retired snapshot is not written to
+type exportersSnapshot struct {
+	entries []exporterEntry
+	routes  []Route
+	groups  map[string][]exporterEntry
+	lock    sync.RWMutex
+	retired bool
+}
+
+func (s *exportersSnapshot) exporters() ExportersSlice {
+	res := make(ExportersSlice, 0, len(s.entries))
+	for _, entry := range s.entries {
+		res = append(res, entry.exporter)
+	}
+	return res
+}
+
+type exporterEntry struct {
+	id       uint64
+	group    string
+	exporter Exporter
+	// nil if the exporter is written directly, see Factory.SetFanOutConfig
+	worker *exportWorker
+}
+
+// ExporterHandle removes or replaces exporter attached to the Factory
+// safe to use while spans are written
+type ExporterHandle struct {
+	tf *Factory
+	id uint64
+}
+
+// Remove detaches the exporter from the factory, returns false if it was already removed.
+// The exporter is not shut down, when Remove returns it gets no more writes.
+func (h *ExporterHandle) Remove() bool {
+	found := false
+	removed := h.tf.update(
+		func(next *exportersSnapshot) {
+			for i, entry := range next.entries {
+				if entry.id == h.id {
+					found = true
+					next.entries = append(next.entries[:i], next.entries[i+1:]...)
+					return
+				}
+			}
+		},
+	)
+	h.tf.stop(removed)
+	return found
+}
+
+// Replace swaps the exporter for a new one in a single step, every span is written either to the old or to the new one.
+// Returns the replaced exporter, so it can be shut down, or nil if the handle was already removed.
+func (h *ExporterHandle) Replace(exporter Exporter) Exporter {
+	var prev Exporter
+	removed := h.tf.update(
+		func(next *exportersSnapshot) {
+			for i, entry := range next.entries {
+				if entry.id == h.id {
+					prev = entry.exporter
+					next.entries[i].exporter = exporter
+					next.entries[i].worker = h.tf.newWorker(next.entries[i])
+					h.tf.watchAsync(next.entries[i])
+				}
+			}
+		},
+	)
+	h.tf.stop(removed)
+	return prev
 }
 
 // tracer has a fixed component it writes to
@@ -81,8 +352,7 @@ func (t *tracerImpl) Finish(span *Span) {
 	}
 	span.Stop()
 
-	// tracer shouldn't handle write errors
-	// exporters should deal with them their own way
+	// write errors are reported by the factory, see Factory.SetErrorHandler
 	_ = t.tf.write(context.Background(), []*Span{span})
 }
 
@@ -94,6 +364,8 @@ func (c ComponentName) String() string {
 
 type ExportersSlice []Exporter
 
+// Write writes to exporters one after another, as Factory does without SetFanOutConfig,
+// use FanOut to isolate them from each other
 func (t ExportersSlice) Write(ctx context.Context, spans []*Span) error {
 	var childErrs error
 	for _, child := range t {
@@ -103,10 +375,22 @@ func (t ExportersSlice) Write(ctx context.Context, spans []*Span) error {
 	return childErrs
 }
 
+// Shutdown shuts down exporters in parallel
 func (t ExportersSlice) Shutdown(ctx context.Context) error {
+	childErrs := make([]error, len(t))
+	wg := sync.WaitGroup{}
+	wg.Add(len(t))
+	for i, child := range t {
+		go func(i int, child Exporter) {
+			defer wg.Done()
+			childErrs[i] = child.Shutdown(ctx)
+		}(i, child)
+	}
+	wg.Wait()
+
 	var allErrs error
-	for _, child := range t {
-		allErrs = errs.Append(allErrs, child.Shutdown(ctx))
+	for _, err := range childErrs {
+		allErrs = errs.Append(allErrs, err)
 	}
 	return allErrs
 }
@@ -0,0 +1,229 @@
+package klogga
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultErrorInterval = time.Second
+	errorWriteTimeout    = time.Second
+)
+
+// ExportError exporter failure reported by the Factory to the error handler and the error exporter
+type ExportError struct {
+	Exporter Exporter
+	// Name exporter type, or its String() if it implements fmt.Stringer
+	Name  string
+	Group string
+	// Spans count of spans that failed to be written
+	Spans int
+	// Suppressed count of failures dropped by the rate limit since the previous report of this exporter
+	// their spans are included in Spans
+	Suppressed int
+	Err        error
+}
+
+func (e ExportError) Error() string {
+	return fmt.Sprintf(
+		"exporter %s failed to write %d spans (%d reports suppressed): %v", e.Name, e.Spans, e.Suppressed, e.Err,
+	)
+}
+
+// AsyncExporter exporter that writes spans in the background, like batcher.Batcher
+// its write errors can't be returned from Write, so they are passed to the handler
+// Factory sets the handler when the exporter is attached
+type AsyncExporter interface {
+	Exporter
+	SetErrorHandler(handler func(spans int, err error))
+}
+
+// SetErrorHandler sets handler for exporters write errors, reports are rate-limited per exporter,
+// failures held back by the limit are reported on Flush and Shutdown.
+// Errors of the exporter that happen while its own error is reported are written to the standard logger,
+// so the handler may write spans to this factory without recursion
+func (tf *Factory) SetErrorHandler(handler func(ExportError)) *Factory {
+	tf.exportErrs.lock.Lock()
+	defer tf.exportErrs.lock.Unlock()
+	tf.exportErrs.handler = handler
+	return tf
+}
+
+// SetErrorExporter sets exporter where write errors of other exporters are written as spans
+// when it fails too, errors are written to the standard logger
+// errors are written to the standard logger if neither error exporter nor error handler are set
+func (tf *Factory) SetErrorExporter(exporter Exporter) *Factory {
+	tf.exportErrs.lock.Lock()
+	defer tf.exportErrs.lock.Unlock()
+	tf.exportErrs.exporter = exporter
+	return tf
+}
+
+// SetErrorRateLimit each exporter errors are reported not more often than once in the interval, 1 second by default
+// negative interval disables the limit
+func (tf *Factory) SetErrorRateLimit(interval time.Duration) *Factory {
+	tf.exportErrs.lock.Lock()
+	defer tf.exportErrs.lock.Unlock()
+	tf.exportErrs.interval = interval
+	return tf
+}
+
+// exportErrors rate-limits write errors and passes them to the handler and the error exporter
+type exportErrors struct {
+	lock     sync.Mutex
+	handler  func(ExportError)
+	exporter Exporter
+	interval time.Duration
+	// by exporter handle id
+	limits map[uint64]*errorLimit
+	// exporters which errors are being reported, guards against recursion
+	reporting map[uint64]struct{}
+}
+
+type errorLimit struct {
+	reported   time.Time
+	spans      int
+	suppressed int
+	// last suppressed failure
+	last ExportError
+}
+
+func (e *exportErrors) shutdown(ctx context.Context) error {
+	e.flushSuppressed()
+	e.lock.Lock()
+	exporter := e.exporter
+	e.lock.Unlock()
+	if exporter == nil {
+		return nil
+	}
+	return exporter.Shutdown(ctx)
+}
+
+func (e *exportErrors) flush(ctx context.Context) error {
+	e.flushSuppressed()
+	e.lock.Lock()
+	exporter := e.exporter
+	e.lock.Unlock()
+	if flusher, ok := exporter.(Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+func (e *exportErrors) report(id uint64, exportErr ExportError) {
+	e.lock.Lock()
+	allowed := e.allow(id, &exportErr)
+	e.lock.Unlock()
+	if allowed {
+		e.deliver(id, exportErr)
+	}
+}
+
+// flushSuppressed reports the failures held back by the rate limit
+func (e *exportErrors) flushSuppressed() {
+	e.lock.Lock()
+	ids := make([]uint64, 0, len(e.limits))
+	pending := make(map[uint64]ExportError, len(e.limits))
+	for id, limit := range e.limits {
+		if limit.suppressed == 0 {
+			continue
+		}
+		exportErr := limit.last
+		exportErr.Spans, exportErr.Suppressed = limit.spans, limit.suppressed
+		ids = append(ids, id)
+		pending[id] = exportErr
+		*limit = errorLimit{reported: time.Now()}
+	}
+	e.lock.Unlock()
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		e.deliver(id, pending[id])
+	}
+}
+
+// deliver passes the error to the handler and the error exporter
+// the exporter that fails again while its error is delivered is reported to the standard logger
+func (e *exportErrors) deliver(id uint64, exportErr ExportError) {
+	e.lock.Lock()
+	handler, exporter := e.handler, e.exporter
+	_, recursive := e.reporting[id]
+	if recursive || handler == nil && exporter == nil {
+		e.lock.Unlock()
+		log.Println("klogga:", exportErr.Error())
+		return
+	}
+	if e.reporting == nil {
+		e.reporting = map[uint64]struct{}{}
+	}
+	e.reporting[id] = struct{}{}
+	e.lock.Unlock()
+	defer func() {
+		e.lock.Lock()
+		delete(e.reporting, id)
+		e.lock.Unlock()
+	}()
+
+	if handler != nil {
+		handler(exportErr)
+	}
+	if exporter != nil {
+		e.write(exporter, exportErr)
+	}
+}
+
+// allow applies the rate limit, merges suppressed failures into the reported one
+func (e *exportErrors) allow(id uint64, exportErr *ExportError) bool {
+	if e.limits == nil {
+		e.limits = map[uint64]*errorLimit{}
+	}
+	limit, ok := e.limits[id]
+	if !ok {
+		limit = &errorLimit{}
+		e.limits[id] = limit
+	}
+	interval := e.interval
+	if interval == 0 {
+		interval = defaultErrorInterval
+	}
+	now := time.Now()
+	if now.Sub(limit.reported) < interval {
+		limit.spans += exportErr.Spans
+		limit.suppressed++
+		limit.last = *exportErr
+		return false
+	}
+	exportErr.Spans += limit.spans
+	exportErr.Suppressed = limit.suppressed
+	*limit = errorLimit{reported: now}
+	return true
+}
+
+func (e *exportErrors) write(exporter Exporter, exportErr ExportError) {
+	span := StartLeaf(context.Background(), WithName("ExportFailed"), WithPackageClass("klogga", "Factory"))
+	span.component = "klogga"
+	span.Tag("exporter", exportErr.Name).
+		Tag("group", exportErr.Group).
+		Val("spans", exportErr.Spans).
+		Val("suppressed", exportErr.Suppressed).
+		ErrVoid(exportErr.Err)
+	span.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), errorWriteTimeout)
+	defer cancel()
+	if err := exporter.Write(ctx, []*Span{span}); err != nil {
+		log.Println("klogga:", exportErr.Error())
+		log.Println("klogga: error exporter failed:", err)
+	}
+}
+
+func exporterName(exporter Exporter) string {
+	if s, ok := exporter.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", exporter)
+}
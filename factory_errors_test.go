@@ -0,0 +1,140 @@
+package klogga
+
+import (
+	"context"
+	"errors"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type failingExporter struct {
+	writes int
+}
+
+func (e *failingExporter) Write(context.Context, []*Span) error {
+	e.writes++
+	return errors.New("write failed")
+}
+
+func (e *failingExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func TestFactoryErrorHandler(t *testing.T) {
+	var reports []ExportError
+	tf := NewFactory(&namesExporter{}).
+		AddExporterTo("pg", &failingExporter{}).
+		SetRoutes(Route{Groups: []string{DefaultGroup, "pg"}}).
+		SetErrorHandler(func(e ExportError) { reports = append(reports, e) }).
+		SetErrorRateLimit(time.Hour)
+	trs := tf.Named("test")
+
+	trs.Finish(StartLeaf(context.Background()))
+	require.Len(t, reports, 1)
+	require.Equal(t, "*klogga.failingExporter", reports[0].Name)
+	require.Equal(t, "pg", reports[0].Group)
+	require.Equal(t, 1, reports[0].Spans)
+	require.EqualError(t, reports[0].Err, "write failed")
+
+	// rate-limited, merged into the next report
+	trs.Finish(StartLeaf(context.Background()))
+	trs.Finish(StartLeaf(context.Background()))
+	require.Len(t, reports, 1)
+
+	for _, limit := range tf.exportErrs.limits {
+		limit.reported = time.Time{}
+	}
+	trs.Finish(StartLeaf(context.Background()))
+	require.Len(t, reports, 2)
+	require.Equal(t, 3, reports[1].Spans)
+	require.Equal(t, 2, reports[1].Suppressed)
+}
+
+func TestFactoryErrorExporter(t *testing.T) {
+	errExporter := &namesExporter{}
+	tf := NewFactory(&failingExporter{}).SetErrorExporter(errExporter)
+	tf.Named("test").Finish(StartLeaf(context.Background()))
+	require.Equal(t, []string{"ExportFailed"}, errExporter.names)
+
+	// failing error exporter is not retried and doesn't recurse
+	failing := &failingExporter{}
+	tf.SetErrorExporter(failing).SetErrorRateLimit(-1)
+	tf.Named("test").Finish(StartLeaf(context.Background()))
+	require.Equal(t, 1, failing.writes)
+}
+
+func TestFactoryErrorHandlerRecursion(t *testing.T) {
+	exporter := &failingExporter{}
+	tf := NewFactory(exporter).SetErrorRateLimit(-1)
+	trs := tf.Named("test")
+	calls := 0
+	tf.SetErrorHandler(
+		func(e ExportError) {
+			calls++
+			// written to the same failing factory
+			StartLeaf(context.Background()).ErrSpan(e).FlushTo(trs)
+		},
+	)
+	trs.Finish(StartLeaf(context.Background()))
+	require.Equal(t, 1, calls)
+	require.Equal(t, 2, exporter.writes)
+}
+
+func TestFactoryErrorHandlerConcurrent(t *testing.T) {
+	tf := NewFactory().
+		AddExporterTo("a", &failingExporter{}).
+		AddExporterTo("b", &failingExporter{}).
+		SetRoutes(Route{Match: ByName("a"), Groups: []string{"a"}}, Route{Match: ByName("b"), Groups: []string{"b"}})
+	trs := tf.Named("test")
+	reported := make(chan string, 2)
+	blocked := make(chan struct{})
+	tf.SetErrorHandler(
+		func(e ExportError) {
+			reported <- e.Group
+			if e.Group == "a" {
+				<-blocked
+			}
+		},
+	)
+	defer close(blocked)
+
+	go trs.Finish(StartLeaf(context.Background(), WithName("a")))
+	require.Equal(t, "a", <-reported)
+	// the other exporter is reported while the first report is in progress
+	trs.Finish(StartLeaf(context.Background(), WithName("b")))
+	select {
+	case group := <-reported:
+		require.Equal(t, "b", group)
+	case <-time.After(time.Second):
+		require.Fail(t, "concurrent error is not reported")
+	}
+}
+
+func TestFactoryErrorSuppressedFlush(t *testing.T) {
+	var reports []ExportError
+	tf := NewFactory(&failingExporter{}).
+		SetErrorHandler(func(e ExportError) { reports = append(reports, e) }).
+		SetErrorRateLimit(time.Hour)
+	trs := tf.Named("test")
+	for i := 0; i < 3; i++ {
+		trs.Finish(StartLeaf(context.Background()))
+	}
+	require.Len(t, reports, 1)
+
+	require.NoError(t, tf.Flush(testutil.Timeout()))
+	require.Len(t, reports, 2)
+	require.Equal(t, 2, reports[1].Spans)
+	require.Equal(t, 2, reports[1].Suppressed)
+	require.EqualError(t, reports[1].Err, "write failed")
+	require.NoError(t, tf.Flush(testutil.Timeout()))
+	require.Len(t, reports, 2)
+
+	trs.Finish(StartLeaf(context.Background()))
+	require.Len(t, reports, 2)
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+	require.Len(t, reports, 3)
+	require.Equal(t, 1, reports[2].Spans)
+	require.Equal(t, 1, reports[2].Suppressed)
+}
@@ -6,7 +6,10 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestSlice_Add(t *testing.T) {
@@ -68,3 +71,197 @@ func TestExportersSlice_Write(t *testing.T) {
 	err := ExportersSlice{exporter}.Write(testutil.Timeout(), SpanSlice{})
 	require.Error(t, err)
 }
+
+type countingExporter struct {
+	written int64
+	entered chan struct{}
+	blocked chan struct{}
+	shut    int32
+}
+
+func (e *countingExporter) Write(_ context.Context, spans []*Span) error {
+	if e.blocked != nil {
+		e.entered <- struct{}{}
+		<-e.blocked
+	}
+	atomic.AddInt64(&e.written, int64(len(spans)))
+	return nil
+}
+
+func (e *countingExporter) Shutdown(context.Context) error {
+	atomic.StoreInt32(&e.shut, 1)
+	return nil
+}
+
+func (e *countingExporter) count() int64 {
+	return atomic.LoadInt64(&e.written)
+}
+
+func TestFactoryAttachRemove(t *testing.T) {
+	first, second := &countingExporter{}, &countingExporter{}
+	tf := NewFactory(first)
+	h := tf.AttachExporter(second)
+	trs := tf.Named("test")
+	trs.Finish(StartLeaf(context.Background()))
+	require.Len(t, tf.Exporters(), 2)
+
+	require.True(t, h.Remove())
+	require.False(t, h.Remove())
+	trs.Finish(StartLeaf(context.Background()))
+	require.Equal(t, int64(2), first.count())
+	require.Equal(t, int64(1), second.count())
+	require.Nil(t, h.Replace(second))
+
+	tf.RemoveAllExporters()
+	trs.Finish(StartLeaf(context.Background()))
+	require.Equal(t, int64(2), first.count())
+	require.Empty(t, tf.Exporters())
+}
+
+func TestFactoryRemoveWaitsForWrites(t *testing.T) {
+	exporter := &countingExporter{entered: make(chan struct{}), blocked: make(chan struct{})}
+	tf := NewFactory()
+	h := tf.AttachExporter(exporter)
+
+	written := make(chan struct{})
+	go func() {
+		tf.Named("test").Finish(StartLeaf(context.Background()))
+		close(written)
+	}()
+	<-exporter.entered
+
+	removed := make(chan struct{})
+	go func() {
+		h.Remove()
+		close(removed)
+	}()
+	select {
+	case <-removed:
+		require.Fail(t, "remove must wait for the in-flight write")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(exporter.blocked)
+	<-written
+	<-removed
+	require.Equal(t, int64(1), exporter.count())
+}
+
+func TestFactoryReplaceConcurrent(t *testing.T) {
+	exporters := []*countingExporter{{}}
+	tf := NewFactory()
+	h := tf.AttachExporter(exporters[0])
+	trs := tf.Named("test")
+
+	const writers, spans = 8, 500
+	wg := sync.WaitGroup{}
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < spans; j++ {
+				trs.Finish(StartLeaf(context.Background()))
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		next := &countingExporter{}
+		exporters = append(exporters, next)
+		require.NotNil(t, h.Replace(next))
+		tf.AttachExporter(&countingExporter{}).Remove()
+	}
+	wg.Wait()
+
+	total := int64(0)
+	for _, exporter := range exporters {
+		total += exporter.count()
+	}
+	require.Equal(t, int64(writers*spans), total)
+}
+
+func TestFactoryErrorHandlerChangesExporters(t *testing.T) {
+	tf := NewFactory()
+	h := tf.AttachExporter(&failingExporter{})
+	trs := tf.Named("test")
+	replacement := &countingExporter{}
+	tf.SetErrorRateLimit(-1).SetErrorHandler(
+		func(e ExportError) {
+			h.Replace(replacement)
+			trs.Finish(StartLeaf(context.Background()))
+		},
+	)
+
+	written := make(chan struct{})
+	go func() {
+		trs.Finish(StartLeaf(context.Background()))
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		require.Fail(t, "error handler must be able to change exporters")
+	}
+	require.Equal(t, int64(1), replacement.count())
+}
+
+func TestFactoryStallIsolated(t *testing.T) {
+	stalled := &stallingExporter{release: make(chan struct{})}
+	fast := &countingExporter{}
+	tf := NewFactory().SetFanOutConfig(FanOutConfig{Timeout: 20 * time.Millisecond}).AddExporter(stalled).AddExporter(fast)
+	var reported []ExportError
+	tf.SetErrorRateLimit(-1).SetErrorHandler(func(e ExportError) { reported = append(reported, e) })
+
+	started := time.Now()
+	tf.Named("test").Finish(StartLeaf(context.Background()))
+	require.Less(t, time.Since(started), time.Second)
+	require.Equal(t, int64(1), fast.count())
+	require.Len(t, reported, 1)
+	require.Equal(t, "*klogga.stallingExporter", reported[0].Name)
+	require.ErrorIs(t, reported[0].Err, context.DeadlineExceeded)
+
+	// the first batch may be written too, if released before its write times out
+	close(stalled.release)
+	tf.Named("test").Finish(StartLeaf(context.Background()))
+	require.GreaterOrEqual(t, stalled.count(), 1)
+	require.Len(t, reported, 1)
+}
+
+func TestFactoryShutdownWaitsForWrites(t *testing.T) {
+	exporter := &countingExporter{entered: make(chan struct{}), blocked: make(chan struct{})}
+	tf := NewFactory(exporter)
+	go tf.Named("test").Finish(StartLeaf(context.Background()))
+	<-exporter.entered
+
+	shut := make(chan error)
+	go func() {
+		shut <- tf.Shutdown(testutil.Timeout())
+	}()
+	select {
+	case <-shut:
+		require.Fail(t, "shutdown must wait for the in-flight write")
+	case <-time.After(10 * time.Millisecond):
+	}
+	require.Equal(t, int32(0), atomic.LoadInt32(&exporter.shut))
+	close(exporter.blocked)
+	require.NoError(t, <-shut)
+	require.Equal(t, int64(1), exporter.count())
+	require.Equal(t, int32(1), atomic.LoadInt32(&exporter.shut))
+	require.Empty(t, tf.Exporters())
+}
+
+func TestFactoryWorkersOptIn(t *testing.T) {
+	exporter := &countingExporter{}
+	tf := NewFactory(exporter)
+	require.Nil(t, tf.snapshot().entries[0].worker, "no goroutine without SetFanOutConfig")
+	tf.Named("test").Finish(StartLeaf(context.Background()))
+	require.Equal(t, int64(1), exporter.count())
+
+	tf.SetFanOutConfig(FanOutConfig{})
+	w := tf.snapshot().entries[0].worker
+	require.NotNil(t, w)
+	tf.Named("test").Finish(StartLeaf(context.Background()))
+	require.Equal(t, int64(2), exporter.count())
+
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+	<-w.done
+	require.Equal(t, int32(1), atomic.LoadInt32(&exporter.shut))
+}
@@ -0,0 +1,319 @@
+package klogga
+
+import (
+	"context"
+	"fmt"
+	"github.com/KasperskyLab/klogga/util/errs"
+	"github.com/pkg/errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQueueFull returned by FanOut.Write when the exporter queue has no space for the batch
+var ErrQueueFull = errors.New("exporter queue is full")
+
+// errWorkerStopped the exporter is removed or shut down
+var errWorkerStopped = errors.New("exporter is stopped")
+
+type FanOutConfig struct {
+	// QueueSize batches buffered for each exporter, 100 if zero
+	QueueSize int
+	// Timeout for each exporter Write call, 5 seconds if zero
+	Timeout time.Duration
+}
+
+func (c *FanOutConfig) GetQueueSize() int {
+	if c.QueueSize <= 0 {
+		return 100
+	}
+	return c.QueueSize
+}
+
+func (c *FanOutConfig) GetTimeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return c.Timeout
+}
+
+// FanOut writes to each exporter from its own queue and worker,
+// so a slow or stalled exporter never delays the others or the caller.
+// When the exporter queue is full, the batch is dropped for that exporter only and ErrQueueFull is returned.
+// Write errors of the exporters are passed to the handler set by SetErrorHandler.
+type FanOut struct {
+	workers []*exportWorker
+
+	lock       sync.RWMutex
+	closed     bool
+	errHandler atomic.Value
+}
+
+func NewFanOut(conf FanOutConfig, exporters ...Exporter) *FanOut {
+	f := &FanOut{}
+	for _, exporter := range exporters {
+		f.workers = append(f.workers, newExportWorker(exporter, conf, f.handleErr))
+	}
+	return f
+}
+
+// FanOut isolates the exporters from each other, see FanOut
+func (t ExportersSlice) FanOut(conf FanOutConfig) *FanOut {
+	return NewFanOut(conf, t...)
+}
+
+func (f *FanOut) handleErr(w *exportWorker, spans int, err error) {
+	if handler, ok := f.errHandler.Load().(func(int, error)); ok {
+		handler(spans, errors.Wrap(err, exporterName(w.exporter)))
+	}
+}
+
+// Write queues spans for each exporter without waiting for them
+func (f *FanOut) Write(_ context.Context, spans []*Span) error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.closed {
+		return errors.New("fan-out is shut down")
+	}
+	// callers may reuse the slice, exporters get a copy
+	batch := append([]*Span(nil), spans...)
+	var allErrs error
+	for _, w := range f.workers {
+		if err := w.push(batch, nil); err != nil {
+			allErrs = errs.Append(allErrs, errors.Wrap(err, exporterName(w.exporter)))
+		}
+	}
+	return allErrs
+}
+
+// Flush waits until the batches queued before the call are written and flushes the exporters
+// write errors of these batches go to the error handler, only the exporters Flush errors are returned
+func (f *FanOut) Flush(ctx context.Context) error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.closed {
+		return nil
+	}
+	return flushWorkers(ctx, f.workers, true)
+}
+
+// SetErrorHandler handler is called with the failed batch size and the exporter error
+func (f *FanOut) SetErrorHandler(handler func(spans int, err error)) {
+	f.errHandler.Store(handler)
+}
+
+// DroppedCount spans dropped because of the full queues, summed for all exporters
+func (f *FanOut) DroppedCount() (res uint64) {
+	for _, w := range f.workers {
+		res += atomic.LoadUint64(&w.dropped)
+	}
+	return res
+}
+
+func (f *FanOut) String() string {
+	names := make([]string, 0, len(f.workers))
+	for _, w := range f.workers {
+		names = append(names, exporterName(w.exporter))
+	}
+	return fmt.Sprintf("fanout%v", names)
+}
+
+// Shutdown drains all queues in parallel and shuts down the exporters
+// if the context is done before the queues are drained, the rest of the spans is lost,
+// see shutdownWorkers
+func (f *FanOut) Shutdown(ctx context.Context) error {
+	f.lock.Lock()
+	f.closed = true
+	f.lock.Unlock()
+	return shutdownWorkers(ctx, f.workers, nil)
+}
+
+// exportWorker writes to the exporter from its own queue, each Write call is limited by the timeout
+type exportWorker struct {
+	exporter Exporter
+	timeout  time.Duration
+	// handles errors of the batches nobody waits for
+	onErr   func(w *exportWorker, spans int, err error)
+	queue   chan fanOutItem
+	done    chan struct{}
+	dropped uint64
+	// the rest of the queue is dropped, set when shutdown deadline is reached
+	abandoned int32
+
+	lock    sync.RWMutex
+	stopped bool
+}
+
+// fanOutItem either a batch or a Flush request
+type fanOutItem struct {
+	spans []*Span
+	// receives the write error when the caller waits for the batch
+	written chan error
+
+	flushCtx context.Context
+	flushed  chan error
+}
+
+func newExportWorker(exporter Exporter, conf FanOutConfig, onErr func(*exportWorker, int, error)) *exportWorker {
+	w := &exportWorker{
+		exporter: exporter,
+		timeout:  conf.GetTimeout(),
+		onErr:    onErr,
+		queue:    make(chan fanOutItem, conf.GetQueueSize()),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *exportWorker) run() {
+	defer close(w.done)
+	for item := range w.queue {
+		if item.flushed != nil {
+			item.flushed <- w.flush(item.flushCtx)
+			continue
+		}
+		if atomic.LoadInt32(&w.abandoned) != 0 {
+			atomic.AddUint64(&w.dropped, uint64(len(item.spans)))
+			if item.written != nil {
+				item.written <- errWorkerStopped
+			}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+		err := w.exporter.Write(ctx, item.spans)
+		cancel()
+		if item.written != nil {
+			item.written <- err
+			continue
+		}
+		if err != nil && w.onErr != nil {
+			w.onErr(w, len(item.spans), err)
+		}
+	}
+}
+
+func (w *exportWorker) flush(ctx context.Context) error {
+	if flusher, ok := w.exporter.(Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+// push queues the batch without waiting, written gets the write error if it is not nil
+func (w *exportWorker) push(spans []*Span, written chan error) error {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.stopped {
+		return errWorkerStopped
+	}
+	select {
+	case w.queue <- fanOutItem{spans: spans, written: written}:
+		return nil
+	default:
+		atomic.AddUint64(&w.dropped, uint64(len(spans)))
+		return ErrQueueFull
+	}
+}
+
+// pushFlush queues the Flush request after the queued batches, the reply is nil if the worker is stopped
+func (w *exportWorker) pushFlush(ctx context.Context) (chan error, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.stopped {
+		return nil, nil
+	}
+	reply := make(chan error, 1)
+	select {
+	case w.queue <- fanOutItem{flushCtx: ctx, flushed: reply}:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stop closes the queue, the queued batches are still written
+func (w *exportWorker) stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.queue)
+	}
+}
+
+// wait waits until the queue is drained, when the context is done first the rest of the queue is dropped
+func (w *exportWorker) wait(ctx context.Context) error {
+	select {
+	case <-w.done:
+		return nil
+	default:
+	}
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		atomic.StoreInt32(&w.abandoned, 1)
+		return ctx.Err()
+	}
+}
+
+// flushWorkers flushes the exporters after the batches queued before the call
+func flushWorkers(ctx context.Context, workers []*exportWorker, wrap bool) error {
+	replies := make([]chan error, len(workers))
+	for i, w := range workers {
+		reply, err := w.pushFlush(ctx)
+		if err != nil {
+			return err
+		}
+		replies[i] = reply
+	}
+
+	var allErrs error
+	for i, reply := range replies {
+		if reply == nil {
+			continue
+		}
+		select {
+		case err := <-reply:
+			if wrap {
+				err = errors.Wrap(err, exporterName(workers[i].exporter))
+			}
+			allErrs = errs.Append(allErrs, err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return allErrs
+}
+
+// shutdownWorkers drains the queues in parallel and shuts down the exporters along with the direct ones,
+// that are written without workers.
+// Exporter is never shut down during its write:
+// when the context is done first, the rest of the queue is dropped
+// and the exporter is shut down in the background after the write in progress.
+func shutdownWorkers(ctx context.Context, workers []*exportWorker, direct ExportersSlice) error {
+	for _, w := range workers {
+		w.stop()
+	}
+	drained := append(make(ExportersSlice, 0, len(workers)+len(direct)), direct...)
+	var drainErr error
+	for _, w := range workers {
+		if err := w.wait(ctx); err != nil {
+			drainErr = errors.Wrap(err, "exporter queues are not drained")
+			go w.shutdownLate()
+			continue
+		}
+		drained = append(drained, w.exporter)
+	}
+	return errs.Append(drainErr, drained.Shutdown(ctx))
+}
+
+func (w *exportWorker) shutdownLate() {
+	<-w.done
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+	if err := w.exporter.Shutdown(ctx); err != nil && w.onErr != nil {
+		w.onErr(w, 0, errors.Wrap(err, "shutdown failed"))
+	}
+}
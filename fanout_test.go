@@ -0,0 +1,119 @@
+package klogga
+
+import (
+	"context"
+	"errors"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stallingExporter blocks writes until released or the write context is done
+type stallingExporter struct {
+	release chan struct{}
+	mu      sync.Mutex
+	spans   int
+	shut    bool
+}
+
+func (e *stallingExporter) Write(ctx context.Context, spans []*Span) error {
+	select {
+	case <-e.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans += len(spans)
+	return nil
+}
+
+func (e *stallingExporter) Shutdown(context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.shut = true
+	return nil
+}
+
+func (e *stallingExporter) isShut() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.shut
+}
+
+func (e *stallingExporter) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.spans
+}
+
+func TestFanOutStallIsolated(t *testing.T) {
+	stalled := &stallingExporter{release: make(chan struct{})}
+	fast := &countingExporter{}
+	f := NewFanOut(FanOutConfig{QueueSize: 2, Timeout: time.Minute}, stalled, fast)
+
+	write := func(expected int64) error {
+		err := f.Write(testutil.Timeout(), []*Span{StartLeaf(context.Background())})
+		require.Eventually(t, func() bool { return fast.count() == expected }, time.Second, time.Millisecond)
+		return err
+	}
+	require.NoError(t, write(1))
+	require.Eventually(t, func() bool { return len(f.workers[0].queue) == 0 }, time.Second, time.Millisecond)
+	// one batch is being written, two are queued
+	require.NoError(t, write(2))
+	require.NoError(t, write(3))
+	for i := int64(4); i <= 5; i++ {
+		err := write(i)
+		require.ErrorIs(t, err, ErrQueueFull)
+		require.Contains(t, err.Error(), "*klogga.stallingExporter")
+		require.NotContains(t, err.Error(), "*klogga.countingExporter")
+	}
+	require.Equal(t, uint64(2), f.DroppedCount())
+
+	close(stalled.release)
+	require.NoError(t, f.Shutdown(testutil.Timeout()))
+	require.Equal(t, 3, stalled.count())
+	require.Error(t, f.Write(testutil.Timeout(), []*Span{StartLeaf(context.Background())}))
+}
+
+func TestFanOutTimeout(t *testing.T) {
+	stalled := &stallingExporter{release: make(chan struct{})}
+	f := NewFanOut(FanOutConfig{Timeout: time.Millisecond}, stalled)
+	reported := make(chan error, 1)
+	NewFactory(f).SetErrorHandler(func(e ExportError) { reported <- e.Err })
+
+	require.NoError(t, f.Write(testutil.Timeout(), []*Span{StartLeaf(context.Background())}))
+	select {
+	case err := <-reported:
+		require.True(t, errors.Is(err, context.DeadlineExceeded))
+		require.Contains(t, err.Error(), "*klogga.stallingExporter")
+	case <-time.After(time.Second):
+		require.Fail(t, "timeout was not reported")
+	}
+	require.NoError(t, f.Shutdown(testutil.Timeout()))
+}
+
+func TestFanOutShutdownDeadline(t *testing.T) {
+	stalled := &stallingExporter{release: make(chan struct{})}
+	fast := &countingExporter{}
+	f := ExportersSlice{stalled, fast}.FanOut(FanOutConfig{Timeout: time.Minute})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, f.Write(testutil.Timeout(), []*Span{StartLeaf(context.Background())}))
+	}
+	require.Eventually(t, func() bool { return fast.count() == 3 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, f.Shutdown(ctx), context.DeadlineExceeded)
+	require.Equal(t, int64(3), fast.count())
+	require.Equal(t, int32(1), atomic.LoadInt32(&fast.shut))
+	// not shut down during the write, the queued batches are dropped
+	require.False(t, stalled.isShut())
+	close(stalled.release)
+	require.Eventually(t, stalled.isShut, time.Second, time.Millisecond)
+	require.Equal(t, 1, stalled.count())
+	require.Equal(t, uint64(2), f.DroppedCount())
+}
@@ -0,0 +1,52 @@
+package klogga
+
+import (
+	"context"
+	"github.com/KasperskyLab/klogga/util/errs"
+	"sync"
+)
+
+// Flusher implemented by exporters that buffer spans, like batcher.Batcher or FanOut
+type Flusher interface {
+	// Flush blocks until spans written before the call are exported or failed
+	Flush(ctx context.Context) error
+}
+
+// Flush waits for all exporters including the error exporter to export the spans written before the call
+// returns errors of the spans that were lost, these errors are reported to the error handler as well
+func (tf *Factory) Flush(ctx context.Context) error {
+	var workers []*exportWorker
+	var direct ExportersSlice
+	for _, entry := range tf.snapshot().entries {
+		if entry.worker == nil {
+			direct = append(direct, entry.exporter)
+			continue
+		}
+		workers = append(workers, entry.worker)
+	}
+	return errs.Append(flushWorkers(ctx, workers, false), direct.Flush(ctx), tf.exportErrs.flush(ctx))
+}
+
+// Flush flushes exporters in parallel, exporters that are not Flusher are skipped
+func (t ExportersSlice) Flush(ctx context.Context) error {
+	childErrs := make([]error, len(t))
+	wg := sync.WaitGroup{}
+	for i, child := range t {
+		flusher, ok := child.(Flusher)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, flusher Flusher) {
+			defer wg.Done()
+			childErrs[i] = flusher.Flush(ctx)
+		}(i, flusher)
+	}
+	wg.Wait()
+
+	var allErrs error
+	for _, err := range childErrs {
+		allErrs = errs.Append(allErrs, err)
+	}
+	return allErrs
+}
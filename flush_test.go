@@ -0,0 +1,66 @@
+package klogga
+
+import (
+	"context"
+	"errors"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bufferingExporter keeps spans until Flush
+type bufferingExporter struct {
+	mu       sync.Mutex
+	buffered int
+	flushed  int
+	err      error
+}
+
+func (e *bufferingExporter) Write(_ context.Context, spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.buffered += len(spans)
+	return nil
+}
+
+func (e *bufferingExporter) Flush(context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.flushed += e.buffered
+	e.buffered = 0
+	return e.err
+}
+
+func (e *bufferingExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func (e *bufferingExporter) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.flushed
+}
+
+func TestFactoryFlush(t *testing.T) {
+	direct := &bufferingExporter{}
+	behindFanOut := &bufferingExporter{}
+	failing := &bufferingExporter{err: errors.New("flush failed")}
+	tf := NewFactory(direct, &countingExporter{}, NewFanOut(FanOutConfig{Timeout: time.Minute}, behindFanOut))
+	tf.AddExporterTo("failing", failing)
+	trs := tf.NamedPkg()
+	for i := 0; i < 10; i++ {
+		trs.Finish(StartLeaf(context.Background()))
+	}
+
+	// exporters of all groups are flushed
+	require.EqualError(t, tf.Flush(testutil.Timeout()), "flush failed")
+	require.Equal(t, 10, direct.count())
+	require.Equal(t, 10, behindFanOut.count())
+	require.Equal(t, 0, failing.count())
+
+	failing.err = nil
+	require.NoError(t, tf.Flush(testutil.Timeout()))
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+}
@@ -0,0 +1,28 @@
+package klogga
+
+// LevelTracer writes only spans with the level not lower than the configured one,
+// spans with errors or warnings are always written
+type LevelTracer struct {
+	trs   Tracer
+	level LogLevel
+}
+
+func NewLevelTracer(trs Tracer, level LogLevel) *LevelTracer {
+	return &LevelTracer{trs: trs, level: level}
+}
+
+// Level the lowest level of the written spans
+func (t *LevelTracer) Level() LogLevel {
+	return t.level
+}
+
+func (t *LevelTracer) Name() ComponentName {
+	return t.trs.Name()
+}
+
+func (t *LevelTracer) Finish(span *Span) {
+	if span.LevelGet() < t.level && span.EWState() == "" {
+		return
+	}
+	t.trs.Finish(span)
+}
@@ -0,0 +1,24 @@
+package klogga
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestLevelTracer(t *testing.T) {
+	sb := strings.Builder{}
+	trs := NewLevelTracer(NewFactory(NewWriterExporter(&sb)).Named("level_test"), Warn)
+	require.Equal(t, ComponentName("level_test"), trs.Name())
+
+	StartLeaf(context.Background()).Level(Info).Message("skipped_info").FlushTo(trs)
+	StartLeaf(context.Background()).Level(Warn).Message("written_warn").FlushTo(trs)
+	StartLeaf(context.Background()).Level(Debug).ErrSpan(errors.New("written_err")).FlushTo(trs)
+
+	res := sb.String()
+	require.NotContains(t, res, "skipped_info")
+	require.Contains(t, res, "written_warn")
+	require.Contains(t, res, "written_err")
+}
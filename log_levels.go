@@ -1,5 +1,10 @@
 package klogga
 
+import (
+	"github.com/pkg/errors"
+	"strings"
+)
+
 // LogLevel log levels simplify compatibility with some logging systems
 type LogLevel int
 
@@ -27,3 +32,21 @@ const (
 	Error LogLevel = 2
 	Fatal LogLevel = 3
 )
+
+// ParseLogLevel parses level name like "info" or its short form like "I", case-insensitive
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug", "d":
+		return Debug, nil
+	case "info", "i":
+		return Info, nil
+	case "warn", "warning", "w":
+		return Warn, nil
+	case "error", "e":
+		return Error, nil
+	case "fatal", "f":
+		return Fatal, nil
+	default:
+		return Info, errors.Errorf("unknown log level: %q", s)
+	}
+}
@@ -0,0 +1,225 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/batcher"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+const namespace = "klogga"
+
+// Metrics prometheus collector of the klogga own health: batchers queues and exporters writes
+// register it once, then add batchers with AddBatcher and wrap exporters with Exporter
+type Metrics struct {
+	lock     sync.Mutex
+	batchers map[string]*batcher.Batcher
+
+	queueDepth    *prometheus.Desc
+	queueCapacity *prometheus.Desc
+	flushed       *prometheus.Desc
+	erred         *prometheus.Desc
+	dropped       *prometheus.Desc
+	retried       *prometheus.Desc
+	deadLettered  *prometheus.Desc
+
+	batchSize     *prometheus.HistogramVec
+	flushDuration *prometheus.HistogramVec
+	lostBatches   *prometheus.CounterVec
+
+	writeDuration *prometheus.HistogramVec
+	writtenSpans  *prometheus.CounterVec
+	writeErrors   *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	batcherDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "batcher", name), help, []string{"batcher"}, nil)
+	}
+	return &Metrics{
+		batchers: map[string]*batcher.Batcher{},
+
+		queueDepth:    batcherDesc("queue_depth", "Spans buffered or spooled and not written yet."),
+		queueCapacity: batcherDesc("queue_capacity", "How many spans can be buffered, zero for the spool."),
+		flushed:       batcherDesc("flushed_spans_total", "Spans written to the exporter."),
+		erred:         batcherDesc("erred_spans_total", "Spans the exporter failed to write."),
+		dropped:       batcherDesc("dropped_spans_total", "Spans dropped on the buffer overflow."),
+		retried:       batcherDesc("retried_writes_total", "Write attempts that were retried."),
+		deadLettered:  batcherDesc("dead_lettered_spans_total", "Spans written to the dead letter exporter."),
+
+		batchSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace, Subsystem: "batcher", Name: "batch_size",
+				Help:    "Spans in the exported batches.",
+				Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+			}, []string{"batcher"},
+		),
+		flushDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace, Subsystem: "batcher", Name: "flush_duration_seconds",
+				Help:    "Batch export duration including retries.",
+				Buckets: prometheus.DefBuckets,
+			}, []string{"batcher"},
+		),
+		lostBatches: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace, Subsystem: "batcher", Name: "lost_batches_total",
+				Help: "Batches written neither to the exporter nor to the dead letter exporter.",
+			}, []string{"batcher"},
+		),
+
+		writeDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace, Subsystem: "exporter", Name: "write_duration_seconds",
+				Help:    "Exporter Write duration.",
+				Buckets: prometheus.DefBuckets,
+			}, []string{"exporter"},
+		),
+		writtenSpans: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace, Subsystem: "exporter", Name: "written_spans_total",
+				Help: "Spans passed to the exporter Write.",
+			}, []string{"exporter"},
+		),
+		writeErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace, Subsystem: "exporter", Name: "write_errors_total",
+				Help: "Exporter Write calls that returned an error.",
+			}, []string{"exporter"},
+		),
+	}
+}
+
+// AddBatcher starts collecting the batcher metrics labeled with the name
+// replaces the batcher's observer set by batcher.Batcher.SetBatchObserver
+func (m *Metrics) AddBatcher(name string, b *batcher.Batcher) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.batchers[name]; ok {
+		return errors.Errorf("batcher %s is already added", name)
+	}
+	m.batchers[name] = b
+
+	batchSize := m.batchSize.WithLabelValues(name)
+	flushDuration := m.flushDuration.WithLabelValues(name)
+	lostBatches := m.lostBatches.WithLabelValues(name)
+	b.SetBatchObserver(
+		func(spans int, took time.Duration, err error) {
+			batchSize.Observe(float64(spans))
+			flushDuration.Observe(took.Seconds())
+			if err != nil {
+				lostBatches.Inc()
+			}
+		},
+	)
+	return nil
+}
+
+// RemoveBatcher stops collecting the batcher metrics, e.g. after the batcher is shut down
+func (m *Metrics) RemoveBatcher(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if b, ok := m.batchers[name]; ok {
+		b.SetBatchObserver(func(int, time.Duration, error) {})
+		delete(m.batchers, name)
+	}
+	m.batchSize.DeleteLabelValues(name)
+	m.flushDuration.DeleteLabelValues(name)
+	m.lostBatches.DeleteLabelValues(name)
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		m.queueDepth, m.queueCapacity, m.flushed, m.erred, m.dropped, m.retried, m.deadLettered,
+	} {
+		ch <- desc
+	}
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.lock.Lock()
+	for name, b := range m.batchers {
+		ch <- prometheus.MustNewConstMetric(m.queueDepth, prometheus.GaugeValue, float64(b.QueueLen()), name)
+		ch <- prometheus.MustNewConstMetric(m.queueCapacity, prometheus.GaugeValue, float64(b.QueueCap()), name)
+		for desc, count := range map[*prometheus.Desc]uint64{
+			m.flushed:      b.FlushedCount(),
+			m.erred:        b.ErredCount(),
+			m.dropped:      b.DroppedCount(),
+			m.retried:      b.RetriedCount(),
+			m.deadLettered: b.DeadLetteredCount(),
+		} {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(count), name)
+		}
+	}
+	m.lock.Unlock()
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.batchSize, m.flushDuration, m.lostBatches, m.writeDuration, m.writtenSpans, m.writeErrors,
+	}
+}
+
+// Exporter wraps the exporter to measure its writes, labeled with the name
+func (m *Metrics) Exporter(name string, exporter klogga.Exporter) klogga.Exporter {
+	return &instrumentedExporter{
+		next:          exporter,
+		writeDuration: m.writeDuration.WithLabelValues(name),
+		writtenSpans:  m.writtenSpans.WithLabelValues(name),
+		writeErrors:   m.writeErrors.WithLabelValues(name),
+	}
+}
+
+type instrumentedExporter struct {
+	next          klogga.Exporter
+	writeDuration prometheus.Observer
+	writtenSpans  prometheus.Counter
+	writeErrors   prometheus.Counter
+}
+
+func (e *instrumentedExporter) Write(ctx context.Context, spans []*klogga.Span) error {
+	start := time.Now()
+	err := e.next.Write(ctx, spans)
+	e.writeDuration.Observe(time.Since(start).Seconds())
+	e.writtenSpans.Add(float64(len(spans)))
+	if err != nil {
+		e.writeErrors.Inc()
+	}
+	return err
+}
+
+// SetErrorHandler keeps the background errors of the wrapped klogga.AsyncExporter reported
+func (e *instrumentedExporter) SetErrorHandler(handler func(spans int, err error)) {
+	if async, ok := e.next.(klogga.AsyncExporter); ok {
+		async.SetErrorHandler(handler)
+	}
+}
+
+func (e *instrumentedExporter) Flush(ctx context.Context) error {
+	if flusher, ok := e.next.(klogga.Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+func (e *instrumentedExporter) Shutdown(ctx context.Context) error {
+	return e.next.Shutdown(ctx)
+}
+
+// String name of the wrapped exporter, so the factory error reports don't change
+func (e *instrumentedExporter) String() string {
+	if s, ok := e.next.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", e.next)
+}
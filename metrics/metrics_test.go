@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"context"
+	"github.com/KasperskyLab/klogga"
+	"github.com/KasperskyLab/klogga/batcher"
+	"github.com/KasperskyLab/klogga/exporters/spancollector"
+	"github.com/KasperskyLab/klogga/util/testutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failingExporter struct {
+	spancollector.SpanCollector
+	fail bool
+}
+
+func (e *failingExporter) Write(ctx context.Context, spans []*klogga.Span) error {
+	if e.fail {
+		return errors.New("write failed")
+	}
+	return e.SpanCollector.Write(ctx, spans)
+}
+
+func writeSpans(t *testing.T, b *batcher.Batcher, n int) {
+	for i := 0; i < n; i++ {
+		require.NoError(t, b.Write(testutil.Timeout(), []*klogga.Span{klogga.StartLeaf(context.Background())}))
+	}
+}
+
+func TestBatcherMetrics(t *testing.T) {
+	m := New()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(m))
+
+	exporter := &failingExporter{}
+	b := batcher.New(m.Exporter("pg", exporter), batcher.Config{BatchSize: 10, BufferSize: 20, Timeout: time.Hour})
+	require.NoError(t, m.AddBatcher("pg", b))
+	require.Error(t, m.AddBatcher("pg", b))
+
+	writeSpans(t, b, 3)
+	require.NoError(t, b.Flush(testutil.Timeout()))
+	exporter.fail = true
+	writeSpans(t, b, 2)
+	require.Error(t, b.Flush(testutil.Timeout()))
+	writeSpans(t, b, 1)
+
+	require.NoError(
+		t, promtest.GatherAndCompare(
+			reg, strings.NewReader(
+				`
+# HELP klogga_batcher_queue_depth Spans buffered or spooled and not written yet.
+# TYPE klogga_batcher_queue_depth gauge
+klogga_batcher_queue_depth{batcher="pg"} 1
+# HELP klogga_batcher_queue_capacity How many spans can be buffered, zero for the spool.
+# TYPE klogga_batcher_queue_capacity gauge
+klogga_batcher_queue_capacity{batcher="pg"} 25
+# HELP klogga_batcher_flushed_spans_total Spans written to the exporter.
+# TYPE klogga_batcher_flushed_spans_total counter
+klogga_batcher_flushed_spans_total{batcher="pg"} 3
+# HELP klogga_batcher_erred_spans_total Spans the exporter failed to write.
+# TYPE klogga_batcher_erred_spans_total counter
+klogga_batcher_erred_spans_total{batcher="pg"} 2
+# HELP klogga_batcher_lost_batches_total Batches written neither to the exporter nor to the dead letter exporter.
+# TYPE klogga_batcher_lost_batches_total counter
+klogga_batcher_lost_batches_total{batcher="pg"} 1
+# HELP klogga_exporter_written_spans_total Spans passed to the exporter Write.
+# TYPE klogga_exporter_written_spans_total counter
+klogga_exporter_written_spans_total{exporter="pg"} 5
+# HELP klogga_exporter_write_errors_total Exporter Write calls that returned an error.
+# TYPE klogga_exporter_write_errors_total counter
+klogga_exporter_write_errors_total{exporter="pg"} 1
+`,
+			),
+			"klogga_batcher_queue_depth", "klogga_batcher_queue_capacity", "klogga_batcher_flushed_spans_total",
+			"klogga_batcher_erred_spans_total", "klogga_batcher_lost_batches_total",
+			"klogga_exporter_written_spans_total", "klogga_exporter_write_errors_total",
+		),
+	)
+	require.Equal(t, 2, promtest.CollectAndCount(m, "klogga_batcher_batch_size", "klogga_batcher_flush_duration_seconds"))
+	problems, err := promtest.CollectAndLint(m)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	require.NoError(t, b.Shutdown(testutil.Timeout()))
+	m.RemoveBatcher("pg")
+	require.Equal(t, 0, promtest.CollectAndCount(m, "klogga_batcher_queue_depth", "klogga_batcher_batch_size"))
+}
+
+func TestExporterKeepsAsyncErrors(t *testing.T) {
+	m := New()
+	exporter := &failingExporter{fail: true}
+	b := batcher.New(exporter, batcher.Config{BatchSize: 10, Timeout: time.Hour})
+	wrapped := m.Exporter("async", b)
+	require.Equal(t, b.String(), wrapped.(interface{ String() string }).String())
+
+	var reported []klogga.ExportError
+	tf := klogga.NewFactory(wrapped).SetErrorHandler(func(e klogga.ExportError) { reported = append(reported, e) })
+	tf.NamedPkg().Finish(klogga.StartLeaf(context.Background()))
+	require.Error(t, tf.Flush(testutil.Timeout()))
+	require.NoError(t, tf.Shutdown(testutil.Timeout()))
+	require.Len(t, reported, 1)
+	require.Equal(t, b.String(), reported[0].Name)
+}
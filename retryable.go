@@ -0,0 +1,35 @@
+package klogga
+
+import "errors"
+
+// Retryable marks the exporter error as temporary, e.g. a connection failure,
+// so the write can be retried, see batcher.RetryPolicy
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+// IsRetryable checks if the error is marked with Retryable
+// or any error in the chain implements Retryable() bool returning true
+func IsRetryable(err error) bool {
+	var r interface{ Retryable() bool }
+	return errors.As(err, &r) && r.Retryable()
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+func (e *retryableError) Retryable() bool {
+	return true
+}
@@ -0,0 +1,20 @@
+package klogga
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRetryable(t *testing.T) {
+	require.Nil(t, Retryable(nil))
+	base := errors.New("connection refused")
+	err := Retryable(base)
+	require.True(t, IsRetryable(err))
+	require.True(t, IsRetryable(fmt.Errorf("write: %w", err)))
+	require.ErrorIs(t, err, base)
+	require.Equal(t, base.Error(), err.Error())
+	require.False(t, IsRetryable(base))
+	require.False(t, IsRetryable(nil))
+}
@@ -0,0 +1,223 @@
+package klogga
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// DefaultGroup exporters group for the spans that match no route
+const DefaultGroup = ""
+
+// Route sends spans matched by the predicate to the exporter groups
+// nil Match matches all spans
+type Route struct {
+	Match  Predicate
+	Groups []string
+}
+
+// Predicate selects spans for the Route, called for each finished span
+type Predicate func(span *Span) bool
+
+// ByComponent matches spans of any of the components
+func ByComponent(components ...ComponentName) Predicate {
+	return func(span *Span) bool {
+		for _, c := range components {
+			if span.component == c {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ByLevel matches spans with any of the levels
+func ByLevel(levels ...LogLevel) Predicate {
+	return func(span *Span) bool {
+		for _, level := range levels {
+			if span.level == level {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ByMinLevel matches spans with the level not lower than min
+func ByMinLevel(min LogLevel) Predicate {
+	return func(span *Span) bool {
+		return span.level >= min
+	}
+}
+
+// ByEWState matches spans with any of the states, see Span.EWState
+func ByEWState(states ...string) Predicate {
+	return func(span *Span) bool {
+		state := span.EWState()
+		for _, s := range states {
+			if state == s {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HasErrors matches spans with errors or defer errors
+func HasErrors() Predicate {
+	return ByEWState("E")
+}
+
+// ByTag matches spans that have the tag with the value, values are compared as strings
+func ByTag(key string, value interface{}) Predicate {
+	expected := fmt.Sprint(value)
+	return func(span *Span) bool {
+		val, ok := span.tags[key]
+		return ok && fmt.Sprint(val) == expected
+	}
+}
+
+// HasTag matches spans that have the tag with any value
+func HasTag(key string) Predicate {
+	return func(span *Span) bool {
+		_, ok := span.tags[key]
+		return ok
+	}
+}
+
+// ByName matches spans with any of the names
+func ByName(names ...string) Predicate {
+	return func(span *Span) bool {
+		for _, name := range names {
+			if span.name == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// All matches spans that match all predicates
+func All(predicates ...Predicate) Predicate {
+	return func(span *Span) bool {
+		for _, p := range predicates {
+			if !p(span) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Any matches spans that match at least one predicate
+func Any(predicates ...Predicate) Predicate {
+	return func(span *Span) bool {
+		for _, p := range predicates {
+			if p(span) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not inverts the predicate
+func Not(p Predicate) Predicate {
+	return func(span *Span) bool {
+		return !p(span)
+	}
+}
+
+// write queues each span to the groups of the matched routes, the exporters without workers are written right away
+// the queued writes are waited for when the snapshot is released
+func (s *exportersSnapshot) write(ctx context.Context, spans []*Span) []pendingWrite {
+	if len(s.routes) == 0 {
+		return writeGroup(ctx, s.groups[DefaultGroup], spans, nil)
+	}
+
+	var order []string
+	byGroup := map[string][]*Span{}
+	add := func(group string, span *Span) {
+		groupSpans, ok := byGroup[group]
+		if !ok {
+			order = append(order, group)
+		}
+		// same span can be routed to the group by several routes
+		if len(groupSpans) > 0 && groupSpans[len(groupSpans)-1] == span {
+			return
+		}
+		byGroup[group] = append(groupSpans, span)
+	}
+	for _, span := range spans {
+		matched := false
+		for _, route := range s.routes {
+			if route.Match != nil && !route.Match(span) {
+				continue
+			}
+			matched = true
+			for _, group := range route.Groups {
+				add(group, span)
+			}
+		}
+		if !matched {
+			add(DefaultGroup, span)
+		}
+	}
+
+	var pending []pendingWrite
+	for _, group := range order {
+		pending = writeGroup(ctx, s.groups[group], byGroup[group], pending)
+	}
+	return pending
+}
+
+// pendingWrite batch queued to the exporter worker
+type pendingWrite struct {
+	entry    exporterEntry
+	spans    int
+	written  chan error
+	deadline time.Time
+	// the batch is not queued or is already written
+	err error
+}
+
+func writeGroup(ctx context.Context, entries []exporterEntry, spans []*Span, pending []pendingWrite) []pendingWrite {
+	for _, entry := range entries {
+		p := pendingWrite{entry: entry, spans: len(spans)}
+		if entry.worker == nil {
+			p.err = entry.exporter.Write(ctx, spans)
+			pending = append(pending, p)
+			continue
+		}
+		p.written = make(chan error, 1)
+		p.deadline = time.Now().Add(entry.worker.timeout)
+		if p.err = entry.worker.push(spans, p.written); p.err != nil {
+			p.written = nil
+		}
+		pending = append(pending, p)
+	}
+	return pending
+}
+
+// wait waits for the write, but not longer than the exporter timeout
+func (p pendingWrite) wait(ctx context.Context) error {
+	if p.written == nil {
+		return p.err
+	}
+	select {
+	case err := <-p.written:
+		return err
+	default:
+	}
+	timer := time.NewTimer(time.Until(p.deadline))
+	defer timer.Stop()
+	select {
+	case err := <-p.written:
+		return err
+	case <-timer.C:
+		return errors.Wrap(context.DeadlineExceeded, "exporter write is not finished")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,72 @@
+package klogga
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type namesExporter struct {
+	names []string
+}
+
+func (e *namesExporter) Write(_ context.Context, spans []*Span) error {
+	for _, span := range spans {
+		e.names = append(e.names, span.Name())
+	}
+	return nil
+}
+
+func (e *namesExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func TestFactoryRoutes(t *testing.T) {
+	def, pg, pager, file := &namesExporter{}, &namesExporter{}, &namesExporter{}, &namesExporter{}
+	tf := NewFactory(def).
+		AddExporterTo("pg", pg).
+		AddExporterTo("pager", pager).
+		AddExporterTo("file", file).
+		SetRoutes(
+			Route{Match: HasErrors(), Groups: []string{"pg", "pager"}},
+			Route{Match: ByComponent("audit"), Groups: []string{"pg"}},
+			Route{Match: ByLevel(Debug), Groups: []string{"file"}},
+		)
+
+	trs := tf.Named("app")
+	audit := tf.Named("audit")
+	trs.Finish(StartLeaf(context.Background(), WithName("plain")))
+	trs.Finish(StartLeaf(context.Background(), WithName("err")).ErrSpan(errors.New("err")))
+	audit.Finish(StartLeaf(context.Background(), WithName("audit")))
+	audit.Finish(StartLeaf(context.Background(), WithName("audit_err")).ErrSpan(errors.New("err")))
+	trs.Finish(StartLeaf(context.Background(), WithName("debug")).Level(Debug))
+
+	require.Equal(t, []string{"plain"}, def.names)
+	require.Equal(t, []string{"err", "audit", "audit_err"}, pg.names)
+	require.Equal(t, []string{"err", "audit_err"}, pager.names)
+	require.Equal(t, []string{"debug"}, file.names)
+
+	tf.SetRoutes()
+	trs.Finish(StartLeaf(context.Background(), WithName("debug")).Level(Debug))
+	require.Equal(t, []string{"plain", "debug"}, def.names)
+	require.Len(t, tf.Exporters(), 4)
+}
+
+func TestPredicates(t *testing.T) {
+	span := StartLeaf(context.Background(), WithName("name")).Tag("status", 200).Level(Warn)
+	span.component = "comp"
+
+	require.True(t, ByTag("status", "200")(span))
+	require.False(t, ByTag("status", 404)(span))
+	require.True(t, HasTag("status")(span))
+	require.True(t, ByName("other", "name")(span))
+	require.True(t, ByMinLevel(Info)(span))
+	require.False(t, ByMinLevel(Error)(span))
+	require.False(t, ByEWState("E", "W")(span))
+	require.True(t, ByEWState("W")(span.Warn(errors.New("warn"))))
+	require.True(t, All(ByComponent("comp"), ByName("name"))(span))
+	require.False(t, All(ByComponent("comp"), ByName("other"))(span))
+	require.True(t, Any(ByComponent("other"), ByName("name"))(span))
+	require.True(t, Not(HasErrors())(span))
+}
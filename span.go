@@ -396,6 +396,18 @@ func (s *Span) Tags() map[string]interface{} {
 	return result
 }
 
+// HasTag the span has the tag, without copying the tags
+func (s *Span) HasTag(key string) bool {
+	_, ok := s.tags[key]
+	return ok
+}
+
+// TagGet value of the tag, without copying the tags
+func (s *Span) TagGet(key string) (interface{}, bool) {
+	v, ok := s.tags[key]
+	return v, ok
+}
+
 // Vals get a copy of span vals
 func (s *Span) Vals() map[string]interface{} {
 	result := make(map[string]interface{})
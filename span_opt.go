@@ -42,6 +42,19 @@ func WithNewSpanID() SpanOption {
 	})
 }
 
+type withSpanIDOption struct {
+	spanID SpanID
+}
+
+// WithSpanID overrides generated span id, useful when span ids must be deterministic
+func WithSpanID(spanID SpanID) SpanOption {
+	return &withSpanIDOption{spanID: spanID}
+}
+
+func (o withSpanIDOption) apply(span *Span) {
+	span.id = o.spanID
+}
+
 func WithHostName() SpanOption {
 	return (SpanOptionFunc)(func(span *Span) {
 		span.host = host
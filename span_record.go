@@ -0,0 +1,82 @@
+package klogga
+
+import "time"
+
+// SpanRecord plain copy of the span fields, used to persist finished spans and restore them later
+// parent span reference and propagated tags are not included, parent is only referenced by ParentID
+type SpanRecord struct {
+	ID        SpanID
+	TraceID   TraceID
+	ParentID  SpanID
+	Name      string
+	Package   string
+	Class     string
+	Component ComponentName
+	Host      string
+	Level     LogLevel
+
+	Started  time.Time
+	Finished time.Time
+	Duration time.Duration
+
+	Tags map[string]interface{}
+	Vals map[string]interface{}
+
+	Errs      error
+	Warns     error
+	DeferErrs error
+}
+
+// Record copies the span fields, tags and vals maps are copied too
+func (s *Span) Record() SpanRecord {
+	return SpanRecord{
+		ID:        s.id,
+		TraceID:   s.traceID,
+		ParentID:  s.parentID,
+		Name:      s.name,
+		Package:   s.packageName,
+		Class:     s.className,
+		Component: s.component,
+		Host:      s.host,
+		Level:     s.level,
+		Started:   s.startedTs,
+		Finished:  s.finishedTs,
+		Duration:  s.duration,
+		Tags:      s.Tags(),
+		Vals:      s.Vals(),
+		Errs:      s.errs,
+		Warns:     s.warns,
+		DeferErrs: s.deferErrs,
+	}
+}
+
+// SpanFromRecord restores the span exactly as it was recorded, no defaults are applied
+func SpanFromRecord(r SpanRecord) *Span {
+	span := &Span{
+		id:             r.ID,
+		traceID:        r.TraceID,
+		parentID:       r.ParentID,
+		name:           r.Name,
+		packageName:    r.Package,
+		className:      r.Class,
+		component:      r.Component,
+		host:           r.Host,
+		level:          r.Level,
+		startedTs:      r.Started,
+		finishedTs:     r.Finished,
+		duration:       r.Duration,
+		tags:           make(map[string]interface{}, len(r.Tags)),
+		vals:           make(map[string]interface{}, len(r.Vals)),
+		propagatedTags: map[string]interface{}{},
+		errs:           r.Errs,
+		warns:          r.Warns,
+		deferErrs:      r.DeferErrs,
+	}
+	for k, v := range r.Tags {
+		span.tags[k] = v
+	}
+	for k, v := range r.Vals {
+		span.vals[k] = v
+	}
+	return span
+}
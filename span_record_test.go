@@ -0,0 +1,25 @@
+package klogga
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSpanRecordRoundTrip(t *testing.T) {
+	parent := StartLeaf(context.Background())
+	span := StartLeaf(context.Background(), WithParentSpanID(parent.ID()), WithPackageClass("pkg", "")).
+		Tag("tag", 1).Val("val", "v").Level(Warn).
+		ErrSpan(errors.New("err")).Warn(errors.New("warn")).DeferErr(errors.New("defer"))
+	span.SetComponent("comp")
+	span.Stop()
+
+	restored := SpanFromRecord(span.Record())
+	require.Equal(t, span.Stringify(), restored.Stringify())
+	require.Equal(t, span.Record(), restored.Record())
+	require.Equal(t, "", restored.Class())
+
+	restored.Tag("other", 2)
+	require.NotContains(t, span.Tags(), "other")
+}
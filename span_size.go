@@ -0,0 +1,123 @@
+package klogga
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// spanBaseSize ids, timestamps, level and the encoding overhead
+const spanBaseSize = 128
+
+// EstimatedSize rough size of the encoded span in bytes, used to limit batches and buffers by size
+// strings, byte slices and errors are counted by length, objects are approximated without encoding them,
+// other values are counted by their typical size
+func (s *Span) EstimatedSize() int {
+	size := spanBaseSize + len(s.name) + len(s.className) + len(s.packageName) + len(s.component) + len(s.host)
+	for k, v := range s.tags {
+		size += len(k) + valueSize(v)
+	}
+	for k, v := range s.vals {
+		size += len(k) + valueSize(v)
+	}
+	for _, err := range []error{s.errs, s.warns, s.deferErrs} {
+		if err != nil {
+			size += len(err.Error())
+		}
+	}
+	return size
+}
+
+func valueSize(v interface{}) int {
+	const valueOverhead = 8
+	switch val := v.(type) {
+	case string:
+		return valueOverhead + len(val)
+	case []byte:
+		return valueOverhead + len(val)
+	case *ObjectVal:
+		return valueOverhead + objectSize(val.obj)
+	case ObjectVal:
+		return valueOverhead + objectSize(val.obj)
+	case error:
+		return valueOverhead + len(val.Error())
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, time.Duration:
+		return valueOverhead + 8
+	case time.Time:
+		return valueOverhead + 32
+	case fmt.Stringer:
+		return valueOverhead + len(val.String())
+	default:
+		return valueOverhead + 16
+	}
+}
+
+// objectSize approximates the json size of the object without encoding it,
+// only the first objectSampleSize elements of slices and maps are measured, the rest are extrapolated
+func objectSize(obj interface{}) int {
+	if raw, ok := obj.(json.RawMessage); ok {
+		return len(raw)
+	}
+	return approxJsonSize(reflect.ValueOf(obj), objectMaxDepth)
+}
+
+const (
+	objectSampleSize = 16
+	objectMaxDepth   = 8
+)
+
+func approxJsonSize(v reflect.Value, depth int) int {
+	// quotes, colons and commas
+	const overhead = 4
+	if !v.IsValid() {
+		return overhead
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return overhead
+		}
+		return approxJsonSize(v.Elem(), depth)
+	case reflect.String:
+		return overhead + v.Len()
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return overhead + 8
+	}
+	if depth == 0 {
+		return overhead + 16
+	}
+	size := overhead
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// base64
+			return overhead + v.Len()*4/3
+		}
+		sample := 0
+		for ; sample < v.Len() && sample < objectSampleSize; sample++ {
+			size += approxJsonSize(v.Index(sample), depth-1)
+		}
+		if sample > 0 {
+			size = size * v.Len() / sample
+		}
+	case reflect.Map:
+		sample := 0
+		for it := v.MapRange(); it.Next() && sample < objectSampleSize; sample++ {
+			size += approxJsonSize(it.Key(), depth-1) + approxJsonSize(it.Value(), depth-1)
+		}
+		if sample > 0 {
+			size = size * v.Len() / sample
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.IsExported() {
+				size += len(f.Name) + approxJsonSize(v.Field(i), depth-1)
+			}
+		}
+	default:
+		size += 16
+	}
+	return size
+}
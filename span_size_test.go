@@ -0,0 +1,43 @@
+package klogga
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEstimatedSize(t *testing.T) {
+	span := StartLeaf(context.Background())
+	base := span.EstimatedSize()
+	require.Greater(t, base, spanBaseSize)
+
+	span.Val("body", strings.Repeat("x", 10000))
+	require.InDelta(t, base+10000, span.EstimatedSize(), 100)
+
+	span.ValAsJson("json", `{"a": "`+strings.Repeat("y", 1000)+`"}`).
+		Val("obj", ValObject(map[string]string{"b": strings.Repeat("z", 1000)})).
+		Tag("n", 1).Tag("ts", time.Now()).
+		ErrSpan(errors.New(strings.Repeat("e", 500)))
+	require.InDelta(t, base+12500, span.EstimatedSize(), 200)
+}
+
+func TestEstimatedObjectSize(t *testing.T) {
+	type item struct {
+		Name  string
+		Count int
+		Tags  map[string]string
+	}
+	items := make([]item, 1000)
+	for i := range items {
+		items[i] = item{Name: strings.Repeat("n", i%20), Count: i, Tags: map[string]string{"k": "v"}}
+	}
+	bb, err := json.Marshal(items)
+	require.NoError(t, err)
+	require.InEpsilon(t, len(bb), objectSize(items), 0.5)
+	require.Equal(t, 4, objectSize(nil))
+	require.Less(t, objectSize([]byte("bytes")), 16)
+}
@@ -28,6 +28,17 @@ func TestSpanString(t *testing.T) {
 	t.Log("str:", str)
 }
 
+func TestSpanTagGet(t *testing.T) {
+	span := StartLeaf(context.Background())
+	span.Tag("user", "u").Val("count", 1)
+
+	v, ok := span.TagGet("user")
+	require.True(t, ok)
+	require.Equal(t, "u", v)
+	_, ok = span.TagGet("count")
+	require.False(t, ok, "vals are not tags")
+}
+
 func TestSpanDuration(t *testing.T) {
 	span := StartLeaf(context.Background())
 	time.Sleep(10 * time.Millisecond)
@@ -16,11 +16,13 @@ const pathSeparator = string("/")
 func GetPackageClassFunc(skip int) (string, string, string) {
 	pc, _, _, _ := runtime.Caller(skip)
 
-	fnc := runtime.FuncForPC(pc)
+	return ParseFuncName(runtime.FuncForPC(pc).Name())
+}
+
+// ParseFuncName parses package, class and func of the function name as returned by runtime.FuncForPC
+func ParseFuncName(fullName string) (string, string, string) {
 	// We have something like "path.to/my/pkg.MyFunction". If the function is
 	// a closure, it is something like, "path.to/my/pkg.MyFunction.func1".
-	fullName := fnc.Name()
-
 	// remove path to package
 	// Everything up to the first "." after the last "/" is the package name.
 	// Everything after the "." is the full function name.